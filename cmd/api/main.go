@@ -4,13 +4,22 @@ package main
 import (
 	"os"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/rithindattag/realtime-streaming-api/internal/admission"
 	"github.com/rithindattag/realtime-streaming-api/internal/api"
+	"github.com/rithindattag/realtime-streaming-api/internal/checkpoint"
 	"github.com/rithindattag/realtime-streaming-api/internal/kafka"
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
 	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/rithindattag/realtime-streaming-api/pkg/ratelimit"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
 	"github.com/valyala/fasthttp"
 	"golang.org/x/sys/unix"
 )
@@ -67,15 +76,111 @@ func main() {
 	}
 	defer consumer.Close()
 
-	// Initialize WebSocket hub
+	// Configure WebSocket buffers and compression
+	wsConfig := websocket.DefaultConfig()
+	wsConfig.Compression = os.Getenv("WS_COMPRESSION") != "false"
+	wsConfig.CompressionLevel = envInt("WS_COMPRESSION_LEVEL", wsConfig.CompressionLevel)
+	wsConfig.CompressionThreshold = envInt("WS_COMPRESSION_THRESHOLD", wsConfig.CompressionThreshold)
+	wsConfig.WriteBufferSize = envInt("WS_WRITE_BUFFER_SIZE", wsConfig.WriteBufferSize)
+	if err := websocket.Configure(wsConfig); err != nil {
+		log.Error("Invalid WebSocket configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize WebSocket hub, which converts Protobuf payloads with the
+	// schemas registered through the API
+	schemas := schema.NewRegistry()
 	hub := websocket.NewHub(log)
+	hub.SetSchemas(schemas)
 	go hub.Run()
 
-	// Start consuming messages and broadcasting to WebSocket clients
-	go consumer.ConsumeMessages(hub)
+	// Start consuming messages, processing them with their stream's
+	// pipeline and broadcasting the results to WebSocket clients
+	broadcast := func(streamID string, format codec.Format, data []byte) {
+		hub.BroadcastMessage(websocket.Message{StreamID: streamID, Data: data, Format: format})
+	}
+	proc := processor.NewProcessor(log)
+	go proc.Run(broadcast)
+	defer proc.Stop()
 
 	// Initialize and start API server
 	handlers := api.NewHandlers(producer, consumer, hub, log)
+	handlers.Topic = kafkaTopic
+	handlers.Schemas = schemas
+	handlers.Processor = proc
+
+	// Load the lookup tables and reload them as their files change
+	if dir := os.Getenv("LOOKUP_TABLE_DIR"); dir != "" {
+		if err := lookup.Default.LoadDir(dir); err != nil {
+			log.Error("Failed to load lookup tables", "dir", dir, "error", err)
+		}
+		log.Info("Loaded lookup tables", "dir", dir, "tables", len(lookup.Default.Names()))
+		interval := time.Duration(envInt("LOOKUP_RELOAD_INTERVAL_MS", 5000)) * time.Millisecond
+		go lookup.Default.Watch(dir, interval, log)
+	}
+
+	// Restore the processor's state from the latest checkpoint and resume
+	// consuming where it was taken
+	if dir := os.Getenv("CHECKPOINT_DIR"); dir != "" {
+		store, err := checkpoint.NewStore(dir)
+		if err != nil {
+			log.Error("Failed to open checkpoint store", "error", err)
+			os.Exit(1)
+		}
+		cp, err := store.Load()
+		if err != nil {
+			log.Error("Failed to load checkpoint", "error", err)
+			os.Exit(1)
+		}
+		if cp != nil {
+			if err := handlers.RestoreStreams(cp.Catalog); err != nil {
+				log.Error("Failed to restore streams", "error", err)
+			}
+			// Only the pipelines of streams that exist again are restored
+			streams := make(map[string]processor.StreamState)
+			for streamID, state := range cp.Streams {
+				if hub.StreamExists(streamID) {
+					streams[streamID] = state
+				}
+			}
+			restored, err := proc.Restore(streams)
+			if err != nil {
+				log.Error("Failed to restore checkpoint", "error", err)
+				os.Exit(1)
+			}
+			log.Info("Restored checkpoint", "time", cp.Time, "streams", len(cp.Catalog), "pipelines", len(restored), "partitions", len(cp.Offsets))
+		}
+		interval := time.Duration(envInt("CHECKPOINT_INTERVAL_MS", 10000)) * time.Millisecond
+		consumer.EnableCheckpoints(store, interval, cp, handlers.Catalog)
+	}
+	go consumer.ConsumeMessages(proc, broadcast)
+
+	// Share the global rate limit across API replicas when a store is configured
+	if storeAddr := os.Getenv("RATE_LIMIT_STORE_ADDR"); storeAddr != "" {
+		limit := int64(envInt("RATE_LIMIT_RPS", 50000))
+		store := ratelimit.NewRedisStore(storeAddr, 0)
+		defer store.Close()
+		handlers.Limiter = ratelimit.NewDistributedLimiter(ratelimit.DistributedConfig{
+			Store:    store,
+			Name:     "global",
+			Limit:    limit,
+			Window:   time.Second,
+			Replicas: envInt("RATE_LIMIT_REPLICAS", 1),
+			Logger:   log,
+			Metrics:  metrics.RateLimit{},
+		})
+		log.Info("Using distributed rate limiting", "store", storeAddr, "limit", limit)
+	}
+
+	// Shed load before the producer or hub tips over
+	handlers.Admission = admission.NewController(admission.Config{
+		MaxQueueLen: envInt("ADMISSION_MAX_QUEUE", 100000),
+		MaxLatency:  time.Duration(envInt("ADMISSION_MAX_LATENCY_MS", 500)) * time.Millisecond,
+		MaxBacklog:  envInt("ADMISSION_MAX_BACKLOG", 50000),
+	}, producer, hub, log)
+	go handlers.Admission.Run()
+	defer handlers.Admission.Stop()
+
 	router := api.NewRouter(handlers)
 
 	server := &fasthttp.Server{
@@ -95,3 +200,12 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// envInt reads a positive integer environment variable, returning def when it is unset or invalid
+func envInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
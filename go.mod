@@ -13,6 +13,8 @@ require (
 	github.com/valyala/fasthttp v1.55.0
 	golang.org/x/sys v0.21.0
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/protobuf v1.28.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 // Add any other dependencies your project uses
@@ -0,0 +1,186 @@
+// Package admission provides adaptive load shedding for the ingest path
+package admission
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+)
+
+const (
+	defaultInterval   = 250 * time.Millisecond
+	defaultRetryAfter = time.Second
+	defaultShedAt     = 0.8
+	defaultRecoverAt  = 0.6
+	minAdmitRatio     = 0.01
+	recoverStep       = 0.05
+)
+
+// ProducerProbe reports the health of the Kafka producer
+type ProducerProbe interface {
+	QueueLen() int
+	DeliveryLatency() time.Duration
+}
+
+// BacklogProbe reports the number of messages waiting for delivery
+type BacklogProbe interface {
+	Backlog() int
+}
+
+// Config holds the thresholds for a Controller. A signal whose limit is
+// zero is ignored.
+type Config struct {
+	// MaxQueueLen is the producer queue length considered saturated
+	MaxQueueLen int
+	// MaxLatency is the delivery latency considered saturated
+	MaxLatency time.Duration
+	// MaxBacklog is the hub backlog considered saturated
+	MaxBacklog int
+	// ShedAt is the pressure above which the admit ratio is cut
+	ShedAt float64
+	// RecoverAt is the pressure below which the admit ratio grows again
+	RecoverAt float64
+	// Interval is how often the signals are sampled
+	Interval time.Duration
+	// RetryAfter is the delay suggested to rejected clients
+	RetryAfter time.Duration
+}
+
+// Controller decides whether new requests are admitted. It samples the
+// producer and hub on a fixed interval, derives a pressure value where 1.0
+// means a signal has hit its limit, and adjusts the fraction of requests it
+// admits: halving it while pressure exceeds ShedAt and growing it back
+// gradually once pressure falls below RecoverAt.
+type Controller struct {
+	cfg      Config
+	producer ProducerProbe
+	hub      BacklogProbe
+	logger   *logger.Logger
+	// admitRatio and pressure hold float64 bits
+	admitRatio uint64
+	pressure   uint64
+	stop       chan struct{}
+}
+
+// NewController creates a new Controller instance
+func NewController(cfg Config, producer ProducerProbe, hub BacklogProbe, logger *logger.Logger) *Controller {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = defaultRetryAfter
+	}
+	if cfg.ShedAt <= 0 {
+		cfg.ShedAt = defaultShedAt
+	}
+	if cfg.RecoverAt <= 0 || cfg.RecoverAt > cfg.ShedAt {
+		cfg.RecoverAt = math.Min(defaultRecoverAt, cfg.ShedAt)
+	}
+
+	c := &Controller{
+		cfg:      cfg,
+		producer: producer,
+		hub:      hub,
+		logger:   logger,
+		stop:     make(chan struct{}),
+	}
+	c.setAdmitRatio(1)
+	return c
+}
+
+// Run samples the signals until Stop is called
+func (c *Controller) Run() {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Update()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Stop terminates Run
+func (c *Controller) Stop() {
+	close(c.stop)
+}
+
+// Update samples the signals once and adjusts the admit ratio
+func (c *Controller) Update() {
+	pressure := c.samplePressure()
+	atomic.StoreUint64(&c.pressure, math.Float64bits(pressure))
+	metrics.AdmissionPressure.Set(pressure)
+
+	ratio := c.AdmitRatio()
+	next := ratio
+	switch {
+	case pressure >= c.cfg.ShedAt:
+		next = math.Max(ratio/2, minAdmitRatio)
+	case pressure < c.cfg.RecoverAt:
+		next = math.Min(ratio+recoverStep, 1)
+	}
+
+	if next != ratio {
+		if ratio == 1 {
+			c.logger.Warn("Load shedding started", "pressure", pressure)
+		} else if next == 1 {
+			c.logger.Info("Load shedding stopped", "pressure", pressure)
+		}
+		c.setAdmitRatio(next)
+	}
+}
+
+// Admit reports whether a new request should be accepted
+func (c *Controller) Admit() bool {
+	ratio := c.AdmitRatio()
+	if ratio >= 1 || rand.Float64() < ratio {
+		return true
+	}
+	metrics.AdmissionRejected.Inc()
+	return false
+}
+
+// AdmitRatio returns the fraction of requests currently admitted
+func (c *Controller) AdmitRatio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.admitRatio))
+}
+
+// Pressure returns the most recently sampled pressure
+func (c *Controller) Pressure() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.pressure))
+}
+
+// RetryAfter returns the Retry-After header value for rejected requests
+func (c *Controller) RetryAfter() string {
+	return strconv.Itoa(int(math.Ceil(c.cfg.RetryAfter.Seconds())))
+}
+
+// samplePressure returns the highest utilisation among the configured signals
+func (c *Controller) samplePressure() float64 {
+	var pressure float64
+	if c.producer != nil {
+		if c.cfg.MaxQueueLen > 0 {
+			pressure = math.Max(pressure, float64(c.producer.QueueLen())/float64(c.cfg.MaxQueueLen))
+		}
+		if c.cfg.MaxLatency > 0 {
+			pressure = math.Max(pressure, float64(c.producer.DeliveryLatency())/float64(c.cfg.MaxLatency))
+		}
+	}
+	if c.hub != nil && c.cfg.MaxBacklog > 0 {
+		pressure = math.Max(pressure, float64(c.hub.Backlog())/float64(c.cfg.MaxBacklog))
+	}
+	return pressure
+}
+
+// setAdmitRatio stores the admit ratio and publishes it as a metric
+func (c *Controller) setAdmitRatio(ratio float64) {
+	atomic.StoreUint64(&c.admitRatio, math.Float64bits(ratio))
+	metrics.AdmissionRatio.Set(ratio)
+}
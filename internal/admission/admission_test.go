@@ -0,0 +1,49 @@
+package admission_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/admission"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProducer reports a fixed queue length and latency
+type fakeProducer struct {
+	queue   int
+	latency time.Duration
+}
+
+func (p *fakeProducer) QueueLen() int                  { return p.queue }
+func (p *fakeProducer) DeliveryLatency() time.Duration { return p.latency }
+
+// TestControllerShedsAndRecovers tests that the admit ratio follows pressure
+func TestControllerShedsAndRecovers(t *testing.T) {
+	producer := &fakeProducer{}
+	c := admission.NewController(admission.Config{
+		MaxQueueLen: 100,
+		MaxLatency:  time.Second,
+	}, producer, nil, logger.NewLogger())
+
+	c.Update()
+	assert.Equal(t, 1.0, c.AdmitRatio())
+	assert.True(t, c.Admit())
+
+	producer.queue = 90
+	c.Update()
+	assert.InDelta(t, 0.9, c.Pressure(), 0.001)
+	assert.Equal(t, 0.5, c.AdmitRatio())
+
+	producer.queue = 0
+	producer.latency = 2 * time.Second
+	c.Update()
+	assert.Equal(t, 0.25, c.AdmitRatio())
+
+	producer.latency = 0
+	for i := 0; i < 100; i++ {
+		c.Update()
+	}
+	assert.Equal(t, 1.0, c.AdmitRatio())
+	assert.Equal(t, "1", c.RetryAfter())
+}
@@ -5,14 +5,26 @@ import (
 	"sync"
 	"golang.org/x/time/rate"
 	"github.com/google/uuid"
+	"strconv"
 	"strings"
 	"fmt"
+	"time"
 
+	gorillaWS "github.com/gorilla/websocket"
 	"github.com/valyala/fasthttp"
+	"github.com/rithindattag/realtime-streaming-api/internal/admission"
+	"github.com/rithindattag/realtime-streaming-api/internal/checkpoint"
 	"github.com/rithindattag/realtime-streaming-api/internal/kafka"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
 	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
 	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+	"github.com/rithindattag/realtime-streaming-api/pkg/ratelimit"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
 )
 
 var (
@@ -24,6 +36,13 @@ type Handlers struct {
 	Consumer      *kafka.Consumer
 	Hub           *websocket.Hub
 	Logger        *logger.Logger
+	Limiter       ratelimit.Limiter
+	Admission     *admission.Controller
+	Schemas       *schema.Registry
+	Processor     *processor.Processor
+	Tables        *lookup.Tables
+	// Topic is the Kafka topic every stream is produced to
+	Topic         string
 	ActiveStreams map[string]bool
 	StreamsMutex  sync.RWMutex
 }
@@ -34,6 +53,10 @@ func NewHandlers(producer *kafka.Producer, consumer *kafka.Consumer, hub *websoc
 		Consumer:      consumer,
 		Hub:           hub,
 		Logger:        logger,
+		Limiter:       globalLimiter,
+		Schemas:       schema.NewRegistry(),
+		Processor:     processor.NewProcessor(logger),
+		Tables:        lookup.Default,
 		ActiveStreams: make(map[string]bool),
 		StreamsMutex:  sync.RWMutex{},
 	}
@@ -47,21 +70,73 @@ func (h *Handlers) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 		h.SendData(ctx)
 	case "/stream/{stream_id}/results":
 		h.StreamResults(ctx)
+	case "/stream/{stream_id}/ingest":
+		h.Ingest(ctx)
+	case "/stream/{stream_id}/schema":
+		h.StreamSchema(ctx)
+	case "/stream/{stream_id}/pipeline":
+		h.StreamPipeline(ctx)
+	case "/stream/join":
+		h.CreateJoin(ctx)
+	case "/stream/{stream_id}/join":
+		h.StreamJoin(ctx)
+	case "/tables":
+		h.LookupTables(ctx)
+	case "/ws":
+		h.Multiplex(ctx)
 	default:
 		ctx.Error("Not found", fasthttp.StatusNotFound)
 	}
 }
 
 func (h *Handlers) StartStream(ctx *fasthttp.RequestCtx) {
+	policy, err := websocket.ParsePolicy(string(ctx.QueryArgs().Peek("policy")))
+	if err != nil {
+		h.Logger.Error("Invalid slow consumer policy", "error", err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	var config models.StreamConfig
+	if body := ctx.PostBody(); len(body) > 0 {
+		if err := decodeDocument(ctx, &config); err != nil {
+			h.Logger.Error("Failed to parse stream configuration", "error", err)
+			ctx.Error("Invalid JSON or YAML data", fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	var pipeline *processor.Pipeline
+	if config.Pipeline != nil {
+		if pipeline, err = h.compilePipeline(*config.Pipeline); err != nil {
+			h.Logger.Error("Invalid stream pipeline", "error", err)
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
 	streamID := uuid.New().String()
 
+	if config.Schema != nil {
+		if _, err := h.registerSchema(streamID, *config.Schema); err != nil {
+			h.Logger.Error("Invalid stream schema", "error", err)
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
 	h.StreamsMutex.Lock()
 	h.ActiveStreams[streamID] = true
 	h.StreamsMutex.Unlock()
 
-	h.Hub.CreateStream(streamID)
+	if pipeline != nil {
+		h.Processor.SetPipeline(streamID, pipeline)
+	}
+
+	h.Hub.SetStreamPolicy(streamID, policy)
+	h.Hub.RegisterStream(websocket.StreamInfo{ID: streamID, Name: config.Name, Labels: config.Labels})
 
-	h.Logger.Info("New stream created", "stream_id", streamID)
+	h.Logger.Info("New stream created", "stream_id", streamID, "name", config.Name)
 
 	metrics.StreamsCreated.Inc()
 
@@ -76,62 +151,437 @@ func (h *Handlers) SendData(ctx *fasthttp.RequestCtx) {
 	h.Logger.Info("Request headers", "headers", ctx.Request.Header.String())
 	h.Logger.Info("Request body", "body", string(ctx.PostBody()))
 
-	if !globalLimiter.Allow() {
-		h.Logger.Error("Rate limit exceeded")
-		ctx.Error("Too many requests", fasthttp.StatusTooManyRequests)
-		return
-	}
-
 	path := string(ctx.Path())
 	h.Logger.Info("Request path", "path", path)
 
-	parts := strings.Split(path, "/")
-	if len(parts) != 4 || parts[1] != "stream" || parts[3] != "send" {
+	streamID, ok := streamIDFromPath(path, "send")
+	if !ok {
 		h.Logger.Error("Invalid path", "path", path)
 		ctx.Error("Invalid path", fasthttp.StatusBadRequest)
 		return
 	}
-	streamID := parts[2]
 	h.Logger.Info("Stream ID extracted", "streamID", streamID)
 
+	format, err := codec.FromContentType(string(ctx.Request.Header.ContentType()))
+	if err != nil {
+		h.Logger.Error("Unsupported content type", "error", err)
+		ctx.Error(err.Error(), fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err := h.Publish(streamID, format, ctx.PostBody()); err != nil {
+		perr, ok := err.(*publishError)
+		if !ok {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		if perr.status == fasthttp.StatusServiceUnavailable {
+			ctx.Response.Header.Set("Retry-After", h.Admission.RetryAfter())
+		}
+		if perr.violations != nil {
+			ctx.SetStatusCode(perr.status)
+			ctx.SetContentType("application/json")
+			json.NewEncoder(ctx).Encode(map[string]interface{}{
+				"error":   "payload does not match schema",
+				"subject": perr.schema.Subject,
+				"version": perr.schema.Version,
+				"errors":  perr.violations,
+			})
+			return
+		}
+		ctx.Error(err.Error(), perr.status)
+		return
+	}
+
+	h.Logger.Info("Data sent to stream", "stream_id", streamID)
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+	json.NewEncoder(ctx).Encode(map[string]string{"status": "accepted"})
+}
+
+// publishError is a rejected message together with the HTTP status describing why
+type publishError struct {
+	status  int
+	message string
+	// schema and violations are set when the payload does not match the stream's schema
+	schema     *schema.Schema
+	violations schema.ValidationErrors
+}
+
+func (e *publishError) Error() string {
+	return e.message
+}
+
+// StatusCode returns the HTTP status of the rejection
+func (e *publishError) StatusCode() int {
+	return e.status
+}
+
+// Publish validates a message and produces it to Kafka. It is the single
+// ingest path shared by SendData and WebSocket producers, so every message
+// goes through the same rate limiting, admission control and validation.
+func (h *Handlers) Publish(streamID string, format codec.Format, body []byte) error {
+	if !h.Limiter.Allow() {
+		h.Logger.Error("Rate limit exceeded")
+		return &publishError{status: fasthttp.StatusTooManyRequests, message: "Too many requests"}
+	}
+
+	if h.Admission != nil && !h.Admission.Admit() {
+		h.Logger.Warn("Request shed due to overload")
+		return &publishError{status: fasthttp.StatusServiceUnavailable, message: "Service overloaded"}
+	}
+
+	if !h.streamExists(streamID) {
+		h.Logger.Error("Stream not found", "stream_id", streamID)
+		return &publishError{status: fasthttp.StatusNotFound, message: "Stream not found"}
+	}
+
+	// The payload is validated but produced exactly as received. It is only
+	// decoded when a schema needs to inspect its values.
+	s, err := h.Schemas.Latest(streamID)
+	if err != nil || !s.Validates() {
+		if err := codec.ValidateObject(format, body); err != nil {
+			h.Logger.Error("Invalid payload", "error", err, "format", format)
+			return &publishError{status: fasthttp.StatusBadRequest, message: fmt.Sprintf("Invalid %s data", format)}
+		}
+	} else if format == codec.Protobuf && s.Type == schema.Protobuf {
+		// A Protobuf payload is valid when it decodes as the schema's message
+		if _, err := s.DecodeProtobuf(body); err != nil {
+			metrics.SchemaValidationFailures.WithLabelValues(streamID).Inc()
+			violations, _ := err.(schema.ValidationErrors)
+			return &publishError{status: fasthttp.StatusUnprocessableEntity, message: err.Error(), schema: s, violations: violations}
+		}
+	} else {
+		payload, err := codec.DecodeObject(format, body)
+		if err != nil && err != codec.ErrOpaque {
+			h.Logger.Error("Invalid payload", "error", err, "format", format)
+			return &publishError{status: fasthttp.StatusBadRequest, message: fmt.Sprintf("Invalid %s data", format)}
+		}
+		if payload == nil {
+			return &publishError{status: fasthttp.StatusUnprocessableEntity, message: fmt.Sprintf("%s payloads cannot be validated against a %s schema", format, s.Type)}
+		}
+		if err := s.Validate(payload); err != nil {
+			metrics.SchemaValidationFailures.WithLabelValues(streamID).Inc()
+			return &publishError{status: fasthttp.StatusUnprocessableEntity, message: err.Error(), schema: s, violations: err.(schema.ValidationErrors)}
+		}
+	}
+
+	if err := h.Producer.Publish(h.topicFor(streamID), streamID, format, body); err != nil {
+		h.Logger.Error("Failed to send message to Kafka", "error", err, "stream_id", streamID)
+		return &publishError{status: fasthttp.StatusInternalServerError, message: fmt.Sprintf("Failed to process data: %v", err)}
+	}
+	return nil
+}
+
+// topicFor returns the Kafka topic a stream is produced to: the shared
+// topic the consumer reads, or a topic per stream when none is configured
+func (h *Handlers) topicFor(streamID string) string {
+	if h.Topic != "" {
+		return h.Topic
+	}
+	return streamID
+}
+
+// StreamResults upgrades the request to a WebSocket that delivers the raw
+// messages of a single stream
+func (h *Handlers) StreamResults(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	streamID, ok := streamIDFromPath(path, "results")
+	if !ok {
+		h.Logger.Error("Invalid path", "path", path)
+		ctx.Error("Invalid path", fasthttp.StatusBadRequest)
+		return
+	}
+
 	if !h.streamExists(streamID) {
 		h.Logger.Error("Stream not found", "stream_id", streamID)
 		ctx.Error("Stream not found", fasthttp.StatusNotFound)
 		return
 	}
 
-	h.Logger.Info("Received data for stream", "stream_id", streamID)
+	var opts websocket.Options
+	if filter := ctx.QueryArgs().Peek("filter"); len(filter) > 0 {
+		compiled, err := expr.Compile(string(filter))
+		if err != nil {
+			h.Logger.Error("Invalid filter", "error", err)
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		opts.Filter = compiled
+	}
+	if fields := ctx.QueryArgs().Peek("fields"); len(fields) > 0 {
+		projection, err := websocket.ParseProjectionList(string(fields))
+		if err != nil {
+			h.Logger.Error("Invalid fields", "error", err)
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		opts.Projection = projection
+	}
+	args := ctx.QueryArgs()
+	sample, err := websocket.ParseSampling(string(args.Peek("sample_rate")), string(args.Peek("sample_every")), string(args.Peek("sample_interval")))
+	if err != nil {
+		h.Logger.Error("Invalid sampling", "error", err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	opts.Sample = sample
 
-	var data map[string]interface{}
-	if err := json.Unmarshal(ctx.PostBody(), &data); err != nil {
-		h.Logger.Error("Failed to parse JSON data", "error", err)
-		ctx.Error("Invalid JSON data", fasthttp.StatusBadRequest)
+	writeOpts, err := writeOptions(ctx.QueryArgs())
+	if err != nil {
+		h.Logger.Error("Invalid write options", "error", err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
 		return
 	}
 
-	jsonData, err := json.Marshal(data)
+	accepted, err := codec.Negotiate(string(ctx.Request.Header.Peek("Accept")))
 	if err != nil {
-		h.Logger.Error("Failed to marshal data to JSON", "error", err)
-		ctx.Error("Failed to process data", fasthttp.StatusInternalServerError)
+		ctx.Error(err.Error(), fasthttp.StatusNotAcceptable)
 		return
 	}
 
-	// Log before sending to Kafka
-	h.Logger.Info("Attempting to send message to Kafka", "stream_id", streamID)
-	if err := h.Producer.SendMessage(streamID, jsonData); err != nil {
-		h.Logger.Error("Failed to send message to Kafka", "error", err, "stream_id", streamID)
-		ctx.Error(fmt.Sprintf("Failed to process data: %v", err), fasthttp.StatusInternalServerError)
+	err = websocket.UpgradeFastHTTP(ctx, func(conn *gorillaWS.Conn) {
+		client := websocket.NewClient(h.Hub, streamID, conn)
+		client.SetWriteOptions(writeOpts)
+		client.SetFormat(connFormat(conn, accepted))
+		h.Hub.Register(client, opts)
+		go client.WritePump()
+		client.ReadPump()
+	})
+	if err != nil {
+		h.Logger.Error("WebSocket upgrade failed", "error", err)
+		ctx.Error("WebSocket upgrade required", fasthttp.StatusBadRequest)
+	}
+}
+
+// Ingest upgrades the request to a WebSocket on which a producer publishes
+// every frame it sends into a single stream
+func (h *Handlers) Ingest(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	streamID, ok := streamIDFromPath(path, "ingest")
+	if !ok {
+		h.Logger.Error("Invalid path", "path", path)
+		ctx.Error("Invalid path", fasthttp.StatusBadRequest)
 		return
 	}
-	h.Logger.Info("Successfully sent message to Kafka", "stream_id", streamID)
 
-	h.Logger.Info("Data sent to stream", "stream_id", streamID)
-	ctx.SetStatusCode(fasthttp.StatusAccepted)
-	json.NewEncoder(ctx).Encode(map[string]string{"status": "accepted"})
+	if !h.streamExists(streamID) {
+		h.Logger.Error("Stream not found", "stream_id", streamID)
+		ctx.Error("Stream not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	format, err := codec.FromContentType(string(ctx.Request.Header.ContentType()))
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+
+	err = websocket.UpgradeFastHTTP(ctx, func(conn *gorillaWS.Conn) {
+		client := websocket.NewIngestClient(h.Hub, streamID, conn, h)
+		client.SetFormat(connFormat(conn, format))
+		go client.WritePump()
+		client.ReadPump()
+	})
+	if err != nil {
+		h.Logger.Error("WebSocket upgrade failed", "error", err)
+		ctx.Error("WebSocket upgrade required", fasthttp.StatusBadRequest)
+	}
 }
 
-func (h *Handlers) StreamResults(ctx *fasthttp.RequestCtx) {
-	// Implementation remains the same, but adapt it to use fasthttp.RequestCtx instead of http.ResponseWriter and *http.Request
+// Multiplex upgrades the request to a WebSocket on which the client
+// subscribes to any number of streams with control messages. With
+// ?ack=true every data frame carries a sequence number that the client
+// acknowledges; ?session= resumes a session after a disconnect.
+func (h *Handlers) Multiplex(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	sessionID := string(args.Peek("session"))
+	ack := args.GetBool("ack")
+
+	var opts websocket.AckOptions
+	if ack {
+		var err error
+		if opts, err = ackOptions(args); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	writeOpts, err := writeOptions(args)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	if ack && writeOpts.Binary {
+		ctx.Error("acknowledgements are not supported with binary frames", fasthttp.StatusBadRequest)
+		return
+	}
+
+	accepted, err := codec.Negotiate(string(ctx.Request.Header.Peek("Accept")))
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusNotAcceptable)
+		return
+	}
+	if ack && accepted.Binary() {
+		ctx.Error("acknowledgements are only supported for JSON", fasthttp.StatusBadRequest)
+		return
+	}
+
+	if sessionID != "" {
+		switch err := h.Hub.CheckSession(sessionID); err {
+		case nil:
+		case websocket.ErrSessionInUse:
+			ctx.Error(err.Error(), fasthttp.StatusConflict)
+			return
+		default:
+			ctx.Error(err.Error(), fasthttp.StatusNotFound)
+			return
+		}
+	}
+
+	err = websocket.UpgradeFastHTTP(ctx, func(conn *gorillaWS.Conn) {
+		var client *websocket.Client
+		if sessionID != "" {
+			var err error
+			if client, err = h.Hub.Resume(sessionID, conn); err != nil {
+				msg := gorillaWS.FormatCloseMessage(gorillaWS.ClosePolicyViolation, err.Error())
+				conn.WriteMessage(gorillaWS.CloseMessage, msg)
+				conn.Close()
+				return
+			}
+		} else {
+			client = websocket.NewMultiplexClient(h.Hub, conn)
+			client.Publisher = h
+			client.SetWriteOptions(writeOpts)
+			client.SetFormat(connFormat(conn, accepted))
+			if ack && client.Format().Binary() {
+				msg := gorillaWS.FormatCloseMessage(gorillaWS.ClosePolicyViolation, "acknowledgements are only supported for JSON")
+				conn.WriteMessage(gorillaWS.CloseMessage, msg)
+				conn.Close()
+				return
+			}
+			if ack {
+				h.Hub.StartSession(client, opts)
+			}
+		}
+		go client.WritePump()
+		client.ReadPump()
+	})
+	if err != nil {
+		h.Logger.Error("WebSocket upgrade failed", "error", err)
+		ctx.Error("WebSocket upgrade required", fasthttp.StatusBadRequest)
+	}
+}
+
+// connFormat returns the payload format of a connection: the format named
+// by the negotiated subprotocol, or def when none was negotiated
+func connFormat(conn *gorillaWS.Conn, def codec.Format) codec.Format {
+	if f, ok := websocket.SubprotocolFormat(conn.Subprotocol()); ok {
+		return f
+	}
+	return def
+}
+
+// writeOptions reads how a connection wants its data frames written:
+// binary frames, and whether and how hard to compress them
+func writeOptions(args *fasthttp.Args) (websocket.WriteOptions, error) {
+	opts := websocket.DefaultWriteOptions()
+	opts.Binary = args.GetBool("binary")
+	if args.Has("compress") {
+		opts.Compress = args.GetBool("compress")
+	}
+	if args.Has("compression_level") {
+		level, err := strconv.Atoi(string(args.Peek("compression_level")))
+		if err != nil {
+			return opts, fmt.Errorf("compression_level must be an integer")
+		}
+		opts.CompressionLevel = level
+	}
+	return opts, opts.Validate()
+}
+
+// ackOptions reads the in-flight window and redelivery timeout of an acknowledging connection
+func ackOptions(args *fasthttp.Args) (websocket.AckOptions, error) {
+	var opts websocket.AckOptions
+	if args.Has("window") {
+		window, err := args.GetUint("window")
+		if err != nil || window < 1 || window > websocket.MaxAckWindow {
+			return opts, fmt.Errorf("window must be between 1 and %d", websocket.MaxAckWindow)
+		}
+		opts.Window = window
+	}
+	if args.Has("ack_timeout_ms") {
+		timeout, err := args.GetUint("ack_timeout_ms")
+		if err != nil || timeout < 1 {
+			return opts, fmt.Errorf("ack_timeout_ms must be a positive integer")
+		}
+		opts.Timeout = time.Duration(timeout) * time.Millisecond
+	}
+	return opts, nil
+}
+
+// Catalog describes every stream for a checkpoint
+func (h *Handlers) Catalog() map[string]checkpoint.StreamInfo {
+	h.StreamsMutex.RLock()
+	streamIDs := make([]string, 0, len(h.ActiveStreams))
+	for streamID := range h.ActiveStreams {
+		streamIDs = append(streamIDs, streamID)
+	}
+	h.StreamsMutex.RUnlock()
+
+	catalog := make(map[string]checkpoint.StreamInfo, len(streamIDs))
+	for _, streamID := range streamIDs {
+		stream, _ := h.Hub.Stream(streamID)
+		info := checkpoint.StreamInfo{
+			Name:   stream.Name,
+			Labels: stream.Labels,
+			Policy: string(h.Hub.StreamPolicy(streamID)),
+		}
+		if compatibility, versions, ok := h.Schemas.Subject(streamID); ok {
+			info.Compatibility, info.Schemas = string(compatibility), versions
+		}
+		catalog[streamID] = info
+	}
+	return catalog
+}
+
+// RestoreStreams re-creates the streams of a checkpoint's catalog with
+// their names, labels, policies and schemas. A stream whose schema cannot
+// be restored is not re-created, so that it does not accept payloads its
+// schema would reject.
+func (h *Handlers) RestoreStreams(catalog map[string]checkpoint.StreamInfo) error {
+	var firstErr error
+	for streamID, info := range catalog {
+		if err := h.restoreStream(streamID, info); err != nil {
+			h.Logger.Error("Failed to restore stream", "stream_id", streamID, "error", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("stream %s: %v", streamID, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func (h *Handlers) restoreStream(streamID string, info checkpoint.StreamInfo) error {
+	policy, err := websocket.ParsePolicy(info.Policy)
+	if err != nil {
+		return err
+	}
+	if len(info.Schemas) > 0 {
+		compatibility, err := schema.ParseCompatibility(info.Compatibility)
+		if err != nil {
+			return err
+		}
+		if err := h.Schemas.Restore(streamID, compatibility, info.Schemas); err != nil {
+			return err
+		}
+	}
+
+	h.StreamsMutex.Lock()
+	h.ActiveStreams[streamID] = true
+	h.StreamsMutex.Unlock()
+	h.Hub.SetStreamPolicy(streamID, policy)
+	h.Hub.RegisterStream(websocket.StreamInfo{ID: streamID, Name: info.Name, Labels: info.Labels})
+	return nil
 }
 
 func (h *Handlers) streamExists(streamID string) bool {
@@ -139,3 +589,12 @@ func (h *Handlers) streamExists(streamID string) bool {
 	defer h.StreamsMutex.RUnlock()
 	return h.ActiveStreams[streamID]
 }
+
+// streamIDFromPath extracts the stream ID from a /stream/{stream_id}/{action} path
+func streamIDFromPath(path, action string) (string, bool) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 4 || parts[1] != "stream" || parts[2] == "" || parts[3] != action {
+		return "", false
+	}
+	return parts[2], true
+}
@@ -0,0 +1,295 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/api"
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+// server routes requests to handlers without a Kafka producer or consumer
+type server struct {
+	t        *testing.T
+	handlers *api.Handlers
+	handle   fasthttp.RequestHandler
+}
+
+func newServer(t *testing.T) *server {
+	log := logger.NewLogger()
+	hub := websocket.NewHub(log)
+	go hub.Run()
+	h := api.NewHandlers(nil, nil, hub, log)
+	h.Tables = lookup.NewTables()
+	return &server{t: t, handlers: h, handle: api.NewRouter(h)}
+}
+
+// do serves a request and returns the response status and body
+func (s *server) do(method, uri, contentType, body string) (int, string) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	if contentType != "" {
+		ctx.Request.Header.SetContentType(contentType)
+	}
+	ctx.Request.SetBodyString(body)
+	s.handle(&ctx)
+	return ctx.Response.StatusCode(), string(ctx.Response.Body())
+}
+
+// startStream creates a stream and returns its ID
+func (s *server) startStream(body string) string {
+	status, resp := s.do("POST", "/stream/start", "application/json", body)
+	require.Equal(s.t, fasthttp.StatusOK, status, resp)
+	var created map[string]string
+	require.NoError(s.t, json.Unmarshal([]byte(resp), &created))
+	return created["stream_id"]
+}
+
+// process runs a JSON message of a stream through the processor and
+// returns the payloads delivered per stream
+func (s *server) process(streamID, message string) map[string][]string {
+	out := make(map[string][]string)
+	s.handlers.Processor.Process(streamID, codec.JSON, []byte(message), func(streamID string, _ codec.Format, data []byte) {
+		out[streamID] = append(out[streamID], string(data))
+	})
+	return out
+}
+
+// TestPipelineHotSwap tests installing, replacing, fetching and removing a
+// stream's pipeline, and that each message runs through the pipeline
+// installed when it arrives
+func TestPipelineHotSwap(t *testing.T) {
+	s := newServer(t)
+	streamID := s.startStream(`{"name":"sensors"}`)
+	uri := "/stream/" + streamID + "/pipeline"
+
+	status, _ := s.do("GET", uri, "", "")
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+
+	status, resp := s.do("PUT", uri, "application/json", `{"stages":[{"type":"filter","expr":"temperature > 30"}]}`)
+	require.Equal(t, fasthttp.StatusOK, status, resp)
+	assert.JSONEq(t, `{"stream_id":"`+streamID+`","stages":1}`, resp)
+	assert.Empty(t, s.process(streamID, `{"temperature":20}`))
+	assert.Len(t, s.process(streamID, `{"temperature":40}`)[streamID], 1)
+
+	// The replacement applies to the next message
+	status, resp = s.do("PUT", uri, "application/json", `{"stages":[{"type":"filter","expr":"temperature < 30"}]}`)
+	require.Equal(t, fasthttp.StatusOK, status, resp)
+	assert.Len(t, s.process(streamID, `{"temperature":20}`)[streamID], 1)
+	assert.Empty(t, s.process(streamID, `{"temperature":40}`))
+
+	status, resp = s.do("GET", uri, "", "")
+	require.Equal(t, fasthttp.StatusOK, status)
+	assert.JSONEq(t, `{"stages":[{"type":"filter","expr":"temperature < 30"}]}`, resp)
+
+	// A rejected pipeline leaves the installed one in place
+	status, _ = s.do("PUT", uri, "application/json", `{"stages":[{"type":"unknown"}]}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = s.do("PUT", uri, "application/json", `{"stages":`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Len(t, s.process(streamID, `{"temperature":20}`)[streamID], 1)
+
+	// Swapping while messages are processed loses none of them: each runs
+	// through one pipeline or the other, which here both pass it
+	done := make(chan int)
+	go func() {
+		passed := 0
+		for i := 0; i < 1000; i++ {
+			passed += len(s.process(streamID, `{"temperature":20}`)[streamID])
+		}
+		done <- passed
+	}()
+	for i := 0; i < 50; i++ {
+		status, _ = s.do("PUT", uri, "application/json", `{"stages":[{"type":"filter","expr":"temperature < 25"}]}`)
+		require.Equal(t, fasthttp.StatusOK, status)
+		status, _ = s.do("PUT", uri, "application/json", `{"stages":[{"type":"filter","expr":"temperature < 30"}]}`)
+		require.Equal(t, fasthttp.StatusOK, status)
+	}
+	assert.Equal(t, 1000, <-done)
+
+	status, _ = s.do("DELETE", uri, "", "")
+	assert.Equal(t, fasthttp.StatusNoContent, status)
+	assert.Equal(t, []string{`{"temperature":40}`}, s.process(streamID, `{"temperature":40}`)[streamID])
+
+	status, _ = s.do("PUT", "/stream/missing/pipeline", "application/json", `{"stages":[]}`)
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+}
+
+// TestPipelineYAML tests that pipelines may be sent as YAML, with or
+// without a charset, and map onto the same fields as JSON
+func TestPipelineYAML(t *testing.T) {
+	s := newServer(t)
+	streamID := s.startStream("")
+	uri := "/stream/" + streamID + "/pipeline"
+
+	pipeline := "stages:\n  - type: filter\n    expr: temperature > 30\n"
+	for _, contentType := range []string{"application/yaml", "text/yaml; charset=utf-8", "Application/X-YAML"} {
+		status, resp := s.do("PUT", uri, contentType, pipeline)
+		require.Equal(t, fasthttp.StatusOK, status, contentType+": "+resp)
+		status, resp = s.do("GET", uri, "", "")
+		require.Equal(t, fasthttp.StatusOK, status)
+		assert.JSONEq(t, `{"stages":[{"type":"filter","expr":"temperature > 30"}]}`, resp, contentType)
+	}
+
+	// YAML is only decoded when the Content-Type says so
+	status, _ := s.do("PUT", uri, "application/json", pipeline)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = s.do("PUT", uri, "application/yaml", "stages: [")
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+
+	// Streams can be created with a YAML body too
+	status, resp := s.do("POST", "/stream/start", "application/yaml", "name: yaml\npipeline:\n  stages:\n    - type: filter\n      expr: v > 1\n")
+	require.Equal(t, fasthttp.StatusOK, status, resp)
+	var created map[string]string
+	require.NoError(t, json.Unmarshal([]byte(resp), &created))
+	status, resp = s.do("GET", "/stream/"+created["stream_id"]+"/pipeline", "", "")
+	require.Equal(t, fasthttp.StatusOK, status)
+	assert.JSONEq(t, `{"stages":[{"type":"filter","expr":"v > 1"}]}`, resp)
+}
+
+// TestPipelineRouteTargets tests that pipelines may only route to streams
+// that exist
+func TestPipelineRouteTargets(t *testing.T) {
+	s := newServer(t)
+	streamID := s.startStream("")
+	target := s.startStream("")
+	uri := "/stream/" + streamID + "/pipeline"
+
+	status, resp := s.do("PUT", uri, "application/json", `{"stages":[{"type":"route","stream":"missing","copy":true}]}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	assert.Contains(t, resp, `route target stream "missing" not found`)
+	assert.Nil(t, s.handlers.Processor.Pipeline(streamID))
+
+	status, _ = s.do("POST", "/stream/start", "application/json", `{"pipeline":{"stages":[{"type":"route","stream":"missing","copy":true}]}}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+
+	status, resp = s.do("PUT", uri, "application/json", `{"stages":[{"type":"route","stream":"`+target+`","copy":true}]}`)
+	require.Equal(t, fasthttp.StatusOK, status, resp)
+	out := s.process(streamID, `{"v":1}`)
+	assert.Equal(t, []string{`{"v":1}`}, out[streamID])
+	assert.Equal(t, []string{`{"v":1}`}, out[target])
+}
+
+// TestJoins tests creating, fetching, running and deleting a join
+func TestJoins(t *testing.T) {
+	s := newServer(t)
+	orders := s.startStream("")
+	payments := s.startStream("")
+
+	status, _ := s.do("POST", "/stream/join", "application/json", `{"left":"`+orders+`","right":"missing","key":"id","window":"1m"}`)
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+	status, _ = s.do("POST", "/stream/join", "application/json", `{"left":"`+orders+`","right":"`+payments+`","key":"id"}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = s.do("GET", "/stream/join", "", "")
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, status)
+
+	status, resp := s.do("POST", "/stream/join", "application/yaml", "name: paid\nleft: "+orders+"\nright: "+payments+"\nkey: id\nwindow: 1m\n")
+	require.Equal(t, fasthttp.StatusOK, status, resp)
+	var created map[string]string
+	require.NoError(t, json.Unmarshal([]byte(resp), &created))
+	joined := created["stream_id"]
+	require.NotEmpty(t, joined)
+	info, ok := s.handlers.Hub.Stream(joined)
+	require.True(t, ok)
+	assert.Equal(t, "paid", info.Name)
+
+	status, resp = s.do("GET", "/stream/"+joined+"/join", "", "")
+	require.Equal(t, fasthttp.StatusOK, status)
+	var config map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(resp), &config))
+	assert.Equal(t, orders, config["left"])
+	assert.Equal(t, payments, config["right"])
+	assert.Equal(t, joined, config["stream"])
+
+	s.process(orders, `{"id":1,"item":"book"}`)
+	out := s.process(payments, `{"id":1,"amount":12}`)
+	require.Len(t, out[joined], 1)
+	assert.JSONEq(t, `{"left":{"id":1,"item":"book"},"right":{"id":1,"amount":12}}`, out[joined][0])
+
+	status, _ = s.do("DELETE", "/stream/"+joined+"/join", "", "")
+	assert.Equal(t, fasthttp.StatusNoContent, status)
+	status, _ = s.do("GET", "/stream/"+joined+"/join", "", "")
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+	s.process(orders, `{"id":2}`)
+	assert.Empty(t, s.process(payments, `{"id":2}`)[joined])
+	// The derived stream remains
+	assert.True(t, s.handlers.Hub.StreamExists(joined))
+}
+
+// TestLookupTables tests the lookup table API, and that tables loaded from
+// files cannot be changed through it
+func TestLookupTables(t *testing.T) {
+	s := newServer(t)
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "devices.csv"), []byte("id,site\n1,north\n"), 0644))
+	require.NoError(t, s.handlers.Tables.LoadDir(dir))
+
+	status, resp := s.do("PUT", "/tables/users", "application/json", `{"u1":{"name":"Ann"},"u2":{"name":"Bob"}}`)
+	require.Equal(t, fasthttp.StatusOK, status, resp)
+	assert.JSONEq(t, `{"name":"users","rows":2}`, resp)
+
+	status, resp = s.do("GET", "/tables", "", "")
+	require.Equal(t, fasthttp.StatusOK, status)
+	assert.JSONEq(t, `[{"name":"devices","rows":1,"file":"`+filepath.Join(dir, "devices.csv")+`"},{"name":"users","rows":2}]`, resp)
+
+	status, resp = s.do("GET", "/tables/users/rows/u1", "", "")
+	require.Equal(t, fasthttp.StatusOK, status)
+	assert.JSONEq(t, `{"name":"Ann"}`, resp)
+	status, _ = s.do("PUT", "/tables/users/rows/u3", "application/yaml", "name: Cy\n")
+	assert.Equal(t, fasthttp.StatusOK, status)
+	status, _ = s.do("PUT", "/tables/users/rows/u4", "application/json", `[1]`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = s.do("DELETE", "/tables/users/rows/u2", "", "")
+	assert.Equal(t, fasthttp.StatusNoContent, status)
+	status, _ = s.do("DELETE", "/tables/users/rows/u2", "", "")
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+	status, resp = s.do("GET", "/tables/users", "", "")
+	require.Equal(t, fasthttp.StatusOK, status)
+	assert.JSONEq(t, `{"u1":{"name":"Ann"},"u3":{"name":"Cy"}}`, resp)
+
+	// Numbers are kept as in tables loaded from files
+	status, _ = s.do("PUT", "/tables/codes/rows/c1", "application/json", `{"code":9007199254740993}`)
+	require.Equal(t, fasthttp.StatusOK, status)
+	row, _ := s.handlers.Tables.Get("codes").Get("c1")
+	fromFile, err := lookup.ParseJSON([]byte(`{"c1":{"code":9007199254740993}}`))
+	require.NoError(t, err)
+	assert.Equal(t, fromFile["c1"], row)
+
+	// Rows can be set in tables that do not exist yet
+	status, _ = s.do("PUT", "/tables/sites/rows/north", "application/json", `{"region":"eu"}`)
+	assert.Equal(t, fasthttp.StatusOK, status)
+	assert.NotNil(t, s.handlers.Tables.Get("sites"))
+
+	status, _ = s.do("PUT", "/tables/users", "application/json", `{"u1":null}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, status)
+	status, _ = s.do("POST", "/tables", "application/json", `{}`)
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, status)
+	status, _ = s.do("GET", "/tables/users/columns", "", "")
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+
+	for _, req := range []struct{ method, uri, body string }{
+		{"PUT", "/tables/devices", `{"2":{"site":"south"}}`},
+		{"DELETE", "/tables/devices", ""},
+		{"PUT", "/tables/devices/rows/2", `{"site":"south"}`},
+		{"DELETE", "/tables/devices/rows/1", ""},
+	} {
+		status, resp := s.do(req.method, req.uri, "application/json", req.body)
+		assert.Equal(t, fasthttp.StatusConflict, status, req.method+" "+req.uri)
+		assert.Contains(t, resp, "devices.csv")
+	}
+	assert.Equal(t, 1, s.handlers.Tables.Get("devices").Len())
+
+	status, _ = s.do("DELETE", "/tables/users", "", "")
+	assert.Equal(t, fasthttp.StatusNoContent, status)
+	status, _ = s.do("GET", "/tables/users", "", "")
+	assert.Equal(t, fasthttp.StatusNotFound, status)
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/valyala/fasthttp"
+)
+
+// CreateJoin serves POST /stream/join, which joins two existing streams
+// and creates the derived stream that receives the joined records
+func (h *Handlers) CreateJoin(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() && !ctx.IsPut() {
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	var config models.JoinConfig
+	if err := decodeDocument(ctx, &config); err != nil {
+		h.Logger.Error("Failed to parse join", "error", err)
+		ctx.Error("Invalid JSON or YAML data", fasthttp.StatusBadRequest)
+		return
+	}
+	for _, streamID := range []string{config.Left, config.Right} {
+		if streamID != "" && !h.streamExists(streamID) {
+			h.Logger.Error("Stream not found", "stream_id", streamID)
+			ctx.Error("Stream not found: "+streamID, fasthttp.StatusNotFound)
+			return
+		}
+	}
+
+	config.Stream = uuid.New().String()
+	join, err := processor.CompileJoin(config)
+	if err != nil {
+		h.Logger.Error("Join rejected", "error", err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	h.StreamsMutex.Lock()
+	h.ActiveStreams[config.Stream] = true
+	h.StreamsMutex.Unlock()
+	h.Hub.RegisterStream(websocket.StreamInfo{ID: config.Stream, Name: config.Name})
+	h.Processor.SetJoin(join)
+
+	h.Logger.Info("Join created", "stream_id", config.Stream, "left", config.Left, "right", config.Right)
+	metrics.StreamsCreated.Inc()
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]string{"stream_id": config.Stream})
+}
+
+// StreamJoin serves GET /stream/{stream_id}/join, which returns the
+// definition of the join deriving a stream, and DELETE, which stops the
+// join. The derived stream itself remains.
+func (h *Handlers) StreamJoin(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	streamID, ok := streamIDFromPath(path, "join")
+	if !ok {
+		h.Logger.Error("Invalid path", "path", path)
+		ctx.Error("Invalid path", fasthttp.StatusBadRequest)
+		return
+	}
+
+	join := h.Processor.Join(streamID)
+	if join == nil {
+		ctx.Error("Join not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	switch {
+	case ctx.IsGet():
+		ctx.SetContentType("application/json")
+		json.NewEncoder(ctx).Encode(join.Config())
+	case ctx.IsDelete():
+		h.Processor.RemoveJoin(streamID)
+		h.Logger.Info("Join removed", "stream_id", streamID)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
+)
+
+// StreamPipeline serves GET /stream/{stream_id}/pipeline, which returns the
+// stream's pipeline definition, PUT, which compiles a new definition and
+// swaps it in without interrupting the stream, and DELETE, which removes
+// the pipeline so that messages pass through unchanged
+func (h *Handlers) StreamPipeline(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	streamID, ok := streamIDFromPath(path, "pipeline")
+	if !ok {
+		h.Logger.Error("Invalid path", "path", path)
+		ctx.Error("Invalid path", fasthttp.StatusBadRequest)
+		return
+	}
+
+	if !h.streamExists(streamID) {
+		h.Logger.Error("Stream not found", "stream_id", streamID)
+		ctx.Error("Stream not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	switch {
+	case ctx.IsGet():
+		pipeline := h.Processor.Pipeline(streamID)
+		if pipeline == nil {
+			ctx.Error("Pipeline not found", fasthttp.StatusNotFound)
+			return
+		}
+		ctx.SetContentType("application/json")
+		enc := json.NewEncoder(ctx)
+		enc.SetEscapeHTML(false)
+		enc.Encode(pipeline.Config())
+	case ctx.IsPut() || ctx.IsPost():
+		h.putPipeline(ctx, streamID)
+	case ctx.IsDelete():
+		h.Processor.RemovePipeline(streamID)
+		h.Logger.Info("Pipeline removed", "stream_id", streamID)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) putPipeline(ctx *fasthttp.RequestCtx, streamID string) {
+	var config models.PipelineConfig
+	if err := decodeDocument(ctx, &config); err != nil {
+		h.Logger.Error("Failed to parse pipeline", "error", err)
+		ctx.Error("Invalid JSON or YAML data", fasthttp.StatusBadRequest)
+		return
+	}
+
+	pipeline, err := h.compilePipeline(config)
+	if err != nil {
+		h.Logger.Error("Pipeline rejected", "stream_id", streamID, "error", err)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	h.Processor.SetPipeline(streamID, pipeline)
+
+	h.Logger.Info("Pipeline installed", "stream_id", streamID, "stages", len(config.Stages))
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{"stream_id": streamID, "stages": len(config.Stages)})
+}
+
+// compilePipeline compiles a pipeline definition and checks that the
+// streams it routes to exist. Routed messages are delivered to their
+// stream directly and do not run through that stream's own pipeline.
+func (h *Handlers) compilePipeline(config models.PipelineConfig) (*processor.Pipeline, error) {
+	pipeline, err := processor.Compile(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range pipeline.Routes() {
+		if !h.streamExists(target) {
+			return nil, fmt.Errorf("route target stream %q not found", target)
+		}
+	}
+	return pipeline, nil
+}
+
+// decodeDocument decodes a JSON request body, or a YAML one when the
+// Content-Type says so. YAML is converted to JSON first so that both
+// syntaxes map onto the same JSON tags. Numbers are kept as json.Number, as
+// in decoded messages and tables loaded from files.
+func decodeDocument(ctx *fasthttp.RequestCtx, v interface{}) error {
+	body := ctx.PostBody()
+	contentType := string(ctx.Request.Header.ContentType())
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	switch strings.TrimSpace(strings.ToLower(contentType)) {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		var doc interface{}
+		if err := yaml.Unmarshal(body, &doc); err != nil {
+			return err
+		}
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("yaml: %v", err)
+		}
+		body = converted
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("trailing data after document")
+	}
+	return nil
+}
@@ -1,12 +1,16 @@
 package api
 
 import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
 	"github.com/rithindattag/realtime-streaming-api/pkg/auth"
 	"strings"
 )
 
 func NewRouter(h *Handlers) fasthttp.RequestHandler {
+	metricsHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+
 	return func(ctx *fasthttp.RequestCtx) {
 		// API Key authentication
 		if !auth.ValidateAPIKey(string(ctx.Request.Header.Peek("X-API-Key"))) {
@@ -16,12 +20,28 @@ func NewRouter(h *Handlers) fasthttp.RequestHandler {
 
 		path := string(ctx.Path())
 		switch {
+		case path == "/metrics":
+			metricsHandler(ctx)
+		case path == "/ws":
+			h.Multiplex(ctx)
 		case path == "/stream/start":
 			h.StartStream(ctx)
+		case path == "/stream/join":
+			h.CreateJoin(ctx)
+		case path == "/tables" || strings.HasPrefix(path, "/tables/"):
+			h.LookupTables(ctx)
 		case strings.HasPrefix(path, "/stream/") && strings.HasSuffix(path, "/send"):
 			h.SendData(ctx)
 		case strings.HasPrefix(path, "/stream/") && strings.HasSuffix(path, "/results"):
 			h.StreamResults(ctx)
+		case strings.HasPrefix(path, "/stream/") && strings.HasSuffix(path, "/ingest"):
+			h.Ingest(ctx)
+		case strings.HasPrefix(path, "/stream/") && strings.HasSuffix(path, "/schema"):
+			h.StreamSchema(ctx)
+		case strings.HasPrefix(path, "/stream/") && strings.HasSuffix(path, "/pipeline"):
+			h.StreamPipeline(ctx)
+		case strings.HasPrefix(path, "/stream/") && strings.HasSuffix(path, "/join"):
+			h.StreamJoin(ctx)
 		default:
 			ctx.Error("Not found", fasthttp.StatusNotFound)
 		}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
+	"github.com/valyala/fasthttp"
+)
+
+// StreamSchema serves GET /stream/{stream_id}/schema, which returns the
+// latest schema of a stream or the version given by ?version=, and PUT,
+// which registers a new version after checking its compatibility
+func (h *Handlers) StreamSchema(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	streamID, ok := streamIDFromPath(path, "schema")
+	if !ok {
+		h.Logger.Error("Invalid path", "path", path)
+		ctx.Error("Invalid path", fasthttp.StatusBadRequest)
+		return
+	}
+
+	if !h.streamExists(streamID) {
+		h.Logger.Error("Stream not found", "stream_id", streamID)
+		ctx.Error("Stream not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	switch {
+	case ctx.IsGet():
+		h.getSchema(ctx, streamID)
+	case ctx.IsPut() || ctx.IsPost():
+		h.putSchema(ctx, streamID)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) getSchema(ctx *fasthttp.RequestCtx, streamID string) {
+	var s *schema.Schema
+	var err error
+	if ctx.QueryArgs().Has("version") {
+		version, verr := ctx.QueryArgs().GetUint("version")
+		if verr != nil {
+			ctx.Error("version must be a positive integer", fasthttp.StatusBadRequest)
+			return
+		}
+		s, err = h.Schemas.Version(streamID, version)
+	} else {
+		s, err = h.Schemas.Latest(streamID)
+	}
+	if err != nil {
+		ctx.Error("Schema not found", fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"subject":    s.Subject,
+		"version":    s.Version,
+		"versions":   h.Schemas.Versions(streamID),
+		"type":       s.Type,
+		"schema":     s.Definition,
+		"created_at": s.CreatedAt,
+	})
+}
+
+func (h *Handlers) putSchema(ctx *fasthttp.RequestCtx, streamID string) {
+	var config models.SchemaConfig
+	if err := json.Unmarshal(ctx.PostBody(), &config); err != nil {
+		h.Logger.Error("Failed to parse schema", "error", err)
+		ctx.Error("Invalid JSON data", fasthttp.StatusBadRequest)
+		return
+	}
+
+	s, err := h.registerSchema(streamID, config)
+	if err != nil {
+		h.Logger.Error("Schema rejected", "stream_id", streamID, "error", err)
+		if _, ok := err.(*schema.IncompatibleError); ok {
+			ctx.Error(err.Error(), fasthttp.StatusConflict)
+			return
+		}
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	h.Logger.Info("Schema registered", "stream_id", streamID, "version", s.Version)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{"subject": s.Subject, "version": s.Version})
+}
+
+// registerSchema registers a schema version under a stream's ID
+func (h *Handlers) registerSchema(streamID string, config models.SchemaConfig) (*schema.Schema, error) {
+	t, err := schema.ParseType(config.Type)
+	if err != nil {
+		return nil, err
+	}
+	var compatibility schema.Compatibility
+	if config.Compatibility != "" {
+		if compatibility, err = schema.ParseCompatibility(config.Compatibility); err != nil {
+			return nil, err
+		}
+	}
+	return h.Schemas.Register(streamID, t, config.Definition, compatibility)
+}
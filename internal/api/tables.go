@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
+	"github.com/valyala/fasthttp"
+)
+
+// LookupTables serves the lookup tables used by lookup stages:
+//
+//	GET    /tables                    lists the tables
+//	GET    /tables/{name}             returns a table's rows by key
+//	PUT    /tables/{name}             replaces a table's rows
+//	DELETE /tables/{name}             removes a table
+//	GET    /tables/{name}/rows/{key}  returns a row
+//	PUT    /tables/{name}/rows/{key}  sets a row, creating the table if needed
+//	DELETE /tables/{name}/rows/{key}  removes a row
+//
+// Tables loaded from files change with their file and cannot be modified
+// through the API.
+func (h *Handlers) LookupTables(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
+	if path == "/tables" {
+		if !ctx.IsGet() {
+			ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+			return
+		}
+		h.listTables(ctx)
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 5)
+	switch {
+	case len(parts) == 3 && parts[2] != "":
+		h.lookupTable(ctx, parts[2])
+	case len(parts) == 5 && parts[2] != "" && parts[3] == "rows" && parts[4] != "":
+		h.lookupRow(ctx, parts[2], parts[4])
+	default:
+		ctx.Error("Not found", fasthttp.StatusNotFound)
+	}
+}
+
+// tableInfo describes a table in the table list
+type tableInfo struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+	File string `json:"file,omitempty"`
+}
+
+func (h *Handlers) listTables(ctx *fasthttp.RequestCtx) {
+	tables := []tableInfo{}
+	for _, name := range h.Tables.Names() {
+		if t := h.Tables.Get(name); t != nil {
+			tables = append(tables, tableInfo{Name: name, Rows: t.Len(), File: t.File()})
+		}
+	}
+	writeJSON(ctx, tables)
+}
+
+func (h *Handlers) lookupTable(ctx *fasthttp.RequestCtx, name string) {
+	table := h.Tables.Get(name)
+	switch {
+	case ctx.IsGet():
+		if table == nil {
+			ctx.Error("Table not found", fasthttp.StatusNotFound)
+			return
+		}
+		writeJSON(ctx, table.Rows())
+	case ctx.IsPut() || ctx.IsPost():
+		if !h.writableTable(ctx, table) {
+			return
+		}
+		var rows map[string]map[string]interface{}
+		if err := decodeDocument(ctx, &rows); err != nil {
+			h.Logger.Error("Failed to parse lookup table", "table", name, "error", err)
+			ctx.Error("Invalid JSON or YAML data", fasthttp.StatusBadRequest)
+			return
+		}
+		if rows == nil {
+			rows = make(map[string]map[string]interface{})
+		}
+		for key, row := range rows {
+			if row == nil {
+				ctx.Error("Row "+key+" must be an object", fasthttp.StatusBadRequest)
+				return
+			}
+		}
+		if err := h.Tables.Set(name, rows); err != nil {
+			h.Logger.Error("Lookup table rejected", "table", name, "error", err)
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		h.Logger.Info("Lookup table replaced", "table", name, "rows", len(rows))
+		writeJSON(ctx, tableInfo{Name: name, Rows: len(rows)})
+	case ctx.IsDelete():
+		if table == nil {
+			ctx.Error("Table not found", fasthttp.StatusNotFound)
+			return
+		}
+		if !h.writableTable(ctx, table) {
+			return
+		}
+		h.Tables.Remove(name)
+		h.Logger.Info("Lookup table removed", "table", name)
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) lookupRow(ctx *fasthttp.RequestCtx, name, key string) {
+	table := h.Tables.Get(name)
+	switch {
+	case ctx.IsGet():
+		var row map[string]interface{}
+		if table != nil {
+			row, _ = table.Get(key)
+		}
+		if row == nil {
+			ctx.Error("Row not found", fasthttp.StatusNotFound)
+			return
+		}
+		writeJSON(ctx, row)
+	case ctx.IsPut() || ctx.IsPost():
+		if !h.writableTable(ctx, table) {
+			return
+		}
+		var row map[string]interface{}
+		if err := decodeDocument(ctx, &row); err != nil || row == nil {
+			h.Logger.Error("Failed to parse lookup row", "table", name, "error", err)
+			ctx.Error("Row must be a JSON or YAML object", fasthttp.StatusBadRequest)
+			return
+		}
+		if err := h.Tables.Ensure(name).Put(key, row); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		writeJSON(ctx, row)
+	case ctx.IsDelete():
+		if !h.writableTable(ctx, table) {
+			return
+		}
+		if table == nil || !table.Delete(key) {
+			ctx.Error("Row not found", fasthttp.StatusNotFound)
+			return
+		}
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	default:
+		ctx.Error("Method not allowed", fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+// writableTable rejects changes to tables loaded from files
+func (h *Handlers) writableTable(ctx *fasthttp.RequestCtx, table *lookup.Table) bool {
+	if table != nil && table.File() != "" {
+		ctx.Error("Table is loaded from "+table.File()+" and changes with it", fasthttp.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes a JSON response
+func writeJSON(ctx *fasthttp.RequestCtx, v interface{}) {
+	ctx.SetContentType("application/json")
+	enc := json.NewEncoder(ctx)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
@@ -0,0 +1,127 @@
+// Package checkpoint stores snapshots of processor state on local disk
+// together with the Kafka offsets they correspond to
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
+)
+
+// fileName is the name of the latest checkpoint in a store's directory
+const fileName = "checkpoint.json"
+
+// version is the format of the checkpoints written
+const version = 1
+
+// Offset is the next offset to consume from a partition
+type Offset struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Checkpoint is the state of the processor after it processed every
+// message before Offsets. Restoring it and consuming from Offsets applies
+// every message to the state exactly once. Catalog describes every stream
+// by ID, and Streams holds the pipelines and joins of some of them.
+type Checkpoint struct {
+	Version int                              `json:"version"`
+	Time    time.Time                        `json:"time"`
+	Offsets []Offset                         `json:"offsets"`
+	Catalog map[string]StreamInfo            `json:"catalog,omitempty"`
+	Streams map[string]processor.StreamState `json:"streams"`
+}
+
+// StreamInfo is what a stream was created with besides its pipeline
+type StreamInfo struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Policy string            `json:"policy,omitempty"`
+	// Compatibility and Schemas are the stream's schema subject
+	Compatibility string           `json:"compatibility,omitempty"`
+	Schemas       []*schema.Schema `json:"schemas,omitempty"`
+}
+
+// Store keeps the latest checkpoint in a directory. Checkpoints are
+// written to a temporary file and renamed into place, so a crash while
+// saving leaves the previous one intact.
+type Store struct {
+	dir string
+}
+
+// NewStore creates a store in dir, creating the directory if needed
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Save writes a checkpoint, replacing the previous one
+func (s *Store) Save(cp *Checkpoint) error {
+	cp.Version = version
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, fileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// The data must be on disk before the rename makes it the checkpoint
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, fileName)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Load reads the latest checkpoint. It returns nil without an error when
+// none was saved yet.
+func (s *Store) Load() (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint: %v", err)
+	}
+	if cp.Version != version {
+		return nil, fmt.Errorf("checkpoint: unsupported version %d", cp.Version)
+	}
+	return &cp, nil
+}
+
+// syncDir persists a rename in dir
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
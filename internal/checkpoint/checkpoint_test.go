@@ -0,0 +1,113 @@
+package checkpoint_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/checkpoint"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckpointRoundTrip tests that window state and offsets survive a
+// save and a restore into a new processor
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := checkpoint.NewStore(dir)
+	require.NoError(t, err)
+
+	cp, err := store.Load()
+	require.NoError(t, err)
+	assert.Nil(t, cp)
+
+	config := models.PipelineConfig{Stages: []json.RawMessage{
+		json.RawMessage(`{"type":"window","size":"1h","group_by":["site"],"aggregates":{"n":{"op":"count"},"total":{"op":"sum","field":"v"}}}`),
+	}}
+	pipeline, err := processor.Compile(config)
+	require.NoError(t, err)
+	proc := processor.NewProcessor(logger.NewLogger())
+	proc.SetPipeline("s", pipeline)
+	proc.SetPipeline("plain", mustCompile(t, `{"type":"filter","expr":"true"}`))
+	discard := func(string, codec.Format, []byte) {}
+	proc.Process("s", codec.JSON, []byte(`{"site":"A","v":1}`), discard)
+	proc.Process("s", codec.JSON, []byte(`{"site":"A","v":2}`), discard)
+
+	streams, err := proc.Snapshot()
+	require.NoError(t, err)
+	assert.Empty(t, streams["plain"].State)
+	registry := schema.NewRegistry()
+	_, err = registry.Register("s", schema.JSONSchema, []byte(`{"type":"object","required":["site"]}`), schema.CompatibilityNone)
+	require.NoError(t, err)
+	compatibility, versions, _ := registry.Subject("s")
+	catalog := map[string]checkpoint.StreamInfo{
+		"s":     {Name: "sites", Labels: map[string]string{"env": "prod"}, Policy: "coalesce", Compatibility: string(compatibility), Schemas: versions},
+		"plain": {},
+	}
+	require.NoError(t, store.Save(&checkpoint.Checkpoint{
+		Time:    time.Now(),
+		Offsets: []checkpoint.Offset{{Topic: "events", Partition: 0, Offset: 42}},
+		Catalog: catalog,
+		Streams: streams,
+	}))
+
+	// Nothing but the checkpoint is left in the directory
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "checkpoint.json", files[0].Name())
+
+	cp, err = store.Load()
+	require.NoError(t, err)
+	require.NotNil(t, cp)
+	assert.Equal(t, []checkpoint.Offset{{Topic: "events", Partition: 0, Offset: 42}}, cp.Offsets)
+	assert.Equal(t, "sites", cp.Catalog["s"].Name)
+	assert.Equal(t, "coalesce", cp.Catalog["s"].Policy)
+	require.Len(t, cp.Catalog["s"].Schemas, 1)
+	restoredSchemas := schema.NewRegistry()
+	require.NoError(t, restoredSchemas.Restore("s", schema.Compatibility(cp.Catalog["s"].Compatibility), cp.Catalog["s"].Schemas))
+	latest, err := restoredSchemas.Latest("s")
+	require.NoError(t, err)
+	assert.Error(t, latest.Validate(map[string]interface{}{}))
+
+	restored := processor.NewProcessor(logger.NewLogger())
+	ids, err := restored.Restore(cp.Streams)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plain", "s"}, ids)
+
+	restored.Process("s", codec.JSON, []byte(`{"site":"A","v":3}`), discard)
+	var out []*processor.Message
+	require.NoError(t, restored.Pipeline("s").Flush(func(m *processor.Message) { out = append(out, m) }))
+	require.Len(t, out, 1)
+	assert.Equal(t, "s", out[0].StreamID)
+	assert.Equal(t, int64(3), out[0].Value["n"])
+	assert.Equal(t, float64(6), out[0].Value["total"])
+}
+
+// TestLoadErrors tests that unreadable checkpoints are reported
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	store, err := checkpoint.NewStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "checkpoint.json"), []byte(`{"version":99}`), 0o644))
+	_, err = store.Load()
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "checkpoint.json"), []byte(`{`), 0o644))
+	_, err = store.Load()
+	assert.Error(t, err)
+}
+
+func mustCompile(t *testing.T, stage string) *processor.Pipeline {
+	p, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(stage)}})
+	require.NoError(t, err)
+	return p
+}
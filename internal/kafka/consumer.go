@@ -2,18 +2,56 @@
 package kafka
 
 import (
-	"encoding/json"
+	"sort"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/checkpoint"
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
 )
 
+// checkpointReadTimeout bounds how long the consumer waits for a message
+// while checkpoints are enabled, so that they are taken while idle too
+const checkpointReadTimeout = time.Second
+
+// partition identifies a partition of a topic
+type partition struct {
+	topic string
+	id    int32
+}
+
+// client is the part of *kafka.Consumer the consumer uses
+type client interface {
+	ReadMessage(timeout time.Duration) (*kafka.Message, error)
+	Assign(partitions []kafka.TopicPartition) error
+	Unassign() error
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Close() error
+}
+
 // Consumer represents a Kafka consumer.
 type Consumer struct {
-	consumer *kafka.Consumer
+	consumer client
 	topic    string
 	logger   *logger.Logger
+	// proc is the processor messages are consumed into, checkpointed when
+	// partitions are revoked
+	proc *processor.Processor
+
+	// checkpoints receives a snapshot of the processor every
+	// checkpointInterval when set
+	checkpoints        *checkpoint.Store
+	checkpointInterval time.Duration
+	lastCheckpoint     time.Time
+	// catalog describes the streams whose state is checkpointed
+	catalog func() map[string]checkpoint.StreamInfo
+	// positions holds the next offset to consume of each partition
+	// processed, and resume the offsets to start assigned partitions from
+	positions map[partition]int64
+	resume    map[partition]int64
 }
 
 // NewConsumer creates and returns a new Kafka consumer.
@@ -33,48 +71,192 @@ func NewConsumer(bootstrapServers, topic string, logger *logger.Logger) (*Consum
 		return nil, err
 	}
 
+	consumer := &Consumer{
+		consumer:  c,
+		topic:     topic,
+		logger:    logger,
+		positions: make(map[partition]int64),
+		resume:    make(map[partition]int64),
+	}
+
 	// Subscribe to the specified topic
 	logger.Info("Subscribing to topic", "topic", topic)
-	err = c.SubscribeTopics([]string{topic}, nil)
+	err = c.SubscribeTopics([]string{topic}, consumer.rebalance)
 	if err != nil {
 		logger.Error("Failed to subscribe to topic", "error", err)
 		return nil, err
 	}
 
-	return &Consumer{
-		consumer: c,
-		topic:    topic,
-		logger:   logger,
-	}, nil
+	return consumer, nil
+}
+
+// EnableCheckpoints makes ConsumeMessages save the processor's state with
+// the offsets it corresponds to every interval, together with the streams
+// returned by catalog. When from is not nil, partitions are consumed from
+// its offsets, which must be called before ConsumeMessages starts.
+func (c *Consumer) EnableCheckpoints(store *checkpoint.Store, interval time.Duration, from *checkpoint.Checkpoint, catalog func() map[string]checkpoint.StreamInfo) {
+	c.checkpoints = store
+	c.catalog = catalog
+	c.checkpointInterval = interval
+	c.lastCheckpoint = time.Now()
+	if from == nil {
+		return
+	}
+	// Offsets are also committed with every checkpoint, so partitions not
+	// consumed since still resume from them
+	for _, o := range from.Offsets {
+		p := partition{topic: o.Topic, id: o.Partition}
+		c.resume[p] = o.Offset
+	}
+}
+
+// rebalance starts assigned partitions from their checkpointed offsets,
+// and checkpoints the processor before partitions are revoked so that
+// their offsets are committed with the state that includes them. Otherwise
+// a partition assigned again, even to this consumer, would be consumed
+// again from the previous checkpoint's offsets. It is called while reading
+// messages, on the consuming goroutine, so no message is half processed.
+func (c *Consumer) rebalance(_ *kafka.Consumer, ev kafka.Event) error {
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		partitions := e.Partitions
+		for i, tp := range partitions {
+			p := partition{topic: *tp.Topic, id: tp.Partition}
+			if offset, ok := c.resume[p]; ok {
+				partitions[i].Offset = kafka.Offset(offset)
+				// Later assignments resume from the committed offset
+				delete(c.resume, p)
+			}
+		}
+		c.logger.Info("Partitions assigned", "partitions", len(partitions))
+		return c.consumer.Assign(partitions)
+	case kafka.RevokedPartitions:
+		c.logger.Info("Partitions revoked", "partitions", len(e.Partitions))
+		if c.checkpoints != nil && c.proc != nil {
+			c.lastCheckpoint = time.Now()
+			c.saveCheckpoint(c.proc)
+		}
+		// Another consumer may own them now; committing their offsets
+		// later would rewind it
+		for _, tp := range e.Partitions {
+			delete(c.positions, partition{topic: *tp.Topic, id: tp.Partition})
+		}
+		return c.consumer.Unassign()
+	}
+	return nil
 }
 
 // ConsumeMessages starts consuming messages from the subscribed Kafka topic.
-// It continuously reads messages and broadcasts them to connected WebSocket clients.
-func (c *Consumer) ConsumeMessages(hub *websocket.Hub) {
+// It continuously reads messages, runs them through their stream's pipeline
+// and passes the results to out, which broadcasts them to WebSocket clients.
+func (c *Consumer) ConsumeMessages(proc *processor.Processor, out processor.Output) {
 	c.logger.Info("Starting to consume messages", "topic", c.topic)
+	c.proc = proc
+	timeout := time.Duration(-1)
+	if c.checkpoints != nil {
+		timeout = checkpointReadTimeout
+	}
 	for {
 		// Read message from Kafka
-		msg, err := c.consumer.ReadMessage(-1)
+		msg, err := c.consumer.ReadMessage(timeout)
 		if err != nil {
-			c.logger.Error("Error reading message", "error", err)
+			if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrTimedOut {
+				c.logger.Error("Error reading message", "error", err)
+			}
+			c.maybeCheckpoint(proc)
 			continue
 		}
 
-		c.logger.Info("Received message", "topic", *msg.TopicPartition.Topic, "partition", msg.TopicPartition.Partition, "offset", msg.TopicPartition.Offset)
+		c.handle(proc, msg, out)
+		c.maybeCheckpoint(proc)
+	}
+}
+
+// handle processes a message and records the position of its partition
+func (c *Consumer) handle(proc *processor.Processor, msg *kafka.Message, out processor.Output) {
+	c.logger.Info("Received message", "topic", *msg.TopicPartition.Topic, "partition", msg.TopicPartition.Partition, "offset", msg.TopicPartition.Offset)
 
-		// Unmarshal the message value
-		var data map[string]interface{}
-		if err := json.Unmarshal(msg.Value, &data); err != nil {
-			c.logger.Error("Error unmarshalling message", "error", err)
-			continue
+	// Payloads are opaque; they are only decoded if a subscriber needs
+	// another format or filters on their content
+	streamID, format := messageStream(msg)
+	proc.Process(streamID, format, msg.Value, out)
+	c.positions[partition{topic: *msg.TopicPartition.Topic, id: msg.TopicPartition.Partition}] = int64(msg.TopicPartition.Offset) + 1
+}
+
+// maybeCheckpoint saves a checkpoint when one is due. It runs between
+// messages, so the state saved reflects exactly the messages before the
+// saved offsets.
+func (c *Consumer) maybeCheckpoint(proc *processor.Processor) {
+	if c.checkpoints == nil || time.Since(c.lastCheckpoint) < c.checkpointInterval {
+		return
+	}
+	c.lastCheckpoint = time.Now()
+	c.saveCheckpoint(proc)
+}
+
+// saveCheckpoint saves a checkpoint, logging and counting failures
+func (c *Consumer) saveCheckpoint(proc *processor.Processor) {
+	if err := c.checkpoint(proc); err != nil {
+		c.logger.Error("Failed to save checkpoint", "error", err)
+		metrics.CheckpointErrors.Inc()
+		return
+	}
+	metrics.CheckpointsSaved.Inc()
+}
+
+// checkpoint saves the processor's state and then commits the offsets it
+// covers, so that the consumer group resumes there even without the
+// checkpoint
+func (c *Consumer) checkpoint(proc *processor.Processor) error {
+	streams, err := proc.Snapshot()
+	if err != nil {
+		return err
+	}
+	cp := &checkpoint.Checkpoint{Time: time.Now(), Streams: streams}
+	if c.catalog != nil {
+		cp.Catalog = c.catalog()
+	}
+	for p, offset := range c.positions {
+		cp.Offsets = append(cp.Offsets, checkpoint.Offset{Topic: p.topic, Partition: p.id, Offset: offset})
+	}
+	sort.Slice(cp.Offsets, func(i, j int) bool {
+		if cp.Offsets[i].Topic != cp.Offsets[j].Topic {
+			return cp.Offsets[i].Topic < cp.Offsets[j].Topic
 		}
+		return cp.Offsets[i].Partition < cp.Offsets[j].Partition
+	})
+	if err := c.checkpoints.Save(cp); err != nil {
+		return err
+	}
 
-		// Broadcast the message to WebSocket clients
-		hub.BroadcastMessage(websocket.Message{
-			StreamID: *msg.TopicPartition.Topic,
-			Data:     msg.Value,
-		})
+	if len(cp.Offsets) == 0 {
+		return nil
+	}
+	offsets := make([]kafka.TopicPartition, len(cp.Offsets))
+	for i, o := range cp.Offsets {
+		topic := o.Topic
+		offsets[i] = kafka.TopicPartition{Topic: &topic, Partition: o.Partition, Offset: kafka.Offset(o.Offset)}
+	}
+	_, err = c.consumer.CommitOffsets(offsets)
+	return err
+}
+
+// messageStream reads the stream ID and payload format from a message's
+// headers. Messages without headers are JSON and belong to the stream
+// named after their topic.
+func messageStream(msg *kafka.Message) (string, codec.Format) {
+	streamID, format := *msg.TopicPartition.Topic, codec.JSON
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case HeaderStreamID:
+			streamID = string(h.Value)
+		case HeaderFormat:
+			if f, err := codec.Parse(string(h.Value)); err == nil {
+				format = f
+			}
+		}
 	}
+	return streamID, format
 }
 
 // Close closes the Kafka consumer connection.
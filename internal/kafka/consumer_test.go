@@ -0,0 +1,112 @@
+package kafka_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rithindattag/realtime-streaming-api/internal/checkpoint"
+	consumer "github.com/rithindattag/realtime-streaming-api/internal/kafka"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient records what the consumer asks of Kafka
+type fakeClient struct {
+	assigned   [][]kafka.TopicPartition
+	unassigned int
+	committed  [][]kafka.TopicPartition
+}
+
+func (f *fakeClient) ReadMessage(time.Duration) (*kafka.Message, error) {
+	return nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+}
+
+func (f *fakeClient) Assign(partitions []kafka.TopicPartition) error {
+	f.assigned = append(f.assigned, partitions)
+	return nil
+}
+
+func (f *fakeClient) Unassign() error {
+	f.unassigned++
+	return nil
+}
+
+func (f *fakeClient) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	f.committed = append(f.committed, offsets)
+	return offsets, nil
+}
+
+func (f *fakeClient) Close() error {
+	return nil
+}
+
+// TestRebalanceCheckpoints tests that revoking partitions checkpoints the
+// state with their offsets, so that they are not consumed twice when they
+// are assigned again
+func TestRebalanceCheckpoints(t *testing.T) {
+	topic := "events"
+	store, err := checkpoint.NewStore(t.TempDir())
+	require.NoError(t, err)
+	fake := &fakeClient{}
+	c := consumer.NewTestConsumer(fake, topic)
+	c.EnableCheckpoints(store, time.Hour, &checkpoint.Checkpoint{Offsets: []checkpoint.Offset{{Topic: topic, Partition: 0, Offset: 5}}}, nil)
+
+	proc := processor.NewProcessor(logger.NewLogger())
+	pipeline, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{
+		json.RawMessage(`{"type":"running","aggregates":{"total":{"op":"sum","field":"v"}}}`),
+	}})
+	require.NoError(t, err)
+	proc.SetPipeline("s", pipeline)
+
+	partitions := func() []kafka.TopicPartition {
+		return []kafka.TopicPartition{
+			{Topic: &topic, Partition: 0, Offset: kafka.OffsetInvalid},
+			{Topic: &topic, Partition: 1, Offset: kafka.OffsetInvalid},
+		}
+	}
+	require.NoError(t, c.Rebalance(kafka.AssignedPartitions{Partitions: partitions()}))
+	require.Len(t, fake.assigned, 1)
+	assert.Equal(t, kafka.Offset(5), fake.assigned[0][0].Offset)
+
+	message := func(partition int32, offset int64) *kafka.Message {
+		return &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: kafka.Offset(offset)},
+			Headers:        []kafka.Header{{Key: consumer.HeaderStreamID, Value: []byte("s")}},
+			Value:          []byte(`{"v":1}`),
+		}
+	}
+	discard := func(string, codec.Format, []byte) {}
+	c.Consume(proc, discard, message(0, 5), message(0, 6), message(1, 0))
+
+	// Eager rebalancing revokes every partition before assigning them again
+	require.NoError(t, c.Rebalance(kafka.RevokedPartitions{Partitions: partitions()}))
+	assert.Equal(t, 1, fake.unassigned)
+	require.Len(t, fake.committed, 1)
+	committed := map[int32]kafka.Offset{}
+	for _, tp := range fake.committed[0] {
+		committed[tp.Partition] = tp.Offset
+	}
+	assert.Equal(t, map[int32]kafka.Offset{0: 7, 1: 1}, committed)
+
+	cp, err := store.Load()
+	require.NoError(t, err)
+	require.NotNil(t, cp)
+	assert.Equal(t, []checkpoint.Offset{{Topic: topic, Partition: 0, Offset: 7}, {Topic: topic, Partition: 1, Offset: 1}}, cp.Offsets)
+	assert.Contains(t, string(cp.Streams["s"].State), `"sum":3`)
+
+	// Reassigned partitions resume from the committed offsets, not the
+	// checkpoint the consumer started from
+	require.NoError(t, c.Rebalance(kafka.AssignedPartitions{Partitions: partitions()}))
+	require.Len(t, fake.assigned, 2)
+	assert.Equal(t, kafka.OffsetInvalid, fake.assigned[1][0].Offset)
+
+	// Without partitions nothing is committed
+	require.NoError(t, c.Rebalance(kafka.RevokedPartitions{Partitions: partitions()}))
+	assert.Len(t, fake.committed, 1)
+}
@@ -0,0 +1,48 @@
+package kafka
+
+import (
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+)
+
+// Client is the part of *kafka.Consumer a consumer uses
+type Client = client
+
+// NewTestConsumer creates a consumer reading from a fake client
+func NewTestConsumer(c Client, topic string) *Consumer {
+	return &Consumer{
+		consumer:  c,
+		topic:     topic,
+		logger:    logger.NewLogger(),
+		positions: make(map[partition]int64),
+		resume:    make(map[partition]int64),
+	}
+}
+
+// Rebalance delivers a rebalance event as the client would
+func (c *Consumer) Rebalance(ev kafka.Event) error {
+	return c.rebalance(nil, ev)
+}
+
+// Consume processes messages as ConsumeMessages would once it read them
+func (c *Consumer) Consume(proc *processor.Processor, out processor.Output, msgs ...*kafka.Message) {
+	c.proc = proc
+	for _, msg := range msgs {
+		c.handle(proc, msg, out)
+	}
+}
+
+// RecordLatency records a delivery report received at now
+func (p *Producer) RecordLatency(d time.Duration, now time.Time) {
+	p.recordLatency(d, now)
+}
+
+// LatencyAt returns the delivery latency as DeliveryLatency would at now
+func (p *Producer) LatencyAt(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Duration(p.latencyNow(now))
+}
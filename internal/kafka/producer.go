@@ -1,14 +1,38 @@
 package kafka
 
 import (
+	"math"
+	"sync"
+	"time"
+
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
 )
 
+// latencyWeight is the smoothing factor of the delivery latency moving average
+const latencyWeight = 0.2
+
+// latencyStale is how long the delivery latency holds without delivery
+// reports. After that it decays towards zero with this time constant, so
+// that a spike does not outlive the traffic that caused it.
+const latencyStale = time.Second
+
+// Headers carried by every message produced with Publish
+const (
+	HeaderStreamID = "stream-id"
+	HeaderFormat   = "content-format"
+)
+
 // Producer represents a Kafka producer
 type Producer struct {
 	producer *kafka.Producer
 	logger   *logger.Logger
+
+	// latency is the moving average delivery latency as of latencyAt
+	mu        sync.Mutex
+	latency   float64
+	latencyAt time.Time
 }
 
 // NewProducer creates and returns a new Kafka producer
@@ -26,10 +50,36 @@ func NewProducer(bootstrapServers string) (*Producer, error) {
 	}
 
 	logger.Info("Kafka producer created successfully")
-	return &Producer{
+	producer := &Producer{
 		producer: p,
 		logger:   logger,
-	}, nil
+	}
+	go producer.handleEvents()
+
+	return producer, nil
+}
+
+// Publish produces a stream's payload to a topic. The payload is sent as is,
+// keyed by stream ID so that a stream keeps its order within a partition,
+// with the stream ID and payload format recorded in headers.
+func (p *Producer) Publish(topic, streamID string, format codec.Format, payload []byte) error {
+	err := p.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            []byte(streamID),
+		Value:          payload,
+		Headers: []kafka.Header{
+			{Key: HeaderStreamID, Value: []byte(streamID)},
+			{Key: HeaderFormat, Value: []byte(format)},
+		},
+		Opaque: time.Now(),
+	}, nil)
+
+	if err != nil {
+		p.logger.Error("Failed to produce message", "error", err)
+		return err
+	}
+
+	return nil
 }
 
 // SendMessage sends a message to a specified Kafka topic
@@ -38,6 +88,7 @@ func (p *Producer) SendMessage(topic string, message []byte) error {
 	err := p.producer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 		Value:          message,
+		Opaque:         time.Now(),
 	}, nil)
 
 	if err != nil {
@@ -48,6 +99,60 @@ func (p *Producer) SendMessage(topic string, message []byte) error {
 	return nil
 }
 
+// QueueLen returns the number of messages waiting to be delivered
+func (p *Producer) QueueLen() int {
+	return p.producer.Len()
+}
+
+// DeliveryLatency returns the moving average time between producing a
+// message and receiving its delivery report. It decays when no reports
+// arrive; a stalled broker shows in QueueLen instead.
+func (p *Producer) DeliveryLatency() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Duration(p.latencyNow(time.Now()))
+}
+
+// latencyNow returns the moving average decayed to now
+func (p *Producer) latencyNow(now time.Time) float64 {
+	idle := now.Sub(p.latencyAt) - latencyStale
+	if idle <= 0 {
+		return p.latency
+	}
+	return p.latency * math.Exp(-float64(idle)/float64(latencyStale))
+}
+
+// handleEvents drains delivery reports and records their latency
+func (p *Producer) handleEvents() {
+	for e := range p.producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			if ev.TopicPartition.Error != nil {
+				p.logger.Error("Message delivery failed", "error", ev.TopicPartition.Error)
+			}
+			if sent, ok := ev.Opaque.(time.Time); ok {
+				now := time.Now()
+				p.recordLatency(now.Sub(sent), now)
+			}
+		case kafka.Error:
+			p.logger.Error("Kafka producer error", "error", ev)
+		}
+	}
+}
+
+// recordLatency folds a delivery latency reported at now into the moving
+// average
+func (p *Producer) recordLatency(d time.Duration, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latencyAt.IsZero() {
+		p.latency = float64(d)
+	} else {
+		p.latency = p.latencyNow(now)*(1-latencyWeight) + float64(d)*latencyWeight
+	}
+	p.latencyAt = now
+}
+
 // Close closes the Kafka producer
 func (p *Producer) Close() {
 	p.producer.Close()
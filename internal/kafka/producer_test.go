@@ -0,0 +1,32 @@
+package kafka_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeliveryLatencyRecovers tests that a latency spike decays once
+// delivery reports stop, and that new reports pull the average back down
+func TestDeliveryLatencyRecovers(t *testing.T) {
+	p := &kafka.Producer{}
+	start := time.Unix(1700000000, 0)
+	assert.Equal(t, time.Duration(0), p.LatencyAt(start))
+
+	p.RecordLatency(2*time.Second, start)
+	assert.Equal(t, 2*time.Second, p.LatencyAt(start))
+	// The average holds for a second without reports, then decays
+	assert.Equal(t, 2*time.Second, p.LatencyAt(start.Add(time.Second)))
+	assert.Less(t, int64(p.LatencyAt(start.Add(6*time.Second))), int64(20*time.Millisecond))
+
+	// Fast reports after a spike bring the average down without waiting
+	p.RecordLatency(2*time.Second, start)
+	now := start
+	for i := 0; i < 50; i++ {
+		now = now.Add(10 * time.Millisecond)
+		p.RecordLatency(5*time.Millisecond, now)
+	}
+	assert.InDelta(t, float64(5*time.Millisecond), float64(p.LatencyAt(now)), float64(time.Millisecond))
+}
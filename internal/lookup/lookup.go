@@ -0,0 +1,325 @@
+// Package lookup holds the reference tables pipelines enrich messages
+// from. Tables are loaded from CSV or JSON files in a directory and
+// reloaded when the files change, or managed row by row through the API.
+package lookup
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+)
+
+// maxRows bounds the rows of a table
+const maxRows = 1000000
+
+// ErrTooManyRows is returned when a table would grow past maxRows
+var ErrTooManyRows = fmt.Errorf("lookup: table has more than %d rows", maxRows)
+
+// Default holds the tables the lookup stage reads
+var Default = NewTables()
+
+// Table maps keys to rows. Rows must not be modified once stored.
+type Table struct {
+	mu   sync.RWMutex
+	rows map[string]map[string]interface{}
+	// file and modTime are set for tables loaded from a file
+	file    string
+	modTime time.Time
+}
+
+// Get returns the row of a key. Numbers and strings with the same text
+// are the same key, so a message's 42 finds the CSV row "42".
+func (t *Table) Get(key interface{}) (map[string]interface{}, bool) {
+	k, ok := Key(key)
+	if !ok {
+		return nil, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	row, ok := t.rows[k]
+	return row, ok
+}
+
+// Put sets the row of a key
+func (t *Table) Put(key string, row map[string]interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rows[key]; !ok && len(t.rows) >= maxRows {
+		return ErrTooManyRows
+	}
+	t.rows[key] = row
+	return nil
+}
+
+// Delete removes the row of a key and reports whether it existed
+func (t *Table) Delete(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.rows[key]
+	delete(t.rows, key)
+	return ok
+}
+
+// Len returns the number of rows
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.rows)
+}
+
+// Rows returns every row by key
+func (t *Table) Rows() map[string]map[string]interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rows := make(map[string]map[string]interface{}, len(t.rows))
+	for k, row := range t.rows {
+		rows[k] = row
+	}
+	return rows
+}
+
+// File returns the file a table is loaded from, or "" for tables managed
+// through the API
+func (t *Table) File() string {
+	return t.file
+}
+
+// Tables is a set of named tables
+type Tables struct {
+	mu     sync.RWMutex
+	tables map[string]*Table
+}
+
+// NewTables creates an empty set of tables
+func NewTables() *Tables {
+	return &Tables{tables: make(map[string]*Table)}
+}
+
+// Get returns a table, or nil when there is none by that name
+func (ts *Tables) Get(name string) *Table {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.tables[name]
+}
+
+// Set replaces a table's rows, creating it if needed. Lookups see either
+// the old rows or the new ones, never a mix.
+func (ts *Tables) Set(name string, rows map[string]map[string]interface{}) error {
+	if len(rows) > maxRows {
+		return ErrTooManyRows
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tables[name] = &Table{rows: rows}
+	return nil
+}
+
+// Ensure returns a table, creating an empty one if needed
+func (ts *Tables) Ensure(name string) *Table {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tables[name]
+	if !ok {
+		t = &Table{rows: make(map[string]map[string]interface{})}
+		ts.tables[name] = t
+	}
+	return t
+}
+
+// Remove deletes a table and reports whether it existed
+func (ts *Tables) Remove(name string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	_, ok := ts.tables[name]
+	delete(ts.tables, name)
+	return ok
+}
+
+// Names returns the names of every table in order
+func (ts *Tables) Names() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	names := make([]string, 0, len(ts.tables))
+	for name := range ts.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadDir loads every .csv and .json file in dir as the table named after
+// the file, skipping files that have not changed since they were loaded.
+// Tables whose file was removed are removed too. A file that fails to load
+// leaves its table as it was; the first such error is returned. Names
+// given by more than one file, such as a.csv and a.json, are errors too,
+// and neither file is loaded.
+func (ts *Tables) LoadDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var tableFiles []os.FileInfo
+	names := make(map[string][]string)
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".csv" && ext != ".json") {
+			continue
+		}
+		tableFiles = append(tableFiles, entry)
+		name := tableName(entry)
+		names[name] = append(names[name], entry.Name())
+	}
+
+	var firstErr error
+	seen := make(map[string]bool)
+	for _, entry := range tableFiles {
+		name := tableName(entry)
+		path := filepath.Join(dir, entry.Name())
+		seen[path] = true
+		if len(names[name]) > 1 {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("table %s is defined by %s", name, strings.Join(names[name], " and "))
+			}
+			continue
+		}
+
+		if t := ts.Get(name); t != nil && t.file == path && t.modTime.Equal(entry.ModTime()) {
+			continue
+		}
+		rows, err := LoadFile(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", path, err)
+			}
+			continue
+		}
+		ts.mu.Lock()
+		ts.tables[name] = &Table{rows: rows, file: path, modTime: entry.ModTime()}
+		ts.mu.Unlock()
+	}
+
+	ts.mu.Lock()
+	for name, t := range ts.tables {
+		if t.file != "" && filepath.Dir(t.file) == filepath.Clean(dir) && !seen[t.file] {
+			delete(ts.tables, name)
+		}
+	}
+	ts.mu.Unlock()
+	return firstErr
+}
+
+// tableName returns the name of the table a file holds
+func tableName(file os.FileInfo) string {
+	return strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+}
+
+// Watch reloads the tables of dir every interval. It never returns.
+func (ts *Tables) Watch(dir string, interval time.Duration, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := ts.LoadDir(dir); err != nil {
+			log.Error("Failed to reload lookup tables", "dir", dir, "error", err)
+		}
+	}
+}
+
+// LoadFile reads a table file. A CSV file has a header row, and its first
+// column is the key. A JSON file is an object mapping keys to rows.
+func LoadFile(path string) (map[string]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return parseCSV(data)
+	}
+	return ParseJSON(data)
+}
+
+// parseCSV reads rows of string columns keyed by their first column
+func parseCSV(data []byte) (map[string]map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows := make(map[string]map[string]interface{})
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) >= maxRows {
+			return nil, ErrTooManyRows
+		}
+		row := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		rows[record[0]] = row
+	}
+}
+
+// ParseJSON reads an object mapping keys to rows, keeping numbers as
+// json.Number like decoded messages do
+func ParseJSON(data []byte) (map[string]map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var rows map[string]map[string]interface{}
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		return nil, errors.New("table must be an object mapping keys to rows")
+	}
+	if len(rows) > maxRows {
+		return nil, ErrTooManyRows
+	}
+	for k, row := range rows {
+		if row == nil {
+			return nil, fmt.Errorf("row %q must be an object", k)
+		}
+	}
+	return rows, nil
+}
+
+// Key returns the text a value is looked up by. Only strings, numbers and
+// booleans are keys.
+func Key(v interface{}) (string, bool) {
+	switch k := v.(type) {
+	case string:
+		return k, true
+	case json.Number:
+		return k.String(), true
+	case float64:
+		return strconv.FormatFloat(k, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(k, 10), true
+	case uint64:
+		return strconv.FormatUint(k, 10), true
+	case bool:
+		return strconv.FormatBool(k), true
+	}
+	return "", false
+}
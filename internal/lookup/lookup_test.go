@@ -0,0 +1,99 @@
+package lookup_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadDir tests loading, reloading and removing tables from files
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	devices := filepath.Join(dir, "devices.csv")
+	require.NoError(t, ioutil.WriteFile(devices, []byte("id,site\n1,north\n2,south\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "users.json"), []byte(`{"u1":{"name":"Ann","age":42}}`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644))
+
+	tables := lookup.NewTables()
+	require.NoError(t, tables.LoadDir(dir))
+	assert.Equal(t, []string{"devices", "users"}, tables.Names())
+
+	row, ok := tables.Get("devices").Get(json.Number("2"))
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"id": "2", "site": "south"}, row)
+	row, ok = tables.Get("users").Get("u1")
+	require.True(t, ok)
+	assert.Equal(t, json.Number("42"), row["age"])
+	assert.Equal(t, devices, tables.Get("devices").File())
+
+	// A changed file is reloaded
+	require.NoError(t, ioutil.WriteFile(devices, []byte("id,site\n1,east\n"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(devices, later, later))
+	require.NoError(t, tables.LoadDir(dir))
+	assert.Equal(t, 1, tables.Get("devices").Len())
+	row, _ = tables.Get("devices").Get(float64(1))
+	assert.Equal(t, "east", row["site"])
+
+	// A file that fails to load leaves its table as it was
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "users.json"), []byte(`[1]`), 0644))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "users.json"), later, later))
+	assert.Error(t, tables.LoadDir(dir))
+	assert.Equal(t, 1, tables.Get("users").Len())
+
+	// A removed file removes its table, but not tables managed through the API
+	require.NoError(t, tables.Ensure("manual").Put("k", map[string]interface{}{"v": 1}))
+	require.NoError(t, os.Remove(devices))
+	tables.LoadDir(dir)
+	assert.Nil(t, tables.Get("devices"))
+	assert.NotNil(t, tables.Get("manual"))
+}
+
+// TestLoadDirDuplicateNames tests that a name given by two files is
+// rejected rather than loaded from either
+func TestLoadDirDuplicateNames(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sites.csv"), []byte("id,region\nnorth,eu\n"), 0644))
+	tables := lookup.NewTables()
+	require.NoError(t, tables.LoadDir(dir))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sites.json"), []byte(`{"north":{"region":"us"}}`), 0644))
+	for i := 0; i < 2; i++ {
+		err := tables.LoadDir(dir)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "sites.csv and sites.json")
+		row, _ := tables.Get("sites").Get("north")
+		assert.Equal(t, "eu", row["region"])
+	}
+}
+
+// TestKey tests that keys are normalised to text
+func TestKey(t *testing.T) {
+	testCases := []struct {
+		value interface{}
+		key   string
+		ok    bool
+	}{
+		{"a", "a", true},
+		{json.Number("7"), "7", true},
+		{float64(7), "7", true},
+		{1.5, "1.5", true},
+		{int64(-3), "-3", true},
+		{true, "true", true},
+		{nil, "", false},
+		{map[string]interface{}{}, "", false},
+	}
+	for _, tc := range testCases {
+		key, ok := lookup.Key(tc.value)
+		assert.Equal(t, tc.ok, ok, "%v", tc.value)
+		assert.Equal(t, tc.key, key, "%v", tc.value)
+	}
+}
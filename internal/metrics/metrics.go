@@ -26,4 +26,114 @@ var (
 		Help:    "Time taken to process messages",
 		Buckets: prometheus.DefBuckets,
 	}, []string{"stream_id"})
+
+	RateLimiterKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rate_limiter_keys",
+		Help: "Number of keys currently tracked by a rate limiter",
+	}, []string{"limiter"})
+
+	RateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "The total number of requests rejected by a rate limiter",
+	}, []string{"limiter"})
+
+	RateLimitStoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_store_errors_total",
+		Help: "The total number of failed calls to the shared rate limit store",
+	}, []string{"limiter"})
+
+	AdmissionRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "admission_admit_ratio",
+		Help: "Fraction of ingest requests currently admitted by the load shedder",
+	})
+
+	AdmissionPressure = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "admission_pressure",
+		Help: "Most recent load pressure sampled by the load shedder, 1.0 meaning saturated",
+	})
+
+	AdmissionRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "admission_rejected_total",
+		Help: "The total number of ingest requests rejected by the load shedder",
+	})
+
+	WebSocketMessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_messages_dropped_total",
+		Help: "The total number of messages dropped for slow WebSocket clients",
+	}, []string{"stream_id", "policy"})
+
+	WebSocketMessagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_messages_filtered_total",
+		Help: "The total number of messages withheld from subscribers by their filters",
+	}, []string{"stream_id"})
+
+	WebSocketMessagesSampledOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_messages_sampled_out_total",
+		Help: "The total number of messages withheld from subscribers by their sampling",
+	}, []string{"stream_id"})
+
+	WebSocketFilterErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_filter_errors_total",
+		Help: "The total number of messages a subscriber filter could not evaluate",
+	}, []string{"stream_id"})
+
+	WebSocketProjectionBytesSaved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_projection_bytes_saved_total",
+		Help: "The total number of payload bytes removed by subscriber projections",
+	}, []string{"stream_id"})
+
+	WebSocketRedeliveries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "websocket_redeliveries_total",
+		Help: "The total number of frames redelivered to WebSocket clients after an acknowledgement timeout",
+	})
+
+	PayloadConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payload_conversions_total",
+		Help: "The total number of payloads converted for subscribers that asked for another format",
+	}, []string{"from", "to"})
+
+	PayloadConversionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payload_conversion_errors_total",
+		Help: "The total number of payloads that could not be converted to a subscriber's format",
+	}, []string{"from", "to"})
+
+	SchemaValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "schema_validation_failures_total",
+		Help: "The total number of payloads rejected for not matching their stream's schema",
+	}, []string{"stream_id"})
+
+	PipelineErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipeline_errors_total",
+		Help: "The total number of messages a stream's pipeline failed to process",
+	}, []string{"stream_id"})
+
+	PipelineLateMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pipeline_late_messages_total",
+		Help: "The total number of events that arrived too late for any open window",
+	}, []string{"stream_id"})
+
+	CheckpointsSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "checkpoints_saved_total",
+		Help: "The total number of processor checkpoints saved",
+	})
+
+	CheckpointErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "checkpoint_errors_total",
+		Help: "The total number of processor checkpoints that failed",
+	})
+
+	LookupMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lookup_misses_total",
+		Help: "The total number of messages whose key had no row in a lookup table",
+	}, []string{"table"})
+
+	DedupDuplicates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dedup_duplicates_total",
+		Help: "The total number of duplicate messages dropped by dedup stages",
+	}, []string{"stream_id"})
+
+	DedupEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dedup_evictions_total",
+		Help: "The total number of messages forgotten early by dedup stages with a full store",
+	}, []string{"stream_id"})
 )
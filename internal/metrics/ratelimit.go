@@ -0,0 +1,19 @@
+package metrics
+
+// RateLimit exports the reports of the limiters of pkg/ratelimit
+type RateLimit struct{}
+
+// KeysChanged updates the number of keys a limiter tracks
+func (RateLimit) KeysChanged(limiter string, delta int) {
+	RateLimiterKeys.WithLabelValues(limiter).Add(float64(delta))
+}
+
+// Rejected counts a request a limiter turned down
+func (RateLimit) Rejected(limiter string) {
+	RateLimitRejections.WithLabelValues(limiter).Inc()
+}
+
+// StoreError counts a failed call to a limiter's shared store
+func (RateLimit) StoreError(limiter string) {
+	RateLimitStoreErrors.WithLabelValues(limiter).Inc()
+}
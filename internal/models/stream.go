@@ -1,5 +1,75 @@
 package models
 
+import "encoding/json"
+
 type StreamData struct {
 	Data []byte `json:"data"`
 }
+
+// StreamConfig is the optional body of a stream creation request
+type StreamConfig struct {
+	Name     string            `json:"name,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Schema   *SchemaConfig     `json:"schema,omitempty"`
+	Pipeline *PipelineConfig   `json:"pipeline,omitempty"`
+}
+
+// SchemaConfig registers a version of a stream's schema
+type SchemaConfig struct {
+	// Type is json (the default), avro or protobuf
+	Type string `json:"type,omitempty"`
+	// Compatibility is none, backward (the default), forward or full
+	Compatibility string          `json:"compatibility,omitempty"`
+	Definition    json.RawMessage `json:"definition"`
+}
+
+// PipelineConfig declares the processing applied to a stream's messages
+type PipelineConfig struct {
+	// Stages run in order. Each is an object whose type field selects the
+	// stage, for example {"type": "filter", "expr": "temperature > 30"}.
+	Stages []json.RawMessage `json:"stages"`
+	// EventTime windows messages by a timestamp they carry rather than by
+	// when they are processed
+	EventTime *EventTimeConfig `json:"event_time,omitempty"`
+}
+
+// EventTimeConfig reads event times from messages and bounds how late they may arrive
+type EventTimeConfig struct {
+	// Field holds the event time, as an RFC 3339 string or a Unix timestamp
+	Field string `json:"field"`
+	// Format is rfc3339, unix, unix_ms, unix_us or unix_ns. By default
+	// strings are RFC 3339 and numbers are Unix milliseconds.
+	Format string `json:"format,omitempty"`
+	// MaxOutOfOrderness is how far behind the latest event time the
+	// watermark trails, such as "5s"
+	MaxOutOfOrderness string `json:"max_out_of_orderness,omitempty"`
+	// AllowedLateness is how long after the watermark passes a window it
+	// still accepts late events, re-emitting its result for each one
+	AllowedLateness string `json:"allowed_lateness,omitempty"`
+	// LateStream receives events too late for any window; they are dropped when it is empty
+	LateStream string `json:"late_stream,omitempty"`
+}
+
+// JoinConfig pairs the messages of two streams that have the same key and
+// whose times are at most Window apart. Joined records are delivered to a
+// derived stream.
+type JoinConfig struct {
+	// Name labels the derived stream
+	Name string `json:"name,omitempty"`
+	// Left and Right are the IDs of the joined streams
+	Left  string `json:"left"`
+	Right string `json:"right"`
+	// Key is the field holding the join key in both streams; LeftKey and
+	// RightKey override it for one side
+	Key      string `json:"key,omitempty"`
+	LeftKey  string `json:"left_key,omitempty"`
+	RightKey string `json:"right_key,omitempty"`
+	// Window is the longest time between joined messages, such as "10m"
+	Window string `json:"window"`
+	// LeftAs and RightAs name the fields of a joined record holding each
+	// side's message; they default to left and right
+	LeftAs  string `json:"left_as,omitempty"`
+	RightAs string `json:"right_as,omitempty"`
+	// Stream is the ID of the derived stream, assigned when the join is created
+	Stream string `json:"stream,omitempty"`
+}
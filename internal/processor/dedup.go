@@ -0,0 +1,310 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+)
+
+// maxBloomBits bounds the size of each of a bloom dedup stage's filters
+const maxBloomBits = 1 << 28
+
+// dedupStage drops messages already seen within a window. Messages are the
+// same when their key field is equal, or without a key when the fields
+// listed in fields, or else the whole messages, are equal. Messages without
+// the key field always pass.
+//
+// The exact mode remembers each message for the window in a state store of
+// at most 100000 keys; when it is full, the message that would expire
+// soonest is forgotten early. The bloom mode remembers them in two bloom filters
+// sized for capacity messages per window at error_rate, each covering one
+// window, so duplicates are caught for between one and two windows and a
+// few distinct messages are dropped as duplicates.
+//
+//	{"type": "dedup", "key": "event_id", "window": "10m"}
+//	{"type": "dedup", "fields": ["sensor", "value"], "window": "1h",
+//	 "mode": "bloom", "capacity": 1000000, "error_rate": 0.001}
+type dedupStage struct {
+	key    fieldPath
+	fields []fieldPath
+	window time.Duration
+	// seen is set in exact mode, bloom in bloom mode
+	seen  *StateStore
+	bloom *rotatingBloom
+}
+
+func newDedupStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Key       string   `json:"key"`
+		Fields    []string `json:"fields"`
+		Window    Duration `json:"window"`
+		Mode      string   `json:"mode"`
+		Capacity  int      `json:"capacity"`
+		ErrorRate float64  `json:"error_rate"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.Window <= 0 {
+		return nil, errors.New("window must be a positive duration")
+	}
+	if def.Key != "" && len(def.Fields) > 0 {
+		return nil, errors.New("key and fields cannot both be set")
+	}
+
+	s := &dedupStage{window: time.Duration(def.Window)}
+	var err error
+	if def.Key != "" {
+		if s.key, err = parseFieldPath(def.Key); err != nil {
+			return nil, err
+		}
+	}
+	if s.fields, err = parseFieldPaths(def.Fields); err != nil {
+		return nil, err
+	}
+
+	switch def.Mode {
+	case "", "exact":
+		if def.Capacity != 0 || def.ErrorRate != 0 {
+			return nil, errors.New("capacity and error_rate need mode bloom")
+		}
+		s.seen = NewStateStore(s.window)
+	case "bloom":
+		if def.Capacity == 0 {
+			def.Capacity = 1000000
+		}
+		if def.ErrorRate == 0 {
+			def.ErrorRate = 0.01
+		}
+		if def.Capacity < 0 {
+			return nil, errors.New("capacity must be positive")
+		}
+		if def.ErrorRate <= 0 || def.ErrorRate >= 1 {
+			return nil, errors.New("error_rate must be between 0 and 1")
+		}
+		if s.bloom, err = newRotatingBloom(def.Capacity, def.ErrorRate, s.window); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q", def.Mode)
+	}
+	return s, nil
+}
+
+func (s *dedupStage) Process(msg *Message, emit Emit) error {
+	digest, ok, err := s.digest(msg.Value)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		emit(msg)
+		return nil
+	}
+
+	if s.bloom != nil {
+		if s.bloom.addNew(digest, msg.Time) {
+			emit(msg)
+		} else {
+			metrics.DedupDuplicates.WithLabelValues(msg.StreamID).Inc()
+		}
+		return nil
+	}
+
+	// Keys that expired since the last Advance must not count as seen
+	s.seen.Expire(msg.Time, nil)
+	key := hex.EncodeToString(digest[:16])
+	if _, ok := s.seen.Get(key); ok {
+		metrics.DedupDuplicates.WithLabelValues(msg.StreamID).Inc()
+		return nil
+	}
+	// A full store forgets the message that would expire soonest, which
+	// shortens the window rather than stop remembering new messages
+	if s.seen.Len() >= maxStateKeys {
+		s.seen.Evict()
+		metrics.DedupEvictions.WithLabelValues(msg.StreamID).Inc()
+	}
+	emit(msg)
+	return s.seen.Put(key, nil, msg.Time)
+}
+
+// digest hashes what identifies a message, reporting false when it has no
+// key field
+func (s *dedupStage) digest(value map[string]interface{}) ([sha256.Size]byte, bool, error) {
+	var identity interface{} = value
+	switch {
+	case s.key != nil:
+		v, ok := s.key.get(value)
+		if !ok || v == nil {
+			return [sha256.Size]byte{}, false, nil
+		}
+		identity = v
+	case len(s.fields) > 0:
+		fields := make([]interface{}, len(s.fields))
+		for i, path := range s.fields {
+			fields[i], _ = path.get(value)
+		}
+		identity = fields
+	}
+	// Map keys are encoded in order, so equal messages encode equally
+	encoded, err := json.Marshal(identity)
+	if err != nil {
+		return [sha256.Size]byte{}, false, err
+	}
+	return sha256.Sum256(encoded), true, nil
+}
+
+// Advance forgets the messages seen more than a window ago
+func (s *dedupStage) Advance(now time.Time, emit Emit) error {
+	if s.bloom != nil {
+		s.bloom.rotate(now)
+		return nil
+	}
+	s.seen.Expire(now, nil)
+	return nil
+}
+
+// Flush does nothing: dedup holds no messages back
+func (s *dedupStage) Flush(emit Emit) error {
+	return nil
+}
+
+// Snapshot encodes the messages seen
+func (s *dedupStage) Snapshot() (json.RawMessage, error) {
+	if s.bloom != nil {
+		return json.Marshal(s.bloom.snapshot())
+	}
+	return s.seen.Snapshot(func(interface{}) interface{} { return nil })
+}
+
+// Restore replaces the messages seen with a snapshot
+func (s *dedupStage) Restore(state json.RawMessage) error {
+	if s.bloom != nil {
+		var snapshot bloomSnapshot
+		if err := json.Unmarshal(state, &snapshot); err != nil {
+			return err
+		}
+		return s.bloom.restore(snapshot)
+	}
+	return s.seen.Restore(state, func(json.RawMessage) (interface{}, error) { return nil, nil })
+}
+
+// rotatingBloom is a pair of bloom filters over consecutive windows
+// aligned to the window size. Messages are checked against both and added
+// to the current one; when a window ends the current filter becomes the
+// previous one and the oldest is cleared.
+type rotatingBloom struct {
+	window            time.Duration
+	hashes            int
+	start             time.Time
+	current, previous []uint64
+}
+
+func newRotatingBloom(capacity int, errorRate float64, window time.Duration) (*rotatingBloom, error) {
+	bits := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	if bits > maxBloomBits {
+		return nil, fmt.Errorf("capacity and error_rate need more than %d bits per filter", maxBloomBits)
+	}
+	words := (int(bits) + 63) / 64
+	hashes := int(math.Round(float64(words*64) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	if hashes > 30 {
+		hashes = 30
+	}
+	return &rotatingBloom{
+		window:   window,
+		hashes:   hashes,
+		current:  make([]uint64, words),
+		previous: make([]uint64, words),
+	}, nil
+}
+
+// addNew adds a digest seen at t and reports whether it was new
+func (b *rotatingBloom) addNew(digest [sha256.Size]byte, t time.Time) bool {
+	b.rotate(t)
+	// Double hashing derives every index from two halves of the digest
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	size := uint64(len(b.current) * 64)
+	seen, seenBefore := true, true
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % size
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.current[word]&mask == 0 {
+			seen = false
+			b.current[word] |= mask
+		}
+		if b.previous[word]&mask == 0 {
+			seenBefore = false
+		}
+	}
+	return !seen && !seenBefore
+}
+
+// rotate moves the filters on to the window holding now. Messages older
+// than the current window are added to it.
+func (b *rotatingBloom) rotate(now time.Time) {
+	start := now.Truncate(b.window)
+	switch {
+	case !start.After(b.start):
+		return
+	case start.Equal(b.start.Add(b.window)):
+		b.previous, b.current = b.current, b.previous
+		clearBits(b.current)
+	default:
+		clearBits(b.current)
+		clearBits(b.previous)
+	}
+	b.start = start
+}
+
+func clearBits(bits []uint64) {
+	for i := range bits {
+		bits[i] = 0
+	}
+}
+
+// bloomSnapshot is the snapshot of a rotating bloom filter
+type bloomSnapshot struct {
+	Start    time.Time `json:"start"`
+	Current  []byte    `json:"current"`
+	Previous []byte    `json:"previous"`
+}
+
+func (b *rotatingBloom) snapshot() bloomSnapshot {
+	return bloomSnapshot{Start: b.start, Current: encodeBits(b.current), Previous: encodeBits(b.previous)}
+}
+
+func (b *rotatingBloom) restore(snapshot bloomSnapshot) error {
+	size := len(b.current) * 8
+	if len(snapshot.Current) != size || len(snapshot.Previous) != size {
+		return errors.New("bloom filter snapshot has a different size")
+	}
+	b.start = snapshot.Start
+	decodeBits(b.current, snapshot.Current)
+	decodeBits(b.previous, snapshot.Previous)
+	return nil
+}
+
+func encodeBits(bits []uint64) []byte {
+	data := make([]byte, len(bits)*8)
+	for i, word := range bits {
+		binary.BigEndian.PutUint64(data[i*8:], word)
+	}
+	return data
+}
+
+func decodeBits(bits []uint64, data []byte) {
+	for i := range bits {
+		bits[i] = binary.BigEndian.Uint64(data[i*8:])
+	}
+}
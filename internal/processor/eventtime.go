@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+)
+
+// eventClock reads event times from messages and tracks the watermark: the
+// time before which no more events are expected. The watermark trails the
+// latest event time by the maximum out-of-orderness and moves with events,
+// so results depend on the data alone and not on when it arrives. Once no
+// event has arrived for idleAfter, it moves on with processing time instead,
+// so that an idle stream still closes its last windows.
+type eventClock struct {
+	field      fieldPath
+	format     string
+	delay      time.Duration
+	lateness   time.Duration
+	lateStream string
+	idleAfter  time.Duration
+
+	watermark time.Time
+	started   bool
+	// arrived is the processing time of the latest event, and arrivedMark
+	// the watermark it left
+	arrived     time.Time
+	arrivedMark time.Time
+}
+
+// newEventClock validates an event time configuration
+func newEventClock(config models.EventTimeConfig) (*eventClock, error) {
+	if config.Field == "" {
+		return nil, errors.New("event_time: field is required")
+	}
+	field, err := parseFieldPath(config.Field)
+	if err != nil {
+		return nil, fmt.Errorf("event_time: %v", err)
+	}
+	c := &eventClock{field: field, format: config.Format, lateStream: config.LateStream}
+	switch config.Format {
+	case "", "rfc3339", "unix", "unix_ms", "unix_us", "unix_ns":
+	default:
+		return nil, fmt.Errorf("event_time: unknown format %q", config.Format)
+	}
+	if c.delay, err = parseDelay(config.MaxOutOfOrderness); err != nil {
+		return nil, fmt.Errorf("event_time: max_out_of_orderness: %v", err)
+	}
+	if c.lateness, err = parseDelay(config.AllowedLateness); err != nil {
+		return nil, fmt.Errorf("event_time: allowed_lateness: %v", err)
+	}
+	return c, nil
+}
+
+// parseDelay parses an optional non-negative duration
+func parseDelay(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return d, nil
+}
+
+// timestamp reads the event time of a message
+func (c *eventClock) timestamp(msg map[string]interface{}) (time.Time, error) {
+	v, ok := c.field.get(msg)
+	if !ok || v == nil {
+		return time.Time{}, fmt.Errorf("event time field %s is missing", c.field)
+	}
+	if s, ok := v.(string); ok {
+		if c.format != "" && c.format != "rfc3339" {
+			return time.Time{}, fmt.Errorf("event time field %s must be a number", c.field)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("event time field %s: %v", c.field, err)
+		}
+		return t, nil
+	}
+
+	if c.format == "rfc3339" {
+		return time.Time{}, fmt.Errorf("event time field %s must be a string, got %T", c.field, v)
+	}
+	unit := int64(time.Millisecond)
+	switch c.format {
+	case "unix":
+		unit = int64(time.Second)
+	case "unix_us":
+		unit = int64(time.Microsecond)
+	case "unix_ns":
+		unit = 1
+	}
+	// Integers are converted exactly, since nanosecond timestamps do not
+	// fit a float64
+	if n, ok := toInt(v); ok {
+		if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+			return time.Time{}, fmt.Errorf("event time field %s is out of range", c.field)
+		}
+		return time.Unix(0, n*unit), nil
+	}
+	n, ok := toFloat(v)
+	if !ok {
+		return time.Time{}, fmt.Errorf("event time field %s must be a timestamp, got %T", c.field, v)
+	}
+	ns := n * float64(unit)
+	if math.IsNaN(ns) || ns >= math.MaxInt64 || ns < math.MinInt64 {
+		return time.Time{}, fmt.Errorf("event time field %s is out of range", c.field)
+	}
+	return time.Unix(0, int64(ns)), nil
+}
+
+// toInt converts a decoded number that is an integer
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// late reports whether an event is too late for any window still open
+func (c *eventClock) late(t time.Time) bool {
+	return c.started && t.Add(c.lateness).Before(c.watermark)
+}
+
+// observe moves the watermark forward after an event that arrived at the
+// processing time arrived
+func (c *eventClock) observe(t, arrived time.Time) {
+	if w := t.Add(-c.delay); !c.started || w.After(c.watermark) {
+		c.watermark = w
+		c.started = true
+	}
+	c.arrived, c.arrivedMark = arrived, c.watermark
+}
+
+// idle moves the watermark on with processing time once no event has
+// arrived for idleAfter, and reports whether it moved. After a restore the
+// idle time starts with the first call.
+func (c *eventClock) idle(now time.Time) bool {
+	if !c.started {
+		return false
+	}
+	if c.arrived.IsZero() {
+		c.arrived, c.arrivedMark = now, c.watermark
+		return false
+	}
+	since := now.Sub(c.arrived)
+	if since < c.idleAfter {
+		return false
+	}
+	w := c.arrivedMark.Add(since)
+	if !w.After(c.watermark) {
+		return false
+	}
+	c.watermark = w
+	return true
+}
@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fieldPath is a dotted path into a message, such as "sensor.id"
+type fieldPath []string
+
+// parseFieldPath splits a dotted path, rejecting empty segments
+func parseFieldPath(field string) (fieldPath, error) {
+	path := fieldPath(strings.Split(field, "."))
+	for _, seg := range path {
+		if seg == "" {
+			return nil, fmt.Errorf("invalid field path %q", field)
+		}
+	}
+	return path, nil
+}
+
+func (p fieldPath) String() string {
+	return strings.Join(p, ".")
+}
+
+// get returns the value at the path and whether it exists
+func (p fieldPath) get(obj map[string]interface{}) (interface{}, bool) {
+	var v interface{} = obj
+	for _, seg := range p {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// set stores a value at the path, creating intermediate objects. It fails
+// if an intermediate field exists but is not an object.
+func (p fieldPath) set(obj map[string]interface{}, v interface{}) error {
+	m := obj
+	for i, seg := range p[:len(p)-1] {
+		child, ok := m[seg]
+		if !ok || child == nil {
+			next := make(map[string]interface{})
+			m[seg] = next
+			m = next
+			continue
+		}
+		if m, ok = child.(map[string]interface{}); !ok {
+			return fmt.Errorf("cannot set %s: %s is not an object", p, p[:i+1])
+		}
+	}
+	m[p[len(p)-1]] = v
+	return nil
+}
+
+// remove deletes the field at the path and returns its value
+func (p fieldPath) remove(obj map[string]interface{}) (interface{}, bool) {
+	m := obj
+	for _, seg := range p[:len(p)-1] {
+		child, ok := m[seg].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		m = child
+	}
+	v, ok := m[p[len(p)-1]]
+	delete(m, p[len(p)-1])
+	return v, ok
+}
+
+// cloneValue deep copies a decoded message so that branches of a pipeline
+// can modify their copies independently
+func cloneValue(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(node))
+		for k, child := range node {
+			out[k] = cloneValue(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(node))
+		for i, child := range node {
+			out[i] = cloneValue(child)
+		}
+		return out
+	}
+	return v
+}
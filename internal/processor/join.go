@@ -0,0 +1,227 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+)
+
+// maxJoinBuffer bounds the messages buffered per key on each side of a
+// join; beyond it the oldest are dropped
+const maxJoinBuffer = 1000
+
+// Join is an inner join of two streams: every pair of messages, one from
+// each stream, with equal keys and times at most the window apart yields
+// one record on the derived stream. Each side buffers its messages per key,
+// so pairs are found in whichever order they arrive. Messages are kept for
+// twice the window, which lets messages up to a window out of order still
+// find their pairs.
+type Join struct {
+	config            models.JoinConfig
+	leftKey, rightKey fieldPath
+	leftAs, rightAs   string
+	window            time.Duration
+	leftBuf, rightBuf *StateStore
+	mu                sync.Mutex
+}
+
+// joinEntry is a buffered message
+type joinEntry struct {
+	time  time.Time
+	value map[string]interface{}
+}
+
+// CompileJoin validates a join definition
+func CompileJoin(config models.JoinConfig) (*Join, error) {
+	if config.Left == "" || config.Right == "" {
+		return nil, errors.New("left and right streams are required")
+	}
+	if config.Left == config.Right {
+		return nil, errors.New("a stream cannot be joined with itself")
+	}
+	window, err := time.ParseDuration(config.Window)
+	if err != nil || window <= 0 {
+		return nil, errors.New("window must be a positive duration such as \"10m\"")
+	}
+
+	j := &Join{
+		config:   config,
+		leftAs:   config.LeftAs,
+		rightAs:  config.RightAs,
+		window:   window,
+		leftBuf:  NewStateStore(window),
+		rightBuf: NewStateStore(window),
+	}
+	if j.leftAs == "" {
+		j.leftAs = "left"
+	}
+	if j.rightAs == "" {
+		j.rightAs = "right"
+	}
+	if j.leftAs == j.rightAs {
+		return nil, errors.New("left_as and right_as must differ")
+	}
+
+	leftKey, rightKey := config.LeftKey, config.RightKey
+	if leftKey == "" {
+		leftKey = config.Key
+	}
+	if rightKey == "" {
+		rightKey = config.Key
+	}
+	if leftKey == "" || rightKey == "" {
+		return nil, errors.New("key is required")
+	}
+	if j.leftKey, err = parseFieldPath(leftKey); err != nil {
+		return nil, fmt.Errorf("left key: %v", err)
+	}
+	if j.rightKey, err = parseFieldPath(rightKey); err != nil {
+		return nil, fmt.Errorf("right key: %v", err)
+	}
+	return j, nil
+}
+
+// Config returns the definition the join was compiled from
+func (j *Join) Config() models.JoinConfig {
+	return j.config
+}
+
+// Process adds a message of either joined stream, and emits a record to
+// the derived stream for every buffered message of the other stream it
+// pairs with. Messages without a key are ignored.
+func (j *Join) Process(msg *Message, emit Emit) error {
+	var key fieldPath
+	var own, other *StateStore
+	left := msg.StreamID == j.config.Left
+	switch msg.StreamID {
+	case j.config.Left:
+		key, own, other = j.leftKey, j.leftBuf, j.rightBuf
+	case j.config.Right:
+		key, own, other = j.rightKey, j.rightBuf, j.leftBuf
+	default:
+		return fmt.Errorf("stream %s is not part of the join", msg.StreamID)
+	}
+	v, ok := key.get(msg.Value)
+	if !ok || v == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	t := msg.Time
+	horizon := t.Add(-2 * j.window)
+	j.leftBuf.Expire(t.Add(-j.window), nil)
+	j.rightBuf.Expire(t.Add(-j.window), nil)
+
+	if buffered, ok := other.Get(string(encoded)); ok {
+		for _, e := range buffered.([]joinEntry) {
+			if e.time.Before(t.Add(-j.window)) || e.time.After(t.Add(j.window)) {
+				continue
+			}
+			leftValue, rightValue := msg.Value, e.value
+			if !left {
+				leftValue, rightValue = e.value, msg.Value
+			}
+			at := t
+			if e.time.After(at) {
+				at = e.time
+			}
+			emit(&Message{
+				StreamID: j.config.Stream,
+				Format:   msg.Format,
+				Time:     at,
+				Value:    map[string]interface{}{j.leftAs: leftValue, j.rightAs: rightValue},
+			})
+		}
+	}
+
+	var entries []joinEntry
+	if buffered, ok := own.Get(string(encoded)); ok {
+		entries = buffered.([]joinEntry)
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if !e.time.Before(horizon) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) >= maxJoinBuffer {
+		kept = kept[len(kept)-maxJoinBuffer+1:]
+	}
+	kept = append(kept, joinEntry{time: t, value: msg.Value})
+	return own.Put(string(encoded), kept, t)
+}
+
+// joinState is the snapshot of a join's buffers
+type joinState struct {
+	Left  json.RawMessage `json:"left"`
+	Right json.RawMessage `json:"right"`
+}
+
+// joinEntryState is the snapshot of a buffered message
+type joinEntryState struct {
+	Time  time.Time              `json:"time"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// Snapshot encodes the buffered messages
+func (j *Join) Snapshot() (json.RawMessage, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	encode := func(v interface{}) interface{} {
+		entries := v.([]joinEntry)
+		states := make([]joinEntryState, len(entries))
+		for i, e := range entries {
+			states[i] = joinEntryState{Time: e.time, Value: e.value}
+		}
+		return states
+	}
+	var state joinState
+	var err error
+	if state.Left, err = j.leftBuf.Snapshot(encode); err != nil {
+		return nil, err
+	}
+	if state.Right, err = j.rightBuf.Snapshot(encode); err != nil {
+		return nil, err
+	}
+	return json.Marshal(state)
+}
+
+// Restore replaces the buffered messages with a snapshot
+func (j *Join) Restore(data json.RawMessage) error {
+	var state joinState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	decode := func(raw json.RawMessage) (interface{}, error) {
+		var states []joinEntryState
+		if err := decodeState(raw, &states); err != nil {
+			return nil, err
+		}
+		if len(states) > maxJoinBuffer {
+			return nil, fmt.Errorf("more than %d buffered messages for a key", maxJoinBuffer)
+		}
+		entries := make([]joinEntry, len(states))
+		for i, s := range states {
+			entries[i] = joinEntry{time: s.Time, value: s.Value}
+		}
+		return entries, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.leftBuf.Restore(state.Left, decode); err != nil {
+		return err
+	}
+	return j.rightBuf.Restore(state.Right, decode)
+}
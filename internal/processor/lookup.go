@@ -0,0 +1,165 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+)
+
+// lookupStage enriches messages with the row of a reference table whose
+// key is a field of the message. Without fields the whole row is merged
+// into the message, or set under into; fields picks columns instead. As
+// with enrich, fields already present are kept unless overwrite is set.
+// on_missing decides what happens to messages whose key has no row: keep
+// passes them on unchanged, drop drops them, error drops and counts them
+// as failed, and default enriches them from defaults instead.
+//
+//	{"type": "lookup", "table": "devices", "key": "device_id",
+//	 "fields": {"site": "site", "owner.name": "owner"}, "on_missing": "drop"}
+type lookupStage struct {
+	tables    *lookup.Tables
+	table     string
+	key       fieldPath
+	into      fieldPath
+	targets   []fieldPath
+	columns   []string
+	overwrite bool
+	onMissing string
+	defaults  map[string]interface{}
+}
+
+func newLookupStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Table     string                 `json:"table"`
+		Key       string                 `json:"key"`
+		Fields    map[string]string      `json:"fields"`
+		Into      string                 `json:"into"`
+		Overwrite bool                   `json:"overwrite"`
+		OnMissing string                 `json:"on_missing"`
+		Defaults  map[string]interface{} `json:"defaults"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.Table == "" {
+		return nil, errors.New("table is required")
+	}
+	if def.Key == "" {
+		return nil, errors.New("key is required")
+	}
+	if len(def.Fields) > 0 && def.Into != "" {
+		return nil, errors.New("fields and into cannot both be set")
+	}
+
+	s := &lookupStage{tables: lookup.Default, table: def.Table, overwrite: def.Overwrite, onMissing: def.OnMissing}
+	switch s.onMissing {
+	case "":
+		s.onMissing = "keep"
+	case "keep", "drop", "error":
+	case "default":
+		if def.Defaults == nil {
+			return nil, errors.New("defaults is required when on_missing is default")
+		}
+		s.defaults = def.Defaults
+	default:
+		return nil, fmt.Errorf("unknown on_missing %q", def.OnMissing)
+	}
+	if def.Defaults != nil && s.onMissing != "default" {
+		return nil, errors.New("defaults needs on_missing to be default")
+	}
+
+	var err error
+	if s.key, err = parseFieldPath(def.Key); err != nil {
+		return nil, err
+	}
+	if def.Into != "" {
+		if s.into, err = parseFieldPath(def.Into); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range sortedFields(def.Fields) {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		s.targets = append(s.targets, path)
+		s.columns = append(s.columns, def.Fields[field])
+	}
+	return s, nil
+}
+
+func (s *lookupStage) Process(msg *Message, emit Emit) error {
+	table := s.tables.Get(s.table)
+	if table == nil {
+		return fmt.Errorf("lookup table %q not found", s.table)
+	}
+	var row map[string]interface{}
+	if key, ok := s.key.get(msg.Value); ok {
+		row, _ = table.Get(key)
+	}
+	if row == nil {
+		metrics.LookupMisses.WithLabelValues(s.table).Inc()
+		switch s.onMissing {
+		case "keep":
+			emit(msg)
+			return nil
+		case "drop":
+			return nil
+		case "error":
+			return fmt.Errorf("no row in lookup table %q for %s", s.table, s.key)
+		}
+		row = s.defaults
+	}
+
+	if s.into != nil {
+		if err := s.set(msg, s.into, cloneValue(row)); err != nil {
+			return err
+		}
+		emit(msg)
+		return nil
+	}
+	if s.targets == nil {
+		for _, column := range sortedColumns(row) {
+			if err := s.set(msg, fieldPath{column}, cloneValue(row[column])); err != nil {
+				return err
+			}
+		}
+		emit(msg)
+		return nil
+	}
+	for i, path := range s.targets {
+		// Columns missing from the row are left unset
+		if v, ok := row[s.columns[i]]; ok {
+			if err := s.set(msg, path, cloneValue(v)); err != nil {
+				return err
+			}
+		}
+	}
+	emit(msg)
+	return nil
+}
+
+// set sets a field unless it is present and overwrite is off
+func (s *lookupStage) set(msg *Message, path fieldPath, v interface{}) error {
+	if !s.overwrite {
+		if _, ok := path.get(msg.Value); ok {
+			return nil
+		}
+	}
+	return path.set(msg.Value, v)
+}
+
+// sortedColumns returns the columns of a row in a stable order
+func sortedColumns(row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	for k := range row {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+	return columns
+}
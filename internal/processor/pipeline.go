@@ -0,0 +1,439 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+// maxStages bounds the length of a pipeline
+const maxStages = 64
+
+// Message is a decoded message flowing through a pipeline
+type Message struct {
+	// StreamID is the stream the message is delivered to; route stages change it
+	StreamID string
+	// Format is the encoding the message is produced in
+	Format codec.Format
+	// Time places the message on the time line windows are computed over: its
+	// processing time, or in event time pipelines the time read from it
+	Time  time.Time
+	Value map[string]interface{}
+}
+
+// Emit passes a message on to the next stage
+type Emit func(*Message)
+
+// Stage is a step of a pipeline. It calls emit for every message it passes
+// on, which may be none, the message itself, or several messages.
+type Stage interface {
+	Process(msg *Message, emit Emit) error
+}
+
+// Timed is implemented by stages that hold messages back until time
+// passes, such as windows
+type Timed interface {
+	// Advance emits whatever is due at now
+	Advance(now time.Time, emit Emit) error
+	// Flush emits everything still held, for example before the stage is replaced
+	Flush(emit Emit) error
+}
+
+// Stateful is implemented by stages that keep state across messages, so
+// that it can be checkpointed and restored
+type Stateful interface {
+	// Snapshot encodes the stage's state
+	Snapshot() (json.RawMessage, error)
+	// Restore replaces the stage's state with a snapshot
+	Restore(state json.RawMessage) error
+}
+
+// spanner is implemented by timed stages that hold messages for a span of
+// time, such as windows
+type spanner interface {
+	span() time.Duration
+}
+
+// router is implemented by stages that deliver messages to other streams
+type router interface {
+	routes() []string
+}
+
+// lateAccepter is implemented by timed stages that keep accepting late
+// events for a while after emitting, in event time pipelines
+type lateAccepter interface {
+	allowLateness(d time.Duration)
+}
+
+// stageBuilders compile the stages of each type from their JSON definition
+var stageBuilders = map[string]func(raw json.RawMessage) (Stage, error){
+	"filter":      newFilterStage,
+	"map":         newMapStage,
+	"rename":      newRenameStage,
+	"drop-fields": newDropFieldsStage,
+	"enrich":      newEnrichStage,
+	"route":       newRouteStage,
+	"window":      newWindowStage,
+	"session":     newSessionStage,
+	"running":     newRunningStage,
+	"lookup":      newLookupStage,
+	"dedup":       newDedupStage,
+	"sample":      newSampleStage,
+	"downsample":  newDownsampleStage,
+}
+
+// stageHeader holds the fields shared by every stage definition
+type stageHeader struct {
+	Type string `json:"type"`
+	// Name labels the stage in errors; it defaults to the stage's type
+	Name string `json:"name,omitempty"`
+}
+
+// decodeStage decodes a stage definition, rejecting unknown fields so that
+// typos fail at compile time rather than silently doing nothing
+func decodeStage(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Pipeline is a compiled chain of stages. Runs are serialised, so stages
+// may keep state without locking.
+type Pipeline struct {
+	config models.PipelineConfig
+	stages []Stage
+	names  []string
+	routes []string
+	// timed is set when a stage implements Timed, stateful when one
+	// implements Stateful or the pipeline runs on event time
+	timed, stateful bool
+	// clock is set for event time pipelines
+	clock *eventClock
+	// retired is set once the pipeline has been replaced
+	retired bool
+	mu      sync.Mutex
+}
+
+// Compile validates a pipeline definition and builds its stages
+func Compile(config models.PipelineConfig) (*Pipeline, error) {
+	if len(config.Stages) > maxStages {
+		return nil, fmt.Errorf("pipeline has %d stages, at most %d are allowed", len(config.Stages), maxStages)
+	}
+	p := &Pipeline{config: config}
+	if config.EventTime != nil {
+		clock, err := newEventClock(*config.EventTime)
+		if err != nil {
+			return nil, err
+		}
+		p.clock = clock
+		p.stateful = true
+		if clock.lateStream != "" {
+			p.routes = append(p.routes, clock.lateStream)
+		}
+	}
+	var longest time.Duration
+	for i, raw := range config.Stages {
+		var header stageHeader
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, fmt.Errorf("stage %d: %v", i, err)
+		}
+		build, ok := stageBuilders[header.Type]
+		if !ok {
+			return nil, fmt.Errorf("stage %d: unknown stage type %q", i, header.Type)
+		}
+		name := header.Name
+		if name == "" {
+			name = header.Type
+		}
+		stage, err := build(raw)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %v", i, name, err)
+		}
+		if _, ok := stage.(Timed); ok {
+			p.timed = true
+		}
+		if _, ok := stage.(Stateful); ok {
+			p.stateful = true
+		}
+		if l, ok := stage.(lateAccepter); ok && p.clock != nil {
+			l.allowLateness(p.clock.lateness)
+		}
+		if r, ok := stage.(router); ok {
+			p.routes = append(p.routes, r.routes()...)
+		}
+		if s, ok := stage.(spanner); ok && s.span() > longest {
+			longest = s.span()
+		}
+		p.stages = append(p.stages, stage)
+		p.names = append(p.names, name)
+	}
+	if p.clock != nil {
+		// By then every window holding the latest event is due, late
+		// events included
+		p.clock.idleAfter = p.clock.delay + p.clock.lateness + longest
+	}
+	return p, nil
+}
+
+// Config returns the definition the pipeline was compiled from
+func (p *Pipeline) Config() models.PipelineConfig {
+	return p.config
+}
+
+// Routes returns the streams route stages deliver to
+func (p *Pipeline) Routes() []string {
+	return p.routes
+}
+
+// Watermark returns the event time up to which windows have been closed,
+// or the zero time for processing time pipelines and before any event
+func (p *Pipeline) Watermark() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clock == nil {
+		return time.Time{}
+	}
+	return p.clock.watermark
+}
+
+// Stateful reports whether the pipeline keeps state that Snapshot saves
+func (p *Pipeline) Stateful() bool {
+	return p.stateful
+}
+
+// pipelineState is the snapshot of a pipeline
+type pipelineState struct {
+	// Watermark is set for event time pipelines once events arrived
+	Watermark *time.Time   `json:"watermark,omitempty"`
+	Stages    []stageState `json:"stages,omitempty"`
+}
+
+// stageState is the snapshot of a stateful stage. The stage's definition
+// is kept so that state is only restored into the same stage.
+type stageState struct {
+	Index      int             `json:"index"`
+	Definition json.RawMessage `json:"definition"`
+	State      json.RawMessage `json:"state"`
+}
+
+// Snapshot encodes the state of the pipeline's stateful stages and its
+// watermark
+func (p *Pipeline) Snapshot() (json.RawMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var state pipelineState
+	if p.clock != nil && p.clock.started {
+		watermark := p.clock.watermark
+		state.Watermark = &watermark
+	}
+	for i, stage := range p.stages {
+		stateful, ok := stage.(Stateful)
+		if !ok {
+			continue
+		}
+		data, err := stateful.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %v", i, p.names[i], err)
+		}
+		state.Stages = append(state.Stages, stageState{Index: i, Definition: p.config.Stages[i], State: data})
+	}
+	return json.Marshal(state)
+}
+
+// Restore replaces the pipeline's state with a snapshot. State of stages
+// whose definition changed since the snapshot was taken is skipped, so
+// that those stages start empty.
+func (p *Pipeline) Restore(data json.RawMessage) error {
+	var state pipelineState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clock != nil && state.Watermark != nil {
+		p.clock.watermark = *state.Watermark
+		p.clock.started = true
+	}
+	for _, s := range state.Stages {
+		if s.Index < 0 || s.Index >= len(p.stages) || !sameDefinition(s.Definition, p.config.Stages[s.Index]) {
+			continue
+		}
+		stateful, ok := p.stages[s.Index].(Stateful)
+		if !ok {
+			continue
+		}
+		if err := stateful.Restore(s.State); err != nil {
+			return fmt.Errorf("stage %d (%s): %v", s.Index, p.names[s.Index], err)
+		}
+	}
+	return nil
+}
+
+// sameDefinition compares stage definitions, ignoring formatting
+func sameDefinition(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// Run passes a message through every stage and calls emit with each
+// message that comes out of the last one. In event time pipelines the
+// message's time is read from it, events too late for any window go to the
+// late stream, and the watermark then moves on; timed stages emit what it
+// makes due. Otherwise the message's time, its processing time, does. A
+// retired pipeline flushes what the message adds, so that it is not lost.
+func (p *Pipeline) Run(msg *Message, emit Emit) error {
+	return p.locked(emit, func(emit Emit) error {
+		return p.runLocked(msg, emit)
+	})
+}
+
+func (p *Pipeline) runLocked(msg *Message, emit Emit) error {
+	arrived := msg.Time
+	if p.clock != nil {
+		t, err := p.clock.timestamp(msg.Value)
+		if err != nil {
+			return err
+		}
+		msg.Time = t
+		if p.clock.late(t) {
+			metrics.PipelineLateMessages.WithLabelValues(msg.StreamID).Inc()
+			if p.clock.lateStream != "" {
+				msg.StreamID = p.clock.lateStream
+				emit(msg)
+			}
+			return nil
+		}
+	}
+
+	err := p.run(0, msg, emit)
+	now := msg.Time
+	if p.clock != nil {
+		p.clock.observe(msg.Time, arrived)
+		now = p.clock.watermark
+	}
+	if advanceErr := p.advance(now, emit); err == nil {
+		err = advanceErr
+	}
+	if p.retired {
+		if flushErr := p.flush(emit); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Advance lets timed stages emit what is due at now. Their output runs
+// through the stages after them. Event time pipelines advance with their
+// events, and with now only once they have been idle for their
+// out-of-orderness, allowed lateness and longest window together.
+func (p *Pipeline) Advance(now time.Time, emit Emit) error {
+	return p.locked(emit, func(emit Emit) error {
+		if p.clock != nil {
+			if !p.clock.idle(now) {
+				return nil
+			}
+			now = p.clock.watermark
+		}
+		return p.advance(now, emit)
+	})
+}
+
+func (p *Pipeline) advance(now time.Time, emit Emit) error {
+	return p.eachTimed(emit, func(stage Timed, next Emit) error {
+		return stage.Advance(now, next)
+	})
+}
+
+// Flush makes timed stages emit everything they hold, first to last, so
+// that what one stage flushes is included in the next one's output
+func (p *Pipeline) Flush(emit Emit) error {
+	return p.locked(emit, p.flush)
+}
+
+// Retire flushes a pipeline that has been replaced. Runs that were already
+// under way and finish after it flush again.
+func (p *Pipeline) Retire(emit Emit) error {
+	return p.locked(emit, func(emit Emit) error {
+		p.retired = true
+		return p.flush(emit)
+	})
+}
+
+func (p *Pipeline) flush(emit Emit) error {
+	return p.eachTimed(emit, func(stage Timed, next Emit) error {
+		return stage.Flush(next)
+	})
+}
+
+// locked calls f holding p.mu and passes what it emits on to emit once the
+// lock is released, so that a slow consumer of the output does not hold up
+// the pipeline
+func (p *Pipeline) locked(emit Emit, f func(emit Emit) error) error {
+	var out []*Message
+	p.mu.Lock()
+	err := f(func(msg *Message) { out = append(out, msg) })
+	p.mu.Unlock()
+	for _, msg := range out {
+		emit(msg)
+	}
+	return err
+}
+
+// eachTimed calls f for every timed stage with an emit function feeding
+// the rest of the pipeline. The caller holds p.mu.
+func (p *Pipeline) eachTimed(emit Emit, f func(stage Timed, next Emit) error) error {
+	if !p.timed {
+		return nil
+	}
+
+	var firstErr error
+	for i, stage := range p.stages {
+		timed, ok := stage.(Timed)
+		if !ok {
+			continue
+		}
+		var downstream error
+		err := f(timed, func(out *Message) {
+			if err := p.run(i+1, out, emit); err != nil && downstream == nil {
+				downstream = err
+			}
+		})
+		if err != nil {
+			err = fmt.Errorf("stage %d (%s): %v", i, p.names[i], err)
+		} else {
+			err = downstream
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *Pipeline) run(i int, msg *Message, emit Emit) error {
+	if i == len(p.stages) {
+		emit(msg)
+		return nil
+	}
+	var downstream error
+	err := p.stages[i].Process(msg, func(out *Message) {
+		if err := p.run(i+1, out, emit); err != nil && downstream == nil {
+			downstream = err
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("stage %d (%s): %v", i, p.names[i], err)
+	}
+	return downstream
+}
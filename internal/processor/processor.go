@@ -2,22 +2,319 @@ package processor
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
 )
 
-// Processor handles message processing
+// Output receives the payloads a pipeline produces, encoded in the format
+// of the message they came from
+type Output func(streamID string, format codec.Format, data []byte)
+
+// tickInterval is how often timed stages are advanced while no messages arrive
+const tickInterval = 100 * time.Millisecond
+
+// Processor handles message processing. Each stream may have a pipeline;
+// messages of streams without one pass through untouched. Joins receive
+// the messages delivered to the streams they join.
 type Processor struct {
-	logger *logger.Logger
+	logger    *logger.Logger
+	mu        sync.RWMutex
+	pipelines map[string]*Pipeline
+	// joins are keyed by their derived stream, sources by joined stream
+	joins   map[string]*Join
+	sources map[string][]*Join
+	// out receives what timed stages emit; it is set by Run
+	out      Output
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewProcessor creates a new Processor instance
 func NewProcessor(logger *logger.Logger) *Processor {
 	return &Processor{
-		logger: logger,
+		logger:    logger,
+		pipelines: make(map[string]*Pipeline),
+		joins:     make(map[string]*Join),
+		sources:   make(map[string][]*Join),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetPipeline installs a stream's pipeline, replacing any previous one. A
+// message already being processed finishes with the pipeline it started
+// with, and every later message uses the new one, so none are lost. Open
+// windows of the previous pipeline are flushed with their partial results,
+// including what a message finishing with it adds after the swap.
+func (p *Processor) SetPipeline(streamID string, pipeline *Pipeline) {
+	p.mu.Lock()
+	previous := p.pipelines[streamID]
+	p.pipelines[streamID] = pipeline
+	out := p.out
+	p.mu.Unlock()
+	p.flush(previous, out)
+}
+
+// RemovePipeline removes a stream's pipeline so that its messages pass through
+func (p *Processor) RemovePipeline(streamID string) {
+	p.mu.Lock()
+	previous := p.pipelines[streamID]
+	delete(p.pipelines, streamID)
+	out := p.out
+	p.mu.Unlock()
+	p.flush(previous, out)
+}
+
+// flush retires a replaced pipeline, emitting what it still holds
+func (p *Processor) flush(pipeline *Pipeline, out Output) {
+	if pipeline == nil || out == nil {
+		return
 	}
+	if err := pipeline.Retire(p.emitter(out)); err != nil {
+		p.logger.Error("Failed to flush pipeline", "error", err)
+	}
+}
+
+// Pipeline returns a stream's pipeline, or nil when it has none
+func (p *Processor) Pipeline(streamID string) *Pipeline {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pipelines[streamID]
+}
+
+// SetJoin installs a join, replacing any previous one with the same
+// derived stream
+func (p *Processor) SetJoin(join *Join) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.joins[join.config.Stream] = join
+	p.indexJoins()
+}
+
+// RemoveJoin removes the join delivering to a derived stream
+func (p *Processor) RemoveJoin(streamID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.joins, streamID)
+	p.indexJoins()
+}
+
+// Join returns the join delivering to a derived stream, or nil
+func (p *Processor) Join(streamID string) *Join {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.joins[streamID]
+}
+
+// indexJoins rebuilds the joins of each joined stream. The caller holds p.mu.
+func (p *Processor) indexJoins() {
+	sources := make(map[string][]*Join)
+	for _, join := range p.joins {
+		sources[join.config.Left] = append(sources[join.config.Left], join)
+		sources[join.config.Right] = append(sources[join.config.Right], join)
+	}
+	p.sources = sources
+}
+
+// joinsOf returns the joins a stream is part of
+func (p *Processor) joinsOf(streamID string) []*Join {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.sources[streamID]
+}
+
+// StreamState is the checkpointed pipeline or join of a stream
+type StreamState struct {
+	Pipeline *models.PipelineConfig `json:"pipeline,omitempty"`
+	// State is set for stateful pipelines
+	State json.RawMessage `json:"state,omitempty"`
+	// Join is set for streams derived by a join, with the messages it buffers
+	Join      *models.JoinConfig `json:"join,omitempty"`
+	JoinState json.RawMessage    `json:"join_state,omitempty"`
+}
+
+// Snapshot returns the pipeline and join of every stream with their
+// state. To be consistent with the input processed, it must not run
+// concurrently with Process.
+func (p *Processor) Snapshot() (map[string]StreamState, error) {
+	p.mu.RLock()
+	pipelines := make(map[string]*Pipeline, len(p.pipelines))
+	for id, pipeline := range p.pipelines {
+		pipelines[id] = pipeline
+	}
+	joins := make(map[string]*Join, len(p.joins))
+	for id, join := range p.joins {
+		joins[id] = join
+	}
+	p.mu.RUnlock()
+
+	streams := make(map[string]StreamState, len(pipelines)+len(joins))
+	for id, pipeline := range pipelines {
+		config := pipeline.Config()
+		stream := StreamState{Pipeline: &config}
+		if pipeline.Stateful() {
+			data, err := pipeline.Snapshot()
+			if err != nil {
+				return nil, fmt.Errorf("stream %s: %v", id, err)
+			}
+			stream.State = data
+		}
+		streams[id] = stream
+	}
+	for id, join := range joins {
+		data, err := join.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("join %s: %v", id, err)
+		}
+		stream := streams[id]
+		config := join.Config()
+		stream.Join, stream.JoinState = &config, data
+		streams[id] = stream
+	}
+	return streams, nil
+}
+
+// Restore installs the pipelines and joins of a snapshot with their
+// state, and returns the streams restored. Pipelines and joins set since
+// are left alone.
+func (p *Processor) Restore(streams map[string]StreamState) ([]string, error) {
+	var restored []string
+	for id, stream := range streams {
+		if stream.Pipeline != nil && p.Pipeline(id) == nil {
+			pipeline, err := Compile(*stream.Pipeline)
+			if err != nil {
+				return restored, fmt.Errorf("stream %s: %v", id, err)
+			}
+			if len(stream.State) > 0 {
+				if err := pipeline.Restore(stream.State); err != nil {
+					return restored, fmt.Errorf("stream %s: %v", id, err)
+				}
+			}
+			p.SetPipeline(id, pipeline)
+		}
+		if stream.Join != nil && p.Join(id) == nil {
+			join, err := CompileJoin(*stream.Join)
+			if err != nil {
+				return restored, fmt.Errorf("join %s: %v", id, err)
+			}
+			if len(stream.JoinState) > 0 {
+				if err := join.Restore(stream.JoinState); err != nil {
+					return restored, fmt.Errorf("join %s: %v", id, err)
+				}
+			}
+			p.SetJoin(join)
+		}
+		restored = append(restored, id)
+	}
+	sort.Strings(restored)
+	return restored, nil
+}
+
+// Process runs a message through its stream's pipeline and passes every
+// resulting payload to out. Payloads of streams without a pipeline are
+// passed on byte for byte. Messages that cannot be decoded or that fail a
+// stage are dropped and counted.
+func (p *Processor) Process(streamID string, format codec.Format, data []byte, out Output) {
+	pipeline := p.Pipeline(streamID)
+	if pipeline == nil {
+		out(streamID, format, data)
+		if joins := p.joinsOf(streamID); len(joins) > 0 {
+			value, err := codec.DecodeObject(format, data)
+			if err != nil {
+				p.logger.Error("Failed to decode message for joining", "stream_id", streamID, "format", format, "error", err)
+				metrics.PipelineErrors.WithLabelValues(streamID).Inc()
+				return
+			}
+			p.join(joins, &Message{StreamID: streamID, Format: format, Time: time.Now(), Value: value}, out)
+		}
+		return
+	}
+
+	value, err := codec.DecodeObject(format, data)
+	if err != nil {
+		p.logger.Error("Failed to decode message for processing", "stream_id", streamID, "format", format, "error", err)
+		metrics.PipelineErrors.WithLabelValues(streamID).Inc()
+		return
+	}
+
+	msg := &Message{StreamID: streamID, Format: format, Time: time.Now(), Value: value}
+	if err := pipeline.Run(msg, p.emitter(out)); err != nil {
+		p.logger.Error("Pipeline failed", "stream_id", streamID, "error", err)
+		metrics.PipelineErrors.WithLabelValues(streamID).Inc()
+	}
+}
+
+// emitter encodes the messages a pipeline emits and passes them to out,
+// and to the joins of the stream they are delivered to
+func (p *Processor) emitter(out Output) Emit {
+	return func(msg *Message) {
+		encoded, err := codec.Encode(msg.Format, msg.Value)
+		if err != nil {
+			p.logger.Error("Failed to encode processed message", "stream_id", msg.StreamID, "error", err)
+			metrics.PipelineErrors.WithLabelValues(msg.StreamID).Inc()
+			return
+		}
+		out(msg.StreamID, msg.Format, encoded)
+		if joins := p.joinsOf(msg.StreamID); len(joins) > 0 {
+			p.join(joins, msg, out)
+		}
+	}
+}
+
+// join passes a delivered message to the joins of its stream
+func (p *Processor) join(joins []*Join, msg *Message, out Output) {
+	emit := p.emitter(out)
+	for _, join := range joins {
+		if err := join.Process(msg, emit); err != nil {
+			p.logger.Error("Join failed", "stream_id", join.config.Stream, "error", err)
+			metrics.PipelineErrors.WithLabelValues(join.config.Stream).Inc()
+		}
+	}
+}
+
+// Run advances the timed stages of every pipeline, such as windows, so
+// that they emit their results to out as time passes. It returns when
+// Stop is called.
+func (p *Processor) Run(out Output) {
+	p.mu.Lock()
+	p.out = out
+	p.mu.Unlock()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	emit := p.emitter(out)
+	for {
+		select {
+		case now := <-ticker.C:
+			p.mu.RLock()
+			pipelines := make(map[string]*Pipeline, len(p.pipelines))
+			for id, pipeline := range p.pipelines {
+				pipelines[id] = pipeline
+			}
+			p.mu.RUnlock()
+
+			for id, pipeline := range pipelines {
+				if err := pipeline.Advance(now, emit); err != nil {
+					p.logger.Error("Pipeline failed", "stream_id", id, "error", err)
+					metrics.PipelineErrors.WithLabelValues(id).Inc()
+				}
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Stop ends Run
+func (p *Processor) Stop() {
+	p.stopOnce.Do(func() { close(p.done) })
 }
 
 // ProcessMessage processes a single message
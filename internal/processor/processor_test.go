@@ -1,11 +1,19 @@
 package processor_test
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rithindattag/realtime-streaming-api/internal/lookup"
+	"github.com/rithindattag/realtime-streaming-api/internal/models"
 	"github.com/rithindattag/realtime-streaming-api/internal/processor"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestProcessMessage tests the ProcessMessage function
@@ -31,3 +39,876 @@ func TestProcessMessage(t *testing.T) {
 		})
 	}
 }
+
+// compile builds a pipeline from JSON stage definitions
+func compile(t *testing.T, stages ...string) *processor.Pipeline {
+	config := models.PipelineConfig{}
+	for _, s := range stages {
+		config.Stages = append(config.Stages, json.RawMessage(s))
+	}
+	p, err := processor.Compile(config)
+	require.NoError(t, err)
+	return p
+}
+
+// run passes a JSON message through a pipeline and returns the output messages
+func run(t *testing.T, p *processor.Pipeline, message string) []*processor.Message {
+	var value map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(message), &value))
+	var out []*processor.Message
+	require.NoError(t, p.Run(&processor.Message{StreamID: "in", Value: value}, func(m *processor.Message) {
+		out = append(out, m)
+	}))
+	return out
+}
+
+// TestCompileErrors tests that invalid definitions are rejected
+func TestCompileErrors(t *testing.T) {
+	testCases := []string{
+		`{"type":"explode"}`,
+		`{"type":"filter"}`,
+		`{"type":"filter","expr":"a >"}`,
+		`{"type":"filter","expr":"a > 1","exprs":"typo"}`,
+		`{"type":"map","fields":{"a..b":"1"}}`,
+		`{"type":"rename","fields":{}}`,
+		`{"type":"drop-fields"}`,
+		`{"type":"enrich"}`,
+		`{"type":"route"}`,
+		`[1]`,
+	}
+	for _, tc := range testCases {
+		_, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(tc)}})
+		assert.Error(t, err, tc)
+	}
+}
+
+// TestStages tests each stage type
+func TestStages(t *testing.T) {
+	p := compile(t,
+		`{"type":"filter","expr":"temperature > 30"}`,
+		`{"type":"rename","fields":{"temperature":"reading.celsius","missing":"x"}}`,
+		`{"type":"map","fields":{"hot":"reading.celsius > 40","site":"location","reading.fahrenheit":"reading.celsius * 1.8 + 32"}}`,
+		`{"type":"drop-fields","fields":["location","debug.trace"]}`,
+		`{"type":"enrich","fields":{"region":"eu","site":"ignored"},"timestamp":"processed_at"}`,
+	)
+
+	assert.Empty(t, run(t, p, `{"temperature":20}`))
+
+	out := run(t, p, `{"temperature":45,"location":"A","debug":{"trace":1,"keep":true}}`)
+	require.Len(t, out, 1)
+	v := out[0].Value
+	assert.Equal(t, map[string]interface{}{"celsius": float64(45), "fahrenheit": float64(113)}, v["reading"])
+	assert.Equal(t, true, v["hot"])
+	assert.Equal(t, "A", v["site"])
+	assert.NotContains(t, v, "location")
+	assert.NotContains(t, v, "temperature")
+	assert.NotContains(t, v, "x")
+	assert.Equal(t, map[string]interface{}{"keep": true}, v["debug"])
+	assert.Equal(t, "eu", v["region"])
+	assert.Contains(t, v, "processed_at")
+}
+
+// TestRoute tests routing and copying messages to another stream
+func TestRoute(t *testing.T) {
+	p := compile(t,
+		`{"type":"route","stream":"alerts","when":"level == \"high\"","copy":true}`,
+		`{"type":"enrich","fields":{"routed":true}}`,
+	)
+	assert.Equal(t, []string{"alerts"}, p.Routes())
+
+	out := run(t, p, `{"level":"low"}`)
+	require.Len(t, out, 1)
+	assert.Equal(t, "in", out[0].StreamID)
+
+	out = run(t, p, `{"level":"high"}`)
+	require.Len(t, out, 2)
+	assert.Equal(t, "in", out[0].StreamID)
+	assert.Equal(t, "alerts", out[1].StreamID)
+	out[0].Value["level"] = "changed"
+	assert.Equal(t, "high", out[1].Value["level"])
+}
+
+// TestProcessorSwap tests pass-through, processing and replacing a stream's pipeline
+func TestProcessorSwap(t *testing.T) {
+	p := processor.NewProcessor(logger.NewLogger())
+	var got []string
+	out := func(streamID string, format codec.Format, data []byte) {
+		got = append(got, streamID+" "+string(data))
+	}
+
+	raw := []byte(`{"b":1, "a":18446744073709551615}`)
+	p.Process("s", codec.JSON, raw, out)
+	assert.Equal(t, []string{"s " + string(raw)}, got)
+
+	p.SetPipeline("s", compile(t, `{"type":"drop-fields","fields":["b"]}`))
+	got = nil
+	p.Process("s", codec.JSON, raw, out)
+	assert.Equal(t, []string{`s {"a":18446744073709551615}`}, got)
+
+	p.SetPipeline("s", compile(t, `{"type":"filter","expr":"b == 2"}`))
+	got = nil
+	p.Process("s", codec.JSON, raw, out)
+	p.Process("s", codec.Protobuf, []byte{0x08, 0x01}, out)
+	assert.Empty(t, got)
+
+	p.RemovePipeline("s")
+	p.Process("s", codec.JSON, raw, out)
+	assert.Len(t, got, 1)
+}
+
+// TestPipelineRetire tests that a replaced pipeline flushes what runs that
+// finish after the swap add, and that output is emitted without holding
+// the pipeline
+func TestPipelineRetire(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	p := compile(t, `{"type":"window","size":"1m","aggregates":{"n":{"op":"count"}}}`)
+	collect := func(m *processor.Message) {
+		p.Watermark()
+		out = append(out, m)
+	}
+
+	runAt(t, p, base, `{"v":1}`, collect)
+	require.NoError(t, p.Retire(collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, int64(1), out[0].Value["n"])
+
+	runAt(t, p, base, `{"v":2}`, collect)
+	require.Len(t, out, 2)
+	assert.Equal(t, int64(1), out[1].Value["n"])
+}
+
+// runAt passes a message stamped with a time through a pipeline
+func runAt(t *testing.T, p *processor.Pipeline, at time.Time, message string, emit processor.Emit) {
+	var value map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(message), &value))
+	require.NoError(t, p.Run(&processor.Message{StreamID: "in", Format: codec.JSON, Time: at, Value: value}, emit))
+}
+
+// TestTumblingWindow tests grouped aggregates over tumbling windows
+func TestTumblingWindow(t *testing.T) {
+	p := compile(t, `{"type":"window","size":"1m","group_by":["site"],"aggregates":{
+		"n":{"op":"count"},"total":{"op":"sum","field":"v"},"avg":{"op":"avg","field":"v"},
+		"lo":{"op":"min","field":"v"},"hi":{"op":"max","field":"v"},"p50":{"op":"percentile","field":"v","percentile":50},
+		"with_v":{"op":"count","field":"v"}}}`)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+
+	runAt(t, p, base.Add(1*time.Second), `{"site":"B","v":4}`, collect)
+	runAt(t, p, base.Add(2*time.Second), `{"site":"A","v":1}`, collect)
+	runAt(t, p, base.Add(3*time.Second), `{"site":"A","v":3}`, collect)
+	runAt(t, p, base.Add(4*time.Second), `{"site":"A"}`, collect)
+	assert.Empty(t, out)
+
+	// The next window's first message closes the previous one
+	runAt(t, p, base.Add(61*time.Second), `{"site":"A","v":10}`, collect)
+	require.Len(t, out, 2)
+	assert.Equal(t, "in", out[0].StreamID)
+	assert.Equal(t, base.Add(time.Minute), out[0].Time)
+	assert.Equal(t, map[string]interface{}{
+		"window_start": "2024-05-01T12:00:00Z", "window_end": "2024-05-01T12:01:00Z",
+		"site": "A", "n": int64(3), "with_v": int64(2), "total": float64(4), "avg": float64(2),
+		"lo": float64(1), "hi": float64(3), "p50": float64(2),
+	}, out[0].Value)
+	assert.Equal(t, "B", out[1].Value["site"])
+	assert.Equal(t, int64(1), out[1].Value["n"])
+
+	out = nil
+	require.NoError(t, p.Advance(base.Add(119*time.Second), collect))
+	assert.Empty(t, out)
+	require.NoError(t, p.Advance(base.Add(120*time.Second), collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, float64(10), out[0].Value["total"])
+}
+
+// TestHoppingWindow tests overlapping windows delivered to a derived stream
+func TestHoppingWindow(t *testing.T) {
+	p := compile(t, `{"type":"window","size":"1m","slide":"30s","stream":"stats","aggregates":{"n":{"op":"count"}}}`)
+	assert.Equal(t, []string{"stats"}, p.Routes())
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var raw, results []*processor.Message
+	collect := func(m *processor.Message) {
+		if m.StreamID == "stats" {
+			results = append(results, m)
+		} else {
+			raw = append(raw, m)
+		}
+	}
+	runAt(t, p, base.Add(10*time.Second), `{}`, collect)
+	runAt(t, p, base.Add(40*time.Second), `{}`, collect)
+	assert.Len(t, raw, 2)
+
+	require.NoError(t, p.Advance(base.Add(89*time.Second), collect))
+	require.Len(t, results, 2)
+	assert.Equal(t, "2024-05-01T11:59:30Z", results[0].Value["window_start"])
+	assert.Equal(t, int64(1), results[0].Value["n"])
+	assert.Equal(t, "2024-05-01T12:00:00Z", results[1].Value["window_start"])
+	assert.Equal(t, int64(2), results[1].Value["n"])
+
+	// Flushing emits the window that is still open
+	results = nil
+	require.NoError(t, p.Flush(collect))
+	require.Len(t, results, 1)
+	assert.Equal(t, "2024-05-01T12:00:30Z", results[0].Value["window_start"])
+}
+
+// TestWindowCompileErrors tests that invalid windows are rejected
+func TestWindowCompileErrors(t *testing.T) {
+	testCases := []string{
+		`{"type":"window","aggregates":{"n":{"op":"count"}}}`,
+		`{"type":"window","size":"1m"}`,
+		`{"type":"window","size":"soon","aggregates":{"n":{"op":"count"}}}`,
+		`{"type":"window","size":"1m","slide":"2m","aggregates":{"n":{"op":"count"}}}`,
+		`{"type":"window","size":"1h","slide":"1s","aggregates":{"n":{"op":"count"}}}`,
+		`{"type":"window","size":"1m","aggregates":{"n":{"op":"median","field":"v"}}}`,
+		`{"type":"window","size":"1m","aggregates":{"n":{"op":"sum"}}}`,
+		`{"type":"window","size":"1m","aggregates":{"n":{"op":"percentile","field":"v","percentile":101}}}`,
+	}
+	for _, tc := range testCases {
+		_, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(tc)}})
+		assert.Error(t, err, tc)
+	}
+}
+
+// TestProcessorRun tests that Run closes processing time windows as time passes
+func TestProcessorRun(t *testing.T) {
+	p := processor.NewProcessor(logger.NewLogger())
+	results := make(chan string, 10)
+	out := func(streamID string, format codec.Format, data []byte) {
+		results <- streamID + " " + string(data)
+	}
+	go p.Run(out)
+	defer p.Stop()
+
+	p.SetPipeline("s", compile(t, `{"type":"window","size":"200ms","aggregates":{"n":{"op":"count"}}}`))
+	p.Process("s", codec.JSON, []byte(`{"v":1}`), out)
+	p.Process("s", codec.JSON, []byte(`{"v":2}`), out)
+
+	select {
+	case result := <-results:
+		assert.Contains(t, result, `s {"n":`)
+	case <-time.After(2 * time.Second):
+		t.Fatal("window was not emitted")
+	}
+}
+
+// TestEventTime tests windows over event time with out of order and late events
+func TestEventTime(t *testing.T) {
+	p, err := processor.Compile(models.PipelineConfig{
+		EventTime: &models.EventTimeConfig{Field: "ts", Format: "unix",
+			MaxOutOfOrderness: "10s", AllowedLateness: "30s", LateStream: "late"},
+		Stages: []json.RawMessage{json.RawMessage(`{"type":"window","size":"1m","aggregates":{"n":{"op":"count"}}}`)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"late"}, p.Routes())
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+	at := func(seconds int) string {
+		return fmt.Sprintf(`{"ts":%d}`, base.Unix()+int64(seconds))
+	}
+
+	// Processing time plays no part
+	runAt(t, p, time.Time{}, at(5), collect)
+	runAt(t, p, time.Time{}, at(50), collect)
+	runAt(t, p, time.Time{}, at(30), collect)
+	runAt(t, p, time.Time{}, at(65), collect)
+	require.NoError(t, p.Advance(base.Add(time.Hour), collect))
+	assert.Empty(t, out)
+	assert.Equal(t, base.Add(55*time.Second), p.Watermark().UTC())
+
+	// The watermark passing the window's end closes it
+	runAt(t, p, time.Time{}, at(71), collect)
+	require.Len(t, out, 1)
+	assert.Equal(t, int64(3), out[0].Value["n"])
+	assert.Equal(t, base.Add(time.Minute), out[0].Time.UTC())
+
+	// A late event within the allowed lateness updates the window's results
+	out = nil
+	runAt(t, p, time.Time{}, at(45), collect)
+	require.Len(t, out, 1)
+	assert.Equal(t, int64(4), out[0].Value["n"])
+
+	// Later ones go to the late stream unchanged
+	out = nil
+	runAt(t, p, time.Time{}, at(20), collect)
+	require.Len(t, out, 1)
+	assert.Equal(t, "late", out[0].StreamID)
+	assert.Equal(t, float64(base.Unix()+20), out[0].Value["ts"])
+
+	// Events without a time are rejected
+	assert.Error(t, p.Run(&processor.Message{StreamID: "in", Value: map[string]interface{}{}}, collect))
+
+	// The window is discarded once the watermark passes its lateness
+	out = nil
+	runAt(t, p, time.Time{}, at(95), collect)
+	runAt(t, p, time.Time{}, at(50), collect)
+	require.Len(t, out, 1)
+	assert.Equal(t, "late", out[0].StreamID)
+}
+
+// TestEventTimeIdle tests that an event time pipeline without events moves
+// its watermark on with processing time, once it has been idle for its
+// out-of-orderness, allowed lateness and window size
+func TestEventTimeIdle(t *testing.T) {
+	p, err := processor.Compile(models.PipelineConfig{
+		EventTime: &models.EventTimeConfig{Field: "ts", Format: "unix",
+			MaxOutOfOrderness: "10s", AllowedLateness: "30s"},
+		Stages: []json.RawMessage{json.RawMessage(`{"type":"window","size":"1m","aggregates":{"n":{"op":"count"}}}`)},
+	})
+	require.NoError(t, err)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	runAt(t, p, now, fmt.Sprintf(`{"ts":%d}`, base.Unix()+5), collect)
+	require.NoError(t, p.Advance(now.Add(99*time.Second), collect))
+	assert.Empty(t, out)
+	assert.Equal(t, base.Add(-5*time.Second), p.Watermark().UTC())
+
+	require.NoError(t, p.Advance(now.Add(100*time.Second), collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, int64(1), out[0].Value["n"])
+	assert.Equal(t, base.Add(95*time.Second), p.Watermark().UTC())
+}
+
+// TestEventTimeFormats tests reading event times
+func TestEventTimeFormats(t *testing.T) {
+	testCases := []struct {
+		format string
+		value  string
+		want   time.Time
+	}{
+		{"", `"2024-05-01T12:00:00.5+02:00"`, time.Date(2024, 5, 1, 10, 0, 0, 5e8, time.UTC)},
+		{"", `1714564800500`, time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC)},
+		{"unix", `1714564800.5`, time.Date(2024, 5, 1, 12, 0, 0, 5e8, time.UTC)},
+		{"unix_us", `1714564800000001`, time.Date(2024, 5, 1, 12, 0, 0, 1000, time.UTC)},
+		{"unix_ns", `1714564800000000001`, time.Date(2024, 5, 1, 12, 0, 0, 1, time.UTC)},
+	}
+	for _, tc := range testCases {
+		p, err := processor.Compile(models.PipelineConfig{
+			EventTime: &models.EventTimeConfig{Field: "meta.ts", Format: tc.format},
+			Stages:    []json.RawMessage{json.RawMessage(`{"type":"filter","expr":"true"}`)},
+		})
+		require.NoError(t, err)
+		dec := json.NewDecoder(strings.NewReader(`{"meta":{"ts":` + tc.value + `}}`))
+		dec.UseNumber()
+		var value map[string]interface{}
+		require.NoError(t, dec.Decode(&value))
+		var out []*processor.Message
+		require.NoError(t, p.Run(&processor.Message{Value: value}, func(m *processor.Message) { out = append(out, m) }), tc.value)
+		require.Len(t, out, 1)
+		assert.True(t, tc.want.Equal(out[0].Time), "%s: got %s", tc.value, out[0].Time)
+	}
+
+	for _, config := range []models.EventTimeConfig{
+		{},
+		{Field: "ts", Format: "iso"},
+		{Field: "ts", MaxOutOfOrderness: "-1s"},
+		{Field: "ts", AllowedLateness: "later"},
+	} {
+		_, err := processor.Compile(models.PipelineConfig{EventTime: &config})
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+// TestStateStore tests expiry and snapshots of keyed state
+func TestStateStore(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := processor.NewStateStore(time.Minute)
+	require.NoError(t, s.Put("a", 1, base))
+	require.NoError(t, s.Put("b", 2, base.Add(10*time.Second)))
+	require.NoError(t, s.Put("a", 3, base.Add(20*time.Second)))
+
+	var expired []string
+	s.Expire(base.Add(70*time.Second), func(key string, value interface{}) {
+		expired = append(expired, fmt.Sprint(key, "=", value))
+	})
+	assert.Equal(t, []string{"b=2"}, expired)
+	v, ok := s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+
+	data, err := s.Snapshot(func(v interface{}) interface{} { return v })
+	require.NoError(t, err)
+	restored := processor.NewStateStore(time.Minute)
+	require.NoError(t, restored.Restore(data, func(raw json.RawMessage) (interface{}, error) {
+		var n int
+		err := json.Unmarshal(raw, &n)
+		return n, err
+	}))
+	assert.Equal(t, 1, restored.Len())
+	restored.Expire(base.Add(80*time.Second), nil)
+	assert.Equal(t, 0, restored.Len())
+}
+
+// TestSessionWindow tests sessions closing after a gap of inactivity
+func TestSessionWindow(t *testing.T) {
+	p := compile(t, `{"type":"session","gap":"30s","group_by":["user"],"aggregates":{"n":{"op":"count"},"total":{"op":"sum","field":"v"}}}`)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+
+	runAt(t, p, base, `{"user":"a","v":1}`, collect)
+	runAt(t, p, base.Add(20*time.Second), `{"user":"a","v":2}`, collect)
+	runAt(t, p, base.Add(25*time.Second), `{"user":"b","v":5}`, collect)
+	runAt(t, p, base.Add(45*time.Second), `{"user":"a","v":3}`, collect)
+	assert.Empty(t, out)
+
+	// b has been idle for 30s
+	require.NoError(t, p.Advance(base.Add(55*time.Second), collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, map[string]interface{}{
+		"window_start": "2024-05-01T12:00:25Z", "window_end": "2024-05-01T12:00:55Z",
+		"user": "b", "n": int64(1), "total": float64(5),
+	}, out[0].Value)
+
+	// A message after the gap starts a new session
+	out = nil
+	runAt(t, p, base.Add(80*time.Second), `{"user":"a","v":10}`, collect)
+	require.Len(t, out, 1)
+	assert.Equal(t, int64(3), out[0].Value["n"])
+	assert.Equal(t, "2024-05-01T12:01:15Z", out[0].Value["window_end"])
+
+	out = nil
+	require.NoError(t, p.Flush(collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, float64(10), out[0].Value["total"])
+}
+
+// TestRunningAggregate tests per key state that expires and survives a restore
+func TestRunningAggregate(t *testing.T) {
+	stage := `{"type":"running","group_by":["user"],"ttl":"1h","aggregates":{"total":{"op":"sum","field":"amount"},"orders":{"op":"count"}}}`
+	p := compile(t, stage)
+	assert.True(t, p.Stateful())
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+	runAt(t, p, base, `{"user":"a","amount":5}`, collect)
+	runAt(t, p, base.Add(time.Minute), `{"user":"b","amount":1}`, collect)
+	runAt(t, p, base.Add(2*time.Minute), `{"user":"a","amount":7}`, collect)
+	require.Len(t, out, 3)
+	assert.Equal(t, float64(12), out[2].Value["total"])
+	assert.Equal(t, int64(2), out[2].Value["orders"])
+
+	state, err := p.Snapshot()
+	require.NoError(t, err)
+
+	// The state is restored into the same stage of a new pipeline
+	restored := compile(t, stage)
+	require.NoError(t, restored.Restore(state))
+	out = nil
+	runAt(t, restored, base.Add(3*time.Minute), `{"user":"a","amount":1}`, collect)
+	assert.Equal(t, float64(13), out[0].Value["total"])
+
+	// but not into a stage whose definition changed
+	changed := compile(t, `{"type":"running","group_by":["user"],"aggregates":{"total":{"op":"sum","field":"amount"}}}`)
+	require.NoError(t, changed.Restore(state))
+	out = nil
+	runAt(t, changed, base.Add(3*time.Minute), `{"user":"a","amount":1}`, collect)
+	assert.Equal(t, float64(1), out[0].Value["total"])
+
+	// b's state expires an hour after its last order
+	out = nil
+	runAt(t, restored, base.Add(62*time.Minute), `{"user":"b","amount":1}`, collect)
+	runAt(t, restored, base.Add(62*time.Minute), `{"user":"a","amount":1}`, collect)
+	assert.Equal(t, float64(1), out[0].Value["total"])
+	assert.Equal(t, float64(14), out[1].Value["total"])
+
+	_, err = processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{
+		json.RawMessage(`{"type":"running","aggregates":{"p":{"op":"percentile","field":"v","percentile":50}}}`),
+	}})
+	assert.Error(t, err)
+}
+
+// TestJoin tests joining two streams on a key within a window
+func TestJoin(t *testing.T) {
+	join, err := processor.CompileJoin(models.JoinConfig{
+		Left: "orders", Right: "payments", Key: "order_id", Window: "10m",
+		LeftAs: "order", RightAs: "payment", Stream: "paid",
+	})
+	require.NoError(t, err)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+	process := func(stream string, at time.Duration, message string) {
+		var value map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(message), &value))
+		require.NoError(t, join.Process(&processor.Message{StreamID: stream, Format: codec.JSON, Time: base.Add(at), Value: value}, collect))
+	}
+
+	process("orders", 0, `{"order_id":1,"total":10}`)
+	process("orders", time.Minute, `{"order_id":2,"total":20}`)
+	process("payments", 5*time.Minute, `{"order_id":1,"amount":10}`)
+	require.Len(t, out, 1)
+	assert.Equal(t, "paid", out[0].StreamID)
+	assert.Equal(t, base.Add(5*time.Minute), out[0].Time)
+	assert.Equal(t, map[string]interface{}{
+		"order":   map[string]interface{}{"order_id": float64(1), "total": float64(10)},
+		"payment": map[string]interface{}{"order_id": float64(1), "amount": float64(10)},
+	}, out[0].Value)
+
+	// Pairs further apart than the window are not joined
+	out = nil
+	process("payments", 12*time.Minute, `{"order_id":2,"amount":20}`)
+	assert.Empty(t, out)
+
+	// The right side is buffered too, and survives a restore
+	state, err := join.Snapshot()
+	require.NoError(t, err)
+	join, err = processor.CompileJoin(join.Config())
+	require.NoError(t, err)
+	require.NoError(t, join.Restore(state))
+	process("orders", 14*time.Minute, `{"order_id":2,"total":20}`)
+	require.Len(t, out, 1)
+	assert.Equal(t, json.Number("20"), out[0].Value["payment"].(map[string]interface{})["amount"])
+
+	for _, config := range []models.JoinConfig{
+		{Left: "a", Right: "a", Key: "id", Window: "1m"},
+		{Left: "a", Right: "b", Window: "1m"},
+		{Left: "a", Right: "b", Key: "id"},
+		{Left: "a", Right: "b", Key: "id", Window: "1m", LeftAs: "x", RightAs: "x"},
+	} {
+		_, err := processor.CompileJoin(config)
+		assert.Error(t, err, "%+v", config)
+	}
+}
+
+// TestProcessorJoin tests that joins see the messages delivered to their streams
+func TestProcessorJoin(t *testing.T) {
+	p := processor.NewProcessor(logger.NewLogger())
+	join, err := processor.CompileJoin(models.JoinConfig{Left: "orders", Right: "payments", Key: "id", Window: "1m", Stream: "paid"})
+	require.NoError(t, err)
+	p.SetJoin(join)
+	p.SetPipeline("payments", compile(t, `{"type":"map","fields":{"id":"payment.order"}}`))
+
+	var out []string
+	collect := func(streamID string, format codec.Format, data []byte) {
+		out = append(out, streamID+" "+string(data))
+	}
+	p.Process("orders", codec.JSON, []byte(`{"id":7}`), collect)
+	p.Process("payments", codec.JSON, []byte(`{"payment":{"order":7}}`), collect)
+	require.Len(t, out, 3)
+	assert.Equal(t, `orders {"id":7}`, out[0])
+	assert.Contains(t, out[2], `paid {"left":{"id":7},"right":{"id":7,"payment":{"order":7}}}`)
+
+	state, err := p.Snapshot()
+	require.NoError(t, err)
+	require.NotNil(t, state["paid"].Join)
+	p.RemoveJoin("paid")
+	assert.Nil(t, p.Join("paid"))
+}
+
+// TestLookup tests enriching messages from a lookup table
+func TestLookup(t *testing.T) {
+	require.NoError(t, lookup.Default.Set("test-devices", map[string]map[string]interface{}{
+		"1": {"site": "north", "owner": "ops"},
+		"2": {"site": "south"},
+	}))
+	defer lookup.Default.Remove("test-devices")
+
+	p := compile(t, `{"type":"lookup","table":"test-devices","key":"device","fields":{"location.site":"site","owner":"owner"}}`)
+	out := run(t, p, `{"device":1}`)
+	require.Len(t, out, 1)
+	assert.Equal(t, map[string]interface{}{"site": "north"}, out[0].Value["location"])
+	assert.Equal(t, "ops", out[0].Value["owner"])
+
+	// Columns missing from the row are left unset, and present fields kept
+	out = run(t, p, `{"device":"2","owner":"me"}`)
+	assert.Equal(t, "me", out[0].Value["owner"])
+
+	out = run(t, compile(t, `{"type":"lookup","table":"test-devices","key":"device","into":"info"}`), `{"device":2}`)
+	assert.Equal(t, map[string]interface{}{"site": "south"}, out[0].Value["info"])
+
+	out = run(t, compile(t, `{"type":"lookup","table":"test-devices","key":"device","overwrite":true}`), `{"device":1,"site":"x"}`)
+	assert.Equal(t, "north", out[0].Value["site"])
+	assert.Equal(t, "ops", out[0].Value["owner"])
+
+	// Missing keys follow on_missing
+	assert.Len(t, run(t, compile(t, `{"type":"lookup","table":"test-devices","key":"device"}`), `{"device":3}`), 1)
+	assert.Len(t, run(t, compile(t, `{"type":"lookup","table":"test-devices","key":"device","on_missing":"drop"}`), `{"device":3}`), 0)
+	out = run(t, compile(t, `{"type":"lookup","table":"test-devices","key":"device","on_missing":"default","defaults":{"site":"unknown"}}`), `{}`)
+	assert.Equal(t, "unknown", out[0].Value["site"])
+
+	var value map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"device":3}`), &value))
+	discard := func(*processor.Message) {}
+	failing := compile(t, `{"type":"lookup","table":"test-devices","key":"device","on_missing":"error"}`)
+	assert.Error(t, failing.Run(&processor.Message{StreamID: "in", Value: value}, discard))
+	missing := compile(t, `{"type":"lookup","table":"test-missing","key":"device"}`)
+	assert.Error(t, missing.Run(&processor.Message{StreamID: "in", Value: value}, discard))
+
+	for _, stage := range []string{
+		`{"type":"lookup","key":"device"}`,
+		`{"type":"lookup","table":"t"}`,
+		`{"type":"lookup","table":"t","key":"device","on_missing":"skip"}`,
+		`{"type":"lookup","table":"t","key":"device","on_missing":"default"}`,
+		`{"type":"lookup","table":"t","key":"device","into":"a","fields":{"b":"b"}}`,
+	} {
+		_, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(stage)}})
+		assert.Error(t, err, stage)
+	}
+}
+
+// TestDedup tests dropping messages seen within a window
+func TestDedup(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+
+	stage := `{"type":"dedup","key":"id","window":"10m"}`
+	p := compile(t, stage)
+	assert.True(t, p.Stateful())
+	runAt(t, p, base, `{"id":1,"v":1}`, collect)
+	runAt(t, p, base.Add(time.Minute), `{"id":1,"v":2}`, collect)
+	runAt(t, p, base.Add(time.Minute), `{"id":2}`, collect)
+	runAt(t, p, base.Add(time.Minute), `{"v":3}`, collect)
+	runAt(t, p, base.Add(time.Minute), `{"v":3}`, collect)
+	assert.Len(t, out, 4)
+
+	// The window starts when a message is first seen
+	out = nil
+	runAt(t, p, base.Add(9*time.Minute), `{"id":1}`, collect)
+	runAt(t, p, base.Add(10*time.Minute), `{"id":1}`, collect)
+	assert.Len(t, out, 1)
+
+	state, err := p.Snapshot()
+	require.NoError(t, err)
+	restored := compile(t, stage)
+	require.NoError(t, restored.Restore(state))
+	out = nil
+	runAt(t, restored, base.Add(10*time.Minute), `{"id":2}`, collect)
+	runAt(t, restored, base.Add(11*time.Minute), `{"id":1}`, collect)
+	assert.Empty(t, out)
+	runAt(t, restored, base.Add(11*time.Minute), `{"id":2}`, collect)
+	assert.Len(t, out, 1)
+
+	// Without a key messages are compared by content, or by some fields
+	out = nil
+	byContent := compile(t, `{"type":"dedup","window":"1m"}`)
+	runAt(t, byContent, base, `{"a":1,"b":{"c":2}}`, collect)
+	runAt(t, byContent, base, `{"b":{"c":2},"a":1}`, collect)
+	runAt(t, byContent, base, `{"a":1,"b":{"c":3}}`, collect)
+	assert.Len(t, out, 2)
+	out = nil
+	byFields := compile(t, `{"type":"dedup","fields":["a"],"window":"1m"}`)
+	runAt(t, byFields, base, `{"a":1,"ts":1}`, collect)
+	runAt(t, byFields, base, `{"a":1,"ts":2}`, collect)
+	assert.Len(t, out, 1)
+
+	for _, stage := range []string{
+		`{"type":"dedup"}`,
+		`{"type":"dedup","window":"1m","key":"id","fields":["a"]}`,
+		`{"type":"dedup","window":"1m","mode":"fuzzy"}`,
+		`{"type":"dedup","window":"1m","capacity":10}`,
+		`{"type":"dedup","window":"1m","mode":"bloom","error_rate":2}`,
+		`{"type":"dedup","window":"1m","mode":"bloom","capacity":1000000000000}`,
+	} {
+		_, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(stage)}})
+		assert.Error(t, err, stage)
+	}
+}
+
+// TestDedupFull tests that an exact dedup stage whose store is full forgets
+// the oldest messages rather than fail
+func TestDedupFull(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+
+	p := compile(t, `{"type":"dedup","key":"id","window":"1h"}`)
+	for i := 0; i <= 100000; i++ {
+		runAt(t, p, base.Add(time.Duration(i)*time.Millisecond), fmt.Sprintf(`{"id":%d}`, i), collect)
+	}
+	assert.Len(t, out, 100001)
+
+	out = nil
+	at := base.Add(time.Minute)
+	runAt(t, p, at, `{"id":100000}`, collect)
+	runAt(t, p, at, `{"id":2}`, collect)
+	assert.Empty(t, out)
+	runAt(t, p, at, `{"id":0}`, collect)
+	assert.Len(t, out, 1)
+}
+
+// TestDedupBloom tests dropping duplicates with bloom filters
+func TestDedupBloom(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+
+	stage := `{"type":"dedup","key":"id","window":"10m","mode":"bloom","capacity":1000,"error_rate":0.001}`
+	p := compile(t, stage)
+	for i := 0; i < 500; i++ {
+		runAt(t, p, base, fmt.Sprintf(`{"id":%d}`, i), collect)
+	}
+	assert.Len(t, out, 500)
+
+	// Duplicates are dropped in the next window and after a restore
+	state, err := p.Snapshot()
+	require.NoError(t, err)
+	restored := compile(t, stage)
+	require.NoError(t, restored.Restore(state))
+	out = nil
+	for i := 0; i < 500; i++ {
+		runAt(t, restored, base.Add(15*time.Minute), fmt.Sprintf(`{"id":%d}`, i), collect)
+	}
+	assert.Empty(t, out)
+
+	// and forgotten two windows later
+	runAt(t, restored, base.Add(30*time.Minute), `{"id":1}`, collect)
+	assert.Len(t, out, 1)
+}
+
+// TestSample tests random and every nth sampling
+func TestSample(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+
+	p := compile(t, `{"type":"sample","every":3,"group_by":["sensor"]}`)
+	for i := 0; i < 7; i++ {
+		runAt(t, p, base, fmt.Sprintf(`{"sensor":"a","i":%d}`, i), collect)
+		runAt(t, p, base, fmt.Sprintf(`{"sensor":"b","i":%d}`, i), collect)
+	}
+	require.Len(t, out, 6)
+	assert.Equal(t, float64(0), out[0].Value["i"])
+	assert.Equal(t, float64(3), out[2].Value["i"])
+	assert.Equal(t, float64(6), out[5].Value["i"])
+
+	// The position within each group survives a restore
+	state, err := p.Snapshot()
+	require.NoError(t, err)
+	restored := compile(t, `{"type":"sample","every":3,"group_by":["sensor"]}`)
+	require.NoError(t, restored.Restore(state))
+	out = nil
+	for i := 7; i < 10; i++ {
+		runAt(t, restored, base, fmt.Sprintf(`{"sensor":"a","i":%d}`, i), collect)
+	}
+	require.Len(t, out, 1)
+	assert.Equal(t, float64(9), out[0].Value["i"])
+
+	// With a stream the sample is copied there and every message passes
+	out = nil
+	random := compile(t, `{"type":"sample","rate":0.5,"stream":"sampled"}`)
+	for i := 0; i < 1000; i++ {
+		runAt(t, random, base, `{"v":1}`, collect)
+	}
+	sampled := 0
+	for _, m := range out {
+		if m.StreamID == "sampled" {
+			sampled++
+		}
+	}
+	assert.Equal(t, 1000, len(out)-sampled)
+	assert.InDelta(t, 500, sampled, 100)
+
+	// A group's position is forgotten once it has been idle for the ttl
+	out = nil
+	idle := compile(t, `{"type":"sample","every":3,"group_by":["sensor"],"ttl":"1m"}`)
+	runAt(t, idle, base, `{"sensor":"a","i":0}`, collect)
+	runAt(t, idle, base.Add(30*time.Second), `{"sensor":"a","i":1}`, collect)
+	require.NoError(t, idle.Advance(base.Add(2*time.Minute), collect))
+	runAt(t, idle, base.Add(2*time.Minute), `{"sensor":"a","i":2}`, collect)
+	runAt(t, idle, base.Add(4*time.Minute), `{"sensor":"a","i":3}`, collect)
+	require.Len(t, out, 3)
+	assert.Equal(t, float64(3), out[2].Value["i"])
+
+	// Messages of groups beyond the state's bounds are sampled, not lost
+	out = nil
+	crowded := compile(t, `{"type":"sample","every":1000,"group_by":["id"]}`)
+	for i := 0; i < 100000; i++ {
+		runAt(t, crowded, base, fmt.Sprintf(`{"id":%d}`, i), func(*processor.Message) {})
+	}
+	err = crowded.Run(&processor.Message{StreamID: "in", Format: codec.JSON, Time: base, Value: map[string]interface{}{"id": "new"}}, collect)
+	assert.Error(t, err)
+	require.Len(t, out, 1)
+
+	for _, stage := range []string{
+		`{"type":"sample","rate":0.5,"ttl":"1m"}`,
+		`{"type":"sample","every":2,"ttl":"-1m"}`,
+		`{"type":"sample"}`,
+		`{"type":"sample","rate":0.5,"every":2}`,
+		`{"type":"sample","rate":1.5}`,
+		`{"type":"sample","every":-1}`,
+		`{"type":"sample","rate":0.5,"group_by":["a"]}`,
+	} {
+		_, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(stage)}})
+		assert.Error(t, err, stage)
+	}
+}
+
+// TestDownsample tests keeping one message per interval
+func TestDownsample(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var out []*processor.Message
+	collect := func(m *processor.Message) { out = append(out, m) }
+	feed := func(p *processor.Pipeline) {
+		for i := 0; i < 25; i++ {
+			runAt(t, p, base.Add(time.Duration(i)*10*time.Millisecond), fmt.Sprintf(`{"sensor":"a","i":%d,"v":%d}`, i, i*2), collect)
+		}
+	}
+
+	first := compile(t, `{"type":"downsample","interval":"100ms","keep":"first"}`)
+	feed(first)
+	require.Len(t, out, 3)
+	assert.Equal(t, float64(10), out[1].Value["i"])
+	assert.Equal(t, float64(20), out[2].Value["i"])
+
+	// last and avg emit once the interval ends
+	out = nil
+	last := compile(t, `{"type":"downsample","interval":"100ms","group_by":["sensor"]}`)
+	feed(last)
+	require.Len(t, out, 2)
+	assert.Equal(t, float64(9), out[0].Value["i"])
+	assert.Equal(t, float64(19), out[1].Value["i"])
+	out = nil
+	require.NoError(t, last.Advance(base.Add(300*time.Millisecond), collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, float64(24), out[0].Value["i"])
+
+	out = nil
+	avg := compile(t, `{"type":"downsample","interval":"100ms","keep":"avg","fields":["v"],"stream":"slow"}`)
+	feed(avg)
+	require.Len(t, out, 27)
+	var downsampled []*processor.Message
+	for _, m := range out {
+		if m.StreamID == "slow" {
+			downsampled = append(downsampled, m)
+		}
+	}
+	require.Len(t, downsampled, 2)
+	assert.Equal(t, float64(9), downsampled[0].Value["v"])
+	assert.Equal(t, float64(9), downsampled[0].Value["i"])
+	assert.Equal(t, float64(29), downsampled[1].Value["v"])
+
+	// The open interval survives a restore
+	state, err := avg.Snapshot()
+	require.NoError(t, err)
+	restored := compile(t, `{"type":"downsample","interval":"100ms","keep":"avg","fields":["v"],"stream":"slow"}`)
+	require.NoError(t, restored.Restore(state))
+	out = nil
+	require.NoError(t, restored.Flush(collect))
+	require.Len(t, out, 1)
+	assert.Equal(t, "slow", out[0].StreamID)
+	assert.Equal(t, float64(44), out[0].Value["v"])
+
+	for _, stage := range []string{
+		`{"type":"downsample"}`,
+		`{"type":"downsample","interval":"1s","keep":"median"}`,
+		`{"type":"downsample","interval":"1s","keep":"avg"}`,
+		`{"type":"downsample","interval":"1s","fields":["v"]}`,
+	} {
+		_, err := processor.Compile(models.PipelineConfig{Stages: []json.RawMessage{json.RawMessage(stage)}})
+		assert.Error(t, err, stage)
+	}
+}
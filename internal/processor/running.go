@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// runningStage keeps aggregates per group over every message seen so far,
+// and sets their current values on each message. A group's state expires
+// when it sees no message for ttl; without ttl it is kept until the
+// pipeline is replaced.
+//
+//	{"type": "running", "group_by": ["user"], "ttl": "24h",
+//	 "aggregates": {"total": {"op": "sum", "field": "amount"}}}
+type runningStage struct {
+	groupBy    []fieldPath
+	aggregates []aggregate
+	state      *StateStore
+}
+
+func newRunningStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		GroupBy    []string                       `json:"group_by"`
+		Aggregates map[string]aggregateDefinition `json:"aggregates"`
+		TTL        Duration                       `json:"ttl"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+
+	s := &runningStage{state: NewStateStore(time.Duration(def.TTL))}
+	var err error
+	if s.groupBy, err = parseFieldPaths(def.GroupBy); err != nil {
+		return nil, err
+	}
+	if s.aggregates, err = compileAggregates(def.Aggregates); err != nil {
+		return nil, err
+	}
+	for _, agg := range s.aggregates {
+		if agg.op == "percentile" {
+			// Samples would be kept per group for as long as the group lives
+			return nil, errors.New("percentile is not supported by running aggregates")
+		}
+	}
+	return s, nil
+}
+
+func (s *runningStage) Process(msg *Message, emit Emit) error {
+	// State that expired since the last Advance must not be added to
+	s.state.Expire(msg.Time, nil)
+	_, encodedKey, err := groupKey(s.groupBy, msg.Value)
+	if err != nil {
+		return err
+	}
+	var accumulators []accumulator
+	if v, ok := s.state.Get(encodedKey); ok {
+		accumulators = v.([]accumulator)
+	} else {
+		accumulators = make([]accumulator, len(s.aggregates))
+	}
+	for i, agg := range s.aggregates {
+		accumulators[i].add(agg, msg.Value)
+	}
+	if err := s.state.Put(encodedKey, accumulators, msg.Time); err != nil {
+		return err
+	}
+	for i, agg := range s.aggregates {
+		if err := agg.name.set(msg.Value, accumulators[i].result(agg)); err != nil {
+			return err
+		}
+	}
+	emit(msg)
+	return nil
+}
+
+// Advance expires the state of groups idle for longer than the TTL
+func (s *runningStage) Advance(now time.Time, emit Emit) error {
+	s.state.Expire(now, nil)
+	return nil
+}
+
+// Flush does nothing: running aggregates hold no messages back
+func (s *runningStage) Flush(emit Emit) error {
+	return nil
+}
+
+// Snapshot encodes the aggregates of every group
+func (s *runningStage) Snapshot() (json.RawMessage, error) {
+	return s.state.Snapshot(func(v interface{}) interface{} {
+		return snapshotAccumulators(v.([]accumulator))
+	})
+}
+
+// Restore replaces the aggregates with a snapshot
+func (s *runningStage) Restore(state json.RawMessage) error {
+	return s.state.Restore(state, func(raw json.RawMessage) (interface{}, error) {
+		var states []accumulatorState
+		if err := json.Unmarshal(raw, &states); err != nil {
+			return nil, err
+		}
+		return restoreAccumulators(states, s.aggregates)
+	})
+}
@@ -0,0 +1,382 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+// defaultSampleTTL is how long a group's position within its every messages
+// is kept without messages when the stage sets no ttl
+const defaultSampleTTL = time.Hour
+
+// sampleStage passes a fraction of the messages: each with probability
+// rate, or the first of every every messages of each group. Messages not
+// sampled are dropped, unless stream is set: then the sample is delivered
+// to that stream and every message passes through unchanged. A group's
+// position is forgotten after ttl without messages, so that its next
+// message is sampled.
+//
+//	{"type": "sample", "rate": 0.01}
+//	{"type": "sample", "every": 100, "group_by": ["sensor"], "ttl": "10m", "stream": "<stream_id>"}
+type sampleStage struct {
+	rate    float64
+	every   int64
+	groupBy []fieldPath
+	stream  string
+	// counts holds the messages seen per group when sampling every nth
+	counts *StateStore
+	random *rand.Rand
+}
+
+func newSampleStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Rate    float64  `json:"rate"`
+		Every   int64    `json:"every"`
+		GroupBy []string `json:"group_by"`
+		TTL     Duration `json:"ttl"`
+		Stream  string   `json:"stream"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if (def.Rate != 0) == (def.Every != 0) {
+		return nil, errors.New("exactly one of rate and every is required")
+	}
+	if def.Rate < 0 || def.Rate > 1 {
+		return nil, errors.New("rate must be between 0 and 1")
+	}
+	if def.Every < 0 {
+		return nil, errors.New("every must be positive")
+	}
+	if def.Rate != 0 && (len(def.GroupBy) > 0 || def.TTL != 0) {
+		return nil, errors.New("group_by and ttl need every")
+	}
+	if def.TTL < 0 {
+		return nil, errors.New("ttl must not be negative")
+	}
+	if def.TTL == 0 {
+		def.TTL = Duration(defaultSampleTTL)
+	}
+
+	s := &sampleStage{
+		rate:   def.Rate,
+		every:  def.Every,
+		stream: def.Stream,
+		counts: NewStateStore(time.Duration(def.TTL)),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	var err error
+	if s.groupBy, err = parseFieldPaths(def.GroupBy); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// routes returns the stream the sample is delivered to
+func (s *sampleStage) routes() []string {
+	if s.stream == "" {
+		return nil
+	}
+	return []string{s.stream}
+}
+
+func (s *sampleStage) Process(msg *Message, emit Emit) error {
+	keep, err := s.keep(msg)
+	if err != nil && err != errTooManyKeys {
+		return err
+	}
+	if s.stream == "" {
+		if keep {
+			emit(msg)
+		}
+		return err
+	}
+	if keep {
+		emit(&Message{StreamID: s.stream, Format: msg.Format, Time: msg.Time, Value: cloneValue(msg.Value).(map[string]interface{})})
+	}
+	emit(msg)
+	return err
+}
+
+// keep decides whether a message is part of the sample. A message of a
+// group that cannot be counted is sampled, since dropping it could lose
+// data, and counted as failed.
+func (s *sampleStage) keep(msg *Message) (bool, error) {
+	if s.rate != 0 {
+		return s.random.Float64() < s.rate, nil
+	}
+	// Positions that expired since the last Advance must not be counted on
+	s.counts.Expire(msg.Time, nil)
+	_, encodedKey, err := groupKey(s.groupBy, msg.Value)
+	if err != nil {
+		return false, err
+	}
+	var seen int64
+	if v, ok := s.counts.Get(encodedKey); ok {
+		seen = v.(int64)
+	}
+	if err := s.counts.Put(encodedKey, (seen+1)%s.every, msg.Time); err != nil {
+		return true, err
+	}
+	return seen == 0, nil
+}
+
+// Advance forgets the positions of groups idle for longer than the TTL
+func (s *sampleStage) Advance(now time.Time, emit Emit) error {
+	s.counts.Expire(now, nil)
+	return nil
+}
+
+// Flush does nothing: sample holds no messages back
+func (s *sampleStage) Flush(emit Emit) error {
+	return nil
+}
+
+// Snapshot encodes the position of each group within its every messages
+func (s *sampleStage) Snapshot() (json.RawMessage, error) {
+	return s.counts.Snapshot(func(v interface{}) interface{} { return v })
+}
+
+// Restore replaces the group positions with a snapshot
+func (s *sampleStage) Restore(state json.RawMessage) error {
+	return s.counts.Restore(state, func(raw json.RawMessage) (interface{}, error) {
+		var seen int64
+		if err := json.Unmarshal(raw, &seen); err != nil {
+			return nil, err
+		}
+		if s.every == 0 || seen < 0 || seen >= s.every {
+			return nil, fmt.Errorf("position %d is out of range", seen)
+		}
+		return seen, nil
+	})
+}
+
+// downsampleStage reduces each group to one message per interval of time,
+// keeping the first message of the interval, the last one, or the last one
+// with the fields listed in fields replaced by their average over the
+// interval. first passes messages as they arrive; last and avg emit when
+// the interval ends. Messages of an interval before the group's current one
+// are dropped. As with sample, stream delivers the downsampled messages to
+// another stream and lets every message through.
+//
+//	{"type": "downsample", "interval": "100ms", "keep": "avg",
+//	 "fields": ["value"], "group_by": ["sensor"]}
+type downsampleStage struct {
+	interval   time.Duration
+	keep       string
+	groupBy    []fieldPath
+	aggregates []aggregate
+	stream     string
+	// groups holds a *downsampleGroup per group, expiring when its
+	// interval ends
+	groups *StateStore
+}
+
+// downsampleGroup is the current interval of a group
+type downsampleGroup struct {
+	start time.Time
+	// msg is the latest message of the interval, kept for last and avg
+	msg          *Message
+	accumulators []accumulator
+}
+
+func newDownsampleStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Interval Duration `json:"interval"`
+		Keep     string   `json:"keep"`
+		Fields   []string `json:"fields"`
+		GroupBy  []string `json:"group_by"`
+		Stream   string   `json:"stream"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.Interval <= 0 {
+		return nil, errors.New("interval must be a positive duration")
+	}
+
+	s := &downsampleStage{
+		interval: time.Duration(def.Interval),
+		keep:     def.Keep,
+		stream:   def.Stream,
+		groups:   NewStateStore(time.Duration(def.Interval)),
+	}
+	switch s.keep {
+	case "":
+		s.keep = "last"
+	case "first", "last":
+	case "avg":
+		if len(def.Fields) == 0 {
+			return nil, errors.New("fields is required when keep is avg")
+		}
+	default:
+		return nil, fmt.Errorf("unknown keep %q", def.Keep)
+	}
+	if len(def.Fields) > 0 && s.keep != "avg" {
+		return nil, errors.New("fields needs keep to be avg")
+	}
+
+	var err error
+	if s.groupBy, err = parseFieldPaths(def.GroupBy); err != nil {
+		return nil, err
+	}
+	for _, field := range def.Fields {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		s.aggregates = append(s.aggregates, aggregate{name: path, op: "avg", field: path})
+	}
+	return s, nil
+}
+
+// routes returns the stream downsampled messages are delivered to
+func (s *downsampleStage) routes() []string {
+	if s.stream == "" {
+		return nil
+	}
+	return []string{s.stream}
+}
+
+func (s *downsampleStage) Process(msg *Message, emit Emit) error {
+	_, encodedKey, err := groupKey(s.groupBy, msg.Value)
+	if err != nil {
+		return err
+	}
+	start := msg.Time.Truncate(s.interval)
+
+	var g *downsampleGroup
+	if v, ok := s.groups.Get(encodedKey); ok {
+		g = v.(*downsampleGroup)
+	}
+	switch {
+	case g != nil && g.start.After(start):
+		// An interval this group has moved past
+	case g != nil && g.start.Equal(start):
+		if s.keep != "first" {
+			s.add(g, msg)
+		}
+	default:
+		if g != nil && s.keep != "first" {
+			emit(s.result(g))
+		}
+		g = &downsampleGroup{start: start}
+		if s.keep == "first" {
+			emit(s.held(msg))
+		} else {
+			g.accumulators = make([]accumulator, len(s.aggregates))
+			s.add(g, msg)
+		}
+		if err := s.groups.Put(encodedKey, g, start); err != nil {
+			return err
+		}
+	}
+
+	if s.stream != "" {
+		emit(msg)
+	}
+	return nil
+}
+
+// add accumulates a message into its group's interval
+func (s *downsampleStage) add(g *downsampleGroup, msg *Message) {
+	for i, agg := range s.aggregates {
+		g.accumulators[i].add(agg, msg.Value)
+	}
+	if g.msg == nil || !msg.Time.Before(g.msg.Time) {
+		g.msg = s.held(msg)
+	}
+}
+
+// held returns the message to keep for the downsampled output, a copy when
+// the message itself passes on
+func (s *downsampleStage) held(msg *Message) *Message {
+	if s.stream == "" {
+		return msg
+	}
+	return &Message{StreamID: s.stream, Format: msg.Format, Time: msg.Time, Value: cloneValue(msg.Value).(map[string]interface{})}
+}
+
+// result returns the message a group's interval is reduced to
+func (s *downsampleStage) result(g *downsampleGroup) *Message {
+	for i, agg := range s.aggregates {
+		// Fields no message of the interval had are left as they are
+		if v := g.accumulators[i].result(agg); v != nil {
+			agg.name.set(g.msg.Value, v)
+		}
+	}
+	return g.msg
+}
+
+// Advance emits the groups whose interval ended at or before now
+func (s *downsampleStage) Advance(now time.Time, emit Emit) error {
+	s.groups.Expire(now, func(key string, v interface{}) {
+		if g := v.(*downsampleGroup); g.msg != nil {
+			emit(s.result(g))
+		}
+	})
+	return nil
+}
+
+// Flush emits the groups of intervals that have not ended yet
+func (s *downsampleStage) Flush(emit Emit) error {
+	s.groups.Each(func(key string, v interface{}) {
+		if g := v.(*downsampleGroup); g.msg != nil {
+			emit(s.result(g))
+		}
+	})
+	s.groups.Clear()
+	return nil
+}
+
+// downsampleState is the snapshot of a group's interval
+type downsampleState struct {
+	Start        time.Time              `json:"start"`
+	Stream       string                 `json:"stream,omitempty"`
+	Format       codec.Format           `json:"format,omitempty"`
+	Time         time.Time              `json:"time"`
+	Value        map[string]interface{} `json:"value,omitempty"`
+	Accumulators []accumulatorState     `json:"accumulators,omitempty"`
+}
+
+// Snapshot encodes the current interval of every group
+func (s *downsampleStage) Snapshot() (json.RawMessage, error) {
+	return s.groups.Snapshot(func(v interface{}) interface{} {
+		g := v.(*downsampleGroup)
+		state := downsampleState{Start: g.start, Accumulators: snapshotAccumulators(g.accumulators)}
+		if g.msg != nil {
+			state.Stream, state.Format, state.Time, state.Value = g.msg.StreamID, g.msg.Format, g.msg.Time, g.msg.Value
+		}
+		return state
+	})
+}
+
+// Restore replaces the groups' intervals with a snapshot
+func (s *downsampleStage) Restore(state json.RawMessage) error {
+	return s.groups.Restore(state, func(raw json.RawMessage) (interface{}, error) {
+		var st downsampleState
+		if err := decodeState(raw, &st); err != nil {
+			return nil, err
+		}
+		g := &downsampleGroup{start: st.Start}
+		if s.keep == "first" {
+			return g, nil
+		}
+		if st.Value == nil {
+			return nil, errors.New("state has no message")
+		}
+		g.msg = &Message{StreamID: st.Stream, Format: st.Format, Time: st.Time, Value: st.Value}
+		var err error
+		if g.accumulators, err = restoreAccumulators(st.Accumulators, s.aggregates); err != nil {
+			return nil, err
+		}
+		return g, nil
+	})
+}
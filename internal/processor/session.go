@@ -0,0 +1,253 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+// sessionStage aggregates messages per group over sessions: a session
+// lasts while its messages are less than gap apart, and closes once gap
+// passes after its last message. Each group has one open session. Results
+// are emitted like those of windows, with window_end being the last
+// message's time plus gap. A message more than gap before the start of
+// its group's open session is counted as late and not aggregated.
+//
+//	{"type": "session", "gap": "30m", "group_by": ["user"],
+//	 "aggregates": {"clicks": {"op": "count"}}}
+type sessionStage struct {
+	gap        time.Duration
+	groupBy    []fieldPath
+	aggregates []aggregate
+	stream     string
+
+	// sessions holds the open session of each group, expiring gap after
+	// its last message
+	sessions *StateStore
+	source   string
+	format   codec.Format
+}
+
+// session is the open session of a group
+type session struct {
+	start, last  time.Time
+	key          []interface{}
+	accumulators []accumulator
+}
+
+func newSessionStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Gap        Duration                       `json:"gap"`
+		GroupBy    []string                       `json:"group_by"`
+		Aggregates map[string]aggregateDefinition `json:"aggregates"`
+		Stream     string                         `json:"stream"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.Gap <= 0 {
+		return nil, errors.New("gap must be a positive duration")
+	}
+
+	s := &sessionStage{
+		gap:      time.Duration(def.Gap),
+		stream:   def.Stream,
+		sessions: NewStateStore(time.Duration(def.Gap)),
+		format:   codec.JSON,
+	}
+	var err error
+	if s.groupBy, err = parseFieldPaths(def.GroupBy); err != nil {
+		return nil, err
+	}
+	if s.aggregates, err = compileAggregates(def.Aggregates); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// routes returns the derived stream results are delivered to
+func (s *sessionStage) routes() []string {
+	if s.stream == "" {
+		return nil
+	}
+	return []string{s.stream}
+}
+
+func (s *sessionStage) Process(msg *Message, emit Emit) error {
+	s.source, s.format = msg.StreamID, msg.Format
+	key, encodedKey, err := groupKey(s.groupBy, msg.Value)
+	if err != nil {
+		return err
+	}
+
+	t := msg.Time
+	var current *session
+	if v, ok := s.sessions.Get(encodedKey); ok {
+		current = v.(*session)
+		switch {
+		case !t.Before(current.last.Add(s.gap)):
+			// The session ended before this message; the store has not
+			// expired it yet
+			s.sessions.Delete(encodedKey)
+			s.emitSessions([]*session{current}, emit)
+			current = nil
+		case t.Before(current.start.Add(-s.gap)):
+			metrics.PipelineLateMessages.WithLabelValues(msg.StreamID).Inc()
+			s.pass(msg, emit)
+			return nil
+		}
+	}
+	if current == nil {
+		current = &session{start: t, last: t, key: key, accumulators: make([]accumulator, len(s.aggregates))}
+	}
+	if t.Before(current.start) {
+		current.start = t
+	}
+	if t.After(current.last) {
+		current.last = t
+	}
+	for i, agg := range s.aggregates {
+		current.accumulators[i].add(agg, msg.Value)
+	}
+	if err := s.sessions.Put(encodedKey, current, t); err != nil {
+		return err
+	}
+	s.pass(msg, emit)
+	return nil
+}
+
+// pass emits a message when results go to another stream
+func (s *sessionStage) pass(msg *Message, emit Emit) {
+	if s.stream != "" {
+		emit(msg)
+	}
+}
+
+// span returns how long a session stays open after its last message
+func (s *sessionStage) span() time.Duration {
+	return s.gap
+}
+
+// Advance emits the sessions that ended at or before now
+func (s *sessionStage) Advance(now time.Time, emit Emit) error {
+	var ended []*session
+	s.sessions.Expire(now, func(_ string, v interface{}) {
+		ended = append(ended, v.(*session))
+	})
+	s.emitSessions(ended, emit)
+	return nil
+}
+
+// Flush emits the partial results of every open session
+func (s *sessionStage) Flush(emit Emit) error {
+	var open []*session
+	s.sessions.Each(func(_ string, v interface{}) {
+		open = append(open, v.(*session))
+	})
+	s.sessions.Clear()
+	s.emitSessions(open, emit)
+	return nil
+}
+
+// emitSessions emits results ordered by start and then by group key
+func (s *sessionStage) emitSessions(sessions []*session, emit Emit) {
+	keys := make([]string, len(sessions))
+	for i, sess := range sessions {
+		encoded, _ := json.Marshal(sess.key)
+		keys[i] = string(encoded)
+	}
+	order := make([]int, len(sessions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := sessions[order[i]], sessions[order[j]]
+		if !a.start.Equal(b.start) {
+			return a.start.Before(b.start)
+		}
+		return keys[order[i]] < keys[order[j]]
+	})
+
+	target := s.stream
+	if target == "" {
+		target = s.source
+	}
+	for _, i := range order {
+		sess := sessions[i]
+		end := sess.last.Add(s.gap)
+		v := map[string]interface{}{
+			"window_start": sess.start.UTC().Format(time.RFC3339Nano),
+			"window_end":   end.UTC().Format(time.RFC3339Nano),
+		}
+		setAggregates(v, s.groupBy, sess.key, s.aggregates, sess.accumulators)
+		emit(&Message{StreamID: target, Format: s.format, Time: end, Value: v})
+	}
+}
+
+// sessionState is the snapshot of a session
+type sessionState struct {
+	Start        time.Time          `json:"start"`
+	Last         time.Time          `json:"last"`
+	Key          []interface{}      `json:"key"`
+	Accumulators []accumulatorState `json:"accumulators"`
+}
+
+// sessionSnapshot is the snapshot of a session stage
+type sessionSnapshot struct {
+	Source   string          `json:"source"`
+	Format   codec.Format    `json:"format"`
+	Sessions json.RawMessage `json:"sessions"`
+}
+
+// Snapshot encodes the open sessions
+func (s *sessionStage) Snapshot() (json.RawMessage, error) {
+	sessions, err := s.sessions.Snapshot(func(v interface{}) interface{} {
+		sess := v.(*session)
+		return sessionState{Start: sess.start, Last: sess.last, Key: sess.key, Accumulators: snapshotAccumulators(sess.accumulators)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sessionSnapshot{Source: s.source, Format: s.format, Sessions: sessions})
+}
+
+// Restore replaces the open sessions with a snapshot
+func (s *sessionStage) Restore(state json.RawMessage) error {
+	var snapshot sessionSnapshot
+	if err := json.Unmarshal(state, &snapshot); err != nil {
+		return err
+	}
+	err := s.sessions.Restore(snapshot.Sessions, func(raw json.RawMessage) (interface{}, error) {
+		var st sessionState
+		if err := decodeState(raw, &st); err != nil {
+			return nil, err
+		}
+		if len(st.Key) != len(s.groupBy) {
+			return nil, errors.New("session key does not match group_by")
+		}
+		accumulators, err := restoreAccumulators(st.Accumulators, s.aggregates)
+		if err != nil {
+			return nil, err
+		}
+		return &session{start: st.Start, last: st.Last, key: st.Key, accumulators: accumulators}, nil
+	})
+	if err != nil {
+		return err
+	}
+	s.source, s.format = snapshot.Source, snapshot.Format
+	return nil
+}
+
+// decodeState decodes a snapshot keeping numbers as json.Number, as
+// messages decode them
+func decodeState(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,339 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+)
+
+// filterStage drops messages for which its predicate is not true
+//
+//	{"type": "filter", "expr": "temperature > 30 && site == \"A\""}
+type filterStage struct {
+	expr *expr.Expr
+}
+
+func newFilterStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Expr string `json:"expr"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.Expr == "" {
+		return nil, errors.New("expr is required")
+	}
+	e, err := expr.Compile(def.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return &filterStage{expr: e}, nil
+}
+
+func (s *filterStage) Process(msg *Message, emit Emit) error {
+	ok, err := s.expr.Match(msg.Value)
+	if err != nil {
+		return err
+	}
+	if ok {
+		emit(msg)
+	}
+	return nil
+}
+
+// computedField is a field set from an expression
+type computedField struct {
+	path fieldPath
+	expr *expr.Expr
+}
+
+// mapStage sets fields to the result of expressions. Every expression sees
+// the message as it entered the stage.
+//
+//	{"type": "map", "fields": {"reading.celsius": "temperature"}}
+type mapStage struct {
+	fields []computedField
+}
+
+func newMapStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Fields map[string]string `json:"fields"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if len(def.Fields) == 0 {
+		return nil, errors.New("fields is required")
+	}
+	s := &mapStage{}
+	for _, field := range sortedFields(def.Fields) {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		e, err := expr.Compile(def.Fields[field])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		s.fields = append(s.fields, computedField{path: path, expr: e})
+	}
+	return s, nil
+}
+
+func (s *mapStage) Process(msg *Message, emit Emit) error {
+	values := make([]interface{}, len(s.fields))
+	for i, f := range s.fields {
+		v, err := f.expr.Eval(msg.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.path, err)
+		}
+		values[i] = v
+	}
+	for i, f := range s.fields {
+		if err := f.path.set(msg.Value, values[i]); err != nil {
+			return err
+		}
+	}
+	emit(msg)
+	return nil
+}
+
+// renameStage moves fields; fields missing from a message are skipped
+//
+//	{"type": "rename", "fields": {"temp": "temperature"}}
+type renameStage struct {
+	from, to []fieldPath
+}
+
+func newRenameStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Fields map[string]string `json:"fields"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if len(def.Fields) == 0 {
+		return nil, errors.New("fields is required")
+	}
+	s := &renameStage{}
+	for _, field := range sortedFields(def.Fields) {
+		from, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseFieldPath(def.Fields[field])
+		if err != nil {
+			return nil, err
+		}
+		s.from = append(s.from, from)
+		s.to = append(s.to, to)
+	}
+	return s, nil
+}
+
+func (s *renameStage) Process(msg *Message, emit Emit) error {
+	for i, from := range s.from {
+		v, ok := from.remove(msg.Value)
+		if !ok {
+			continue
+		}
+		if err := s.to[i].set(msg.Value, v); err != nil {
+			return err
+		}
+	}
+	emit(msg)
+	return nil
+}
+
+// dropFieldsStage removes fields
+//
+//	{"type": "drop-fields", "fields": ["debug", "raw.samples"]}
+type dropFieldsStage struct {
+	fields []fieldPath
+}
+
+func newDropFieldsStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Fields []string `json:"fields"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if len(def.Fields) == 0 {
+		return nil, errors.New("fields is required")
+	}
+	s := &dropFieldsStage{}
+	for _, field := range def.Fields {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		s.fields = append(s.fields, path)
+	}
+	return s, nil
+}
+
+func (s *dropFieldsStage) Process(msg *Message, emit Emit) error {
+	for _, path := range s.fields {
+		path.remove(msg.Value)
+	}
+	emit(msg)
+	return nil
+}
+
+// enrichStage adds constant fields and the processing time. Fields already
+// present in a message are kept unless overwrite is set.
+//
+//	{"type": "enrich", "fields": {"region": "eu-west"}, "timestamp": "processed_at"}
+type enrichStage struct {
+	fields    []fieldPath
+	values    []interface{}
+	timestamp fieldPath
+	overwrite bool
+	now       func() time.Time
+}
+
+func newEnrichStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Fields    map[string]json.RawMessage `json:"fields"`
+		Timestamp string                     `json:"timestamp"`
+		Overwrite bool                       `json:"overwrite"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if len(def.Fields) == 0 && def.Timestamp == "" {
+		return nil, errors.New("fields or timestamp is required")
+	}
+	s := &enrichStage{overwrite: def.Overwrite, now: time.Now}
+	keys := make([]string, 0, len(def.Fields))
+	for field := range def.Fields {
+		keys = append(keys, field)
+	}
+	sort.Strings(keys)
+	for _, field := range keys {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal(def.Fields[field], &v); err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+		s.fields = append(s.fields, path)
+		s.values = append(s.values, v)
+	}
+	if def.Timestamp != "" {
+		path, err := parseFieldPath(def.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		s.timestamp = path
+	}
+	return s, nil
+}
+
+func (s *enrichStage) Process(msg *Message, emit Emit) error {
+	for i, path := range s.fields {
+		// Constants are copied so that messages never share mutable values
+		if err := s.add(msg, path, cloneValue(s.values[i])); err != nil {
+			return err
+		}
+	}
+	if s.timestamp != nil {
+		if err := s.add(msg, s.timestamp, s.now().UTC().Format(time.RFC3339Nano)); err != nil {
+			return err
+		}
+	}
+	emit(msg)
+	return nil
+}
+
+func (s *enrichStage) add(msg *Message, path fieldPath, v interface{}) error {
+	if !s.overwrite {
+		if _, ok := path.get(msg.Value); ok {
+			return nil
+		}
+	}
+	return path.set(msg.Value, v)
+}
+
+// routeStage delivers messages to another stream, optionally only those
+// matching a predicate. With copy set, the message is also kept on its
+// current stream.
+//
+//	{"type": "route", "stream": "<stream id>", "when": "temperature > 50", "copy": true}
+type routeStage struct {
+	stream string
+	when   *expr.Expr
+	copy   bool
+}
+
+func newRouteStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Stream string `json:"stream"`
+		When   string `json:"when"`
+		Copy   bool   `json:"copy"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+	if def.Stream == "" {
+		return nil, errors.New("stream is required")
+	}
+	s := &routeStage{stream: def.Stream, copy: def.Copy}
+	if def.When != "" {
+		e, err := expr.Compile(def.When)
+		if err != nil {
+			return nil, err
+		}
+		s.when = e
+	}
+	return s, nil
+}
+
+// routes returns the stream messages are routed to
+func (s *routeStage) routes() []string {
+	return []string{s.stream}
+}
+
+func (s *routeStage) Process(msg *Message, emit Emit) error {
+	if s.when != nil {
+		ok, err := s.when.Match(msg.Value)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			emit(msg)
+			return nil
+		}
+	}
+	if s.copy {
+		clone := *msg
+		clone.Value = cloneValue(msg.Value).(map[string]interface{})
+		emit(&clone)
+	}
+	msg.StreamID = s.stream
+	emit(msg)
+	return nil
+}
+
+// sortedFields returns the keys of a field mapping in a stable order
+func sortedFields(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
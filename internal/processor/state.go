@@ -0,0 +1,178 @@
+package processor
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// maxStateKeys bounds the keys of a state store
+const maxStateKeys = 100000
+
+// errTooManyKeys is returned when a message would add a key past maxStateKeys
+var errTooManyKeys = errors.New("too many keys in state")
+
+// StateStore is the keyed state of a stage. Keys that are not written for
+// the store's TTL expire; a TTL of zero keeps them until they are deleted.
+// Times are message times, so state expires in event time in event time
+// pipelines. A store is used by one stage and is not safe for concurrent use.
+type StateStore struct {
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order holds entries by expiry, soonest first. Entries written with
+	// an earlier time than the latest may expire a little late.
+	order *list.List
+}
+
+// stateEntry is a key's value and when it expires
+type stateEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewStateStore creates an empty store
+func NewStateStore(ttl time.Duration) *StateStore {
+	return &StateStore{ttl: ttl, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// Len returns the number of keys
+func (s *StateStore) Len() int {
+	return len(s.entries)
+}
+
+// Get returns the value of a key
+func (s *StateStore) Get(key string) (interface{}, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*stateEntry).value, true
+}
+
+// Put sets the value of a key written at now, which extends its TTL
+func (s *StateStore) Put(key string, value interface{}, now time.Time) error {
+	var expires time.Time
+	if s.ttl > 0 {
+		expires = now.Add(s.ttl)
+	}
+	if e, ok := s.entries[key]; ok {
+		entry := e.Value.(*stateEntry)
+		entry.value = value
+		if expires.After(entry.expires) {
+			entry.expires = expires
+			s.order.MoveToBack(e)
+		}
+		return nil
+	}
+	if len(s.entries) >= maxStateKeys {
+		return errTooManyKeys
+	}
+	s.entries[key] = s.order.PushBack(&stateEntry{key: key, value: value, expires: expires})
+	return nil
+}
+
+// Delete removes a key
+func (s *StateStore) Delete(key string) {
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+		delete(s.entries, key)
+	}
+}
+
+// Evict removes the key that expires soonest
+func (s *StateStore) Evict() {
+	if e := s.order.Front(); e != nil {
+		s.order.Remove(e)
+		delete(s.entries, e.Value.(*stateEntry).key)
+	}
+}
+
+// Expire removes the keys that expire at or before now, calling expired,
+// when not nil, with each of them
+func (s *StateStore) Expire(now time.Time, expired func(key string, value interface{})) {
+	if s.ttl <= 0 {
+		return
+	}
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		entry := e.Value.(*stateEntry)
+		if entry.expires.After(now) {
+			return
+		}
+		s.order.Remove(e)
+		delete(s.entries, entry.key)
+		if expired != nil {
+			expired(entry.key, entry.value)
+		}
+	}
+}
+
+// Each calls f with every key and value, soonest to expire first
+func (s *StateStore) Each(f func(key string, value interface{})) {
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*stateEntry)
+		f(entry.key, entry.value)
+	}
+}
+
+// Clear removes every key
+func (s *StateStore) Clear() {
+	s.entries = make(map[string]*list.Element)
+	s.order.Init()
+}
+
+// storedEntry is the snapshot of one key
+type storedEntry struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Expires *time.Time      `json:"expires,omitempty"`
+}
+
+// Snapshot encodes every key with encode, which returns a JSON
+// encodable form of a value
+func (s *StateStore) Snapshot(encode func(value interface{}) interface{}) (json.RawMessage, error) {
+	stored := make([]storedEntry, 0, len(s.entries))
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*stateEntry)
+		value, err := json.Marshal(encode(entry.value))
+		if err != nil {
+			return nil, err
+		}
+		item := storedEntry{Key: entry.key, Value: value}
+		if !entry.expires.IsZero() {
+			expires := entry.expires
+			item.Expires = &expires
+		}
+		stored = append(stored, item)
+	}
+	return json.Marshal(stored)
+}
+
+// Restore replaces the store's keys with a snapshot, decoding values with
+// decode
+func (s *StateStore) Restore(data json.RawMessage, decode func(raw json.RawMessage) (interface{}, error)) error {
+	var stored []storedEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	if len(stored) > maxStateKeys {
+		return errTooManyKeys
+	}
+	s.Clear()
+	for _, item := range stored {
+		value, err := decode(item.Value)
+		if err != nil {
+			return err
+		}
+		entry := &stateEntry{key: item.Key, value: value}
+		if item.Expires != nil {
+			entry.expires = *item.Expires
+		}
+		if e, ok := s.entries[item.Key]; ok {
+			s.order.Remove(e)
+		}
+		s.entries[item.Key] = s.order.PushBack(entry)
+	}
+	return nil
+}
@@ -0,0 +1,576 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+const (
+	// maxWindowsPerMessage bounds size/slide of hopping windows, which is
+	// the number of windows each message is added to
+	maxWindowsPerMessage = 100
+	// maxWindowGroups bounds the groups of a single window
+	maxWindowGroups = 10000
+	// maxPercentileSamples bounds the values kept per percentile aggregate;
+	// beyond it a uniform reservoir sample is kept and percentiles are approximate
+	maxPercentileSamples = 10000
+)
+
+// errTooManyGroups is returned when a message would open a group past maxWindowGroups
+var errTooManyGroups = errors.New("too many groups in window")
+
+// Duration is a time.Duration written as a string such as "10s" or "1m"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// aggregate is a computed column of a window's results
+type aggregate struct {
+	name       fieldPath
+	op         string
+	field      fieldPath
+	percentile float64
+}
+
+// aggregateDefinition configures an aggregate:
+//
+//	{"op": "percentile", "field": "latency", "percentile": 95}
+type aggregateDefinition struct {
+	Op         string  `json:"op"`
+	Field      string  `json:"field"`
+	Percentile float64 `json:"percentile"`
+}
+
+// windowStage aggregates messages over tumbling or hopping time windows,
+// optionally per group. A window closes once time passes its end, and
+// emits one result per group. Results replace the messages they were
+// computed from, unless stream is set: then they are delivered to that
+// stream and the messages pass through unchanged. With allowed lateness,
+// a window is kept that much longer after it closes, and events still
+// added to it make it emit its updated results again.
+//
+//	{"type": "window", "size": "1m", "slide": "10s", "group_by": ["site"],
+//	 "aggregates": {"avg_temp": {"op": "avg", "field": "temperature"}}}
+type windowStage struct {
+	size, slide time.Duration
+	groupBy     []fieldPath
+	aggregates  []aggregate
+	stream      string
+	lateness    time.Duration
+
+	windows map[int64]*window
+	// closed is the time up to which windows have been emitted
+	closed time.Time
+	// updated is set when a window that was emitted has new events
+	updated bool
+	// source and format are the stream and format of the latest message,
+	// used for results that are not delivered to another stream
+	source string
+	format codec.Format
+}
+
+// window holds the groups of one window
+type window struct {
+	start, end time.Time
+	groups     map[string]*windowGroup
+	// fired is set once the results were emitted, dirty when events were
+	// added since
+	fired, dirty bool
+}
+
+// windowGroup holds the accumulators of one group of a window
+type windowGroup struct {
+	key          []interface{}
+	accumulators []accumulator
+}
+
+func newWindowStage(raw json.RawMessage) (Stage, error) {
+	var def struct {
+		stageHeader
+		Size       Duration                       `json:"size"`
+		Slide      Duration                       `json:"slide"`
+		GroupBy    []string                       `json:"group_by"`
+		Aggregates map[string]aggregateDefinition `json:"aggregates"`
+		Stream     string                         `json:"stream"`
+	}
+	if err := decodeStage(raw, &def); err != nil {
+		return nil, err
+	}
+
+	s := &windowStage{
+		size:    time.Duration(def.Size),
+		slide:   time.Duration(def.Slide),
+		stream:  def.Stream,
+		windows: make(map[int64]*window),
+		format:  codec.JSON,
+	}
+	if s.size <= 0 {
+		return nil, errors.New("size must be a positive duration")
+	}
+	if s.slide == 0 {
+		s.slide = s.size
+	}
+	if s.slide < 0 || s.slide > s.size {
+		return nil, errors.New("slide must be positive and no longer than size")
+	}
+	if s.size/s.slide > maxWindowsPerMessage {
+		return nil, fmt.Errorf("size may be at most %d times slide", maxWindowsPerMessage)
+	}
+
+	var err error
+	if s.groupBy, err = parseFieldPaths(def.GroupBy); err != nil {
+		return nil, err
+	}
+	if s.aggregates, err = compileAggregates(def.Aggregates); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseFieldPaths parses a list of field paths
+func parseFieldPaths(fields []string) ([]fieldPath, error) {
+	paths := make([]fieldPath, 0, len(fields))
+	for _, field := range fields {
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// compileAggregates validates aggregate definitions, in name order
+func compileAggregates(defs map[string]aggregateDefinition) ([]aggregate, error) {
+	if len(defs) == 0 {
+		return nil, errors.New("aggregates is required")
+	}
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	aggregates := make([]aggregate, 0, len(names))
+	for _, name := range names {
+		agg, err := compileAggregate(name, defs[name])
+		if err != nil {
+			return nil, fmt.Errorf("aggregate %s: %v", name, err)
+		}
+		aggregates = append(aggregates, agg)
+	}
+	return aggregates, nil
+}
+
+// compileAggregate validates an aggregate definition
+func compileAggregate(name string, def aggregateDefinition) (aggregate, error) {
+	path, err := parseFieldPath(name)
+	if err != nil {
+		return aggregate{}, err
+	}
+	agg := aggregate{name: path, op: def.Op, percentile: def.Percentile}
+	switch def.Op {
+	case "count":
+	case "sum", "min", "max", "avg":
+	case "percentile":
+		if def.Percentile < 0 || def.Percentile > 100 {
+			return aggregate{}, errors.New("percentile must be between 0 and 100")
+		}
+	default:
+		return aggregate{}, fmt.Errorf("unknown op %q", def.Op)
+	}
+	if def.Field == "" {
+		if def.Op != "count" {
+			return aggregate{}, errors.New("field is required")
+		}
+		return agg, nil
+	}
+	if agg.field, err = parseFieldPath(def.Field); err != nil {
+		return aggregate{}, err
+	}
+	return agg, nil
+}
+
+// routes returns the derived stream results are delivered to
+func (s *windowStage) routes() []string {
+	if s.stream == "" {
+		return nil
+	}
+	return []string{s.stream}
+}
+
+// span returns how long a message may be held in a window
+func (s *windowStage) span() time.Duration {
+	return s.size
+}
+
+// allowLateness keeps windows open for late events after they close
+func (s *windowStage) allowLateness(d time.Duration) {
+	s.lateness = d
+}
+
+// Process adds a message to its windows. Windows are closed by Advance,
+// which the pipeline calls after every message.
+func (s *windowStage) Process(msg *Message, emit Emit) error {
+	s.source, s.format = msg.StreamID, msg.Format
+
+	if err := s.add(msg); err != nil {
+		return err
+	}
+	if s.stream != "" {
+		emit(msg)
+	}
+	return nil
+}
+
+// add accumulates a message into every window containing its time
+func (s *windowStage) add(msg *Message) error {
+	key, encodedKey, err := groupKey(s.groupBy, msg.Value)
+	if err != nil {
+		return err
+	}
+
+	t := msg.Time
+	last := t.Truncate(s.slide)
+	for start := last; start.After(t.Add(-s.size)); start = start.Add(-s.slide) {
+		end := start.Add(s.size)
+		if !end.Add(s.lateness).After(s.closed) {
+			// The window was already emitted and discarded
+			continue
+		}
+		w, ok := s.windows[start.UnixNano()]
+		if !ok {
+			w = &window{start: start, end: end, groups: make(map[string]*windowGroup)}
+			s.windows[start.UnixNano()] = w
+		}
+		if !end.After(s.closed) {
+			// A late event for a window that has closed
+			w.dirty = true
+			s.updated = true
+		}
+		g, ok := w.groups[encodedKey]
+		if !ok {
+			if len(w.groups) >= maxWindowGroups {
+				return errTooManyGroups
+			}
+			g = &windowGroup{key: key, accumulators: make([]accumulator, len(s.aggregates))}
+			w.groups[encodedKey] = g
+		}
+		for i, agg := range s.aggregates {
+			g.accumulators[i].add(agg, msg.Value)
+		}
+	}
+	return nil
+}
+
+// Advance emits the results of every window that ends at or before now,
+// and again those of closed windows that received late events. Windows
+// are discarded once now passes their end plus the allowed lateness.
+func (s *windowStage) Advance(now time.Time, emit Emit) error {
+	if !now.After(s.closed) && !s.updated {
+		return nil
+	}
+	if now.After(s.closed) {
+		s.closed = now
+	}
+	s.updated = false
+
+	var due []*window
+	for start, w := range s.windows {
+		if w.end.After(s.closed) {
+			continue
+		}
+		if !w.fired || w.dirty {
+			due = append(due, w)
+			w.fired, w.dirty = true, false
+		}
+		if !w.end.Add(s.lateness).After(s.closed) {
+			delete(s.windows, start)
+		}
+	}
+	s.emitWindows(due, emit)
+	return nil
+}
+
+// Flush emits the partial results of every open window, and the updated
+// results of closed ones
+func (s *windowStage) Flush(emit Emit) error {
+	var open []*window
+	for start, w := range s.windows {
+		if !w.fired || w.dirty {
+			open = append(open, w)
+		}
+		delete(s.windows, start)
+	}
+	s.updated = false
+	s.emitWindows(open, emit)
+	return nil
+}
+
+// emitWindows emits results ordered by window and then by group key
+func (s *windowStage) emitWindows(windows []*window, emit Emit) {
+	sort.Slice(windows, func(i, j int) bool { return windows[i].start.Before(windows[j].start) })
+	target := s.stream
+	if target == "" {
+		target = s.source
+	}
+	for _, w := range windows {
+		keys := make([]string, 0, len(w.groups))
+		for k := range w.groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			emit(&Message{StreamID: target, Format: s.format, Time: w.end, Value: s.result(w, w.groups[k])})
+		}
+	}
+}
+
+// result builds the message holding a group's aggregates
+func (s *windowStage) result(w *window, g *windowGroup) map[string]interface{} {
+	v := map[string]interface{}{
+		"window_start": w.start.UTC().Format(time.RFC3339Nano),
+		"window_end":   w.end.UTC().Format(time.RFC3339Nano),
+	}
+	setAggregates(v, s.groupBy, g.key, s.aggregates, g.accumulators)
+	return v
+}
+
+// groupKey returns the values of the group_by fields of a message and
+// their encoding, which identifies the group
+func groupKey(groupBy []fieldPath, msg map[string]interface{}) ([]interface{}, string, error) {
+	key := make([]interface{}, len(groupBy))
+	for i, path := range groupBy {
+		key[i], _ = path.get(msg)
+	}
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, string(encoded), nil
+}
+
+// setAggregates sets a group's key and the results of its aggregates
+func setAggregates(v map[string]interface{}, groupBy []fieldPath, key []interface{}, aggregates []aggregate, accumulators []accumulator) {
+	for i, path := range groupBy {
+		path.set(v, key[i])
+	}
+	for i, agg := range aggregates {
+		agg.name.set(v, accumulators[i].result(agg))
+	}
+}
+
+// windowSnapshot is the snapshot of a window stage
+type windowSnapshot struct {
+	Closed  time.Time     `json:"closed"`
+	Source  string        `json:"source"`
+	Format  codec.Format  `json:"format"`
+	Windows []windowState `json:"windows"`
+}
+
+// windowState is the snapshot of a window
+type windowState struct {
+	Start  time.Time    `json:"start"`
+	Fired  bool         `json:"fired,omitempty"`
+	Dirty  bool         `json:"dirty,omitempty"`
+	Groups []groupState `json:"groups"`
+}
+
+// groupState is the snapshot of a group of a window
+type groupState struct {
+	Key          []interface{}      `json:"key"`
+	Accumulators []accumulatorState `json:"accumulators"`
+}
+
+// Snapshot encodes the open windows
+func (s *windowStage) Snapshot() (json.RawMessage, error) {
+	snapshot := windowSnapshot{Closed: s.closed, Source: s.source, Format: s.format, Windows: []windowState{}}
+	for _, w := range s.windows {
+		ws := windowState{Start: w.start, Fired: w.fired, Dirty: w.dirty}
+		for _, g := range w.groups {
+			ws.Groups = append(ws.Groups, groupState{Key: g.key, Accumulators: snapshotAccumulators(g.accumulators)})
+		}
+		snapshot.Windows = append(snapshot.Windows, ws)
+	}
+	sort.Slice(snapshot.Windows, func(i, j int) bool { return snapshot.Windows[i].Start.Before(snapshot.Windows[j].Start) })
+	return json.Marshal(snapshot)
+}
+
+// Restore replaces the open windows with a snapshot
+func (s *windowStage) Restore(state json.RawMessage) error {
+	var snapshot windowSnapshot
+	if err := decodeState(state, &snapshot); err != nil {
+		return err
+	}
+	windows := make(map[int64]*window, len(snapshot.Windows))
+	updated := false
+	for _, ws := range snapshot.Windows {
+		if len(ws.Groups) > maxWindowGroups {
+			return errTooManyGroups
+		}
+		w := &window{start: ws.Start, end: ws.Start.Add(s.size), fired: ws.Fired, dirty: ws.Dirty, groups: make(map[string]*windowGroup)}
+		for _, gs := range ws.Groups {
+			if len(gs.Key) != len(s.groupBy) {
+				return errors.New("window group key does not match group_by")
+			}
+			encoded, err := json.Marshal(gs.Key)
+			if err != nil {
+				return err
+			}
+			accumulators, err := restoreAccumulators(gs.Accumulators, s.aggregates)
+			if err != nil {
+				return err
+			}
+			w.groups[string(encoded)] = &windowGroup{key: gs.Key, accumulators: accumulators}
+		}
+		windows[ws.Start.UnixNano()] = w
+		updated = updated || ws.Dirty
+	}
+	s.windows, s.closed, s.updated = windows, snapshot.Closed, updated
+	s.source, s.format = snapshot.Source, snapshot.Format
+	return nil
+}
+
+// accumulator folds the values of one aggregate
+type accumulator struct {
+	count    int64
+	sum      float64
+	min, max float64
+	samples  []float64
+	seen     int64
+}
+
+// accumulatorState is the snapshot of an accumulator
+type accumulatorState struct {
+	Count   int64     `json:"count"`
+	Sum     float64   `json:"sum"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Samples []float64 `json:"samples,omitempty"`
+	Seen    int64     `json:"seen,omitempty"`
+}
+
+// snapshotAccumulators encodes accumulators
+func snapshotAccumulators(accumulators []accumulator) []accumulatorState {
+	states := make([]accumulatorState, len(accumulators))
+	for i, a := range accumulators {
+		states[i] = accumulatorState{Count: a.count, Sum: a.sum, Min: a.min, Max: a.max, Samples: a.samples, Seen: a.seen}
+	}
+	return states
+}
+
+// restoreAccumulators decodes accumulators, checking that they match the
+// stage's aggregates
+func restoreAccumulators(states []accumulatorState, aggregates []aggregate) ([]accumulator, error) {
+	if len(states) != len(aggregates) {
+		return nil, fmt.Errorf("state has %d aggregates, want %d", len(states), len(aggregates))
+	}
+	accumulators := make([]accumulator, len(states))
+	for i, st := range states {
+		if len(st.Samples) > maxPercentileSamples {
+			return nil, fmt.Errorf("state has more than %d samples", maxPercentileSamples)
+		}
+		accumulators[i] = accumulator{count: st.Count, sum: st.Sum, min: st.Min, max: st.Max, samples: st.Samples, seen: st.Seen}
+	}
+	return accumulators, nil
+}
+
+func (a *accumulator) add(agg aggregate, msg map[string]interface{}) {
+	if agg.field == nil {
+		a.count++
+		return
+	}
+	v, _ := agg.field.get(msg)
+	if v == nil {
+		return
+	}
+	if agg.op == "count" {
+		a.count++
+		return
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return
+	}
+	if a.count == 0 || f < a.min {
+		a.min = f
+	}
+	if a.count == 0 || f > a.max {
+		a.max = f
+	}
+	a.count++
+	a.sum += f
+
+	if agg.op == "percentile" {
+		a.seen++
+		if len(a.samples) < maxPercentileSamples {
+			a.samples = append(a.samples, f)
+		} else if i := rand.Int63n(a.seen); i < maxPercentileSamples {
+			a.samples[i] = f
+		}
+	}
+}
+
+func (a *accumulator) result(agg aggregate) interface{} {
+	if agg.op == "count" {
+		return a.count
+	}
+	if a.count == 0 {
+		return nil
+	}
+	switch agg.op {
+	case "sum":
+		return a.sum
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "avg":
+		return a.sum / float64(a.count)
+	}
+	return percentile(a.samples, agg.percentile)
+}
+
+// percentile interpolates linearly between the closest ranks
+func percentile(samples []float64, p float64) float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// toFloat converts a decoded number
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
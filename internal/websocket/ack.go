@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAckWindow is the in-flight window used when a client does not pick one
+	DefaultAckWindow = 100
+	// MaxAckWindow bounds the in-flight window a client may request
+	MaxAckWindow = 10000
+	// DefaultAckTimeout is how long a frame may stay unacknowledged before it is redelivered
+	DefaultAckTimeout = 10 * time.Second
+	// sessionTTL is how long a disconnected acknowledging client may resume
+	sessionTTL = 2 * time.Minute
+	// sessionBacklogSize bounds the messages a session holds once its send
+	// queue is full. It outlasts sessionTTL for streams of up to about 500
+	// messages a second; a session that overflows it is ended.
+	sessionBacklogSize = 64 * 1024
+)
+
+// AckOptions enables at-least-once delivery on a multiplexed connection
+type AckOptions struct {
+	// Window is the maximum number of unacknowledged frames in flight
+	Window int
+	// Timeout is how long to wait for an acknowledgement before redelivering
+	Timeout time.Duration
+}
+
+// inflightFrame is a sequenced frame waiting for its acknowledgement
+type inflightFrame struct {
+	seq    uint64
+	frame  []byte
+	sentAt time.Time
+}
+
+// ackTracker sequences frames and keeps them until the client acknowledges them
+type ackTracker struct {
+	mu       sync.Mutex
+	window   int
+	timeout  time.Duration
+	nextSeq  uint64
+	inflight []inflightFrame
+	// backlog holds messages, oldest first, that did not fit the send queue
+	backlog [][]byte
+}
+
+// newAckTracker creates a tracker, applying defaults and limits to opts
+func newAckTracker(opts AckOptions) *ackTracker {
+	if opts.Window <= 0 {
+		opts.Window = DefaultAckWindow
+	}
+	if opts.Window > MaxAckWindow {
+		opts.Window = MaxAckWindow
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultAckTimeout
+	}
+	return &ackTracker{window: opts.Window, timeout: opts.Timeout, nextSeq: 1}
+}
+
+// full reports whether the in-flight window is exhausted
+func (t *ackTracker) full() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inflight) >= t.window
+}
+
+// track assigns the next sequence number to a frame and returns the
+// sequenced frame to write. Frames are JSON objects, so the sequence
+// number is spliced in as their first member.
+func (t *ackTracker) track(frame []byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seq := t.nextSeq
+	t.nextSeq++
+
+	sequenced := make([]byte, 0, len(frame)+24)
+	sequenced = append(sequenced, `{"seq":`...)
+	sequenced = strconv.AppendUint(sequenced, seq, 10)
+	if len(frame) > 2 {
+		sequenced = append(sequenced, ',')
+	}
+	sequenced = append(sequenced, frame[1:]...)
+
+	t.inflight = append(t.inflight, inflightFrame{seq: seq, frame: sequenced, sentAt: time.Now()})
+	return sequenced
+}
+
+// ack releases every frame up to and including seq and returns how many were released
+func (t *ackTracker) ack(seq uint64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for n < len(t.inflight) && t.inflight[n].seq <= seq {
+		n++
+	}
+	t.inflight = append(t.inflight[:0:0], t.inflight[n:]...)
+	return n
+}
+
+// expired returns the frames whose acknowledgement is overdue and restarts their timers
+func (t *ackTracker) expired(now time.Time) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var frames [][]byte
+	for i := range t.inflight {
+		if now.Sub(t.inflight[i].sentAt) >= t.timeout {
+			t.inflight[i].sentAt = now
+			frames = append(frames, t.inflight[i].frame)
+		}
+	}
+	return frames
+}
+
+// pending returns every unacknowledged frame and restarts their timers
+func (t *ackTracker) pending(now time.Time) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frames := make([][]byte, len(t.inflight))
+	for i := range t.inflight {
+		t.inflight[i].sentAt = now
+		frames[i] = t.inflight[i].frame
+	}
+	return frames
+}
@@ -0,0 +1,206 @@
+package websocket_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorillaWS "github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ackFrame is the subset of a frame the acknowledgement tests look at
+type ackFrame struct {
+	Type      string          `json:"type"`
+	Seq       uint64          `json:"seq"`
+	SessionID string          `json:"session_id"`
+	Resumed   bool            `json:"resumed"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// newAckServer serves acknowledging multiplexed connections and reports
+// every client it creates or resumes
+func newAckServer(t *testing.T, hub *websocket.Hub, opts websocket.AckOptions) (*httptest.Server, chan *websocket.Client) {
+	clients := make(chan *websocket.Client, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		var client *websocket.Client
+		if id := r.URL.Query().Get("session"); id != "" {
+			if client, err = hub.Resume(id, conn); err != nil {
+				conn.Close()
+				return
+			}
+		} else {
+			client = websocket.NewMultiplexClient(hub, conn)
+			hub.StartSession(client, opts)
+		}
+		clients <- client
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, clients
+}
+
+func dialAck(t *testing.T, srv *httptest.Server, query string) *gorillaWS.Conn {
+	conn, _, err := gorillaWS.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/"+query, nil)
+	require.NoError(t, err)
+	return conn
+}
+
+func readAck(t *testing.T, conn *gorillaWS.Conn) ackFrame {
+	var f ackFrame
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	require.NoError(t, conn.ReadJSON(&f))
+	return f
+}
+
+// TestAckWindowAndResume tests that the in-flight window holds back frames
+// until they are acknowledged and that a resumed session gets back every
+// unacknowledged frame
+func TestAckWindowAndResume(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	srv, clients := newAckServer(t, hub, websocket.AckOptions{Window: 2, Timeout: time.Minute})
+	conn := dialAck(t, srv, "")
+	client := <-clients
+
+	session := readAck(t, conn)
+	assert.Equal(t, websocket.TypeSession, session.Type)
+	require.NotEmpty(t, session.SessionID)
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "stream_id": "s"}))
+	assert.Equal(t, websocket.TypeSubscribed, readAck(t, conn).Type)
+
+	for _, v := range []string{"1", "2", "3"} {
+		hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(v)})
+	}
+	hub.Flush()
+
+	first, second := readAck(t, conn), readAck(t, conn)
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.Equal(t, uint64(2), second.Seq)
+	assert.Eventually(t, func() bool { return len(client.Send) == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ack", "seq": 1}))
+	third := readAck(t, conn)
+	assert.Equal(t, uint64(3), third.Seq)
+	assert.Equal(t, "3", string(third.Data))
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return hub.CheckSession(session.SessionID) == nil }, time.Second, 10*time.Millisecond)
+
+	conn = dialAck(t, srv, "?session="+session.SessionID)
+	defer conn.Close()
+	assert.Same(t, client, <-clients)
+
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		f := readAck(t, conn)
+		if f.Type == websocket.TypeSession {
+			assert.True(t, f.Resumed)
+			continue
+		}
+		seqs = append(seqs, f.Seq)
+	}
+	assert.Equal(t, []uint64{2, 3}, seqs)
+	assert.Equal(t, websocket.ErrSessionInUse, hub.CheckSession(session.SessionID))
+}
+
+// TestAckRedelivery tests that a frame is redelivered when its acknowledgement times out
+func TestAckRedelivery(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	srv, _ := newAckServer(t, hub, websocket.AckOptions{Timeout: 50 * time.Millisecond})
+	conn := dialAck(t, srv, "")
+	defer conn.Close()
+	readAck(t, conn)
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "stream_id": "s"}))
+	readAck(t, conn)
+
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(`{"v":1}`)})
+	first, again := readAck(t, conn), readAck(t, conn)
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.Equal(t, first, again)
+	assert.JSONEq(t, `{"v":1}`, string(again.Data))
+
+	assert.Equal(t, websocket.ErrSessionNotFound, hub.CheckSession("missing"))
+}
+
+// TestResumeAfterBacklog tests that messages broadcast to a detached session
+// beyond its send queue are kept and delivered once it resumes
+func TestResumeAfterBacklog(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	srv, _ := newAckServer(t, hub, websocket.AckOptions{Timeout: time.Minute})
+	conn := dialAck(t, srv, "")
+	session := readAck(t, conn)
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "stream_id": "s"}))
+	readAck(t, conn)
+
+	conn.Close()
+	require.Eventually(t, func() bool { return hub.CheckSession(session.SessionID) == nil }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(fmt.Sprint(i))})
+	}
+	hub.Flush()
+
+	conn = dialAck(t, srv, "?session="+session.SessionID)
+	defer conn.Close()
+	for i := 0; i < 1000; i++ {
+		f := readAck(t, conn)
+		if f.Type == websocket.TypeSession {
+			assert.True(t, f.Resumed)
+			f = readAck(t, conn)
+		}
+		require.Equal(t, uint64(i+1), f.Seq)
+		require.Equal(t, fmt.Sprint(i), string(f.Data))
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ack", "seq": f.Seq}))
+	}
+}
+
+// TestSessionLost tests that a session whose backlog overflows is ended
+// with a frame telling the client
+func TestSessionLost(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	srv, _ := newAckServer(t, hub, websocket.AckOptions{Window: 1, Timeout: time.Minute})
+	conn := dialAck(t, srv, "")
+	defer conn.Close()
+	session := readAck(t, conn)
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "stream_id": "s"}))
+	readAck(t, conn)
+
+	// Nothing is acknowledged, so the send queue and then the backlog fill up
+	for i := 0; i < 70000; i++ {
+		hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(fmt.Sprint(i))})
+	}
+	hub.Flush()
+
+	assert.Equal(t, uint64(1), readAck(t, conn).Seq)
+	lost := readAck(t, conn)
+	assert.Equal(t, websocket.TypeSessionLost, lost.Type)
+	assert.Equal(t, session.SessionID, lost.SessionID)
+	_, _, err := conn.ReadMessage()
+	assert.IsType(t, &gorillaWS.CloseError{}, err)
+	assert.Equal(t, websocket.ErrSessionNotFound, hub.CheckSession(session.SessionID))
+}
@@ -0,0 +1,328 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+	// maxMessageSize bounds a single frame read from a client, which may be
+	// a control message or a published payload
+	maxMessageSize = 64 * 1024
+	// sendBufferSize is the number of messages queued per client before the
+	// stream's slow consumer policy applies
+	sendBufferSize = 256
+	// controlBufferSize is the number of control replies queued per client
+	controlBufferSize = 16
+	// maxSubscriptions bounds the streams a single connection may subscribe to
+	maxSubscriptions = 1024
+)
+
+var (
+	// ErrTooManySubscriptions is returned when a client exceeds maxSubscriptions
+	ErrTooManySubscriptions = errors.New("too many subscriptions")
+	// ErrAlreadySubscribed is returned when a client subscribes to a stream twice
+	ErrAlreadySubscribed = errors.New("already subscribed")
+	// ErrNotSubscribed is returned when a client unsubscribes from an unknown stream
+	ErrNotSubscribed = errors.New("not subscribed")
+)
+
+var upgrader = newUpgrader(config)
+
+// Client represents a WebSocket client. A client created with NewClient is
+// bound to a single stream and receives raw payloads; a multiplexed client
+// manages its subscriptions with control messages and receives every
+// payload wrapped in a frame tagged with its stream. An ingest client
+// publishes into a stream instead of receiving from one.
+type Client struct {
+	Hub         *Hub
+	StreamID    string
+	Conn        *websocket.Conn
+	Send        chan []byte
+	Multiplexed bool
+	// SessionID identifies an acknowledging client so that it can resume
+	SessionID string
+	// Publisher receives the messages the client publishes; publishing is
+	// refused when it is nil
+	Publisher Publisher
+
+	control       chan []byte
+	dropped       uint64
+	done          chan struct{}
+	closeOnce     sync.Once
+	mu            sync.Mutex
+	subscriptions map[string]bool
+	// ingest clients publish every frame they send; published counts them
+	ingest    bool
+	published uint64
+	writeOpts WriteOptions
+	// format is the encoding the client sends and receives payloads in
+	format codec.Format
+
+	// ack is set for clients that acknowledge frames; acked wakes the
+	// write pump when the in-flight window opens up again
+	ack   *ackTracker
+	acked chan struct{}
+	// detached is closed when the current connection goes away, while the
+	// client itself may live on as a resumable session
+	detached chan struct{}
+	attached bool
+	expiry   *time.Timer
+}
+
+// NewClient creates a new Client for a stream with a buffered send queue
+func NewClient(hub *Hub, streamID string, conn *websocket.Conn) *Client {
+	c := newClient(hub, conn)
+	c.StreamID = streamID
+	return c
+}
+
+// NewMultiplexClient creates a new Client that subscribes to streams on demand
+func NewMultiplexClient(hub *Hub, conn *websocket.Conn) *Client {
+	c := newClient(hub, conn)
+	c.Multiplexed = true
+	return c
+}
+
+// newClient allocates the queues shared by every kind of client
+func newClient(hub *Hub, conn *websocket.Conn) *Client {
+	return &Client{
+		Hub:           hub,
+		Conn:          conn,
+		Send:          make(chan []byte, sendBufferSize),
+		control:       make(chan []byte, controlBufferSize),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]bool),
+		acked:         make(chan struct{}, 1),
+		detached:      make(chan struct{}),
+		attached:      true,
+		writeOpts:     DefaultWriteOptions(),
+		format:        codec.JSON,
+	}
+}
+
+// connection returns the current connection and the channel closed when it goes away
+func (c *Client) connection() (*websocket.Conn, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn, c.detached
+}
+
+// attach binds a resumed client to a new connection. It fails if the
+// client is still attached to another connection.
+func (c *Client) attach(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.attached {
+		return false
+	}
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	c.Conn = conn
+	c.detached = make(chan struct{})
+	c.attached = true
+	return true
+}
+
+// detach marks the current connection as gone and reports whether it was
+// the one attached
+func (c *Client) detach(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.attached || c.Conn != conn {
+		return false
+	}
+	c.attached = false
+	close(c.detached)
+	return true
+}
+
+// Subscriptions returns the IDs of the streams the client is subscribed to
+func (c *Client) Subscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.subscriptions))
+	for id := range c.subscriptions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// addSubscription records a subscription on the client side
+func (c *Client) addSubscription(streamID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscriptions[streamID] {
+		return ErrAlreadySubscribed
+	}
+	if len(c.subscriptions) >= maxSubscriptions {
+		return ErrTooManySubscriptions
+	}
+	c.subscriptions[streamID] = true
+	return nil
+}
+
+// removeSubscription forgets a subscription on the client side
+func (c *Client) removeSubscription(streamID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.subscriptions[streamID] {
+		return ErrNotSubscribed
+	}
+	delete(c.subscriptions, streamID)
+	return nil
+}
+
+// takeSubscriptions forgets and returns every subscription
+func (c *Client) takeSubscriptions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.subscriptions))
+	for id := range c.subscriptions {
+		ids = append(ids, id)
+	}
+	c.subscriptions = make(map[string]bool)
+	return ids
+}
+
+// close signals the write pump to shut the connection down
+func (c *Client) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// closed reports whether the client has been shut down
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendControl queues a control reply, dropping it if the client is not reading
+func (c *Client) sendControl(frame []byte) {
+	select {
+	case c.control <- frame:
+	default:
+	}
+}
+
+func (c *Client) ReadPump() {
+	conn, _ := c.connection()
+	defer func() {
+		c.Hub.disconnect(c, conn)
+		conn.Close()
+	}()
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.Hub.logger.Error("Unexpected close error", "error", err)
+			}
+			break
+		}
+		c.handleControl(message)
+	}
+}
+
+func (c *Client) WritePump() {
+	conn, detached := c.connection()
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+	c.prepareConn(conn)
+
+	var redeliver <-chan time.Time
+	if c.ack != nil {
+		redeliverTicker := time.NewTicker(c.ack.timeout / 2)
+		defer redeliverTicker.Stop()
+		redeliver = redeliverTicker.C
+
+		// A resumed session first gets back everything still unacknowledged
+		for _, frame := range c.ack.pending(time.Now()) {
+			if err := writeFrame(conn, frame); err != nil {
+				return
+			}
+		}
+		c.refill()
+	}
+
+	for {
+		send := c.Send
+		if c.ack != nil && c.ack.full() {
+			send = nil
+		}
+
+		select {
+		case message := <-send:
+			if notice := c.takeDropNotice(); notice != nil {
+				if err := writeFrame(conn, notice); err != nil {
+					return
+				}
+			}
+			if c.ack != nil {
+				c.refill()
+				message = c.ack.track(message)
+			}
+			if err := c.writeData(conn, message); err != nil {
+				return
+			}
+		case frame := <-c.control:
+			if err := writeFrame(conn, frame); err != nil {
+				return
+			}
+		case <-c.acked:
+		case now := <-redeliver:
+			for _, frame := range c.ack.expired(now) {
+				metrics.WebSocketRedeliveries.Inc()
+				if err := writeFrame(conn, frame); err != nil {
+					return
+				}
+			}
+		case <-c.done:
+			// Replies queued before the shutdown, such as a lost session, go out first
+			for len(c.control) > 0 {
+				if err := writeFrame(conn, <-c.control); err != nil {
+					return
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case <-detached:
+			return
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeFrame writes a single text frame
+func writeFrame(conn *websocket.Conn, frame []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	return upgrader.Upgrade(w, r, nil)
+}
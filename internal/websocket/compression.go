@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultCompressionLevel favours speed, as most payloads are small JSON documents
+	DefaultCompressionLevel = flate.BestSpeed
+	// DefaultCompressionThreshold is the frame size below which compression rarely pays off
+	DefaultCompressionThreshold = 512
+	// DefaultBufferSize is the read and write buffer size of each connection
+	DefaultBufferSize = 4096
+)
+
+// Config tunes how connections are upgraded and how frames are written
+type Config struct {
+	// ReadBufferSize and WriteBufferSize size the I/O buffers of each
+	// connection. Write buffers are pooled between writes.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Compression offers permessage-deflate to clients that ask for it
+	Compression bool
+	// CompressionLevel is the default flate level, from -2 (Huffman only) to 9
+	CompressionLevel int
+	// CompressionThreshold is the smallest frame, in bytes, that is compressed
+	CompressionThreshold int
+}
+
+// DefaultConfig returns the configuration used when Configure is never called
+func DefaultConfig() Config {
+	return Config{
+		ReadBufferSize:       DefaultBufferSize,
+		WriteBufferSize:      DefaultBufferSize,
+		Compression:          true,
+		CompressionLevel:     DefaultCompressionLevel,
+		CompressionThreshold: DefaultCompressionThreshold,
+	}
+}
+
+// config is the active configuration; it only changes at startup
+var config = DefaultConfig()
+
+// Configure applies cfg to connections upgraded after the call. It must
+// be called before the server starts accepting connections.
+func Configure(cfg Config) error {
+	if err := validateLevel(cfg.CompressionLevel); err != nil {
+		return err
+	}
+	if cfg.ReadBufferSize <= 0 {
+		cfg.ReadBufferSize = DefaultBufferSize
+	}
+	if cfg.WriteBufferSize <= 0 {
+		cfg.WriteBufferSize = DefaultBufferSize
+	}
+	if cfg.CompressionThreshold < 0 {
+		cfg.CompressionThreshold = 0
+	}
+	config = cfg
+	upgrader = newUpgrader(cfg)
+	return nil
+}
+
+// newUpgrader builds the upgrader for a configuration
+func newUpgrader(cfg Config) websocket.Upgrader {
+	return websocket.Upgrader{
+		Subprotocols:      subprotocols(),
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		WriteBufferPool:   &sync.Pool{},
+		EnableCompression: cfg.Compression,
+	}
+}
+
+// validateLevel checks a flate compression level
+func validateLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("compression level must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+	return nil
+}
+
+// WriteOptions are the per-connection delivery settings
+type WriteOptions struct {
+	// Binary sends data frames as binary WebSocket frames
+	Binary bool
+	// Compress enables compression if the client negotiated permessage-deflate
+	Compress bool
+	// CompressionLevel is the flate level of the connection
+	CompressionLevel int
+}
+
+// DefaultWriteOptions returns the write options of a connection that does not pick its own
+func DefaultWriteOptions() WriteOptions {
+	return WriteOptions{
+		Compress:         config.Compression,
+		CompressionLevel: config.CompressionLevel,
+	}
+}
+
+// Validate checks the write options
+func (o WriteOptions) Validate() error {
+	return validateLevel(o.CompressionLevel)
+}
+
+// SetWriteOptions changes how data frames are written to the client. It
+// must be called before the client subscribes and its write pump starts.
+func (c *Client) SetWriteOptions(opts WriteOptions) {
+	c.writeOpts = opts
+}
+
+// prepareConn applies the write options to a connection
+func (c *Client) prepareConn(conn *websocket.Conn) {
+	if c.writeOpts.Compress {
+		conn.SetCompressionLevel(c.writeOpts.CompressionLevel)
+	}
+}
+
+// writeData writes a data frame. Frames reach the threshold before they are
+// compressed, and single-stream payloads that are not valid UTF-8 are sent
+// as binary frames even when the client did not ask for binary.
+func (c *Client) writeData(conn *websocket.Conn, frame []byte) error {
+	messageType := websocket.TextMessage
+	if c.writeOpts.Binary || (!c.Multiplexed && !utf8.Valid(frame)) {
+		messageType = websocket.BinaryMessage
+	}
+	conn.EnableWriteCompression(c.writeOpts.Compress && len(frame) >= config.CompressionThreshold)
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(messageType, frame)
+}
+
+// binaryFrame wraps a payload for a multiplexed binary connection: the
+// stream ID length as a big-endian uint16, the stream ID, then the payload
+func binaryFrame(streamID string, data []byte) []byte {
+	frame := make([]byte, 2+len(streamID)+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(streamID)))
+	copy(frame[2:], streamID)
+	copy(frame[2+len(streamID):], data)
+	return frame
+}
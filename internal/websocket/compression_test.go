@@ -0,0 +1,109 @@
+package websocket_test
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gorillaWS "github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialDelivery serves a client built by newClient and dials it with permessage-deflate offered
+func dialDelivery(t *testing.T, newClient func(conn *gorillaWS.Conn) *websocket.Client, subprotocols ...string) (*gorillaWS.Conn, *http.Response) {
+	registered := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		client := newClient(conn)
+		close(registered)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := gorillaWS.Dialer{EnableCompression: true, Subprotocols: subprotocols}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	<-registered
+	return conn, resp
+}
+
+func readFrame(t *testing.T, conn *gorillaWS.Conn) (int, []byte) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	return messageType, data
+}
+
+// TestCompressedTextAndBinaryFrames tests that compression is negotiated and
+// that payloads that are not UTF-8 go out as binary frames
+func TestCompressedTextAndBinaryFrames(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	conn, resp := dialDelivery(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		client := websocket.NewClient(hub, "s", conn)
+		hub.Register(client, websocket.Options{})
+		return client
+	})
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+
+	large := `{"v":"` + strings.Repeat("a", 4096) + `"}`
+	raw := []byte{0x82, 0xa1, 0x76, 0xff}
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(large)})
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: raw})
+
+	messageType, data := readFrame(t, conn)
+	assert.Equal(t, gorillaWS.TextMessage, messageType)
+	assert.Equal(t, large, string(data))
+
+	messageType, data = readFrame(t, conn)
+	assert.Equal(t, gorillaWS.BinaryMessage, messageType)
+	assert.Equal(t, raw, data)
+}
+
+// TestMultiplexedBinaryFrames tests the stream ID prefix of binary frames on a multiplexed connection
+func TestMultiplexedBinaryFrames(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("stream-1")
+
+	conn, _ := dialDelivery(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		client := websocket.NewMultiplexClient(hub, conn)
+		opts := websocket.DefaultWriteOptions()
+		opts.Binary = true
+		client.SetWriteOptions(opts)
+		return client
+	})
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "stream_id": "stream-1"}))
+	messageType, _ := readFrame(t, conn)
+	assert.Equal(t, gorillaWS.TextMessage, messageType)
+
+	hub.BroadcastMessage(websocket.Message{StreamID: "stream-1", Data: []byte(`{"v":1}`)})
+	messageType, data := readFrame(t, conn)
+	assert.Equal(t, gorillaWS.BinaryMessage, messageType)
+	n := int(binary.BigEndian.Uint16(data))
+	assert.Equal(t, "stream-1", string(data[2:2+n]))
+	assert.Equal(t, `{"v":1}`, string(data[2+n:]))
+}
+
+// TestWriteOptionsValidate tests the compression level bounds
+func TestWriteOptionsValidate(t *testing.T) {
+	opts := websocket.DefaultWriteOptions()
+	assert.NoError(t, opts.Validate())
+	opts.CompressionLevel = 10
+	assert.Error(t, opts.Validate())
+	assert.Error(t, websocket.Configure(websocket.Config{CompressionLevel: -3}))
+}
@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
+)
+
+// Options customise what a subscription delivers
+type Options struct {
+	// Filter drops messages for which the predicate is not true
+	Filter *expr.Expr
+	// Projection strips every field it does not select
+	Projection *Projection
+	// Sample delivers only a sample of the messages that pass the filter
+	Sample *Sampling
+}
+
+// delivery prepares a broadcast message for its subscribers. Work shared by
+// several subscribers, such as decoding the payload, is done at most once.
+type delivery struct {
+	message   Message
+	schemas   *schema.Registry
+	proto     *schema.Schema
+	didProto  bool
+	decoded   interface{}
+	decErr    error
+	didDec    bool
+	converted map[codec.Format][]byte
+	projected map[string][]byte
+	tagged    map[string][]byte
+}
+
+// value returns the decoded payload
+func (d *delivery) value() (interface{}, error) {
+	if !d.didDec {
+		d.didDec = true
+		d.decoded, d.decErr = d.decode(d.format(), d.message.Data)
+	}
+	return d.decoded, d.decErr
+}
+
+// protoSchema returns the latest schema of the message's stream when it is
+// a Protobuf schema, or nil
+func (d *delivery) protoSchema() *schema.Schema {
+	if !d.didProto {
+		d.didProto = true
+		if d.schemas != nil {
+			if s, err := d.schemas.Latest(d.message.StreamID); err == nil && s.Type == schema.Protobuf {
+				d.proto = s
+			}
+		}
+	}
+	return d.proto
+}
+
+// decode decodes a payload, using the stream's schema for Protobuf
+func (d *delivery) decode(f codec.Format, data []byte) (interface{}, error) {
+	if s := d.protoSchema(); f == codec.Protobuf && s != nil {
+		v, err := s.DecodeProtobuf(data)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return codec.Decode(f, data)
+}
+
+// encode encodes generic values, using the stream's schema for Protobuf
+func (d *delivery) encode(f codec.Format, v interface{}) ([]byte, error) {
+	if s := d.protoSchema(); f == codec.Protobuf && s != nil {
+		return s.EncodeProtobuf(v)
+	}
+	return codec.Encode(f, v)
+}
+
+// payloadFor returns the bytes to queue for a subscriber, or nil if the
+// subscriber's filter or sampling rejects the message or it cannot be
+// projected
+func (d *delivery) payloadFor(sub subscription) []byte {
+	if sub.opts.Filter != nil {
+		v, err := d.value()
+		if err == nil {
+			var ok bool
+			ok, err = sub.opts.Filter.Match(v)
+			if err == nil && !ok {
+				metrics.WebSocketMessagesFiltered.WithLabelValues(d.message.StreamID).Inc()
+				return nil
+			}
+		}
+		if err != nil {
+			metrics.WebSocketFilterErrors.WithLabelValues(d.message.StreamID).Inc()
+			return nil
+		}
+	}
+	if sub.sampler != nil && !sub.sampler.keep(time.Now()) {
+		metrics.WebSocketMessagesSampledOut.WithLabelValues(d.message.StreamID).Inc()
+		return nil
+	}
+
+	// Cached payloads are keyed by format and projection
+	format := sub.client.format
+	data, key := d.message.Data, string(format)
+	if p := sub.opts.Projection; p != nil {
+		projected, err := d.project(p, format)
+		if err != nil {
+			metrics.WebSocketFilterErrors.WithLabelValues(d.message.StreamID).Inc()
+			return nil
+		}
+		// Re-encoding may escape characters, so a projection can be longer
+		// than the payload; counters must not decrease
+		if saved := len(data) - len(projected); saved > 0 {
+			metrics.WebSocketProjectionBytesSaved.WithLabelValues(d.message.StreamID).Add(float64(saved))
+		}
+		data, key = projected, key+":"+p.key
+	} else if data = d.convert(format); data == nil {
+		return nil
+	}
+
+	if !sub.client.Multiplexed {
+		return data
+	}
+	// Format names never start with a NUL byte, so binary frames get their own entries
+	if sub.client.writeOpts.Binary {
+		key = "\x00" + key
+	}
+	if tagged, ok := d.tagged[key]; ok {
+		return tagged
+	}
+	if d.tagged == nil {
+		d.tagged = make(map[string][]byte)
+	}
+	if sub.client.writeOpts.Binary {
+		d.tagged[key] = binaryFrame(d.message.StreamID, data)
+	} else {
+		d.tagged[key] = tagFrame(d.message.StreamID, data)
+	}
+	return d.tagged[key]
+}
@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+// subprotocols returns the WebSocket subprotocols clients may request to
+// pick a payload format, one per format name
+func subprotocols() []string {
+	formats := codec.Formats()
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = string(f)
+	}
+	return names
+}
+
+// SubprotocolFormat returns the format selected by a negotiated
+// subprotocol, or false when none was negotiated
+func SubprotocolFormat(subprotocol string) (codec.Format, bool) {
+	if subprotocol == "" {
+		return "", false
+	}
+	f, err := codec.Parse(subprotocol)
+	return f, err == nil
+}
+
+// SetFormat sets the format the client sends and receives payloads in.
+// Binary formats are always written as binary frames. It must be called
+// before the client subscribes and its write pump starts.
+func (c *Client) SetFormat(f codec.Format) {
+	c.format = f
+	if f.Binary() {
+		c.writeOpts.Binary = true
+	}
+}
+
+// Format returns the format the client sends and receives payloads in
+func (c *Client) Format() codec.Format {
+	return c.format
+}
+
+// format returns the encoding of the broadcast payload
+func (d *delivery) format() codec.Format {
+	if d.message.Format == "" {
+		return codec.JSON
+	}
+	return d.message.Format
+}
+
+// convert returns the payload in the given format, converting it at most
+// once per format. It returns nil if the payload cannot be converted.
+func (d *delivery) convert(to codec.Format) []byte {
+	from := d.format()
+	if from == to {
+		return d.message.Data
+	}
+	if data, ok := d.converted[to]; ok {
+		return data
+	}
+
+	var data []byte
+	v, err := d.value()
+	if err == nil {
+		data, err = d.encode(to, v)
+	}
+	if err != nil {
+		metrics.PayloadConversionErrors.WithLabelValues(string(from), string(to)).Inc()
+	} else {
+		metrics.PayloadConversions.WithLabelValues(string(from), string(to)).Inc()
+	}
+
+	if d.converted == nil {
+		d.converted = make(map[codec.Format][]byte)
+	}
+	d.converted[to] = data
+	return data
+}
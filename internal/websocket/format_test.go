@@ -0,0 +1,161 @@
+package websocket_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	gorillaWS "github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// TestDeliveryFormatConversion tests that payloads are converted only for
+// subscribers whose format differs from the producer's
+func TestDeliveryFormatConversion(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	subscribe := func(format codec.Format, opts websocket.Options) *websocket.Client {
+		client := websocket.NewClient(hub, "s", nil)
+		client.SetFormat(format)
+		hub.Register(client, opts)
+		return client
+	}
+	projection, err := websocket.ParseProjection([]string{"id"})
+	require.NoError(t, err)
+
+	asMsgPack := subscribe(codec.MsgPack, websocket.Options{})
+	asJSON := subscribe(codec.JSON, websocket.Options{})
+	projected := subscribe(codec.JSON, websocket.Options{Projection: projection})
+
+	payload, err := codec.Encode(codec.MsgPack, map[string]interface{}{"id": int64(9007199254740993), "v": 1.5})
+	require.NoError(t, err)
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: payload, Format: codec.MsgPack})
+	hub.Flush()
+
+	assert.Equal(t, payload, <-asMsgPack.Send)
+	assert.JSONEq(t, `{"id":9007199254740993,"v":1.5}`, string(<-asJSON.Send))
+	assert.JSONEq(t, `{"id":9007199254740993}`, string(<-projected.Send))
+}
+
+// TestProtobufIsOpaque tests that protobuf payloads reach protobuf
+// subscribers unchanged and, without a Protobuf schema, are withheld from
+// subscribers that need a conversion
+func TestProtobufIsOpaque(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	asProtobuf := websocket.NewClient(hub, "s", nil)
+	asProtobuf.SetFormat(codec.Protobuf)
+	hub.Register(asProtobuf, websocket.Options{})
+	asJSON := websocket.NewClient(hub, "s", nil)
+	hub.Register(asJSON, websocket.Options{})
+
+	payload := []byte{0x08, 0x96, 0x01}
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: payload, Format: codec.Protobuf})
+	hub.Flush()
+
+	assert.Equal(t, payload, <-asProtobuf.Send)
+	assert.Equal(t, 0, len(asJSON.Send))
+}
+
+// TestProtobufConversion tests that protobuf payloads of a stream with a
+// Protobuf schema are converted, filtered and projected for other formats,
+// and that other formats are converted to protobuf
+func TestProtobufConversion(t *testing.T) {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(number),
+			Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: typ.Enum()}
+	}
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name: proto.String("test.proto"), Package: proto.String("test"), Syntax: proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Reading"), Field: []*descriptorpb.FieldDescriptorProto{
+			field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			field("temperature", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+		}}},
+	}}})
+	require.NoError(t, err)
+	definition, err := json.Marshal(map[string]interface{}{"descriptor_set": set, "message": "test.Reading"})
+	require.NoError(t, err)
+	schemas := schema.NewRegistry()
+	s, err := schemas.Register("s", schema.Protobuf, definition, "")
+	require.NoError(t, err)
+
+	hub := websocket.NewHub(logger.NewLogger())
+	hub.SetSchemas(schemas)
+	go hub.Run()
+	hub.CreateStream("s")
+
+	subscribe := func(format codec.Format, opts websocket.Options) *websocket.Client {
+		client := websocket.NewClient(hub, "s", nil)
+		client.SetFormat(format)
+		hub.Register(client, opts)
+		return client
+	}
+	filter, err := expr.Compile(`temperature > 30`)
+	require.NoError(t, err)
+	projection, err := websocket.ParseProjection([]string{"id"})
+	require.NoError(t, err)
+	asProtobuf := subscribe(codec.Protobuf, websocket.Options{})
+	asJSON := subscribe(codec.JSON, websocket.Options{})
+	hot := subscribe(codec.JSON, websocket.Options{Filter: filter})
+	projected := subscribe(codec.Protobuf, websocket.Options{Projection: projection})
+
+	payload, err := s.EncodeProtobuf(map[string]interface{}{"id": "s-1", "temperature": 21.5})
+	require.NoError(t, err)
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: payload, Format: codec.Protobuf})
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(`{"id":"s-2","temperature":35}`)})
+	hub.Flush()
+
+	assert.Equal(t, payload, <-asProtobuf.Send)
+	v, err := s.DecodeProtobuf(<-asProtobuf.Send)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"id": "s-2", "temperature": json.Number("35")}, v)
+
+	assert.JSONEq(t, `{"id":"s-1","temperature":21.5}`, string(<-asJSON.Send))
+	assert.JSONEq(t, `{"id":"s-2","temperature":35}`, string(<-asJSON.Send))
+	assert.JSONEq(t, `{"id":"s-2","temperature":35}`, string(<-hot.Send))
+	assert.Equal(t, 0, len(hot.Send))
+
+	v, err = s.DecodeProtobuf(<-projected.Send)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"id": "s-1"}, v)
+}
+
+// TestSubprotocolSelectsFormat tests that a multiplexed client negotiating
+// the msgpack subprotocol gets binary msgpack frames
+func TestSubprotocolSelectsFormat(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+
+	conn, resp := dialDelivery(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		client := websocket.NewMultiplexClient(hub, conn)
+		if f, ok := websocket.SubprotocolFormat(conn.Subprotocol()); ok {
+			client.SetFormat(f)
+		}
+		return client
+	}, "msgpack")
+	assert.Equal(t, "msgpack", resp.Header.Get("Sec-Websocket-Protocol"))
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "stream_id": "s"}))
+	readFrame(t, conn)
+
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(`{"a":1}`)})
+	messageType, data := readFrame(t, conn)
+	assert.Equal(t, gorillaWS.BinaryMessage, messageType)
+	n := int(binary.BigEndian.Uint16(data))
+	v, err := codec.Decode(codec.MsgPack, data[2+n:])
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": int64(1)}, v)
+}
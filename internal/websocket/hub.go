@@ -1,195 +1,399 @@
 package websocket
 
 import (
-	"net/http"
+	"errors"
+	"hash/fnv"
+	"runtime"
 	"sync"
-	"time"
+	"sync/atomic"
 
-	"github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
 	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
 )
 
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+// shardQueueSize is the number of broadcasts buffered per shard so that the
+// Kafka consumer does not wait on a single slow fan-out
+const shardQueueSize = 1024
+
+var (
+	// ErrUnknownStream is returned when subscribing to a stream that was never created
+	ErrUnknownStream = errors.New("unknown stream")
+
+	errClientClosed = errors.New("client closed")
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// Hub maintains the set of active clients and broadcasts messages to them.
+// Streams are partitioned across shards by stream ID; every shard runs its
+// own loop with its own lock, so fan-out for unrelated streams proceeds in
+// parallel.
+type Hub struct {
+	shards []*shard
+	logger *logger.Logger
+
+	// mu guards the stream catalog, pattern subscriptions and sessions, which span shards
+	mu       sync.RWMutex
+	catalog  map[string]StreamInfo
+	patterns map[*Client]map[string]*patternSubscription
+	sessions map[string]*Client
 }
 
-// Hub maintains the set of active clients and broadcasts messages to them
-type Hub struct {
-	clients    map[*Client]bool
+// shard owns the subscribers and policies of a subset of streams
+type shard struct {
+	clients    map[*Client]int
 	broadcast  chan Message
-	register   chan *Client
-	unregister chan *Client
-	streams    map[string][]*Client
+	register   chan subscription
+	unregister chan subscription
+	streams    map[string][]subscription
+	known      map[string]bool
+	policies   map[string]Policy
 	mu         sync.RWMutex
 	logger     *logger.Logger
+	pending    int64
+	// schemas holds the stream schemas Protobuf payloads are converted with
+	schemas *schema.Registry
 }
 
-// Client represents a WebSocket client
-type Client struct {
-	Hub      *Hub
-	StreamID string
-	Conn     *websocket.Conn
-	Send     chan []byte
+// subscription attaches a client to a stream
+type subscription struct {
+	client   *Client
+	streamID string
+	opts     Options
+	// sampler holds the subscription's sampling state
+	sampler *sampler
 }
 
 // Message represents a message to be broadcasted
 type Message struct {
 	StreamID string
 	Data     []byte
+	// Format is the encoding of Data; empty means JSON
+	Format codec.Format
+	// flushed is closed once the shard has handled every earlier message
+	flushed chan struct{}
 }
 
-// NewHub creates a new Hub instance
+// NewHub creates a new Hub instance with one shard per CPU
 func NewHub(logger *logger.Logger) *Hub {
-	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		streams:    make(map[string][]*Client),
-		logger:     logger,
+	return NewShardedHub(logger, runtime.NumCPU())
+}
+
+// NewShardedHub creates a new Hub instance with the given number of shards
+func NewShardedHub(logger *logger.Logger, shards int) *Hub {
+	if shards < 1 {
+		shards = 1
+	}
+	h := &Hub{
+		shards:   make([]*shard, shards),
+		logger:   logger,
+		catalog:  make(map[string]StreamInfo),
+		patterns: make(map[*Client]map[string]*patternSubscription),
+		sessions: make(map[string]*Client),
+	}
+	for i := range h.shards {
+		h.shards[i] = &shard{
+			clients:    make(map[*Client]int),
+			broadcast:  make(chan Message, shardQueueSize),
+			register:   make(chan subscription),
+			unregister: make(chan subscription),
+			streams:    make(map[string][]subscription),
+			known:      make(map[string]bool),
+			policies:   make(map[string]Policy),
+			logger:     logger,
+		}
 	}
+	return h
 }
 
-// Run starts the Hub's main loop
+// SetSchemas sets the registry holding the streams' schemas, so that
+// Protobuf payloads of streams with a Protobuf schema can be converted to
+// other formats, filtered and projected. It must be called before Run.
+func (h *Hub) SetSchemas(schemas *schema.Registry) {
+	for _, s := range h.shards {
+		s.schemas = schemas
+	}
+}
+
+// Run starts the loop of every shard and blocks for as long as they run
 func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.registerClient(client)
-		case client := <-h.unregister:
-			h.unregisterClient(client)
-		case message := <-h.broadcast:
-			h.broadcastMessage(message)
-		}
+	var wg sync.WaitGroup
+	wg.Add(len(h.shards))
+	for _, s := range h.shards {
+		go func(s *shard) {
+			defer wg.Done()
+			s.run()
+		}(s)
 	}
+	wg.Wait()
 }
 
-// registerClient adds a new client to the hub
-func (h *Hub) registerClient(client *Client) {
-	h.mu.Lock()
-	h.clients[client] = true
-	h.streams[client.StreamID] = append(h.streams[client.StreamID], client)
-	h.mu.Unlock()
-	h.logger.Info("Client registered", "streamID", client.StreamID)
+// shardFor returns the shard responsible for a stream
+func (h *Hub) shardFor(streamID string) *shard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	f := fnv.New32a()
+	f.Write([]byte(streamID))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
 }
 
-// unregisterClient removes a client from the hub
-func (h *Hub) unregisterClient(client *Client) {
+// CreateStream creates a new stream
+func (h *Hub) CreateStream(streamID string) {
+	h.RegisterStream(StreamInfo{ID: streamID})
+}
+
+// RegisterStream creates a stream with a name and labels and attaches it to
+// every client whose pattern subscriptions match it
+func (h *Hub) RegisterStream(info StreamInfo) {
+	h.shardFor(info.ID).createStream(info.ID)
+
 	h.mu.Lock()
-	if _, ok := h.clients[client]; ok {
-		delete(h.clients, client)
-		close(client.Send)
-		h.removeClientFromStream(client)
-		h.logger.Info("Client unregistered", "streamID", client.StreamID)
-	}
+	h.catalog[info.ID] = info
 	h.mu.Unlock()
+
+	h.attachToPatterns(info)
 }
 
-// broadcastMessage sends a message to all clients in a specific stream
-func (h *Hub) broadcastMessage(message Message) {
+// SetStreamPolicy sets the slow consumer policy of a stream
+func (h *Hub) SetStreamPolicy(streamID string, policy Policy) {
+	h.shardFor(streamID).setPolicy(streamID, policy)
+}
+
+// Stream returns the name and labels a stream was registered with
+func (h *Hub) Stream(streamID string) (StreamInfo, bool) {
 	h.mu.RLock()
-	for _, client := range h.streams[message.StreamID] {
-		select {
-		case client.Send <- message.Data:
-		default:
-			close(client.Send)
-			delete(h.clients, client)
-			h.removeClientFromStream(client)
-			h.logger.Info("Client removed due to blocked channel", "streamID", client.StreamID)
-		}
+	defer h.mu.RUnlock()
+	info, ok := h.catalog[streamID]
+	return info, ok
+}
+
+// StreamPolicy returns the slow consumer policy of a stream
+func (h *Hub) StreamPolicy(streamID string) Policy {
+	s := h.shardFor(streamID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policyFor(streamID)
+}
+
+// StreamExists reports whether a stream has been created
+func (h *Hub) StreamExists(streamID string) bool {
+	return h.shardFor(streamID).exists(streamID)
+}
+
+// Register subscribes a single-stream client to its stream
+func (h *Hub) Register(client *Client, opts Options) {
+	if err := client.addSubscription(client.StreamID); err != nil {
+		return
 	}
-	h.mu.RUnlock()
-	h.logger.Info("Broadcasting message", "streamID", message.StreamID)
+	h.shardFor(client.StreamID).register <- subscription{client: client, streamID: client.StreamID, opts: opts}
 }
 
-// removeClientFromStream removes a client from a specific stream
-func (h *Hub) removeClientFromStream(client *Client) {
-	clients := h.streams[client.StreamID]
-	for i, c := range clients {
-		if c == client {
-			h.streams[client.StreamID] = append(clients[:i], clients[i+1:]...)
-			break
-		}
+// Subscribe attaches a client to an existing stream
+func (h *Hub) Subscribe(client *Client, streamID string, opts Options) error {
+	if !h.StreamExists(streamID) {
+		return ErrUnknownStream
 	}
-	if len(h.streams[client.StreamID]) == 0 {
-		delete(h.streams, client.StreamID)
+	if client.closed() {
+		return errClientClosed
 	}
+	if err := client.addSubscription(streamID); err != nil {
+		return err
+	}
+	h.shardFor(streamID).register <- subscription{client: client, streamID: streamID, opts: opts}
+	return nil
 }
 
-// CreateStream creates a new stream
-func (h *Hub) CreateStream(streamID string) {
+// Unsubscribe detaches a client from a stream, whether it subscribed to it
+// itself or through a pattern
+func (h *Hub) Unsubscribe(client *Client, streamID string) error {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	if _, ok := h.streams[streamID]; !ok {
-		h.streams[streamID] = make([]*Client, 0)
+	h.release(client, streamID)
+	h.mu.Unlock()
+	return h.unsubscribe(client, streamID)
+}
+
+func (h *Hub) unsubscribe(client *Client, streamID string) error {
+	if err := client.removeSubscription(streamID); err != nil {
+		return err
 	}
+	h.shardFor(streamID).unregister <- subscription{client: client, streamID: streamID}
+	return nil
 }
 
-// BroadcastMessage broadcasts a message to all clients
+// Unregister shuts a client down and removes it from every stream
+func (h *Hub) Unregister(client *Client) {
+	client.close()
+	h.mu.Lock()
+	delete(h.patterns, client)
+	if client.SessionID != "" {
+		delete(h.sessions, client.SessionID)
+	}
+	h.mu.Unlock()
+	for _, streamID := range client.takeSubscriptions() {
+		h.shardFor(streamID).unregister <- subscription{client: client, streamID: streamID}
+	}
+}
+
+// BroadcastMessage queues a message for the clients of its stream
 func (h *Hub) BroadcastMessage(message Message) {
-	h.broadcast <- message
+	s := h.shardFor(message.StreamID)
+	atomic.AddInt64(&s.pending, 1)
+	s.broadcast <- message
 }
 
-func (c *Client) ReadPump() {
-	defer func() {
-		c.Hub.unregister <- c
-		c.Conn.Close()
-	}()
-	c.Conn.SetReadLimit(maxMessageSize)
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-	for {
-		_, _, err := c.Conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				c.Hub.logger.Error("Unexpected close error", "error", err)
-			}
-			break
-		}
+// Flush blocks until every message broadcast before the call has been
+// handed to its clients' send queues
+func (h *Hub) Flush() {
+	done := make([]chan struct{}, len(h.shards))
+	for i, s := range h.shards {
+		done[i] = make(chan struct{})
+		atomic.AddInt64(&s.pending, 1)
+		s.broadcast <- Message{flushed: done[i]}
+	}
+	for _, d := range done {
+		<-d
 	}
 }
 
-func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.Conn.Close()
-	}()
+// Backlog returns the number of messages waiting to be broadcast or written to clients
+func (h *Hub) Backlog() int {
+	backlog := 0
+	for _, s := range h.shards {
+		backlog += s.backlog()
+	}
+	return backlog
+}
+
+// run is the shard's main loop
+func (s *shard) run() {
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case sub := <-s.register:
+			s.registerClient(sub)
+		case sub := <-s.unregister:
+			s.unregisterClient(sub)
+		case message := <-s.broadcast:
+			atomic.AddInt64(&s.pending, -1)
+			if message.flushed != nil {
+				close(message.flushed)
+				continue
 			}
+			s.broadcastMessage(message)
+		}
+	}
+}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
+// registerClient subscribes a client to a stream of the shard
+func (s *shard) registerClient(sub subscription) {
+	if sub.opts.Sample != nil {
+		sub.sampler = newSampler(*sub.opts.Sample)
+	}
+	s.mu.Lock()
+	s.clients[sub.client]++
+	s.streams[sub.streamID] = append(s.streams[sub.streamID], sub)
+	s.mu.Unlock()
+	s.logger.Info("Client registered", "streamID", sub.streamID)
+}
+
+// unregisterClient unsubscribes a client from a stream of the shard
+func (s *shard) unregisterClient(sub subscription) {
+	s.mu.Lock()
+	if s.removeClientFromStream(sub) {
+		s.logger.Info("Client unregistered", "streamID", sub.streamID)
+	}
+	s.mu.Unlock()
+}
 
-			if err := w.Close(); err != nil {
-				return
+// broadcastMessage sends a message to all clients in a specific stream whose
+// filters accept it, applying the stream's slow consumer policy to clients
+// that cannot keep up. Clients that have been shut down, or that the policy
+// disconnects, are dropped from the stream.
+func (s *shard) broadcastMessage(message Message) {
+	var gone []*Client
+	d := &delivery{message: message, schemas: s.schemas}
+	s.mu.RLock()
+	policy := s.policyFor(message.StreamID)
+	for _, sub := range s.streams[message.StreamID] {
+		client := sub.client
+		if client.closed() {
+			gone = append(gone, client)
+			continue
+		}
+		data := d.payloadFor(sub)
+		if data == nil {
+			continue
+		}
+		if !client.enqueue(message.StreamID, data, policy) {
+			client.close()
+			gone = append(gone, client)
+			s.logger.Info("Client removed due to blocked channel", "streamID", message.StreamID)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, client := range gone {
+		s.unregisterClient(subscription{client: client, streamID: message.StreamID})
+	}
+}
+
+// removeClientFromStream removes a client from a specific stream and reports
+// whether it was subscribed. The caller must hold the lock.
+func (s *shard) removeClientFromStream(sub subscription) bool {
+	subs := s.streams[sub.streamID]
+	for i, existing := range subs {
+		if c := existing.client; c == sub.client {
+			s.streams[sub.streamID] = append(subs[:i:i], subs[i+1:]...)
+			if s.clients[c]--; s.clients[c] == 0 {
+				delete(s.clients, c)
 			}
-		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
+			if len(s.streams[sub.streamID]) == 0 && !s.known[sub.streamID] {
+				delete(s.streams, sub.streamID)
 			}
+			return true
 		}
 	}
+	return false
 }
 
-func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
-	return upgrader.Upgrade(w, r, nil)
+// createStream registers an empty stream if it does not exist yet
+func (s *shard) createStream(streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.known[streamID] = true
+	if _, ok := s.streams[streamID]; !ok {
+		s.streams[streamID] = make([]subscription, 0)
+	}
+}
+
+// exists reports whether a stream has been created on this shard
+func (s *shard) exists(streamID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.known[streamID]
+}
+
+// policyFor returns the slow consumer policy of a stream. The caller must hold the lock.
+func (s *shard) policyFor(streamID string) Policy {
+	if policy, ok := s.policies[streamID]; ok {
+		return policy
+	}
+	return DefaultPolicy
+}
+
+// setPolicy sets the slow consumer policy of a stream
+func (s *shard) setPolicy(streamID string, policy Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[streamID] = policy
+}
+
+// backlog returns the number of queued broadcasts and unsent client messages
+func (s *shard) backlog() int {
+	backlog := int(atomic.LoadInt64(&s.pending))
+	s.mu.RLock()
+	for client := range s.clients {
+		backlog += len(client.Send)
+	}
+	s.mu.RUnlock()
+	return backlog
 }
@@ -0,0 +1,172 @@
+package websocket_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestHubRoutesByStream tests that clients only receive messages for their stream
+func TestHubRoutesByStream(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 4)
+	go hub.Run()
+
+	clients := make([]*websocket.Client, 8)
+	for i := range clients {
+		clients[i] = websocket.NewClient(hub, fmt.Sprintf("stream-%d", i), nil)
+		hub.Register(clients[i], websocket.Options{})
+	}
+
+	for i := range clients {
+		hub.BroadcastMessage(websocket.Message{StreamID: fmt.Sprintf("stream-%d", i), Data: []byte(fmt.Sprint(i))})
+	}
+	hub.Flush()
+
+	for i, client := range clients {
+		assert.Equal(t, 1, len(client.Send))
+		assert.Equal(t, fmt.Sprint(i), string(<-client.Send))
+	}
+	assert.Equal(t, 0, hub.Backlog())
+}
+
+// BenchmarkHubBroadcast measures fan-out throughput for several shard counts.
+// Run it with -cpu to see how sharding scales with cores.
+func BenchmarkHubBroadcast(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const (
+		streams          = 256
+		clientsPerStream = 16
+	)
+	payload := []byte(`{"data":"benchmark payload"}`)
+
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			hub := websocket.NewShardedHub(logger.NewLogger(), shards)
+			go hub.Run()
+
+			ids := make([]string, streams)
+			for i := range ids {
+				ids[i] = fmt.Sprintf("stream-%d", i)
+				hub.CreateStream(ids[i])
+				hub.SetStreamPolicy(ids[i], websocket.PolicyDropNewest)
+				for j := 0; j < clientsPerStream; j++ {
+					client := websocket.NewClient(hub, ids[i], nil)
+					hub.Register(client, websocket.Options{})
+					go func() {
+						for range client.Send {
+						}
+					}()
+				}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hub.BroadcastMessage(websocket.Message{StreamID: ids[i%streams], Data: payload})
+			}
+			hub.Flush()
+		})
+	}
+}
+
+// TestMultiplexSubscriptions tests that a multiplexed client receives tagged frames for its subscriptions only
+func TestMultiplexSubscriptions(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 4)
+	go hub.Run()
+	hub.CreateStream("a")
+	hub.CreateStream("b")
+
+	client := websocket.NewMultiplexClient(hub, nil)
+	assert.NoError(t, hub.Subscribe(client, "a", websocket.Options{}))
+	assert.NoError(t, hub.Subscribe(client, "b", websocket.Options{}))
+	assert.Equal(t, websocket.ErrAlreadySubscribed, hub.Subscribe(client, "a", websocket.Options{}))
+	assert.Equal(t, websocket.ErrUnknownStream, hub.Subscribe(client, "c", websocket.Options{}))
+
+	hub.BroadcastMessage(websocket.Message{StreamID: "a", Data: []byte(`{"v":1}`)})
+	hub.Flush()
+	assert.JSONEq(t, `{"type":"message","stream_id":"a","data":{"v":1}}`, string(<-client.Send))
+
+	assert.NoError(t, hub.Unsubscribe(client, "a"))
+	assert.Equal(t, websocket.ErrNotSubscribed, hub.Unsubscribe(client, "a"))
+	hub.BroadcastMessage(websocket.Message{StreamID: "a", Data: []byte(`{"v":2}`)})
+	hub.BroadcastMessage(websocket.Message{StreamID: "b", Data: []byte(`{"v":3}`)})
+	hub.Flush()
+	assert.Equal(t, 1, len(client.Send))
+	assert.JSONEq(t, `{"type":"message","stream_id":"b","data":{"v":3}}`, string(<-client.Send))
+	assert.ElementsMatch(t, []string{"b"}, client.Subscriptions())
+}
+
+// TestSubscriptionFilter tests that only messages matching a subscriber's filter are delivered
+func TestSubscriptionFilter(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 1)
+	go hub.Run()
+	hub.CreateStream("s")
+
+	filter, err := expr.Compile(`temperature > 30 && site == "A"`)
+	assert.NoError(t, err)
+	filtered := websocket.NewClient(hub, "s", nil)
+	hub.Register(filtered, websocket.Options{Filter: filter})
+	unfiltered := websocket.NewClient(hub, "s", nil)
+	hub.Register(unfiltered, websocket.Options{})
+
+	for _, msg := range []string{
+		`{"temperature": 35, "site": "A"}`,
+		`{"temperature": 25, "site": "A"}`,
+		`{"temperature": 35, "site": "B"}`,
+		`not json`,
+	} {
+		hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(msg)})
+	}
+	hub.Flush()
+
+	assert.Equal(t, 1, len(filtered.Send))
+	assert.Equal(t, `{"temperature": 35, "site": "A"}`, string(<-filtered.Send))
+	assert.Equal(t, 4, len(unfiltered.Send))
+}
+
+// TestSubscriptionSampling tests that sampled subscribers receive a sample
+// of the stream while others receive every message
+func TestSubscriptionSampling(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 1)
+	go hub.Run()
+	hub.CreateStream("s")
+
+	every, err := websocket.ParseSampling("", "3", "")
+	assert.NoError(t, err)
+	sampled := websocket.NewClient(hub, "s", nil)
+	hub.Register(sampled, websocket.Options{Sample: every})
+	interval, err := websocket.NewSampling(0, 0, time.Hour)
+	assert.NoError(t, err)
+	throttled := websocket.NewClient(hub, "s", nil)
+	hub.Register(throttled, websocket.Options{Sample: interval})
+	raw := websocket.NewClient(hub, "s", nil)
+	hub.Register(raw, websocket.Options{})
+
+	for i := 0; i < 7; i++ {
+		hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(fmt.Sprint(i))})
+	}
+	hub.Flush()
+
+	assert.Equal(t, 3, len(sampled.Send))
+	assert.Equal(t, "0", string(<-sampled.Send))
+	assert.Equal(t, "3", string(<-sampled.Send))
+	assert.Equal(t, 1, len(throttled.Send))
+	assert.Equal(t, 7, len(raw.Send))
+
+	for _, params := range [][3]string{{"0.5", "2", ""}, {"2", "", ""}, {"", "x", ""}, {"", "", "-1s"}} {
+		_, err := websocket.ParseSampling(params[0], params[1], params[2])
+		assert.Error(t, err, params)
+	}
+	none, err := websocket.ParseSampling("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+}
@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+// Publisher accepts messages that WebSocket clients publish into a stream.
+// Errors may implement StatusCode() int to tell the client why the message
+// was rejected in HTTP terms.
+type Publisher interface {
+	Publish(streamID string, format codec.Format, data []byte) error
+}
+
+// NewIngestClient creates a Client that publishes every frame it reads into
+// a stream and answers each one with a published or error reply
+func NewIngestClient(hub *Hub, streamID string, conn *websocket.Conn, publisher Publisher) *Client {
+	c := newClient(hub, conn)
+	c.StreamID = streamID
+	c.Publisher = publisher
+	c.ingest = true
+	return c
+}
+
+// handleIngest publishes a frame read on an ingest connection in the
+// connection's format. Frames are numbered from 1 so that replies can be
+// matched to them.
+func (c *Client) handleIngest(raw []byte) {
+	c.published++
+	c.publish(strconv.FormatUint(c.published, 10), c.StreamID, c.format, raw)
+}
+
+// publish hands a message to the publisher and reports the outcome to the client
+func (c *Client) publish(id, streamID string, format codec.Format, data []byte) {
+	if c.Publisher == nil {
+		c.replyWait(controlReply{Type: TypeError, ID: id, StreamID: streamID, Error: "publishing is not enabled on this connection"})
+		return
+	}
+	if streamID == "" {
+		c.replyWait(controlReply{Type: TypeError, ID: id, Error: "stream_id is required"})
+		return
+	}
+	if len(data) == 0 {
+		c.replyWait(controlReply{Type: TypeError, ID: id, StreamID: streamID, Error: "data is required"})
+		return
+	}
+
+	if err := c.Publisher.Publish(streamID, format, data); err != nil {
+		reply := controlReply{Type: TypeError, ID: id, StreamID: streamID, Error: err.Error()}
+		if coded, ok := err.(interface{ StatusCode() int }); ok {
+			reply.Code = coded.StatusCode()
+		}
+		c.replyWait(reply)
+		return
+	}
+	c.replyWait(controlReply{Type: TypePublished, ID: id, StreamID: streamID})
+}
+
+// replyWait queues a publish reply. Unlike other control replies it waits
+// for room in the queue, so a producer that outpaces its replies is slowed
+// down rather than losing acknowledgements.
+func (c *Client) replyWait(r controlReply) {
+	frame, _ := json.Marshal(r)
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case c.control <- frame:
+	case <-c.done:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,138 @@
+package websocket_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorillaWS "github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusError is a publish error carrying an HTTP status
+type statusError int
+
+func (e statusError) Error() string   { return http.StatusText(int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+// recordingPublisher records published messages and rejects streams named "full"
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (p *recordingPublisher) Publish(streamID string, format codec.Format, data []byte) error {
+	if streamID == "full" {
+		return statusError(http.StatusTooManyRequests)
+	}
+	if streamID == "broken" {
+		return errors.New("broken")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, streamID+":"+string(format)+":"+string(data))
+	return nil
+}
+
+// publishReply is the subset of a reply the ingest tests look at
+type publishReply struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+	Error    string `json:"error"`
+	Code     int    `json:"code"`
+}
+
+func newIngestServer(t *testing.T, newClient func(conn *gorillaWS.Conn) *websocket.Client) *gorillaWS.Conn {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		client := newClient(conn)
+		go client.WritePump()
+		client.ReadPump()
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := gorillaWS.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readReply(t *testing.T, conn *gorillaWS.Conn) publishReply {
+	var r publishReply
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	require.NoError(t, conn.ReadJSON(&r))
+	return r
+}
+
+// TestIngestConnection tests that every frame on an ingest connection is published and acknowledged
+func TestIngestConnection(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	publisher := &recordingPublisher{}
+	conn := newIngestServer(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		return websocket.NewIngestClient(hub, "sensors", conn, publisher)
+	})
+
+	for _, payload := range []string{`{"t":1}`, `{"t":2}`} {
+		require.NoError(t, conn.WriteMessage(gorillaWS.TextMessage, []byte(payload)))
+	}
+	assert.Equal(t, publishReply{Type: websocket.TypePublished, ID: "1", StreamID: "sensors"}, readReply(t, conn))
+	assert.Equal(t, publishReply{Type: websocket.TypePublished, ID: "2", StreamID: "sensors"}, readReply(t, conn))
+
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	assert.Equal(t, []string{`sensors:json:{"t":1}`, `sensors:json:{"t":2}`}, publisher.messages)
+}
+
+// TestPublishOnMultiplexedConnection tests publish control messages and how rejections are reported
+func TestPublishOnMultiplexedConnection(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	publisher := &recordingPublisher{}
+	conn := newIngestServer(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		client := websocket.NewMultiplexClient(hub, conn)
+		client.Publisher = publisher
+		return client
+	})
+
+	testCases := []struct {
+		msg   map[string]interface{}
+		reply publishReply
+	}{
+		{
+			map[string]interface{}{"type": "publish", "stream_id": "s", "id": "a", "data": map[string]int{"v": 1}},
+			publishReply{Type: websocket.TypePublished, ID: "a", StreamID: "s"},
+		},
+		{
+			map[string]interface{}{"type": "publish", "stream_id": "full", "id": "b", "data": map[string]int{"v": 2}},
+			publishReply{Type: websocket.TypeError, ID: "b", StreamID: "full", Error: "Too Many Requests", Code: http.StatusTooManyRequests},
+		},
+		{
+			map[string]interface{}{"type": "publish", "stream_id": "broken", "id": "c", "data": map[string]int{"v": 3}},
+			publishReply{Type: websocket.TypeError, ID: "c", StreamID: "broken", Error: "broken"},
+		},
+		{
+			map[string]interface{}{"type": "publish", "id": "d", "data": map[string]int{"v": 4}},
+			publishReply{Type: websocket.TypeError, ID: "d", Error: "stream_id is required"},
+		},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, conn.WriteJSON(tc.msg))
+		assert.Equal(t, tc.reply, readReply(t, conn))
+	}
+
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	assert.Equal(t, []string{`s:json:{"v":1}`}, publisher.messages)
+}
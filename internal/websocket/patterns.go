@@ -0,0 +1,142 @@
+package websocket
+
+import "errors"
+
+// ErrDuplicatePattern is returned when a client repeats a pattern subscription
+var ErrDuplicatePattern = errors.New("already subscribed to pattern")
+
+// patternSubscription is a selector registered by a client together with
+// the streams it attached
+type patternSubscription struct {
+	selector *Selector
+	opts     Options
+	attached map[string]bool
+}
+
+// SubscribePattern attaches a client to every existing stream matching the
+// selector and to every matching stream registered later. It returns the
+// IDs of the streams attached now.
+func (h *Hub) SubscribePattern(client *Client, sel *Selector, opts Options) ([]string, error) {
+	ps := &patternSubscription{selector: sel, opts: opts, attached: make(map[string]bool)}
+
+	h.mu.Lock()
+	subs := h.patterns[client]
+	if subs == nil {
+		subs = make(map[string]*patternSubscription)
+		h.patterns[client] = subs
+	}
+	if _, ok := subs[sel.key()]; ok {
+		h.mu.Unlock()
+		return nil, ErrDuplicatePattern
+	}
+	if len(subs) >= maxSubscriptions {
+		h.mu.Unlock()
+		return nil, ErrTooManySubscriptions
+	}
+	subs[sel.key()] = ps
+
+	var matches []string
+	for id, info := range h.catalog {
+		if sel.Matches(info) {
+			matches = append(matches, id)
+		}
+	}
+	h.mu.Unlock()
+
+	var attached []string
+	for _, id := range matches {
+		if h.attach(client, ps, id) {
+			attached = append(attached, id)
+		}
+	}
+	return attached, nil
+}
+
+// UnsubscribePattern removes a pattern subscription and detaches the
+// streams it attached. Streams another of the client's patterns matches
+// stay attached on its behalf.
+func (h *Hub) UnsubscribePattern(client *Client, sel *Selector) error {
+	h.mu.Lock()
+	subs := h.patterns[client]
+	ps, ok := subs[sel.key()]
+	if !ok {
+		h.mu.Unlock()
+		return ErrNotSubscribed
+	}
+	delete(subs, sel.key())
+	var detached []string
+	for id := range ps.attached {
+		if !h.handOver(subs, id) {
+			detached = append(detached, id)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, id := range detached {
+		h.unsubscribe(client, id)
+	}
+	return nil
+}
+
+// handOver passes a stream attached by a removed pattern to another of the
+// client's patterns matching it, and reports whether there was one. The
+// caller holds h.mu.
+func (h *Hub) handOver(subs map[string]*patternSubscription, streamID string) bool {
+	info, ok := h.catalog[streamID]
+	if !ok {
+		return false
+	}
+	for _, other := range subs {
+		if other.selector.Matches(info) {
+			other.attached[streamID] = true
+			return true
+		}
+	}
+	return false
+}
+
+// release forgets that patterns attached a stream, once the client
+// unsubscribes from it itself. The caller holds h.mu.
+func (h *Hub) release(client *Client, streamID string) {
+	for _, ps := range h.patterns[client] {
+		delete(ps.attached, streamID)
+	}
+}
+
+// attachToPatterns subscribes every pattern subscriber matching a newly
+// registered stream and notifies them
+func (h *Hub) attachToPatterns(info StreamInfo) {
+	type match struct {
+		client *Client
+		ps     *patternSubscription
+	}
+	var matches []match
+
+	h.mu.RLock()
+	for client, subs := range h.patterns {
+		for _, ps := range subs {
+			if ps.selector.Matches(info) {
+				matches = append(matches, match{client: client, ps: ps})
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, m := range matches {
+		if h.attach(m.client, m.ps, info.ID) {
+			m.client.reply(controlReply{Type: TypeSubscribed, StreamID: info.ID, Pattern: m.ps.selector.Pattern, Selector: m.ps.selector.Labels})
+		}
+	}
+}
+
+// attach subscribes a client to a stream on behalf of a pattern and reports
+// whether the stream was newly attached
+func (h *Hub) attach(client *Client, ps *patternSubscription, streamID string) bool {
+	if err := h.Subscribe(client, streamID, ps.opts); err != nil {
+		return false
+	}
+	h.mu.Lock()
+	ps.attached[streamID] = true
+	h.mu.Unlock()
+	return true
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+)
+
+// Policy decides what happens when a client's send queue is full
+type Policy string
+
+const (
+	// PolicyDisconnect drops the client
+	PolicyDisconnect Policy = "disconnect"
+	// PolicyDropOldest discards the oldest queued message to make room
+	PolicyDropOldest Policy = "drop_oldest"
+	// PolicyDropNewest discards the incoming message
+	PolicyDropNewest Policy = "drop_newest"
+	// PolicyCoalesce discards everything queued and keeps only the latest message
+	PolicyCoalesce Policy = "coalesce"
+)
+
+// DefaultPolicy is applied to streams without an explicit policy
+const DefaultPolicy = PolicyDisconnect
+
+// ParsePolicy validates a policy name. An empty name yields DefaultPolicy.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case "":
+		return DefaultPolicy, nil
+	case PolicyDisconnect, PolicyDropOldest, PolicyDropNewest, PolicyCoalesce:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown slow consumer policy %q", name)
+	}
+}
+
+// dropNotice is the control frame telling a client how many messages it
+// missed. Multiplexed clients share one queue across streams, so their
+// notices carry no stream ID.
+type dropNotice struct {
+	Type     string `json:"type"`
+	StreamID string `json:"stream_id,omitempty"`
+	Count    uint64 `json:"count"`
+}
+
+// enqueue offers data from a stream to the client according to the policy.
+// It reports false when the client must be disconnected. Clients with a
+// session keep every message until it is acknowledged, so the policy does
+// not apply to them.
+func (c *Client) enqueue(streamID string, data []byte, policy Policy) bool {
+	if c.ack != nil {
+		if c.enqueueSession(data) {
+			return true
+		}
+		c.loseSession(streamID)
+		return false
+	}
+
+	select {
+	case c.Send <- data:
+		return true
+	default:
+	}
+
+	switch policy {
+	case PolicyDropNewest:
+		c.recordDrops(streamID, 1, policy)
+	case PolicyDropOldest:
+		c.recordDrops(streamID, c.discard(1), policy)
+		c.offer(streamID, data, policy)
+	case PolicyCoalesce:
+		c.recordDrops(streamID, c.discard(cap(c.Send)), policy)
+		c.offer(streamID, data, policy)
+	default:
+		metrics.WebSocketMessagesDropped.WithLabelValues(streamID, string(PolicyDisconnect)).Inc()
+		return false
+	}
+	return true
+}
+
+// offer attempts a non-blocking send, counting the message as dropped if
+// the writer has not freed any space
+func (c *Client) offer(streamID string, data []byte, policy Policy) {
+	select {
+	case c.Send <- data:
+	default:
+		c.recordDrops(streamID, 1, policy)
+	}
+}
+
+// discard removes up to n queued messages and returns how many were removed
+func (c *Client) discard(n int) uint64 {
+	var removed uint64
+	for i := 0; i < n; i++ {
+		select {
+		case <-c.Send:
+			removed++
+		default:
+			return removed
+		}
+	}
+	return removed
+}
+
+// recordDrops accounts for dropped messages so they can be reported to the client
+func (c *Client) recordDrops(streamID string, n uint64, policy Policy) {
+	if n == 0 {
+		return
+	}
+	atomic.AddUint64(&c.dropped, n)
+	metrics.WebSocketMessagesDropped.WithLabelValues(streamID, string(policy)).Add(float64(n))
+}
+
+// takeDropNotice returns a control frame for messages dropped since the last
+// call, or nil if nothing was dropped
+func (c *Client) takeDropNotice() []byte {
+	n := atomic.SwapUint64(&c.dropped, 0)
+	if n == 0 {
+		return nil
+	}
+	notice, _ := json.Marshal(dropNotice{Type: "dropped", StreamID: c.StreamID, Count: n})
+	return notice
+}
@@ -0,0 +1,130 @@
+package websocket_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	gorillaWS "github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSlowConsumerPolicies tests how each policy treats a client that never reads
+func TestSlowConsumerPolicies(t *testing.T) {
+	testCases := []struct {
+		policy websocket.Policy
+		first  string
+		last   string
+		queued int
+	}{
+		{websocket.PolicyDropNewest, "msg-0", "msg-255", 256},
+		{websocket.PolicyDropOldest, "msg-44", "msg-299", 256},
+		{websocket.PolicyCoalesce, "msg-256", "msg-299", 44},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			hub := websocket.NewHub(logger.NewLogger())
+			go hub.Run()
+
+			hub.CreateStream("s")
+			hub.SetStreamPolicy("s", tc.policy)
+			client := websocket.NewClient(hub, "s", nil)
+			hub.Register(client, websocket.Options{})
+
+			for i := 0; i < 300; i++ {
+				hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(fmt.Sprintf("msg-%d", i))})
+			}
+			hub.Flush()
+
+			assert.Equal(t, tc.queued, len(client.Send))
+			assert.Equal(t, tc.first, string(<-client.Send))
+			var last []byte
+			for len(client.Send) > 0 {
+				last = <-client.Send
+			}
+			if last != nil {
+				assert.Equal(t, tc.last, string(last))
+			}
+		})
+	}
+}
+
+// TestDisconnectPolicy tests that the default policy removes a client whose
+// queue is full, and that the client's connection is closed
+func TestDisconnectPolicy(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+	client := websocket.NewClient(hub, "s", nil)
+	hub.Register(client, websocket.Options{})
+
+	for i := 0; i < 300; i++ {
+		hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(fmt.Sprintf("msg-%d", i))})
+	}
+	hub.Flush()
+
+	// Messages queued before the queue filled stay queued, and nothing
+	// reaches the client once it is removed
+	require.Equal(t, 256, len(client.Send))
+	for len(client.Send) > 0 {
+		<-client.Send
+	}
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte("after")})
+	hub.Flush()
+	assert.Equal(t, 0, len(client.Send))
+
+	// A connected client that is not reading gets a close frame
+	hub.CreateStream("t")
+	conn, _ := dialDelivery(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		client := websocket.NewClient(hub, "t", conn)
+		hub.Register(client, websocket.Options{})
+		for i := 0; i < 300; i++ {
+			hub.BroadcastMessage(websocket.Message{StreamID: "t", Data: []byte(fmt.Sprintf("msg-%d", i))})
+		}
+		hub.Flush()
+		return client
+	})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var err error
+	for err == nil {
+		_, _, err = conn.ReadMessage()
+	}
+	assert.IsType(t, &gorillaWS.CloseError{}, err)
+}
+
+// TestDropNotice tests that a client that missed messages is told how many
+// before the next message it receives
+func TestDropNotice(t *testing.T) {
+	hub := websocket.NewHub(logger.NewLogger())
+	go hub.Run()
+	hub.CreateStream("s")
+	hub.SetStreamPolicy("s", websocket.PolicyDropNewest)
+
+	conn, _ := dialDelivery(t, func(conn *gorillaWS.Conn) *websocket.Client {
+		client := websocket.NewClient(hub, "s", conn)
+		hub.Register(client, websocket.Options{})
+		// The write pump is not running yet, so the queue overflows
+		for i := 0; i < 300; i++ {
+			hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(fmt.Sprintf("msg-%d", i))})
+		}
+		hub.Flush()
+		return client
+	})
+
+	_, notice := readFrame(t, conn)
+	assert.JSONEq(t, `{"type":"dropped","stream_id":"s","count":44}`, string(notice))
+	for i := 0; i < 256; i++ {
+		_, data := readFrame(t, conn)
+		require.Equal(t, fmt.Sprintf("msg-%d", i), string(data))
+	}
+
+	// Later drops are reported once, with the next message
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte("next")})
+	hub.Flush()
+	_, data := readFrame(t, conn)
+	assert.Equal(t, "next", string(data))
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+)
+
+// Projection keeps only selected fields of each message. Fields are dotted
+// paths such as "sensor.id" or JSON Pointers such as "/sensor/id". When a
+// path runs into an array, the rest of the path is applied to every element.
+type Projection struct {
+	paths [][]string
+	key   string
+}
+
+// ParseProjection compiles a list of field paths
+func ParseProjection(fields []string) (*Projection, error) {
+	p := &Projection{}
+	var keys []string
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		path, err := parseFieldPath(field)
+		if err != nil {
+			return nil, err
+		}
+		p.paths = append(p.paths, path)
+		keys = append(keys, field)
+	}
+	if len(p.paths) == 0 {
+		return nil, fmt.Errorf("at least one field is required")
+	}
+	p.key = strings.Join(keys, ",")
+	return p, nil
+}
+
+// ParseProjectionList compiles a comma separated list of field paths
+func ParseProjectionList(fields string) (*Projection, error) {
+	return ParseProjection(strings.Split(fields, ","))
+}
+
+// parseFieldPath splits a dotted path or JSON Pointer into its segments
+func parseFieldPath(field string) ([]string, error) {
+	if !strings.HasPrefix(field, "/") {
+		return strings.Split(field, "."), nil
+	}
+	segments := strings.Split(field[1:], "/")
+	for i, seg := range segments {
+		seg = strings.Replace(seg, "~1", "/", -1)
+		segments[i] = strings.Replace(seg, "~0", "~", -1)
+	}
+	for _, seg := range segments {
+		if seg == "" {
+			return nil, fmt.Errorf("invalid JSON pointer %q", field)
+		}
+	}
+	return segments, nil
+}
+
+// Apply returns the projection of a decoded message. Fields missing from
+// the message are omitted.
+func (p *Projection) Apply(v interface{}) interface{} {
+	var out interface{}
+	for _, path := range p.paths {
+		out = merge(out, project(v, path))
+	}
+	if out == nil {
+		return map[string]interface{}{}
+	}
+	return out
+}
+
+// project extracts a single path, preserving the enclosing structure
+func project(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil
+		}
+		projected := project(child, path[1:])
+		if projected == nil && child != nil {
+			return nil
+		}
+		return map[string]interface{}{path[0]: projected}
+	case []interface{}:
+		out := make([]interface{}, len(node))
+		for i, elem := range node {
+			out[i] = project(elem, path)
+		}
+		return out
+	}
+	return nil
+}
+
+// merge combines two projections of the same message without modifying
+// either, since leaves may alias the shared decoded message
+func merge(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		out := make(map[string]interface{}, len(av)+len(bv))
+		for k, v := range av {
+			out[k] = v
+		}
+		for k, v := range bv {
+			out[k] = merge(out[k], v)
+		}
+		return out
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return a
+		}
+		out := make([]interface{}, len(av))
+		for i := range av {
+			out[i] = merge(av[i], bv[i])
+		}
+		return out
+	}
+	return a
+}
+
+// project returns the projected payload for a subscriber in its format,
+// computing it at most once per distinct projection and format
+func (d *delivery) project(p *Projection, format codec.Format) ([]byte, error) {
+	key := string(format) + ":" + p.key
+	if data, ok := d.projected[key]; ok {
+		return data, nil
+	}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.encode(format, p.Apply(v))
+	if err != nil {
+		return nil, err
+	}
+	if d.projected == nil {
+		d.projected = make(map[string][]byte)
+	}
+	d.projected[key] = data
+	return data, nil
+}
@@ -0,0 +1,76 @@
+package websocket_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProjectionApply tests dotted paths, JSON pointers and arrays
+func TestProjectionApply(t *testing.T) {
+	message := `{"id": 7, "value": 1.5, "processed_at": "now", "noise": "x",
+		"meta": {"site": "A", "owner": "ops", "a/b": 1},
+		"readings": [{"v": 1, "unit": "C"}, {"v": 2, "unit": "C"}]}`
+
+	testCases := []struct {
+		name     string
+		fields   []string
+		expected string
+	}{
+		{"top level", []string{"id", "value", "processed_at"}, `{"id": 7, "value": 1.5, "processed_at": "now"}`},
+		{"nested", []string{"meta.site"}, `{"meta": {"site": "A"}}`},
+		{"json pointer", []string{"/meta/site", "/meta/a~1b"}, `{"meta": {"site": "A", "a/b": 1}}`},
+		{"array elements", []string{"readings.v"}, `{"readings": [{"v": 1}, {"v": 2}]}`},
+		{"missing field", []string{"id", "nope"}, `{"id": 7}`},
+		{"overlapping", []string{"meta", "meta.site"}, `{"meta": {"site": "A", "owner": "ops", "a/b": 1}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var v interface{}
+			assert.NoError(t, json.Unmarshal([]byte(message), &v))
+			p, err := websocket.ParseProjection(tc.fields)
+			assert.NoError(t, err)
+			out, err := json.Marshal(p.Apply(v))
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(out))
+		})
+	}
+
+	_, err := websocket.ParseProjectionList(" , ")
+	assert.Error(t, err)
+}
+
+// TestProjectionDelivery tests that subscribers receive only their projected fields
+func TestProjectionDelivery(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 1)
+	go hub.Run()
+	hub.CreateStream("s")
+
+	projection, _ := websocket.ParseProjectionList("id,value")
+	client := websocket.NewMultiplexClient(hub, nil)
+	assert.NoError(t, hub.Subscribe(client, "s", websocket.Options{Projection: projection}))
+
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(`{"id": 1, "value": 2, "extra": [1, 2, 3]}`)})
+	hub.Flush()
+	assert.JSONEq(t, `{"type":"message","stream_id":"s","data":{"id":1,"value":2}}`, string(<-client.Send))
+}
+
+// TestProjectionLongerThanPayload tests that a projection whose encoding is
+// longer than the payload, because characters are escaped, is delivered
+func TestProjectionLongerThanPayload(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 1)
+	go hub.Run()
+	hub.CreateStream("s")
+
+	projection, _ := websocket.ParseProjectionList("a")
+	client := websocket.NewClient(hub, "s", nil)
+	hub.Register(client, websocket.Options{Projection: projection})
+
+	hub.BroadcastMessage(websocket.Message{StreamID: "s", Data: []byte(`{"a":"<<<<<<<<"}`)})
+	hub.Flush()
+	assert.JSONEq(t, `{"a":"<<<<<<<<"}`, string(<-client.Send))
+}
@@ -0,0 +1,243 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+)
+
+// Control message types exchanged on a multiplexed connection
+const (
+	TypeSubscribe    = "subscribe"
+	TypeUnsubscribe  = "unsubscribe"
+	TypeSubscribed   = "subscribed"
+	TypeUnsubscribed = "unsubscribed"
+	TypeMessage      = "message"
+	TypeError        = "error"
+	TypeAck          = "ack"
+	TypeSession      = "session"
+	TypeSessionLost  = "session_lost"
+	TypePublish      = "publish"
+	TypePublished    = "published"
+)
+
+// controlMessage is a request sent by the client, for example
+// {"type":"subscribe","stream_id":"..."}, {"type":"unsubscribe","stream_ids":["...","..."]}
+// or {"type":"subscribe","pattern":"tenant-a/*","selector":"site=A"}. A
+// subscribe may carry a filter such as "temperature > 30 && site == \"A\""
+// and a projection such as "fields":["id","value","/meta/site"], and
+// sample messages with "sample":{"interval":"100ms"}, {"every":10} or
+// {"rate":0.1}. Clients
+// with a session acknowledge frames with {"type":"ack","seq":42}, which
+// covers every frame up to and including that sequence number. Messages are
+// published with {"type":"publish","stream_id":"...","id":"m-1","data":{...}};
+// the optional id is echoed in the published or error reply.
+type controlMessage struct {
+	Type      string          `json:"type"`
+	StreamID  string          `json:"stream_id,omitempty"`
+	StreamIDs []string        `json:"stream_ids,omitempty"`
+	Pattern   string          `json:"pattern,omitempty"`
+	Selector  string          `json:"selector,omitempty"`
+	Filter    string          `json:"filter,omitempty"`
+	Fields    []string        `json:"fields,omitempty"`
+	Sample    *sampleRequest  `json:"sample,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// sampleRequest is the sampling requested by a subscribe
+type sampleRequest struct {
+	Rate     float64 `json:"rate"`
+	Every    int64   `json:"every"`
+	Interval string  `json:"interval"`
+}
+
+// controlReply acknowledges or rejects a control message
+type controlReply struct {
+	Type      string   `json:"type"`
+	ID        string   `json:"id,omitempty"`
+	StreamID  string   `json:"stream_id,omitempty"`
+	StreamIDs []string `json:"stream_ids,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Selector  string   `json:"selector,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Code      int      `json:"code,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	Window    int      `json:"window,omitempty"`
+	Resumed   bool     `json:"resumed,omitempty"`
+}
+
+// dataFrame wraps a payload delivered on a multiplexed connection
+type dataFrame struct {
+	Type     string          `json:"type"`
+	StreamID string          `json:"stream_id"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// handleControl parses and applies a control message read from the client
+func (c *Client) handleControl(raw []byte) {
+	if c.ingest {
+		c.handleIngest(raw)
+		return
+	}
+
+	var msg controlMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		c.replyError("", "invalid control message")
+		return
+	}
+	if !c.Multiplexed {
+		c.replyError("", "subscriptions are fixed on this endpoint; use /ws")
+		return
+	}
+
+	switch msg.Type {
+	case TypeAck:
+		c.handleAck(msg.Seq)
+		return
+	case TypePublish:
+		c.publish(msg.ID, msg.StreamID, codec.JSON, msg.Data)
+		return
+	}
+
+	opts, err := msg.options()
+	if err != nil {
+		c.replyError(msg.StreamID, err.Error())
+		return
+	}
+
+	if msg.Pattern != "" || msg.Selector != "" {
+		c.handlePatternControl(msg, opts)
+		return
+	}
+
+	ids := msg.StreamIDs
+	if msg.StreamID != "" {
+		ids = append(ids, msg.StreamID)
+	}
+	if len(ids) == 0 {
+		c.replyError("", "stream_id, pattern or selector is required")
+		return
+	}
+
+	for _, id := range ids {
+		switch msg.Type {
+		case TypeSubscribe:
+			if err := c.Hub.Subscribe(c, id, opts); err != nil {
+				c.replyError(id, err.Error())
+				continue
+			}
+			c.reply(controlReply{Type: TypeSubscribed, StreamID: id})
+		case TypeUnsubscribe:
+			if err := c.Hub.Unsubscribe(c, id); err != nil {
+				c.replyError(id, err.Error())
+				continue
+			}
+			c.reply(controlReply{Type: TypeUnsubscribed, StreamID: id})
+		default:
+			c.replyError(id, "unknown control message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// handlePatternControl applies a subscribe or unsubscribe by pattern or label selector
+func (c *Client) handlePatternControl(msg controlMessage, opts Options) {
+	sel, err := ParseSelector(msg.Pattern, msg.Selector)
+	if err != nil {
+		c.reply(controlReply{Type: TypeError, Pattern: msg.Pattern, Selector: msg.Selector, Error: err.Error()})
+		return
+	}
+
+	switch msg.Type {
+	case TypeSubscribe:
+		attached, err := c.Hub.SubscribePattern(c, sel, opts)
+		if err != nil {
+			c.reply(controlReply{Type: TypeError, Pattern: sel.Pattern, Selector: sel.Labels, Error: err.Error()})
+			return
+		}
+		c.reply(controlReply{Type: TypeSubscribed, StreamIDs: attached, Pattern: sel.Pattern, Selector: sel.Labels})
+	case TypeUnsubscribe:
+		if err := c.Hub.UnsubscribePattern(c, sel); err != nil {
+			c.reply(controlReply{Type: TypeError, Pattern: sel.Pattern, Selector: sel.Labels, Error: err.Error()})
+			return
+		}
+		c.reply(controlReply{Type: TypeUnsubscribed, Pattern: sel.Pattern, Selector: sel.Labels})
+	default:
+		c.replyError("", "unknown control message type "+msg.Type)
+	}
+}
+
+// handleAck releases acknowledged frames and wakes the write pump if the
+// window was full
+func (c *Client) handleAck(seq uint64) {
+	if c.ack == nil {
+		c.replyError("", "acknowledgements are not enabled; connect with /ws?ack=true")
+		return
+	}
+	if c.ack.ack(seq) > 0 {
+		select {
+		case c.acked <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// options compiles the delivery options carried by a subscribe message
+func (msg controlMessage) options() (Options, error) {
+	var opts Options
+	if msg.Filter != "" {
+		filter, err := expr.Compile(msg.Filter)
+		if err != nil {
+			return opts, err
+		}
+		opts.Filter = filter
+	}
+	if len(msg.Fields) > 0 {
+		projection, err := ParseProjection(msg.Fields)
+		if err != nil {
+			return opts, err
+		}
+		opts.Projection = projection
+	}
+	if msg.Sample != nil {
+		var interval time.Duration
+		if msg.Sample.Interval != "" {
+			var err error
+			if interval, err = time.ParseDuration(msg.Sample.Interval); err != nil {
+				return opts, err
+			}
+		}
+		sample, err := NewSampling(msg.Sample.Rate, msg.Sample.Every, interval)
+		if err != nil {
+			return opts, err
+		}
+		opts.Sample = sample
+	}
+	return opts, nil
+}
+
+// reply queues a control reply for the client
+func (c *Client) reply(r controlReply) {
+	frame, _ := json.Marshal(r)
+	c.sendControl(frame)
+}
+
+// replyError queues an error reply for the client
+func (c *Client) replyError(streamID, message string) {
+	c.reply(controlReply{Type: TypeError, StreamID: streamID, Error: message})
+}
+
+// tagFrame wraps a payload in a frame naming the stream it belongs to.
+// Payloads that are not valid JSON are embedded as JSON strings.
+func tagFrame(streamID string, data []byte) []byte {
+	frame, err := json.Marshal(dataFrame{Type: TypeMessage, StreamID: streamID, Data: data})
+	if err != nil {
+		quoted, _ := json.Marshal(string(data))
+		frame, _ = json.Marshal(dataFrame{Type: TypeMessage, StreamID: streamID, Data: quoted})
+	}
+	return frame
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Sampling thins out the messages a subscription delivers, so that one
+// subscriber can follow a fast stream at a lower rate while others receive
+// every message. Exactly one field is set.
+type Sampling struct {
+	// Rate delivers each message with this probability
+	Rate float64
+	// Every delivers the first of every Every messages
+	Every int64
+	// Interval delivers at most one message per interval
+	Interval time.Duration
+}
+
+// NewSampling validates sampling parameters
+func NewSampling(rate float64, every int64, interval time.Duration) (*Sampling, error) {
+	set := 0
+	for _, ok := range []bool{rate != 0, every != 0, interval != 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of sample rate, every and interval is required")
+	}
+	if rate < 0 || rate > 1 {
+		return nil, errors.New("sample rate must be between 0 and 1")
+	}
+	if every < 0 {
+		return nil, errors.New("sample every must be positive")
+	}
+	if interval < 0 {
+		return nil, errors.New("sample interval must be positive")
+	}
+	return &Sampling{Rate: rate, Every: every, Interval: interval}, nil
+}
+
+// ParseSampling validates sampling parameters given as query string values,
+// where empty values are unset. It returns nil when none is set.
+func ParseSampling(rate, every, interval string) (*Sampling, error) {
+	if rate == "" && every == "" && interval == "" {
+		return nil, nil
+	}
+	var s Sampling
+	var err error
+	if rate != "" {
+		if s.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+			return nil, errors.New("sample rate must be a number")
+		}
+	}
+	if every != "" {
+		if s.Every, err = strconv.ParseInt(every, 10, 64); err != nil {
+			return nil, errors.New("sample every must be an integer")
+		}
+	}
+	if interval != "" {
+		if s.Interval, err = time.ParseDuration(interval); err != nil {
+			return nil, errors.New("sample interval must be a duration such as \"100ms\"")
+		}
+	}
+	return NewSampling(s.Rate, s.Every, s.Interval)
+}
+
+// sampler applies a subscription's sampling. It is only used by the loop
+// of the shard that owns the subscription.
+type sampler struct {
+	Sampling
+	seen   int64
+	next   time.Time
+	random *rand.Rand
+}
+
+func newSampler(s Sampling) *sampler {
+	return &sampler{Sampling: s, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// keep decides whether the message broadcast at now is delivered
+func (s *sampler) keep(now time.Time) bool {
+	switch {
+	case s.Rate != 0:
+		return s.random.Float64() < s.Rate
+	case s.Every != 0:
+		keep := s.seen == 0
+		s.seen = (s.seen + 1) % s.Every
+		return keep
+	}
+	if now.Before(s.next) {
+		return false
+	}
+	s.next = now.Add(s.Interval)
+	return true
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StreamInfo describes a stream for pattern and label subscriptions
+type StreamInfo struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+}
+
+// Selector matches streams by a glob over their name and a set of label
+// requirements. Both parts are optional; an empty selector matches nothing.
+type Selector struct {
+	Pattern  string
+	Labels   string
+	required []labelRequirement
+}
+
+// labelRequirement is a single clause of a label selector
+type labelRequirement struct {
+	key     string
+	value   string
+	negate  bool
+	exists  bool
+	present bool
+}
+
+// ParseSelector compiles a glob pattern and a label selector. Patterns use
+// '*' for any run of characters, including '/', and '?' for a single
+// character. Label selectors are comma separated clauses of the form
+// key=value, key!=value, key or !key.
+func ParseSelector(pattern, labels string) (*Selector, error) {
+	if pattern == "" && labels == "" {
+		return nil, fmt.Errorf("a pattern or label selector is required")
+	}
+
+	sel := &Selector{Pattern: pattern, Labels: labels}
+	if labels == "" {
+		return sel, nil
+	}
+
+	for _, clause := range strings.Split(labels, ",") {
+		clause = strings.TrimSpace(clause)
+		var req labelRequirement
+		switch {
+		case strings.Contains(clause, "!="):
+			kv := strings.SplitN(clause, "!=", 2)
+			req = labelRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), negate: true}
+		case strings.Contains(clause, "="):
+			kv := strings.SplitN(clause, "=", 2)
+			req = labelRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1])}
+		case strings.HasPrefix(clause, "!"):
+			req = labelRequirement{key: strings.TrimSpace(clause[1:]), exists: true}
+		default:
+			req = labelRequirement{key: clause, exists: true, present: true}
+		}
+		if req.key == "" {
+			return nil, fmt.Errorf("invalid label selector clause %q", clause)
+		}
+		sel.required = append(sel.required, req)
+	}
+	return sel, nil
+}
+
+// Matches reports whether a stream satisfies the selector. Streams without
+// a name are matched against their ID.
+func (s *Selector) Matches(info StreamInfo) bool {
+	if s.Pattern != "" {
+		name := info.Name
+		if name == "" {
+			name = info.ID
+		}
+		if !globMatch(s.Pattern, name) {
+			return false
+		}
+	}
+
+	for _, req := range s.required {
+		value, ok := info.Labels[req.key]
+		switch {
+		case req.exists:
+			if ok != req.present {
+				return false
+			}
+		case req.negate:
+			if ok && value == req.value {
+				return false
+			}
+		default:
+			if !ok || value != req.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// key identifies the selector among a client's pattern subscriptions
+func (s *Selector) key() string {
+	return s.Pattern + "\x00" + s.Labels
+}
+
+// globMatch reports whether name matches pattern, where '*' matches any
+// sequence of characters and '?' matches exactly one
+func globMatch(pattern, name string) bool {
+	px, nx := 0, 0
+	starPx, starNx := -1, 0
+	for nx < len(name) {
+		switch {
+		case px < len(pattern) && (pattern[px] == '?' || pattern[px] == name[nx]):
+			px++
+			nx++
+		case px < len(pattern) && pattern[px] == '*':
+			starPx, starNx = px, nx
+			px++
+		case starPx >= 0:
+			starNx++
+			px, nx = starPx+1, starNx
+		default:
+			return false
+		}
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
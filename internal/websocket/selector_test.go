@@ -0,0 +1,99 @@
+package websocket_test
+
+import (
+	"testing"
+
+	"github.com/rithindattag/realtime-streaming-api/internal/websocket"
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSelectorMatches tests glob patterns and label selectors
+func TestSelectorMatches(t *testing.T) {
+	stream := websocket.StreamInfo{
+		ID:     "42",
+		Name:   "tenant-a/site-1/temperature",
+		Labels: map[string]string{"site": "A", "kind": "sensor"},
+	}
+
+	testCases := []struct {
+		name     string
+		pattern  string
+		labels   string
+		expected bool
+	}{
+		{"prefix glob", "tenant-a/*", "", true},
+		{"other tenant", "tenant-b/*", "", false},
+		{"single character", "tenant-?/site-1/*", "", true},
+		{"suffix glob", "*/temperature", "", true},
+		{"label equality", "", "site=A", true},
+		{"label mismatch", "", "site=B", false},
+		{"label inequality", "", "site!=B", true},
+		{"label exists", "", "kind", true},
+		{"label absent", "", "!owner", true},
+		{"label present but required absent", "", "!kind", false},
+		{"pattern and labels", "tenant-a/*", "site=A,kind=sensor", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sel, err := websocket.ParseSelector(tc.pattern, tc.labels)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, sel.Matches(stream))
+		})
+	}
+
+	_, err := websocket.ParseSelector("", "")
+	assert.Error(t, err)
+	_, err = websocket.ParseSelector("", "=A")
+	assert.Error(t, err)
+}
+
+// TestPatternAttachesNewStreams tests that streams registered later join matching pattern subscriptions
+func TestPatternAttachesNewStreams(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 4)
+	go hub.Run()
+	hub.RegisterStream(websocket.StreamInfo{ID: "1", Name: "tenant-a/one"})
+	hub.RegisterStream(websocket.StreamInfo{ID: "2", Name: "tenant-b/two"})
+
+	client := websocket.NewMultiplexClient(hub, nil)
+	sel, _ := websocket.ParseSelector("tenant-a/*", "")
+	attached, err := hub.SubscribePattern(client, sel, websocket.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, attached)
+
+	hub.RegisterStream(websocket.StreamInfo{ID: "3", Name: "tenant-a/three"})
+	assert.ElementsMatch(t, []string{"1", "3"}, client.Subscriptions())
+
+	assert.NoError(t, hub.UnsubscribePattern(client, sel))
+	assert.Empty(t, client.Subscriptions())
+}
+
+// TestUnsubscribePatternKeepsOtherSubscriptions tests that removing a
+// pattern only detaches the streams it attached itself
+func TestUnsubscribePatternKeepsOtherSubscriptions(t *testing.T) {
+	hub := websocket.NewShardedHub(logger.NewLogger(), 4)
+	go hub.Run()
+	for id, name := range map[string]string{"1": "tenant-a/one", "2": "tenant-a/two", "3": "tenant-a/three", "4": "tenant-b/four"} {
+		hub.RegisterStream(websocket.StreamInfo{ID: id, Name: name})
+	}
+
+	client := websocket.NewMultiplexClient(hub, nil)
+	assert.NoError(t, hub.Subscribe(client, "1", websocket.Options{}))
+	tenantA, _ := websocket.ParseSelector("tenant-a/*", "")
+	attached, err := hub.SubscribePattern(client, tenantA, websocket.Options{})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2", "3"}, attached)
+	three, _ := websocket.ParseSelector("*/three", "")
+	_, err = hub.SubscribePattern(client, three, websocket.Options{})
+	assert.NoError(t, err)
+
+	// Unsubscribing and subscribing again makes a stream the client's own
+	assert.NoError(t, hub.Unsubscribe(client, "2"))
+	assert.NoError(t, hub.Subscribe(client, "2", websocket.Options{}))
+
+	assert.NoError(t, hub.UnsubscribePattern(client, tenantA))
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, client.Subscriptions())
+	assert.NoError(t, hub.UnsubscribePattern(client, three))
+	assert.ElementsMatch(t, []string{"1", "2"}, client.Subscriptions())
+}
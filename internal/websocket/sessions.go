@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/rithindattag/realtime-streaming-api/internal/metrics"
+)
+
+var (
+	// ErrSessionNotFound is returned when resuming a session that expired or never existed
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionInUse is returned when resuming a session that is still connected
+	ErrSessionInUse = errors.New("session in use")
+)
+
+// StartSession enables acknowledgements on a multiplexed client and
+// registers it so that it can resume after a disconnect. The client is
+// told its session ID and window before any data is sent.
+func (h *Hub) StartSession(client *Client, opts AckOptions) string {
+	client.ack = newAckTracker(opts)
+	client.SessionID = uuid.New().String()
+
+	h.mu.Lock()
+	h.sessions[client.SessionID] = client
+	h.mu.Unlock()
+
+	client.reply(controlReply{Type: TypeSession, SessionID: client.SessionID, Window: client.ack.window})
+	return client.SessionID
+}
+
+// CheckSession reports whether a session can currently be resumed
+func (h *Hub) CheckSession(sessionID string) error {
+	h.mu.RLock()
+	client, ok := h.sessions[sessionID]
+	h.mu.RUnlock()
+	if !ok || client.closed() {
+		return ErrSessionNotFound
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.attached {
+		return ErrSessionInUse
+	}
+	return nil
+}
+
+// Resume attaches a new connection to a detached session. Its
+// subscriptions are kept, and every unacknowledged frame is redelivered
+// once the write pump starts.
+func (h *Hub) Resume(sessionID string, conn *websocket.Conn) (*Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.sessions[sessionID]
+	if !ok || client.closed() {
+		return nil, ErrSessionNotFound
+	}
+	if !client.attach(conn) {
+		return nil, ErrSessionInUse
+	}
+	client.reply(controlReply{Type: TypeSession, SessionID: sessionID, Window: client.ack.window, Resumed: true})
+	return client, nil
+}
+
+// disconnect handles the end of a client's connection. Clients without a
+// session are unregistered; a session stays subscribed and keeps queueing
+// messages for sessionTTL so that the client can resume it.
+func (h *Hub) disconnect(client *Client, conn *websocket.Conn) {
+	if client.ack == nil || client.closed() {
+		h.Unregister(client)
+		return
+	}
+	if !client.detach(conn) {
+		return
+	}
+	client.mu.Lock()
+	client.expiry = time.AfterFunc(sessionTTL, func() { h.expireSession(client) })
+	client.mu.Unlock()
+}
+
+// enqueueSession queues data for a client with a session. Messages that do
+// not fit the send queue wait in the session's backlog rather than going
+// through the stream's slow consumer policy, so that none is lost before it
+// is sequenced. It reports false when the backlog is full.
+func (c *Client) enqueueSession(data []byte) bool {
+	t := c.ack
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.backlog) == 0 && c.offerSession(data) {
+		return true
+	}
+	if len(t.backlog) >= sessionBacklogSize {
+		return false
+	}
+	t.backlog = append(t.backlog, data)
+	return true
+}
+
+// refill moves backlogged messages into the send queue as it drains
+func (c *Client) refill() {
+	t := c.ack
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for n < len(t.backlog) && c.offerSession(t.backlog[n]) {
+		t.backlog[n] = nil
+		n++
+	}
+	if n == len(t.backlog) {
+		t.backlog = nil
+	} else {
+		t.backlog = t.backlog[n:]
+	}
+}
+
+// offerSession attempts a non-blocking send to the send queue
+func (c *Client) offerSession(data []byte) bool {
+	select {
+	case c.Send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// loseSession frees the backlog of a session that overflowed and tells the
+// client. The caller closes the client, which ends the session.
+func (c *Client) loseSession(streamID string) {
+	c.ack.mu.Lock()
+	c.ack.backlog = nil
+	c.ack.mu.Unlock()
+	metrics.WebSocketMessagesDropped.WithLabelValues(streamID, string(PolicyDisconnect)).Inc()
+	c.reply(controlReply{Type: TypeSessionLost, SessionID: c.SessionID, Error: "session backlog overflowed; undelivered messages were lost"})
+}
+
+// expireSession unregisters a session that was not resumed in time
+func (h *Hub) expireSession(client *Client) {
+	h.mu.Lock()
+	client.mu.Lock()
+	attached := client.attached
+	client.mu.Unlock()
+	if !attached {
+		delete(h.sessions, client.SessionID)
+	}
+	h.mu.Unlock()
+
+	if !attached {
+		h.Unregister(client)
+	}
+}
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// UpgradeFastHTTP upgrades a fasthttp request to a WebSocket connection and
+// runs handler on it. The connection is closed when handler returns, so
+// handler should block for the lifetime of the connection.
+func UpgradeFastHTTP(ctx *fasthttp.RequestCtx, handler func(*websocket.Conn)) error {
+	// ctx must not be referenced from the hijack handler, so the request is
+	// converted up front
+	var r http.Request
+	if err := fasthttpadaptor.ConvertRequest(ctx, &r, true); err != nil {
+		return err
+	}
+	if !websocket.IsWebSocketUpgrade(&r) {
+		return fmt.Errorf("not a websocket handshake")
+	}
+
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(c net.Conn) {
+		w := &hijackWriter{conn: c, header: make(http.Header)}
+		conn, err := upgrader.Upgrade(w, &r, nil)
+		if err != nil {
+			return
+		}
+		handler(conn)
+	})
+	return nil
+}
+
+// hijackWriter is the minimal http.ResponseWriter gorilla's Upgrader needs
+// to take over a connection that fasthttp has already hijacked
+type hijackWriter struct {
+	conn        net.Conn
+	header      http.Header
+	wroteHeader bool
+}
+
+// Header returns the response headers, used only for handshake errors
+func (w *hijackWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader writes a plain HTTP status line for handshake errors
+func (w *hijackWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	w.header.Set("Connection", "close")
+	w.header.Write(w.conn)
+	w.conn.Write([]byte("\r\n"))
+}
+
+// Write writes a handshake error body
+func (w *hijackWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.conn.Write(b)
+}
+
+// Hijack hands the connection to the Upgrader
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
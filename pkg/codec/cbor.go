@@ -0,0 +1,294 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// cborIndefinite is the additional information of indefinite length items
+const cborIndefinite = 31
+
+// cborBreak ends an indefinite length item
+const cborBreak = 0xff
+
+// encodeCBOR encodes generic values as CBOR. Object keys are written in
+// sorted order and every length is definite.
+func encodeCBOR(v interface{}) ([]byte, error) {
+	return appendCBOR(nil, v, 0)
+}
+
+func appendCBOR(b []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	switch val := v.(type) {
+	case nil:
+		return append(b, 0xf6), nil
+	case bool:
+		if val {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case int:
+		return appendCBORInt(b, int64(val)), nil
+	case int64:
+		return appendCBORInt(b, val), nil
+	case uint64:
+		return appendCBORHead(b, cborUint, val), nil
+	case float64:
+		b = append(b, 0xfb)
+		return appendUint64(b, math.Float64bits(val)), nil
+	case json.Number:
+		n, err := normalizeJSON(val, depth)
+		if err != nil {
+			return nil, err
+		}
+		return appendCBOR(b, n, depth)
+	case string:
+		b = appendCBORHead(b, cborText, uint64(len(val)))
+		return append(b, val...), nil
+	case []byte:
+		b = appendCBORHead(b, cborBytes, uint64(len(val)))
+		return append(b, val...), nil
+	case []interface{}:
+		b = appendCBORHead(b, cborArray, uint64(len(val)))
+		for _, elem := range val {
+			var err error
+			if b, err = appendCBOR(b, elem, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendCBORHead(b, cborMap, uint64(len(val)))
+		for _, k := range sortedKeys(val) {
+			b = appendCBORHead(b, cborText, uint64(len(k)))
+			b = append(b, k...)
+			var err error
+			if b, err = appendCBOR(b, val[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("codec: cannot encode %T as cbor", v)
+}
+
+func appendCBORInt(b []byte, n int64) []byte {
+	if n >= 0 {
+		return appendCBORHead(b, cborUint, uint64(n))
+	}
+	return appendCBORHead(b, cborNegInt, uint64(-(n + 1)))
+}
+
+// appendCBORHead writes the initial byte and argument of an item
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return append(b, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		b = append(b, major|26)
+		return appendUint32(b, uint32(n))
+	}
+	b = append(b, major|27)
+	return appendUint64(b, n)
+}
+
+// decodeCBOR decodes a single CBOR data item
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := &binaryDecoder{data: data}
+	v, err := d.cbor(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("codec: trailing data after cbor item")
+	}
+	return v, nil
+}
+
+// cborHead reads the major type, additional information and argument of
+// the next item
+func (d *binaryDecoder) cborHead() (major byte, info byte, arg uint64, err error) {
+	b, err := d.take(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		arg, err = d.uint(1 << (info - 24))
+	case info == cborIndefinite:
+	default:
+		err = fmt.Errorf("codec: invalid cbor additional information %d", info)
+	}
+	return major, info, arg, err
+}
+
+func (d *binaryDecoder) cbor(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	major, info, arg, err := d.cborHead()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+		return int64(arg), nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		var raw []byte
+		if indefinite {
+			if raw, err = d.cborChunks(major); err != nil {
+				return nil, err
+			}
+		} else {
+			if arg > uint64(len(d.data)-d.pos) {
+				return nil, errShort
+			}
+			chunk, _ := d.take(int(arg))
+			raw = append([]byte(nil), chunk...)
+		}
+		if major == cborText {
+			return string(raw), nil
+		}
+		return raw, nil
+	case cborArray:
+		var arr []interface{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.cborAtBreak() {
+				break
+			}
+			v, err := d.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		if arr == nil {
+			arr = []interface{}{}
+		}
+		return arr, nil
+	case cborMap:
+		m := make(map[string]interface{})
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.cborAtBreak() {
+				break
+			}
+			k, err := d.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, err := mapKey(k)
+			if err != nil {
+				return nil, err
+			}
+			if m[key], err = d.cbor(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		// Tags only annotate the item that follows, which is kept as is
+		return d.cbor(depth + 1)
+	}
+
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, fmt.Errorf("codec: unsupported cbor simple value %d", info)
+}
+
+// cborAtBreak consumes the break byte ending an indefinite length item
+func (d *binaryDecoder) cborAtBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// cborChunks concatenates the definite length chunks of an indefinite string
+func (d *binaryDecoder) cborChunks(major byte) ([]byte, error) {
+	raw := []byte{}
+	for !d.cborAtBreak() {
+		m, info, arg, err := d.cborHead()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || info == cborIndefinite {
+			return nil, errors.New("codec: invalid cbor string chunk")
+		}
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errShort
+		}
+		chunk, _ := d.take(int(arg))
+		raw = append(raw, chunk...)
+	}
+	return raw, nil
+}
+
+// halfToFloat converts an IEEE 754 half precision float
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
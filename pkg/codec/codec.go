@@ -0,0 +1,252 @@
+// Package codec converts message payloads between the wire formats the API
+// accepts: JSON, MessagePack, CBOR and Protobuf. Payloads are decoded into
+// the same generic values encoding/json produces (maps, slices, strings,
+// bools, nil and numbers), with int64 and uint64 kept for exact integers
+// and []byte for binary strings.
+//
+// Protobuf payloads cannot be decoded without their schema, so they are
+// passed through unchanged; pkg/schema converts them given a Protobuf
+// schema.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format identifies a payload encoding
+type Format string
+
+const (
+	JSON     Format = "json"
+	MsgPack  Format = "msgpack"
+	CBOR     Format = "cbor"
+	Protobuf Format = "protobuf"
+)
+
+// maxDepth bounds the nesting of decoded payloads
+const maxDepth = 100
+
+var (
+	// ErrOpaque is returned when a payload cannot be decoded without a schema
+	ErrOpaque = errors.New("codec: protobuf payloads cannot be decoded without a schema")
+	// ErrNotObject is returned when a payload is valid but not an object
+	ErrNotObject = errors.New("codec: payload must be an object")
+	// ErrTooDeep is returned when a payload nests beyond maxDepth
+	ErrTooDeep = errors.New("codec: payload nested too deeply")
+)
+
+// contentTypes maps media types to formats; the first entry per format is canonical
+var contentTypes = []struct {
+	mediaType string
+	format    Format
+}{
+	{"application/json", JSON},
+	{"application/msgpack", MsgPack},
+	{"application/x-msgpack", MsgPack},
+	{"application/vnd.msgpack", MsgPack},
+	{"application/cbor", CBOR},
+	{"application/x-protobuf", Protobuf},
+	{"application/protobuf", Protobuf},
+	{"application/vnd.google.protobuf", Protobuf},
+}
+
+// Formats returns every supported format
+func Formats() []Format {
+	return []Format{JSON, MsgPack, CBOR, Protobuf}
+}
+
+// Parse validates a format name. An empty name yields JSON.
+func Parse(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case "":
+		return JSON, nil
+	case JSON, MsgPack, CBOR, Protobuf:
+		return f, nil
+	}
+	return "", fmt.Errorf("codec: unknown format %q", name)
+}
+
+// ContentType returns the canonical media type of the format
+func (f Format) ContentType() string {
+	for _, ct := range contentTypes {
+		if ct.format == f {
+			return ct.mediaType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// Binary reports whether payloads of the format are binary rather than text
+func (f Format) Binary() bool {
+	return f != JSON
+}
+
+// FromContentType returns the format of a Content-Type header. An empty
+// header yields JSON.
+func FromContentType(contentType string) (Format, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("codec: invalid content type %q", contentType)
+	}
+	for _, ct := range contentTypes {
+		if ct.mediaType == mediaType {
+			return ct.format, nil
+		}
+	}
+	if strings.HasSuffix(mediaType, "+json") {
+		return JSON, nil
+	}
+	return "", fmt.Errorf("codec: unsupported content type %q", mediaType)
+}
+
+// Negotiate picks the preferred supported format of an Accept header. An
+// empty header or a wildcard yields JSON.
+func Negotiate(accept string) (Format, error) {
+	if strings.TrimSpace(accept) == "" {
+		return JSON, nil
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{mediaType, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if c.mediaType == "*/*" || c.mediaType == "application/*" {
+			return JSON, nil
+		}
+		if f, err := FromContentType(c.mediaType); err == nil {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("codec: none of %q is supported", accept)
+}
+
+// Decode decodes a payload into generic values
+func Decode(f Format, data []byte) (interface{}, error) {
+	switch f {
+	case JSON:
+		return decodeJSON(data)
+	case MsgPack:
+		return decodeMsgPack(data)
+	case CBOR:
+		return decodeCBOR(data)
+	case Protobuf:
+		return nil, ErrOpaque
+	}
+	return nil, fmt.Errorf("codec: unknown format %q", f)
+}
+
+// Encode encodes generic values
+func Encode(f Format, v interface{}) ([]byte, error) {
+	switch f {
+	case JSON:
+		return encodeJSON(v)
+	case MsgPack:
+		return encodeMsgPack(v)
+	case CBOR:
+		return encodeCBOR(v)
+	case Protobuf:
+		return nil, ErrOpaque
+	}
+	return nil, fmt.Errorf("codec: unknown format %q", f)
+}
+
+// Convert re-encodes a payload from one format to another. Payloads are
+// returned unchanged when both formats are the same.
+func Convert(data []byte, from, to Format) ([]byte, error) {
+	if from == to {
+		return data, nil
+	}
+	v, err := Decode(from, data)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(to, v)
+}
+
+// ValidateObject checks that a payload is a well-formed object without
+// re-encoding it. JSON is checked without building any values. Protobuf
+// payloads are opaque and only need to be non-empty.
+func ValidateObject(f Format, data []byte) error {
+	if f == JSON {
+		return validateJSON(data)
+	}
+	if _, err := DecodeObject(f, data); err != nil && err != ErrOpaque {
+		return err
+	}
+	return nil
+}
+
+// DecodeObject decodes a payload that must be an object. Protobuf payloads
+// that are not empty yield ErrOpaque.
+func DecodeObject(f Format, data []byte) (map[string]interface{}, error) {
+	if f == Protobuf {
+		if len(data) == 0 {
+			return nil, errors.New("codec: empty payload")
+		}
+		return nil, ErrOpaque
+	}
+	v, err := Decode(f, data)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrNotObject
+	}
+	return obj, nil
+}
+
+// sortedKeys returns the keys of an object in a stable order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mapKey converts a decoded map key to a string. Binary formats allow
+// any key type, but the shared representation only has string keys.
+func mapKey(k interface{}) (string, error) {
+	switch key := k.(type) {
+	case string:
+		return key, nil
+	case []byte:
+		return string(key), nil
+	case int64:
+		return strconv.FormatInt(key, 10), nil
+	case uint64:
+		return strconv.FormatUint(key, 10), nil
+	case bool:
+		return strconv.FormatBool(key), nil
+	}
+	return "", fmt.Errorf("codec: unsupported map key type %T", k)
+}
@@ -0,0 +1,227 @@
+package codec_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+// TestEncodeKnownVectors tests encodings against reference bytes
+func TestEncodeKnownVectors(t *testing.T) {
+	value := map[string]interface{}{
+		"a": int64(1),
+		"b": []interface{}{true, nil, "x"},
+		"c": int64(-300),
+	}
+
+	msgpack, err := codec.Encode(codec.MsgPack, value)
+	require.NoError(t, err)
+	assert.Equal(t, "83a16101a16293c3c0a178a163d1fed4", hex.EncodeToString(msgpack))
+
+	cbor, err := codec.Encode(codec.CBOR, value)
+	require.NoError(t, err)
+	assert.Equal(t, "a3616101616283f5f66178616339012b", hex.EncodeToString(cbor))
+}
+
+// TestDecodeCBORVectors tests decoding examples from RFC 8949 appendix A
+func TestDecodeCBORVectors(t *testing.T) {
+	testCases := []struct {
+		hex      string
+		expected interface{}
+	}{
+		{"1903e8", int64(1000)},
+		{"3903e7", int64(-1000)},
+		{"1bffffffffffffffff", uint64(18446744073709551615)},
+		{"f93c00", 1.0},
+		{"f97bff", 65504.0},
+		{"fa47c35000", 100000.0},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"bf61610161629f0203ffff", map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.hex, func(t *testing.T) {
+			v, err := codec.Decode(codec.CBOR, mustHex(t, tc.hex))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v)
+		})
+	}
+}
+
+// TestDecodeMsgPackTypes tests decoding the MessagePack type families
+func TestDecodeMsgPackTypes(t *testing.T) {
+	testCases := []struct {
+		hex      string
+		expected interface{}
+	}{
+		{"ff", int64(-1)},
+		{"cd0100", int64(256)},
+		{"d3fffffffffffffffe", int64(-2)},
+		{"cfffffffffffffffff", uint64(18446744073709551615)},
+		{"ca3fc00000", 1.5},
+		{"d90568656c6c6f", "hello"},
+		{"c4020102", []byte{1, 2}},
+		{"dc0002c2c3", []interface{}{false, true}},
+		{"d6ff00000000", "1970-01-01T00:00:00Z"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.hex, func(t *testing.T) {
+			v, err := codec.Decode(codec.MsgPack, mustHex(t, tc.hex))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v)
+		})
+	}
+}
+
+// TestConvertKeepsIntegerPrecision tests that integers beyond float64
+// precision survive a round trip through every decodable format
+func TestConvertKeepsIntegerPrecision(t *testing.T) {
+	original := []byte(`{"id":9007199254740993,"big":18446744073709551615,"v":1.25,"tags":["a"],"ok":null}`)
+
+	msgpack, err := codec.Convert(original, codec.JSON, codec.MsgPack)
+	require.NoError(t, err)
+	cbor, err := codec.Convert(msgpack, codec.MsgPack, codec.CBOR)
+	require.NoError(t, err)
+	back, err := codec.Convert(cbor, codec.CBOR, codec.JSON)
+	require.NoError(t, err)
+
+	assert.JSONEq(t, string(original), string(back))
+	assert.Contains(t, string(back), "9007199254740993")
+}
+
+// TestConvertSameFormatIsIdentity tests that payloads are untouched when no conversion is needed
+func TestConvertSameFormatIsIdentity(t *testing.T) {
+	original := []byte(`{"b": 1.000, "a": 2}`)
+	out, err := codec.Convert(original, codec.JSON, codec.JSON)
+	require.NoError(t, err)
+	assert.Equal(t, original, out)
+
+	_, err = codec.Convert([]byte{0x08, 0x01}, codec.Protobuf, codec.JSON)
+	assert.Equal(t, codec.ErrOpaque, err)
+}
+
+// TestMalformedPayloads tests that truncated and hostile payloads are rejected
+func TestMalformedPayloads(t *testing.T) {
+	testCases := []struct {
+		format codec.Format
+		hex    string
+	}{
+		{codec.MsgPack, "dc"},
+		{codec.MsgPack, "dbffffffff"},
+		{codec.MsgPack, "c1"},
+		{codec.MsgPack, "0101"},
+		{codec.CBOR, "9b00000000ffffffff"},
+		{codec.CBOR, "7f6161"},
+		{codec.CBOR, "ff"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.format)+"/"+tc.hex, func(t *testing.T) {
+			_, err := codec.Decode(tc.format, mustHex(t, tc.hex))
+			assert.Error(t, err)
+		})
+	}
+
+	deep := make([]byte, 200)
+	for i := range deep {
+		deep[i] = 0x91
+	}
+	_, err := codec.Decode(codec.MsgPack, append(deep, 0xc0))
+	assert.Equal(t, codec.ErrTooDeep, err)
+}
+
+// TestValidateObject tests ingest validation
+func TestValidateObject(t *testing.T) {
+	assert.NoError(t, codec.ValidateObject(codec.JSON, []byte(`{"a":1}`)))
+	assert.Equal(t, codec.ErrNotObject, codec.ValidateObject(codec.JSON, []byte(`[1]`)))
+	assert.Error(t, codec.ValidateObject(codec.JSON, []byte(`{"a":1} {}`)))
+	assert.Error(t, codec.ValidateObject(codec.JSON, []byte(`{"a":}`)))
+	assert.Error(t, codec.ValidateObject(codec.JSON, nil))
+	for _, tc := range []string{` []`, `"a"`, `1`, `null`} {
+		assert.Equal(t, codec.ErrNotObject, codec.ValidateObject(codec.JSON, []byte(tc)), tc)
+	}
+	assert.NoError(t, codec.ValidateObject(codec.MsgPack, mustHex(t, "81a16101")))
+	assert.NoError(t, codec.ValidateObject(codec.Protobuf, []byte{0x08, 0x01}))
+	assert.Error(t, codec.ValidateObject(codec.Protobuf, nil))
+}
+
+// benchmarkPayload is a representative sensor reading
+var benchmarkPayload = []byte(`{"device_id":"sensor-0042","site":"A","temperature":21.75,"humidity":48,` +
+	`"sequence":9007199254740993,"tags":["roof","north"],"reading":{"unit":"C","raw":[2175,2176,2174],` +
+	`"calibrated":true},"note":"nightly batch \u00e9t\u00e9","ts":"2024-05-01T12:00:00Z"}`)
+
+// BenchmarkIngestValidation compares ways of checking a JSON payload before
+// producing it: the original decode into a map and re-marshal, a full
+// decode, and the check without decoding
+func BenchmarkIngestValidation(b *testing.B) {
+	b.Run("remarshal", func(b *testing.B) {
+		b.SetBytes(int64(len(benchmarkPayload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var data map[string]interface{}
+			if err := json.Unmarshal(benchmarkPayload, &data); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := json.Marshal(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.SetBytes(int64(len(benchmarkPayload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := codec.DecodeObject(codec.JSON, benchmarkPayload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("validate", func(b *testing.B) {
+		b.SetBytes(int64(len(benchmarkPayload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := codec.ValidateObject(codec.JSON, benchmarkPayload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestContentNegotiation tests Content-Type and Accept handling
+func TestContentNegotiation(t *testing.T) {
+	f, err := codec.FromContentType("application/json; charset=utf-8")
+	require.NoError(t, err)
+	assert.Equal(t, codec.JSON, f)
+
+	f, err = codec.FromContentType("application/x-msgpack")
+	require.NoError(t, err)
+	assert.Equal(t, codec.MsgPack, f)
+
+	_, err = codec.FromContentType("text/csv")
+	assert.Error(t, err)
+
+	f, err = codec.Negotiate("application/cbor;q=0.5, application/x-protobuf")
+	require.NoError(t, err)
+	assert.Equal(t, codec.Protobuf, f)
+
+	f, err = codec.Negotiate("text/html, */*;q=0.1")
+	require.NoError(t, err)
+	assert.Equal(t, codec.JSON, f)
+
+	_, err = codec.Negotiate("text/html")
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// decodeJSON decodes a JSON document, keeping integers exact
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("codec: trailing data after JSON document")
+	}
+	return normalizeJSON(v, 0)
+}
+
+// validateJSON checks that data is a single well-formed JSON object
+func validateJSON(data []byte) error {
+	if !json.Valid(data) {
+		return errors.New("codec: malformed JSON document")
+	}
+	if bytes.TrimLeft(data, " \t\r\n")[0] != '{' {
+		return ErrNotObject
+	}
+	return nil
+}
+
+// normalizeJSON replaces json.Number with int64, uint64 or float64
+func normalizeJSON(v interface{}, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	switch node := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(node), 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(node), 10, 64); err == nil {
+			return u, nil
+		}
+		return node.Float64()
+	case map[string]interface{}:
+		for k, child := range node {
+			n, err := normalizeJSON(child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			node[k] = n
+		}
+	case []interface{}:
+		for i, child := range node {
+			n, err := normalizeJSON(child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = n
+		}
+	}
+	return v, nil
+}
+
+// encodeJSON encodes generic values as JSON. Binary strings are encoded as
+// base64 strings, as encoding/json does.
+func encodeJSON(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
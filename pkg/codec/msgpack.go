@@ -0,0 +1,363 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// errShort is returned when a binary payload ends in the middle of a value
+var errShort = errors.New("codec: unexpected end of payload")
+
+// msgpackTimestamp is the extension type of MessagePack timestamps
+const msgpackTimestamp = -1
+
+// encodeMsgPack encodes generic values as MessagePack. Object keys are
+// written in sorted order.
+func encodeMsgPack(v interface{}) ([]byte, error) {
+	return appendMsgPack(nil, v, 0)
+}
+
+func appendMsgPack(b []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	switch val := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if val {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendMsgPackInt(b, int64(val)), nil
+	case int64:
+		return appendMsgPackInt(b, val), nil
+	case uint64:
+		if val <= math.MaxInt64 {
+			return appendMsgPackInt(b, int64(val)), nil
+		}
+		b = append(b, 0xcf)
+		return appendUint64(b, val), nil
+	case float64:
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(val)), nil
+	case json.Number:
+		n, err := normalizeJSON(val, depth)
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgPack(b, n, depth)
+	case string:
+		b = appendMsgPackLen(b, len(val), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(b, val...), nil
+	case []byte:
+		b = appendMsgPackLen(b, len(val), 0, 0, 0xc4, 0xc5, 0xc6)
+		return append(b, val...), nil
+	case []interface{}:
+		b = appendMsgPackLen(b, len(val), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, elem := range val {
+			var err error
+			if b, err = appendMsgPack(b, elem, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgPackLen(b, len(val), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(val) {
+			b = appendMsgPackLen(b, len(k), 0xa0, 32, 0xd9, 0xda, 0xdb)
+			b = append(b, k...)
+			var err error
+			if b, err = appendMsgPack(b, val[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("codec: cannot encode %T as msgpack", v)
+}
+
+// appendMsgPackInt writes an integer in its shortest form
+func appendMsgPackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return append(b, 0xcd, byte(n>>8), byte(n))
+	case n >= 0 && n <= math.MaxUint32:
+		b = append(b, 0xce)
+		return appendUint32(b, uint32(n))
+	case n >= 0:
+		b = append(b, 0xcf)
+		return appendUint64(b, uint64(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return append(b, 0xd1, byte(n>>8), byte(n))
+	case n >= math.MinInt32:
+		b = append(b, 0xd2)
+		return appendUint32(b, uint32(n))
+	}
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(n))
+}
+
+// appendMsgPackLen writes a length header. fix is the fixed-size prefix
+// usable below fixMax (0 when the type has none) and code8 the 8-bit form
+// (0 when the type has none).
+func appendMsgPackLen(b []byte, n int, fix byte, fixMax int, code8, code16, code32 byte) []byte {
+	switch {
+	case fixMax > 0 && n < fixMax:
+		return append(b, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		return append(b, code8, byte(n))
+	case n <= math.MaxUint16:
+		return append(b, code16, byte(n>>8), byte(n))
+	}
+	b = append(b, code32)
+	return appendUint32(b, uint32(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return append(b, byte(n>>56), byte(n>>48), byte(n>>40), byte(n>>32), byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// decodeMsgPack decodes a single MessagePack value
+func decodeMsgPack(data []byte) (interface{}, error) {
+	d := &binaryDecoder{data: data}
+	v, err := d.msgpack(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("codec: trailing data after msgpack value")
+	}
+	return v, nil
+}
+
+// binaryDecoder reads values from a binary payload
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+// take returns the next n bytes
+func (d *binaryDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes
+func (d *binaryDecoder) uint(n int) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// length reads an n-byte length and checks that it fits in the payload
+func (d *binaryDecoder) length(n int) (int, error) {
+	v, err := d.uint(n)
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(len(d.data)-d.pos) {
+		return 0, errShort
+	}
+	return int(v), nil
+}
+
+func (d *binaryDecoder) msgpack(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	b, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.msgpackString(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.msgpackArray(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return d.msgpackMap(int(c&0x0f), depth)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.take(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackExt(n)
+	case 0xca:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(bits))), nil
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxInt64 {
+			return v, nil
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.msgpackExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackString(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackMap(n, depth)
+	}
+	return nil, fmt.Errorf("codec: invalid msgpack type byte 0x%02x", c)
+}
+
+func (d *binaryDecoder) msgpackString(n int) (interface{}, error) {
+	raw, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+func (d *binaryDecoder) msgpackArray(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errShort
+	}
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := d.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (d *binaryDecoder) msgpackMap(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, err := mapKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if m[key], err = d.msgpack(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// msgpackExt decodes an extension value of n data bytes. Only timestamps
+// are understood; they decode to RFC 3339 strings.
+func (d *binaryDecoder) msgpackExt(n int) (interface{}, error) {
+	t, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(t[0]) != msgpackTimestamp {
+		return nil, fmt.Errorf("codec: unsupported msgpack extension type %d", int8(t[0]))
+	}
+
+	var ts time.Time
+	switch n {
+	case 4:
+		ts = time.Unix(int64(binary.BigEndian.Uint32(raw)), 0)
+	case 8:
+		v := binary.BigEndian.Uint64(raw)
+		ts = time.Unix(int64(v&0x3ffffffff), int64(v>>34))
+	case 12:
+		ts = time.Unix(int64(binary.BigEndian.Uint64(raw[4:])), int64(binary.BigEndian.Uint32(raw)))
+	default:
+		return nil, fmt.Errorf("codec: invalid msgpack timestamp length %d", n)
+	}
+	return ts.UTC().Format(time.RFC3339Nano), nil
+}
@@ -0,0 +1,378 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// node is an element of the syntax tree
+type node interface {
+	eval(data interface{}) (interface{}, error)
+}
+
+// literalNode is a constant
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+// pathNode looks up a field of the message. Segments are strings for
+// object keys and ints for array indexes. Missing fields evaluate to null.
+type pathNode struct {
+	segments []interface{}
+}
+
+func (n *pathNode) eval(data interface{}) (interface{}, error) {
+	v, _ := lookup(data, n.segments)
+	return v, nil
+}
+
+// lookup walks a decoded JSON value and reports whether the path exists
+func lookup(data interface{}, segments []interface{}) (interface{}, bool) {
+	v := data
+	for _, seg := range segments {
+		switch key := seg.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = obj[key]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || key >= len(arr) {
+				return nil, false
+			}
+			v = arr[key]
+		}
+	}
+	return v, true
+}
+
+// unaryNode applies a prefix operator
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(data interface{}) (interface{}, error) {
+	v, err := n.operand.eval(data)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expr: operator ! needs a boolean, got %T", v)
+		}
+		return !b, nil
+	default:
+		if v == nil {
+			return nil, nil
+		}
+		if i, ok := toInt(v); ok && i != math.MinInt64 {
+			return -i, nil
+		}
+		f, ok := toNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("expr: operator - needs a number, got %T", v)
+		}
+		return -f, nil
+	}
+}
+
+// binaryNode applies an infix operator
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(data interface{}) (interface{}, error) {
+	left, err := n.left.eval(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expr: operator %s needs booleans, got %T", n.op, left)
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		right, err := n.right.eval(data)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expr: operator %s needs booleans, got %T", n.op, right)
+		}
+		return rb, nil
+	}
+
+	right, err := n.right.eval(data)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "+", "-", "*", "/", "%":
+		return arithmetic(n.op, left, right)
+	}
+	return compare(n.op, left, right)
+}
+
+// conditionalNode picks one of two branches
+type conditionalNode struct {
+	cond, then, otherwise node
+}
+
+func (n *conditionalNode) eval(data interface{}) (interface{}, error) {
+	v, err := n.cond.eval(data)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("expr: condition needs a boolean, got %T", v)
+	}
+	if b {
+		return n.then.eval(data)
+	}
+	return n.otherwise.eval(data)
+}
+
+// hasNode reports whether a field exists, even if its value is null
+type hasNode struct {
+	segments []interface{}
+}
+
+func (n *hasNode) eval(data interface{}) (interface{}, error) {
+	_, ok := lookup(data, n.segments)
+	return ok, nil
+}
+
+// callNode applies a built-in function
+type callNode struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []node
+}
+
+func (n *callNode) eval(data interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("expr: %s(): %v", n.name, err)
+	}
+	return v, nil
+}
+
+// arithmetic applies an arithmetic operator. Integers stay exact unless
+// the result overflows or the operator is division; + also concatenates
+// strings. A null operand yields null, so that computations over optional
+// fields do not fail.
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	if op == "+" {
+		if ls, ok := left.(string); ok {
+			rs, ok := right.(string)
+			if !ok {
+				return nil, fmt.Errorf("expr: operator + cannot add %T to a string", right)
+			}
+			if len(ls)+len(rs) > maxStringLength {
+				return nil, fmt.Errorf("expr: string longer than %d bytes", maxStringLength)
+			}
+			return ls + rs, nil
+		}
+	}
+
+	if li, ok := toInt(left); ok {
+		if ri, ok := toInt(right); ok {
+			if v, ok := intArithmetic(op, li, ri); ok {
+				return v, nil
+			}
+		}
+	}
+
+	lf, lok := toNumber(left)
+	rf, rok := toNumber(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("expr: operator %s needs numbers, got %T and %T", op, left, right)
+	}
+	switch op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("expr: division by zero")
+		}
+		return lf / rf, nil
+	default:
+		if rf == 0 {
+			return nil, fmt.Errorf("expr: modulo by zero")
+		}
+		return math.Mod(lf, rf), nil
+	}
+}
+
+// intArithmetic applies an operator to integers, reporting false when the
+// result is not an exact integer
+func intArithmetic(op string, a, b int64) (int64, bool) {
+	switch op {
+	case "+":
+		c := a + b
+		return c, (c > a) == (b > 0)
+	case "-":
+		c := a - b
+		return c, (c < a) == (b > 0)
+	case "*":
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		c := a * b
+		return c, c/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)
+	case "%":
+		if b == 0 || b == -1 {
+			return 0, false
+		}
+		return a % b, true
+	}
+	return 0, false
+}
+
+// compare applies a comparison operator. Numbers compare numerically and
+// strings lexically; other values only support equality. Ordering a null
+// or mismatched pair is false rather than an error so that predicates over
+// optional fields simply do not match.
+func compare(op string, left, right interface{}) (interface{}, error) {
+	switch op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	}
+
+	if lf, ok := toNumber(left); ok {
+		if rf, ok := toNumber(right); ok {
+			return order(op, compareFloat(lf, rf)), nil
+		}
+		return false, nil
+	}
+	if ls, ok := left.(string); ok {
+		if rs, ok := right.(string); ok {
+			return order(op, compareString(ls, rs)), nil
+		}
+	}
+	return false, nil
+}
+
+// order maps a three-way comparison result onto an ordering operator
+func order(op string, cmp int) bool {
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareString(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// equal compares two decoded JSON scalars
+func equal(a, b interface{}) bool {
+	if af, ok := toNumber(a); ok {
+		bf, ok := toNumber(b)
+		return ok && af == bf
+	}
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	}
+	return false
+}
+
+// toInt converts integer values, including uint64 values that fit in an int64
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// toNumber converts the numeric types produced by JSON decoding
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+// Package expr implements a small expression language evaluated against
+// decoded JSON messages, for example:
+//
+//	temperature > 30 && site == "A"
+//	$.readings[0].value >= 10 || !active
+//	value * 1.8 + 32
+//	has(user.id) ? lower(user.name) : "anonymous"
+//
+// Besides comparisons and boolean logic it supports arithmetic, string
+// concatenation with +, the conditional operator and built-in functions:
+// has, len, lower, upper, trim, contains, startsWith, endsWith, abs,
+// floor, ceil, round, min, max, string, number and coalesce.
+//
+// Expressions have no loops, and their size and nesting are limited at
+// compile time, so evaluation cost is bounded by Cost.
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Expr is a compiled expression. It is safe for concurrent use.
+type Expr struct {
+	source string
+	root   node
+	nodes  int
+}
+
+// Compile parses an expression
+func Compile(source string) (*Expr, error) {
+	root, nodes, err := parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("expr: %v", err)
+	}
+	return &Expr{source: source, root: root, nodes: nodes}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Cost returns the number of nodes of the expression, which bounds the
+// steps an evaluation takes
+func (e *Expr) Cost() int {
+	return e.nodes
+}
+
+// Eval evaluates the expression against a decoded JSON value
+func (e *Expr) Eval(data interface{}) (interface{}, error) {
+	return e.root.eval(data)
+}
+
+// Match evaluates the expression as a predicate. Results that are not
+// booleans are an error.
+func (e *Expr) Match(data interface{}) (bool, error) {
+	v, err := e.Eval(data)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expr: %q evaluated to %T, not a boolean", e.source, v)
+	}
+	return b, nil
+}
+
+// MatchJSON decodes a JSON document and evaluates the expression as a predicate
+func (e *Expr) MatchJSON(data []byte) (bool, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return false, err
+	}
+	return e.Match(v)
+}
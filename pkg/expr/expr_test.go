@@ -0,0 +1,154 @@
+package expr_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMatch tests predicates against a decoded message
+func TestMatch(t *testing.T) {
+	message := []byte(`{"temperature": 31.5, "site": "A", "active": true,
+		"readings": [{"value": 12}, {"value": 3}], "meta": {"owner": "ops team"}}`)
+
+	testCases := []struct {
+		name     string
+		source   string
+		expected bool
+	}{
+		{"conjunction", `temperature > 30 && site == "A"`, true},
+		{"failed conjunction", `temperature > 30 && site == 'B'`, false},
+		{"disjunction", `temperature < 0 || active`, true},
+		{"negation", `!active`, false},
+		{"grouping", `!(site == "B" || temperature <= 31.5)`, false},
+		{"jsonpath", `$.readings[0].value >= 10`, true},
+		{"bracket key", `meta["owner"] == "ops team"`, true},
+		{"missing field is null", `missing == null`, true},
+		{"ordering null is false", `missing > 1`, false},
+		{"negative number", `readings[1].value > -1`, true},
+		{"string ordering", `site < "B"`, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := expr.Compile(tc.source)
+			assert.NoError(t, err)
+			result, err := e.MatchJSON(message)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+// TestCompileErrors tests that malformed expressions are rejected
+func TestCompileErrors(t *testing.T) {
+	for _, source := range []string{``, `a ==`, `(a > 1`, `a > 1 b`, `"unterminated`, `a[x]`, `#`} {
+		_, err := expr.Compile(source)
+		assert.Error(t, err, source)
+	}
+}
+
+// TestMatchRequiresBoolean tests that non-boolean predicates are an error
+func TestMatchRequiresBoolean(t *testing.T) {
+	e, err := expr.Compile(`site`)
+	assert.NoError(t, err)
+	_, err = e.MatchJSON([]byte(`{"site": "A"}`))
+	assert.Error(t, err)
+}
+
+// TestEval tests arithmetic, the conditional operator and functions
+func TestEval(t *testing.T) {
+	message := map[string]interface{}{
+		"value":  float64(20),
+		"count":  int64(7),
+		"big":    int64(math.MaxInt64),
+		"name":   "Sensor-1",
+		"user":   map[string]interface{}{"id": nil, "tags": []interface{}{"a", "b"}},
+		"amount": "12.5",
+	}
+
+	testCases := []struct {
+		source   string
+		expected interface{}
+	}{
+		{`value * 1.8 + 32`, float64(68)},
+		{`count + 1`, int64(8)},
+		{`count - 10 * 2`, int64(-13)},
+		{`count / 2`, 3.5},
+		{`count % 4`, int64(3)},
+		{`-count`, int64(-7)},
+		{`(count + 1) * 2`, int64(16)},
+		{`big + 1`, float64(math.MaxInt64) + 1},
+		{`missing * 2`, nil},
+		{`missing * 2 > 5`, false},
+		{`name + "!"`, "Sensor-1!"},
+		{`has(user.id)`, true},
+		{`has(user.name)`, false},
+		{`has(user.tags[1])`, true},
+		{`count > 5 ? "many" : "few"`, "many"},
+		{`count > 50 ? "many" : count > 5 ? "some" : "few"`, "some"},
+		{`len(name)`, int64(8)},
+		{`len(user.tags)`, int64(2)},
+		{`lower(name)`, "sensor-1"},
+		{`upper(name)`, "SENSOR-1"},
+		{`trim("  x ")`, "x"},
+		{`contains(name, "sor")`, true},
+		{`contains(user.tags, "b")`, true},
+		{`startsWith(name, "Sen") && endsWith(name, "-1")`, true},
+		{`startsWith(missing, "a")`, false},
+		{`abs(-count)`, int64(7)},
+		{`abs(-2.5)`, 2.5},
+		{`round(2.5) + floor(1.9) + ceil(0.1)`, float64(5)},
+		{`min(3, count, value)`, int64(3)},
+		{`max(3, missing, value)`, float64(20)},
+		{`string(count) + "x"`, "7x"},
+		{`number(amount) * 2`, float64(25)},
+		{`coalesce(missing, user.id, name)`, "Sensor-1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source, func(t *testing.T) {
+			e, err := expr.Compile(tc.source)
+			require.NoError(t, err)
+			result, err := e.Eval(message)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+// TestEvalErrors tests runtime errors
+func TestEvalErrors(t *testing.T) {
+	message := map[string]interface{}{"n": int64(1), "s": "x"}
+	for _, source := range []string{`n / 0`, `n % 0`, `s * 2`, `s + n`, `n ? 1 : 2`, `upper(n)`, `number(s)`} {
+		e, err := expr.Compile(source)
+		require.NoError(t, err, source)
+		_, err = e.Eval(message)
+		assert.Error(t, err, source)
+	}
+}
+
+// TestLimits tests that compile time limits bound an expression's cost
+func TestLimits(t *testing.T) {
+	for _, source := range []string{`has(1)`, `has(a, b)`, `nope(a)`, `len()`, `len(a, b)`, `a ? b`, `min()`} {
+		_, err := expr.Compile(source)
+		assert.Error(t, err, source)
+	}
+
+	e, err := expr.Compile(`a + b * 2 > 3`)
+	require.NoError(t, err)
+	assert.Equal(t, 7, e.Cost())
+
+	_, err = expr.Compile(strings.Repeat("(", 100) + "a" + strings.Repeat(")", 100))
+	assert.Error(t, err)
+	_, err = expr.Compile(strings.Repeat("-", 100) + "a")
+	assert.Error(t, err)
+	_, err = expr.Compile(strings.Repeat("a + ", 600) + "a")
+	assert.Error(t, err)
+	_, err = expr.Compile(strings.Repeat(" ", 5000) + "a")
+	assert.Error(t, err)
+}
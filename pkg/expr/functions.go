@@ -0,0 +1,209 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxStringLength bounds the strings expressions may build
+const maxStringLength = 1 << 20
+
+// function is a built-in function. maxArgs is -1 for variadic functions.
+type function struct {
+	minArgs, maxArgs int
+	call             func(args []interface{}) (interface{}, error)
+}
+
+// functions lists the built-in functions. has() is handled by the parser
+// since it takes a field path rather than a value.
+var functions = map[string]function{
+	"len":        {1, 1, fnLen},
+	"lower":      {1, 1, stringFunc(strings.ToLower)},
+	"upper":      {1, 1, stringFunc(strings.ToUpper)},
+	"trim":       {1, 1, stringFunc(strings.TrimSpace)},
+	"contains":   {2, 2, fnContains},
+	"startsWith": {2, 2, stringPredicate(strings.HasPrefix)},
+	"endsWith":   {2, 2, stringPredicate(strings.HasSuffix)},
+	"abs":        {1, 1, fnAbs},
+	"floor":      {1, 1, floatFunc(math.Floor)},
+	"ceil":       {1, 1, floatFunc(math.Ceil)},
+	"round":      {1, 1, floatFunc(math.Round)},
+	"min":        {1, -1, extremum(-1)},
+	"max":        {1, -1, extremum(1)},
+	"string":     {1, 1, fnString},
+	"number":     {1, 1, fnNumber},
+	"coalesce":   {1, -1, fnCoalesce},
+}
+
+// fnLen returns the length of a string in characters, or of an array or object
+func fnLen(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		return int64(utf8.RuneCountInString(v)), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case map[string]interface{}:
+		return int64(len(v)), nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("needs a string, array or object, got %T", args[0])
+}
+
+// stringFunc adapts a string transformation; null passes through
+func stringFunc(f func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("needs a string, got %T", args[0])
+		}
+		return f(s), nil
+	}
+}
+
+// stringPredicate adapts a test between two strings; a null or non-string
+// value is false, like ordering comparisons
+func stringPredicate(f func(s, part string) bool) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		part, pok := args[1].(string)
+		return ok && pok && f(s, part), nil
+	}
+}
+
+// fnContains tests for a substring, or for an element of an array
+func fnContains(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		part, ok := args[1].(string)
+		return ok && strings.Contains(v, part), nil
+	case []interface{}:
+		for _, elem := range v {
+			if equal(elem, args[1]) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func fnAbs(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	if i, ok := toInt(args[0]); ok && i != math.MinInt64 {
+		if i < 0 {
+			return -i, nil
+		}
+		return i, nil
+	}
+	f, ok := toNumber(args[0])
+	if !ok {
+		return nil, fmt.Errorf("needs a number, got %T", args[0])
+	}
+	return math.Abs(f), nil
+}
+
+// floatFunc adapts a rounding function; integers are already rounded
+func floatFunc(f func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		if i, ok := toInt(args[0]); ok {
+			return i, nil
+		}
+		n, ok := toNumber(args[0])
+		if !ok {
+			return nil, fmt.Errorf("needs a number, got %T", args[0])
+		}
+		return f(n), nil
+	}
+}
+
+// extremum returns min (sign -1) or max (sign 1) of its arguments,
+// ignoring nulls
+func extremum(sign int) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		var best interface{}
+		var bestF float64
+		for _, arg := range args {
+			if arg == nil {
+				continue
+			}
+			f, ok := toNumber(arg)
+			if !ok {
+				return nil, fmt.Errorf("needs numbers, got %T", arg)
+			}
+			if best == nil || compareFloat(f, bestF) == sign {
+				best, bestF = arg, f
+			}
+		}
+		return best, nil
+	}
+}
+
+// fnString formats a value as a string; objects and arrays become JSON
+func fnString(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	}
+	data, err := json.Marshal(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxStringLength {
+		return nil, fmt.Errorf("string longer than %d bytes", maxStringLength)
+	}
+	return string(data), nil
+}
+
+// fnNumber parses a string as a number; numbers and null pass through
+func fnNumber(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		s := strings.TrimSpace(v)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	case nil:
+		return nil, nil
+	}
+	if _, ok := toNumber(args[0]); ok {
+		return args[0], nil
+	}
+	return nil, fmt.Errorf("needs a string or number, got %T", args[0])
+}
+
+// fnCoalesce returns its first argument that is not null
+func fnCoalesce(args []interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if arg != nil {
+			return arg, nil
+		}
+	}
+	return nil, nil
+}
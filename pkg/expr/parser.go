@@ -0,0 +1,319 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits that keep compiled expressions cheap. The language has no loops,
+// so evaluating an expression visits each of its nodes at most once.
+const (
+	// maxSourceLength bounds the length of an expression's source
+	maxSourceLength = 4096
+	// maxNodes bounds the number of nodes of a syntax tree
+	maxNodes = 512
+	// maxNesting bounds how deeply parentheses, calls and operators nest
+	maxNesting = 64
+)
+
+// binding powers of the binary operators, higher binds tighter
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// parser is a Pratt parser over a token slice
+type parser struct {
+	tokens []token
+	pos    int
+	nodes  int
+	depth  int
+}
+
+// parse builds the syntax tree of an expression and returns it with its node count
+func parse(src string) (node, int, error) {
+	if len(src) > maxSourceLength {
+		return nil, 0, fmt.Errorf("expression longer than %d bytes", maxSourceLength)
+	}
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.conditional()
+	if err != nil {
+		return nil, 0, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, 0, p.unexpected(tok)
+	}
+	return n, p.nodes, nil
+}
+
+// peek returns the current token without consuming it
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the current token
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// expect consumes the given operator or fails
+func (p *parser) expect(op string) error {
+	tok := p.next()
+	if tok.kind != tokOp || tok.text != op {
+		return fmt.Errorf("expected %q at position %d", op, tok.pos)
+	}
+	return nil
+}
+
+// unexpected reports a token that does not fit the grammar
+func (p *parser) unexpected(tok token) error {
+	if tok.kind == tokEOF {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// add counts a node towards the size limit
+func (p *parser) add(n node) (node, error) {
+	p.nodes++
+	if p.nodes > maxNodes {
+		return nil, fmt.Errorf("expression has more than %d nodes", maxNodes)
+	}
+	return n, nil
+}
+
+// enter and leave track nesting so that deep expressions cannot exhaust the stack
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxNesting {
+		return fmt.Errorf("expression nested deeper than %d levels", maxNesting)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// conditional parses cond ? then : else, which binds loosest of all
+func (p *parser) conditional() (node, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	cond, err := p.expression(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokOp || tok.text != "?" {
+		return cond, nil
+	}
+	p.next()
+	then, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	return p.add(&conditionalNode{cond: cond, then: then, otherwise: otherwise})
+}
+
+// expression parses operators binding tighter than minPrec
+func (p *parser) expression(minPrec int) (node, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		prec, ok := precedence[tok.text]
+		if tok.kind != tokOp || !ok || prec <= minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.expression(prec)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.add(&binaryNode{op: tok.text, left: left, right: right}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unary parses prefix operators
+func (p *parser) unary() (node, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "!" || tok.text == "-") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return p.add(&unaryNode{op: tok.text, operand: operand})
+	}
+	return p.primary()
+}
+
+// primary parses literals, parenthesised expressions, calls and field paths
+func (p *parser) primary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		if !strings.ContainsAny(tok.text, ".eE") {
+			if i, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+				return p.add(&literalNode{value: i})
+			}
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return p.add(&literalNode{value: f})
+	case tokString:
+		return p.add(&literalNode{value: tok.text})
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return p.add(&literalNode{value: true})
+		case "false":
+			return p.add(&literalNode{value: false})
+		case "null":
+			return p.add(&literalNode{value: nil})
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			return p.call(tok)
+		}
+		return p.path(tok)
+	case tokOp:
+		if tok.text == "(" {
+			n, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+	return nil, p.unexpected(tok)
+}
+
+// call parses a function call. has() takes a field path rather than a
+// value, since it asks whether the field exists at all.
+func (p *parser) call(name token) (node, error) {
+	p.next()
+	var args []node
+	if tok := p.peek(); tok.kind == tokOp && tok.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			tok := p.next()
+			if tok.kind == tokOp && tok.text == ")" {
+				break
+			}
+			if tok.kind != tokOp || tok.text != "," {
+				return nil, p.unexpected(tok)
+			}
+		}
+	}
+
+	if name.text == "has" {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("has() takes one field at position %d", name.pos)
+		}
+		path, ok := args[0].(*pathNode)
+		if !ok {
+			return nil, fmt.Errorf("has() needs a field path at position %d", name.pos)
+		}
+		return p.add(&hasNode{segments: path.segments})
+	}
+
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments to %s() at position %d", name.text, name.pos)
+	}
+	return p.add(&callNode{name: name.text, fn: fn.call, args: args})
+}
+
+// path parses a field reference such as a.b[0]["c d"]. A leading "$" or
+// "@" refers to the message root, so JSONPath style paths like $.a.b work.
+func (p *parser) path(first token) (node, error) {
+	n := &pathNode{}
+	if first.text != "$" && first.text != "@" {
+		n.segments = append(n.segments, first.text)
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp {
+			return p.add(n)
+		}
+		switch tok.text {
+		case ".":
+			p.next()
+			field := p.next()
+			if field.kind != tokIdent {
+				return nil, p.unexpected(field)
+			}
+			n.segments = append(n.segments, field.text)
+		case "[":
+			p.next()
+			key := p.next()
+			switch key.kind {
+			case tokString:
+				n.segments = append(n.segments, key.text)
+			case tokNumber:
+				idx, err := strconv.Atoi(key.text)
+				if err != nil || idx < 0 {
+					return nil, fmt.Errorf("invalid index %q at position %d", key.text, key.pos)
+				}
+				n.segments = append(n.segments, idx)
+			default:
+				return nil, p.unexpected(key)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return p.add(n)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/logger"
+	"golang.org/x/time/rate"
+)
+
+const defaultStoreRetry = 5 * time.Second
+
+// Limiter admits or rejects a single request
+type Limiter interface {
+	Allow() bool
+}
+
+// DistributedConfig holds the settings for a DistributedLimiter
+type DistributedConfig struct {
+	// Store holds the counters shared by every instance
+	Store Store
+	// Name prefixes the shared keys and labels the exported metrics
+	Name string
+	// Limit is the number of requests admitted per Window across the cluster
+	Limit  int64
+	Window time.Duration
+	// Replicas is the number of instances sharing Limit. While the store is
+	// unreachable each instance admits its share of Limit for every key;
+	// zero means one.
+	Replicas int
+	// Fallback is consulted per key while the store is unreachable, instead
+	// of a limiter admitting Limit/Replicas requests per Window for each key
+	Fallback *RateLimiter
+	// StoreRetry is how long to rely on the fallback after a store error
+	StoreRetry time.Duration
+	Logger     *logger.Logger
+	// Metrics receives the limiter's reports; nil discards them
+	Metrics Metrics
+}
+
+// DistributedLimiter enforces a quota shared by every API instance using a
+// fixed-window counter kept in a Store. If the store cannot be reached it
+// falls back to local per-key limiters until StoreRetry has elapsed.
+type DistributedLimiter struct {
+	store      Store
+	name       string
+	limit      int64
+	window     time.Duration
+	fallback   *RateLimiter
+	storeRetry time.Duration
+	logger     *logger.Logger
+	metrics    Metrics
+	downUntil  int64
+}
+
+// NewDistributedLimiter creates a new DistributedLimiter instance
+func NewDistributedLimiter(cfg DistributedConfig) *DistributedLimiter {
+	if cfg.Name == "" {
+		cfg.Name = "global"
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second
+	}
+	if cfg.StoreRetry <= 0 {
+		cfg.StoreRetry = defaultStoreRetry
+	}
+	if cfg.Replicas < 1 {
+		cfg.Replicas = 1
+	}
+	if cfg.Fallback == nil {
+		share := cfg.Limit / int64(cfg.Replicas)
+		if share < 1 {
+			share = 1
+		}
+		cfg.Fallback = NewRateLimiter(rate.Limit(float64(share)/cfg.Window.Seconds()), int(share))
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logger.NewLogger()
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = noMetrics{}
+	}
+
+	return &DistributedLimiter{
+		store:      cfg.Store,
+		name:       cfg.Name,
+		limit:      cfg.Limit,
+		window:     cfg.Window,
+		fallback:   cfg.Fallback,
+		storeRetry: cfg.StoreRetry,
+		logger:     cfg.Logger,
+		metrics:    cfg.Metrics,
+	}
+}
+
+// Allow reports whether a request may proceed under the cluster-wide quota
+func (d *DistributedLimiter) Allow() bool {
+	return d.AllowKey("")
+}
+
+// AllowKey reports whether a request for the given key may proceed under
+// the cluster-wide quota for that key
+func (d *DistributedLimiter) AllowKey(key string) bool {
+	allowed := d.allow(key)
+	if !allowed {
+		d.metrics.Rejected(d.name)
+	}
+	return allowed
+}
+
+// allow consults the shared store, or the fallback while the store is down
+func (d *DistributedLimiter) allow(key string) bool {
+	now := time.Now()
+	if now.UnixNano() < atomic.LoadInt64(&d.downUntil) {
+		return d.fallback.GetLimiter(key).Allow()
+	}
+
+	n, err := d.store.Incr(d.windowKey(key, now), d.window)
+	if err != nil {
+		d.metrics.StoreError(d.name)
+		if atomic.SwapInt64(&d.downUntil, now.Add(d.storeRetry).UnixNano()) < now.UnixNano() {
+			d.logger.Warn("Rate limit store unreachable, using local limits", "limiter", d.name, "error", err)
+		}
+		return d.fallback.GetLimiter(key).Allow()
+	}
+
+	return n <= d.limit
+}
+
+// windowKey builds the shared counter key for the window containing now
+func (d *DistributedLimiter) windowKey(key string, now time.Time) string {
+	window := now.UnixNano() / int64(d.window)
+	k := "ratelimit:" + d.name + ":"
+	if key != "" {
+		k += key + ":"
+	}
+	return k + strconv.FormatInt(window, 10)
+}
@@ -0,0 +1,84 @@
+package ratelimit_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+// failingStore is a Store that is never reachable
+type failingStore struct{}
+
+func (failingStore) Incr(string, time.Duration) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+// TestDistributedLimiterSharesQuota tests that instances sharing a store share one quota
+func TestDistributedLimiterSharesQuota(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	newLimiter := func() *ratelimit.DistributedLimiter {
+		return ratelimit.NewDistributedLimiter(ratelimit.DistributedConfig{
+			Store:  store,
+			Limit:  3,
+			Window: time.Minute,
+		})
+	}
+	a, b := newLimiter(), newLimiter()
+
+	assert.True(t, a.Allow())
+	assert.True(t, b.Allow())
+	assert.True(t, a.Allow())
+	assert.False(t, b.Allow())
+	assert.False(t, a.Allow())
+}
+
+// TestDistributedLimiterFallback tests that local limits apply when the store is down
+func TestDistributedLimiterFallback(t *testing.T) {
+	l := ratelimit.NewDistributedLimiter(ratelimit.DistributedConfig{
+		Store:    failingStore{},
+		Limit:    100,
+		Window:   time.Second,
+		Fallback: ratelimit.NewRateLimiter(rate.Limit(1), 2),
+	})
+
+	assert.True(t, l.Allow())
+	assert.True(t, l.Allow())
+	assert.False(t, l.Allow())
+}
+
+// TestDistributedLimiterFallbackShare tests that without a store each
+// replica admits only its share of the cluster limit
+func TestDistributedLimiterFallbackShare(t *testing.T) {
+	l := ratelimit.NewDistributedLimiter(ratelimit.DistributedConfig{
+		Store:    failingStore{},
+		Limit:    9,
+		Window:   time.Minute,
+		Replicas: 3,
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow())
+	}
+	assert.False(t, l.Allow())
+}
+
+// TestDistributedLimiterFallbackPerKey tests that without a store each key
+// keeps its own local limit
+func TestDistributedLimiterFallbackPerKey(t *testing.T) {
+	l := ratelimit.NewDistributedLimiter(ratelimit.DistributedConfig{
+		Store:  failingStore{},
+		Limit:  2,
+		Window: time.Minute,
+	})
+
+	assert.True(t, l.AllowKey("a"))
+	assert.True(t, l.AllowKey("a"))
+	assert.False(t, l.AllowKey("a"))
+	assert.True(t, l.AllowKey("b"))
+	assert.True(t, l.AllowKey("b"))
+	assert.False(t, l.AllowKey("b"))
+}
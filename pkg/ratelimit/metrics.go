@@ -0,0 +1,21 @@
+package ratelimit
+
+// Metrics receives what limiters report, labelled with the limiter's name.
+// It keeps the package free of any metrics backend; internal/metrics
+// exports these to Prometheus.
+type Metrics interface {
+	// KeysChanged reports keys added to a RateLimiter, or evicted from it
+	// when delta is negative
+	KeysChanged(limiter string, delta int)
+	// Rejected reports a request a limiter turned down
+	Rejected(limiter string)
+	// StoreError reports a failed call to a DistributedLimiter's store
+	StoreError(limiter string)
+}
+
+// noMetrics discards every report
+type noMetrics struct{}
+
+func (noMetrics) KeysChanged(string, int) {}
+func (noMetrics) Rejected(string)         {}
+func (noMetrics) StoreError(string)       {}
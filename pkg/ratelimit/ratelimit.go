@@ -1,38 +1,232 @@
 package ratelimit
 
 import (
+	"container/list"
+	"hash/fnv"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+const (
+	defaultShards     = 32
+	defaultIdleTTL    = 10 * time.Minute
+	defaultMaxEntries = 100000
+)
+
+// Config holds the settings for a RateLimiter
+type Config struct {
+	// Rate and Burst configure the token bucket created for every key
+	Rate  rate.Limit
+	Burst int
+	// IdleTTL is how long a key may go unused before it is evicted;
+	// a negative value disables idle eviction. Idle keys are evicted from
+	// a shard as it is used, or by Sweep.
+	IdleTTL time.Duration
+	// SweepInterval, when positive, starts a background janitor calling
+	// Sweep at that interval until Stop is called
+	SweepInterval time.Duration
+	// MaxEntries bounds the number of keys tracked across all shards
+	MaxEntries int
+	// Shards is the number of independently locked partitions of the key space
+	Shards int
+	// Name labels the metrics exported for this limiter
+	Name string
+	// Metrics receives the limiter's reports; nil discards them
+	Metrics Metrics
+}
+
 // RateLimiter manages rate limiting for multiple clients
 type RateLimiter struct {
-	limiters map[string]*rate.Limiter
-	mu       sync.Mutex
+	shards   []*shard
 	r        rate.Limit
 	b        int
+	ttl      time.Duration
+	sweep    time.Duration
+	perShard int
+	name     string
+	metrics  Metrics
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-// NewRateLimiter creates a new RateLimiter instance
+// shard is one lock-protected partition of the limiter's key space
+type shard struct {
+	mu       sync.Mutex
+	limiters map[string]*list.Element
+	// order holds entries by last use, least recently used first
+	order *list.List
+}
+
+// entry pairs a key's limiter with the last time it was used
+type entry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen int64
+}
+
+// NewRateLimiter creates a new RateLimiter instance with default memory bounds
 func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	return &RateLimiter{
-		limiters: make(map[string]*rate.Limiter),
-		r:        r,
-		b:        b,
+	return NewRateLimiterWithConfig(Config{Rate: r, Burst: b})
+}
+
+// NewRateLimiterWithConfig creates a new RateLimiter from the given configuration.
+// Zero values fall back to sensible defaults. No goroutine is started
+// unless SweepInterval is set.
+func NewRateLimiterWithConfig(cfg Config) *RateLimiter {
+	if cfg.Shards <= 0 {
+		cfg.Shards = defaultShards
+	}
+	if cfg.IdleTTL == 0 {
+		cfg.IdleTTL = defaultIdleTTL
 	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultMaxEntries
+	}
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = noMetrics{}
+	}
+
+	perShard := cfg.MaxEntries / cfg.Shards
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	rl := &RateLimiter{
+		shards:   make([]*shard, cfg.Shards),
+		r:        cfg.Rate,
+		b:        cfg.Burst,
+		ttl:      cfg.IdleTTL,
+		sweep:    cfg.SweepInterval,
+		perShard: perShard,
+		name:     cfg.Name,
+		metrics:  cfg.Metrics,
+		stop:     make(chan struct{}),
+	}
+	for i := range rl.shards {
+		rl.shards[i] = &shard{limiters: make(map[string]*list.Element), order: list.New()}
+	}
+
+	if rl.ttl > 0 && rl.sweep > 0 {
+		go rl.janitor()
+	}
+
+	return rl
 }
 
 // GetLimiter returns a rate limiter for a given key
 func (rl *RateLimiter) GetLimiter(key string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+	now := time.Now().UnixNano()
+	s := rl.shardFor(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	limiter, exists := rl.limiters[key]
-	if !exists {
-		limiter = rate.NewLimiter(rl.r, rl.b)
-		rl.limiters[key] = limiter
+	rl.expire(s, now)
+	el, exists := s.limiters[key]
+	if exists {
+		s.order.MoveToBack(el)
+	} else {
+		if len(s.limiters) >= rl.perShard {
+			rl.evictOldest(s)
+		}
+		el = s.order.PushBack(&entry{key: key, limiter: rate.NewLimiter(rl.r, rl.b)})
+		s.limiters[key] = el
+		rl.metrics.KeysChanged(rl.name, 1)
 	}
+	e := el.Value.(*entry)
+	e.lastSeen = now
+
+	return e.limiter
+}
+
+// Allow reports whether a request for the given key may proceed now
+func (rl *RateLimiter) Allow(key string) bool {
+	if rl.GetLimiter(key).Allow() {
+		return true
+	}
+	rl.metrics.Rejected(rl.name)
+	return false
+}
+
+// Len returns the number of keys currently tracked
+func (rl *RateLimiter) Len() int {
+	n := 0
+	for _, s := range rl.shards {
+		s.mu.Lock()
+		n += len(s.limiters)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Sweep evicts every key that has been idle for longer than the configured TTL
+func (rl *RateLimiter) Sweep() {
+	if rl.ttl <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, s := range rl.shards {
+		s.mu.Lock()
+		rl.expire(s, now)
+		s.mu.Unlock()
+	}
+}
+
+// expire evicts a shard's keys idle for longer than the TTL. They are the
+// least recently used, so only the front of the shard's order is looked at.
+// The caller must hold the shard lock.
+func (rl *RateLimiter) expire(s *shard, now int64) {
+	if rl.ttl <= 0 {
+		return
+	}
+	cutoff := now - int64(rl.ttl)
+	for el := s.order.Front(); el != nil && el.Value.(*entry).lastSeen < cutoff; el = s.order.Front() {
+		rl.remove(s, el)
+	}
+}
+
+// Stop terminates the background janitor
+func (rl *RateLimiter) Stop() {
+	rl.stopOnce.Do(func() { close(rl.stop) })
+}
+
+// janitor periodically sweeps idle keys until the limiter is stopped
+func (rl *RateLimiter) janitor() {
+	ticker := time.NewTicker(rl.sweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rl.Sweep()
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+// evictOldest removes the least recently used key from a full shard.
+// The caller must hold the shard lock.
+func (rl *RateLimiter) evictOldest(s *shard) {
+	if el := s.order.Front(); el != nil {
+		rl.remove(s, el)
+	}
+}
+
+// remove drops a key from a shard. The caller must hold the shard lock.
+func (rl *RateLimiter) remove(s *shard, el *list.Element) {
+	s.order.Remove(el)
+	delete(s.limiters, el.Value.(*entry).key)
+	rl.metrics.KeysChanged(rl.name, -1)
+}
 
-	return limiter
+// shardFor picks the shard responsible for a key
+func (rl *RateLimiter) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return rl.shards[h.Sum32()%uint32(len(rl.shards))]
 }
@@ -0,0 +1,179 @@
+package ratelimit_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+// TestGetLimiterReusesKey tests that the same limiter is returned for a key
+func TestGetLimiterReusesKey(t *testing.T) {
+	rl := ratelimit.NewRateLimiter(rate.Limit(10), 1)
+	defer rl.Stop()
+
+	assert.Same(t, rl.GetLimiter("a"), rl.GetLimiter("a"))
+	assert.NotSame(t, rl.GetLimiter("a"), rl.GetLimiter("b"))
+	assert.Equal(t, 2, rl.Len())
+}
+
+// TestAllowRejectsAfterBurst tests that requests beyond the burst are rejected
+func TestAllowRejectsAfterBurst(t *testing.T) {
+	rl := ratelimit.NewRateLimiter(rate.Limit(1), 2)
+	defer rl.Stop()
+
+	assert.True(t, rl.Allow("a"))
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+	assert.True(t, rl.Allow("b"))
+}
+
+// TestMaxEntries tests that the number of tracked keys is bounded
+func TestMaxEntries(t *testing.T) {
+	rl := ratelimit.NewRateLimiterWithConfig(ratelimit.Config{
+		Rate:       rate.Limit(10),
+		Burst:      1,
+		MaxEntries: 4,
+		Shards:     1,
+		IdleTTL:    -1,
+	})
+	defer rl.Stop()
+
+	for i := 0; i < 100; i++ {
+		rl.GetLimiter(fmt.Sprintf("key-%d", i))
+	}
+	assert.Equal(t, 4, rl.Len())
+}
+
+// TestEvictsLeastRecentlyUsed tests that a full limiter evicts the key
+// used least recently rather than the one created first
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	rl := ratelimit.NewRateLimiterWithConfig(ratelimit.Config{
+		Rate:       rate.Limit(10),
+		Burst:      1,
+		MaxEntries: 2,
+		Shards:     1,
+		IdleTTL:    -1,
+	})
+	defer rl.Stop()
+
+	a := rl.GetLimiter("a")
+	b := rl.GetLimiter("b")
+	assert.Same(t, a, rl.GetLimiter("a"))
+	rl.GetLimiter("c")
+
+	assert.Equal(t, 2, rl.Len())
+	assert.Same(t, a, rl.GetLimiter("a"))
+	assert.NotSame(t, b, rl.GetLimiter("b"))
+}
+
+// TestSweepEvictsIdleKeys tests that idle keys are removed by Sweep
+func TestSweepEvictsIdleKeys(t *testing.T) {
+	rl := ratelimit.NewRateLimiterWithConfig(ratelimit.Config{
+		Rate:    rate.Limit(10),
+		Burst:   1,
+		IdleTTL: 10 * time.Millisecond,
+	})
+	defer rl.Stop()
+
+	rl.GetLimiter("a")
+	time.Sleep(20 * time.Millisecond)
+	rl.GetLimiter("b")
+	rl.Sweep()
+
+	assert.Equal(t, 1, rl.Len())
+}
+
+// TestIdleKeysEvictedOnUse tests that a shard evicts its idle keys as it
+// is used, and that the janitor only runs when asked for
+func TestIdleKeysEvictedOnUse(t *testing.T) {
+	rl := ratelimit.NewRateLimiterWithConfig(ratelimit.Config{
+		Rate:    rate.Limit(10),
+		Burst:   1,
+		IdleTTL: 10 * time.Millisecond,
+		Shards:  1,
+	})
+	defer rl.Stop()
+
+	rl.GetLimiter("a")
+	rl.GetLimiter("b")
+	time.Sleep(20 * time.Millisecond)
+	rl.GetLimiter("c")
+	assert.Equal(t, 1, rl.Len())
+
+	swept := ratelimit.NewRateLimiterWithConfig(ratelimit.Config{
+		Rate:          rate.Limit(10),
+		Burst:         1,
+		IdleTTL:       10 * time.Millisecond,
+		SweepInterval: 10 * time.Millisecond,
+	})
+	defer swept.Stop()
+	swept.GetLimiter("a")
+	assert.Eventually(t, func() bool { return swept.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+// TestMemoryStoreExpires tests that counters start over once they expire
+func TestMemoryStoreExpires(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	for want := int64(1); want <= 2; want++ {
+		n, err := store.Incr("a", 10*time.Millisecond)
+		assert.NoError(t, err)
+		assert.Equal(t, want, n)
+	}
+	store.Incr("b", time.Minute)
+	time.Sleep(20 * time.Millisecond)
+
+	n, _ := store.Incr("a", 10*time.Millisecond)
+	assert.Equal(t, int64(1), n)
+	n, _ = store.Incr("b", time.Minute)
+	assert.Equal(t, int64(2), n)
+}
+
+// recordingMetrics keeps what limiters report
+type recordingMetrics struct {
+	keys, rejected, storeErrors map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{keys: map[string]int{}, rejected: map[string]int{}, storeErrors: map[string]int{}}
+}
+
+func (m *recordingMetrics) KeysChanged(limiter string, delta int) { m.keys[limiter] += delta }
+func (m *recordingMetrics) Rejected(limiter string)               { m.rejected[limiter]++ }
+func (m *recordingMetrics) StoreError(limiter string)             { m.storeErrors[limiter]++ }
+
+// TestMetrics tests that limiters report keys, rejections and store errors
+func TestMetrics(t *testing.T) {
+	m := newRecordingMetrics()
+	rl := ratelimit.NewRateLimiterWithConfig(ratelimit.Config{
+		Rate:       rate.Limit(1),
+		Burst:      1,
+		MaxEntries: 2,
+		Shards:     1,
+		IdleTTL:    -1,
+		Name:       "keyed",
+		Metrics:    m,
+	})
+	defer rl.Stop()
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+	rl.GetLimiter("b")
+	rl.GetLimiter("c")
+	assert.Equal(t, 2, m.keys["keyed"])
+	assert.Equal(t, 1, m.rejected["keyed"])
+
+	d := ratelimit.NewDistributedLimiter(ratelimit.DistributedConfig{
+		Store:   failingStore{},
+		Name:    "shared",
+		Limit:   1,
+		Window:  time.Minute,
+		Metrics: m,
+	})
+	assert.True(t, d.Allow())
+	assert.False(t, d.Allow())
+	assert.Equal(t, 1, m.storeErrors["shared"])
+	assert.Equal(t, 1, m.rejected["shared"])
+}
@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRedisTimeout  = 50 * time.Millisecond
+	defaultRedisPoolSize = 16
+)
+
+// incrScript increments a counter and sets its TTL when it is created, in
+// one atomic step so that no counter is left without a TTL
+const incrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+
+// errPoolTimeout is returned when every connection stays busy for the timeout
+var errPoolTimeout = errors.New("redis: no connection available")
+
+// RedisStore is a Store backed by any server speaking the Redis protocol
+// (Redis, KeyDB, Dragonfly, ...) and its Lua scripting. It opens at most a
+// small pool of connections; callers wait up to the timeout for one to be
+// free.
+type RedisStore struct {
+	addr    string
+	timeout time.Duration
+	// idle holds open connections not in use, and slots a token for every
+	// open connection
+	idle  chan *redisConn
+	slots chan struct{}
+}
+
+// redisConn is a single pooled connection with its buffered reader
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisStore creates a new RedisStore for the given address. A timeout of
+// zero uses a short default so that an unreachable store fails fast.
+func NewRedisStore(addr string, timeout time.Duration) *RedisStore {
+	if timeout <= 0 {
+		timeout = defaultRedisTimeout
+	}
+	return &RedisStore{
+		addr:    addr,
+		timeout: timeout,
+		idle:    make(chan *redisConn, defaultRedisPoolSize),
+		slots:   make(chan struct{}, defaultRedisPoolSize),
+	}
+}
+
+// Incr increments the counter stored at key and returns its new value
+func (s *RedisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	c, err := s.get()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.incr(key, ttl, s.timeout)
+	if err != nil {
+		s.discard(c)
+		return 0, err
+	}
+
+	s.put(c)
+	return n, nil
+}
+
+// Close closes every idle pooled connection
+func (s *RedisStore) Close() {
+	for {
+		select {
+		case c := <-s.idle:
+			s.discard(c)
+		default:
+			return
+		}
+	}
+}
+
+// get takes an idle connection, or dials a new one while the pool is not
+// full, waiting up to the timeout for either
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case c := <-s.idle:
+		return c, nil
+	case s.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errPoolTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return &redisConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// put returns a healthy connection to the pool. There is always room, since
+// every open connection holds a slot.
+func (s *RedisStore) put(c *redisConn) {
+	s.idle <- c
+}
+
+// discard closes a connection and frees its slot
+func (s *RedisStore) discard(c *redisConn) {
+	c.conn.Close()
+	<-s.slots
+}
+
+// incr runs the increment script on this connection
+func (c *redisConn) incr(key string, ttl time.Duration, timeout time.Duration) (int64, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	if err := c.write("EVAL", incrScript, "1", key, ms); err != nil {
+		return 0, err
+	}
+	return c.readInteger()
+}
+
+// write sends a command encoded as a RESP array of bulk strings
+func (c *redisConn) write(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// readInteger reads a single RESP integer reply
+func (c *redisConn) readInteger() (int64, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 {
+		return 0, errors.New("redis: short reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '-':
+		return 0, errors.New("redis: " + line[1:])
+	default:
+		return 0, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
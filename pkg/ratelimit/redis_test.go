@@ -0,0 +1,223 @@
+package ratelimit_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a server speaking enough of the Redis protocol to run the
+// store's increment script. Keys named after a reply send it instead.
+type fakeRedis struct {
+	ln    net.Listener
+	delay time.Duration
+
+	mu       sync.Mutex
+	counters map[string]int64
+	ttls     map[string]string
+	commands [][]string
+	accepted int
+	open     int
+	maxOpen  int
+}
+
+// fakeReplies are the replies sent for the keys named after them
+var fakeReplies = map[string]string{
+	"error":   "-ERR boom\r\n",
+	"status":  "+OK\r\n",
+	"short":   "\r\n",
+	"integer": ":abc\r\n",
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeRedis{ln: ln, counters: make(map[string]int64), ttls: make(map[string]string)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.accepted++
+	s.open++
+	if s.open > s.maxOpen {
+		s.maxOpen = s.open
+	}
+	s.mu.Unlock()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		s.open--
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		time.Sleep(s.delay)
+		if _, err := io.WriteString(conn, s.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+// reply runs a command: the increment script, which is recognised by its
+// arguments rather than run
+func (s *fakeRedis) reply(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, args)
+	if len(args) != 5 || args[0] != "EVAL" || args[2] != "1" {
+		return "-ERR unknown command\r\n"
+	}
+	key := args[3]
+	if reply, ok := fakeReplies[key]; ok {
+		return reply
+	}
+	s.counters[key]++
+	if s.counters[key] == 1 {
+		s.ttls[key] = args[4]
+	}
+	return fmt.Sprintf(":%d\r\n", s.counters[key])
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readHeader(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func readHeader(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix {
+		return 0, errors.New("malformed command")
+	}
+	return strconv.Atoi(line[1 : len(line)-2])
+}
+
+// TestRedisStoreIncr tests the commands sent to the server and the parsing
+// of its replies
+func TestRedisStoreIncr(t *testing.T) {
+	server := newFakeRedis(t)
+	store := ratelimit.NewRedisStore(server.ln.Addr().String(), time.Second)
+	defer store.Close()
+
+	for want := int64(1); want <= 3; want++ {
+		n, err := store.Incr("k", 1500*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, want, n)
+	}
+	server.mu.Lock()
+	assert.Equal(t, "1500", server.ttls["k"])
+	assert.Contains(t, server.commands[0][1], "PEXPIRE")
+	accepted := server.accepted
+	server.mu.Unlock()
+	assert.Equal(t, 1, accepted)
+
+	_, err := store.Incr("error", time.Second)
+	assert.EqualError(t, err, "redis: ERR boom")
+	_, err = store.Incr("status", time.Second)
+	assert.EqualError(t, err, `redis: unexpected reply "+OK"`)
+	_, err = store.Incr("short", time.Second)
+	assert.EqualError(t, err, "redis: short reply")
+	_, err = store.Incr("integer", time.Second)
+	assert.Error(t, err)
+
+	// Connections that failed are replaced
+	n, err := store.Incr("k", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	server.mu.Lock()
+	assert.Equal(t, 5, server.accepted)
+	server.mu.Unlock()
+}
+
+// TestRedisStorePool tests that concurrent callers share a bounded pool of
+// connections rather than dialing one each
+func TestRedisStorePool(t *testing.T) {
+	server := newFakeRedis(t)
+	server.delay = 5 * time.Millisecond
+	store := ratelimit.NewRedisStore(server.ln.Addr().String(), time.Second)
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Incr("k", time.Second)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, int64(64), server.counters["k"])
+	assert.LessOrEqual(t, server.accepted, 16)
+	assert.LessOrEqual(t, server.maxOpen, 16)
+}
+
+// TestRedisStoreUnreachable tests that a store that cannot be dialed fails
+func TestRedisStoreUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := ratelimit.NewRedisStore(addr, 0)
+	_, err = store.Incr("k", time.Second)
+	assert.Error(t, err)
+	// The failed dial frees its slot for the next attempt
+	for i := 0; i < 20; i++ {
+		_, err = store.Incr("k", time.Second)
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), "no connection available")
+	}
+}
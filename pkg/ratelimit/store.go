@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Store is a shared counter backend used to coordinate quotas across instances
+type Store interface {
+	// Incr increments the counter stored at key and returns its new value.
+	// The counter expires ttl after it was first created.
+	Incr(key string, ttl time.Duration) (int64, error)
+}
+
+// MemoryStore is an in-process Store. It stands in for a shared store in
+// tests and single-instance deployments.
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+	// expiries holds every counter by expiry, soonest first
+	expiries counterHeap
+}
+
+// counter is a single expiring value held by MemoryStore
+type counter struct {
+	key     string
+	value   int64
+	expires time.Time
+}
+
+// NewMemoryStore creates a new MemoryStore instance
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters: make(map[string]*counter),
+	}
+}
+
+// Incr increments the counter stored at key and returns its new value
+func (s *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, exists := s.counters[key]
+	if !exists || now.After(c.expires) {
+		s.expire(now)
+		c = &counter{key: key, expires: now.Add(ttl)}
+		s.counters[key] = c
+		heap.Push(&s.expiries, c)
+	}
+	c.value++
+
+	return c.value, nil
+}
+
+// expire drops counters whose TTL has passed. The caller must hold the lock.
+func (s *MemoryStore) expire(now time.Time) {
+	for len(s.expiries) > 0 && now.After(s.expiries[0].expires) {
+		c := heap.Pop(&s.expiries).(*counter)
+		// The key may hold a newer counter by now
+		if s.counters[c.key] == c {
+			delete(s.counters, c.key)
+		}
+	}
+}
+
+// counterHeap orders counters by expiry for container/heap
+type counterHeap []*counter
+
+func (h counterHeap) Len() int            { return len(h) }
+func (h counterHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h counterHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *counterHeap) Push(x interface{}) { *h = append(*h, x.(*counter)) }
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return c
+}
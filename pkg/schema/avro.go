@@ -0,0 +1,307 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// avroType is a node of a parsed Avro schema
+type avroType struct {
+	kind string // a primitive name, record, enum, array, map, fixed or union
+
+	name    string
+	fields  []avroField
+	symbols []string
+	items   *avroType
+	values  *avroType
+	size    int
+	union   []*avroType
+	// def is the enum default symbol
+	def string
+}
+
+// avroField is a field of an Avro record
+type avroField struct {
+	name       string
+	typ        *avroType
+	hasDefault bool
+}
+
+// avroPrimitives are the Avro types without attributes
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// compileAvro parses an Avro schema document
+func compileAvro(definition []byte) (*avroType, error) {
+	var doc interface{}
+	if err := json.Unmarshal(definition, &doc); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	p := &avroParser{named: make(map[string]*avroType)}
+	return p.parse(doc, "", 0)
+}
+
+// avroParser resolves references to named types while parsing
+type avroParser struct {
+	named map[string]*avroType
+}
+
+func (p *avroParser) parse(doc interface{}, namespace string, depth int) (*avroType, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("avro schema nested too deeply")
+	}
+	switch node := doc.(type) {
+	case string:
+		if avroPrimitives[node] {
+			return &avroType{kind: node}, nil
+		}
+		if t, ok := p.named[p.fullName(node, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := p.named[node]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown avro type %q", node)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, branch := range node {
+			b, err := p.parse(branch, namespace, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if b.kind == "union" {
+				return nil, fmt.Errorf("avro unions may not contain unions")
+			}
+			t.union = append(t.union, b)
+		}
+		return t, nil
+	case map[string]interface{}:
+		return p.parseComplex(node, namespace, depth)
+	}
+	return nil, fmt.Errorf("invalid avro schema node %v", doc)
+}
+
+func (p *avroParser) parseComplex(node map[string]interface{}, namespace string, depth int) (*avroType, error) {
+	kind, _ := node["type"].(string)
+	if ns, ok := node["namespace"].(string); ok {
+		namespace = ns
+	}
+	if avroPrimitives[kind] {
+		return &avroType{kind: kind}, nil
+	}
+
+	t := &avroType{kind: kind}
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := node["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("avro %s requires a name", kind)
+		}
+		t.name = p.fullName(name, namespace)
+		p.named[t.name] = t
+		if i := strings.LastIndex(t.name, "."); i >= 0 {
+			namespace = t.name[:i]
+		}
+	}
+
+	switch kind {
+	case "record", "error":
+		t.kind = "record"
+		fields, ok := node["fields"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("avro record %s requires fields", t.name)
+		}
+		for _, f := range fields {
+			fobj, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("avro record %s has an invalid field", t.name)
+			}
+			fname, _ := fobj["name"].(string)
+			if fname == "" {
+				return nil, fmt.Errorf("avro record %s has a field without a name", t.name)
+			}
+			ftype, err := p.parse(fobj["type"], namespace, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("field %s.%s: %v", t.name, fname, err)
+			}
+			_, hasDefault := fobj["default"]
+			t.fields = append(t.fields, avroField{name: fname, typ: ftype, hasDefault: hasDefault})
+		}
+	case "enum":
+		symbols, ok := node["symbols"].([]interface{})
+		if !ok || len(symbols) == 0 {
+			return nil, fmt.Errorf("avro enum %s requires symbols", t.name)
+		}
+		for _, s := range symbols {
+			sym, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("avro enum %s has an invalid symbol", t.name)
+			}
+			t.symbols = append(t.symbols, sym)
+		}
+		t.def, _ = node["default"].(string)
+	case "array":
+		items, err := p.parse(node["items"], namespace, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		t.items = items
+	case "map":
+		values, err := p.parse(node["values"], namespace, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		t.values = values
+	case "fixed":
+		size, ok := node["size"].(float64)
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("avro fixed %s requires a size", t.name)
+		}
+		t.size = int(size)
+	default:
+		return nil, fmt.Errorf("unknown avro type %q", kind)
+	}
+	return t, nil
+}
+
+// fullName qualifies a name with a namespace unless it already has one
+func (p *avroParser) fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// validate appends every violation of v to errs. Values are the generic
+// values of the payload decoders, so records are objects and unions take
+// the value of whichever branch it matches.
+func (t *avroType) validate(v interface{}, path string, errs *[]ValidationError, depth int) {
+	if depth > maxDepth {
+		*errs = append(*errs, ValidationError{path, "value nested too deeply"})
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{path, fmt.Sprintf(format, args...)})
+	}
+
+	switch t.kind {
+	case "null":
+		if v != nil {
+			fail("expected null, got %s", jsonTypeOf(v))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("expected boolean, got %s", jsonTypeOf(v))
+		}
+	case "int", "long":
+		f, ok := toFloat(v)
+		if !ok || f != math.Trunc(f) {
+			fail("expected %s, got %s", t.kind, jsonTypeOf(v))
+		} else if t.kind == "int" && (f < math.MinInt32 || f > math.MaxInt32) {
+			fail("%v does not fit in an int", v)
+		}
+	case "float", "double":
+		if _, ok := toFloat(v); !ok {
+			fail("expected %s, got %s", t.kind, jsonTypeOf(v))
+		}
+	case "string", "bytes":
+		switch v.(type) {
+		case string, []byte:
+		default:
+			fail("expected %s, got %s", t.kind, jsonTypeOf(v))
+		}
+	case "enum":
+		s, ok := v.(string)
+		if !ok {
+			fail("expected one of %s, got %s", strings.Join(t.symbols, ", "), jsonTypeOf(v))
+			return
+		}
+		for _, sym := range t.symbols {
+			if sym == s {
+				return
+			}
+		}
+		fail("%q is not one of %s", s, strings.Join(t.symbols, ", "))
+	case "fixed":
+		n := -1
+		switch b := v.(type) {
+		case string:
+			n = len(b)
+		case []byte:
+			n = len(b)
+		}
+		if n != t.size {
+			fail("expected %d fixed bytes", t.size)
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			fail("expected array, got %s", jsonTypeOf(v))
+			return
+		}
+		for i, elem := range arr {
+			t.items.validate(elem, path+"/"+strconv.Itoa(i), errs, depth+1)
+		}
+	case "map":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected map, got %s", jsonTypeOf(v))
+			return
+		}
+		for k, elem := range obj {
+			t.values.validate(elem, path+"/"+escapePointer(k), errs, depth+1)
+		}
+	case "record":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected record %s, got %s", t.name, jsonTypeOf(v))
+			return
+		}
+		known := make(map[string]bool, len(t.fields))
+		for _, f := range t.fields {
+			known[f.name] = true
+			child := path + "/" + escapePointer(f.name)
+			fv, present := obj[f.name]
+			if !present {
+				if !f.hasDefault && !f.typ.allowsNull() {
+					*errs = append(*errs, ValidationError{child, "required field is missing"})
+				}
+				continue
+			}
+			f.typ.validate(fv, child, errs, depth+1)
+		}
+		for k := range obj {
+			if !known[k] {
+				*errs = append(*errs, ValidationError{path + "/" + escapePointer(k), fmt.Sprintf("field is not part of record %s", t.name)})
+			}
+		}
+	case "union":
+		for _, branch := range t.union {
+			var branchErrs []ValidationError
+			branch.validate(v, path, &branchErrs, depth+1)
+			if len(branchErrs) == 0 {
+				return
+			}
+		}
+		fail("does not match any branch of the union")
+	}
+}
+
+// allowsNull reports whether null is a valid value, so that optional
+// fields may be left out
+func (t *avroType) allowsNull() bool {
+	if t.kind == "null" {
+		return true
+	}
+	for _, b := range t.union {
+		if b.kind == "null" {
+			return true
+		}
+	}
+	return false
+}
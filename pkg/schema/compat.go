@@ -0,0 +1,338 @@
+package schema
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// checkCompatibility returns why next cannot follow prev under a
+// compatibility mode, or nil when it can
+func checkCompatibility(prev, next *Schema, mode Compatibility) []string {
+	if mode == CompatibilityNone {
+		return nil
+	}
+	if prev.Type != next.Type {
+		return []string{fmt.Sprintf("schema type changed from %s to %s", prev.Type, next.Type)}
+	}
+
+	var reasons []string
+	check := func(reader, writer *Schema) {
+		c := &compatChecker{seen: make(map[[2]interface{}]bool)}
+		switch {
+		case reader.json != nil:
+			c.json(reader.json, writer.json, "")
+		case reader.avro != nil:
+			c.avro(reader.avro, writer.avro, "")
+		case reader.proto != nil:
+			c.proto(reader.proto, writer.proto, "")
+		}
+		reasons = append(reasons, c.reasons...)
+	}
+	if mode == CompatibilityBackward || mode == CompatibilityFull {
+		check(next, prev)
+	}
+	if mode == CompatibilityForward || mode == CompatibilityFull {
+		check(prev, next)
+	}
+	return reasons
+}
+
+// compatChecker decides whether data written under one schema is accepted
+// by a reader schema. The checks are structural and conservative: they
+// flag narrowed types, new requirements and tightened bounds.
+type compatChecker struct {
+	reasons []string
+	seen    map[[2]interface{}]bool
+}
+
+func (c *compatChecker) fail(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	c.reasons = append(c.reasons, path+": "+fmt.Sprintf(format, args...))
+}
+
+// visit reports whether a pair of nodes is being checked for the first
+// time, so that recursive schemas terminate
+func (c *compatChecker) visit(reader, writer interface{}) bool {
+	key := [2]interface{}{reader, writer}
+	if c.seen[key] {
+		return false
+	}
+	c.seen[key] = true
+	return true
+}
+
+func (c *compatChecker) json(reader, writer *jsonSchema, path string) {
+	reader, writer = reader.deref(), writer.deref()
+	if !c.visit(reader, writer) {
+		return
+	}
+	if reader.always != nil || writer.always != nil {
+		if reader.always != nil && !*reader.always && (writer.always == nil || *writer.always) {
+			c.fail(path, "no value is accepted any more")
+		}
+		return
+	}
+
+	if len(reader.types) > 0 {
+		if len(writer.types) == 0 {
+			c.fail(path, "type restricted to %v", reader.types)
+		}
+		for _, t := range writer.types {
+			if !matchesAnyType(exampleOf(t), reader.types) {
+				c.fail(path, "type %s is no longer accepted", t)
+			}
+		}
+	}
+
+	if reader.enum != nil {
+		if writer.enum == nil {
+			c.fail(path, "values restricted to an enum")
+		}
+		for _, v := range writer.enum {
+			found := false
+			for _, w := range reader.enum {
+				if jsonEqual(v, w) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				c.fail(path, "enum value %v was removed", v)
+			}
+		}
+	}
+
+	writerRequired := make(map[string]bool, len(writer.required))
+	for _, name := range writer.required {
+		writerRequired[name] = true
+	}
+	for _, name := range reader.required {
+		if !writerRequired[name] {
+			c.fail(path+"/"+escapePointer(name), "property became required")
+		}
+	}
+
+	closed := reader.additional != nil && reader.additional.always != nil && !*reader.additional.always
+	for name, w := range writer.properties {
+		child := path + "/" + escapePointer(name)
+		if r, ok := reader.properties[name]; ok {
+			c.json(r, w, child)
+		} else if closed {
+			c.fail(child, "property is no longer allowed")
+		} else if reader.additional != nil {
+			c.json(reader.additional, w, child)
+		}
+	}
+	if closed && (writer.additional == nil || writer.additional.always == nil || *writer.additional.always) {
+		c.fail(path, "additional properties are no longer allowed")
+	}
+
+	if reader.items != nil && writer.items != nil {
+		c.json(reader.items, writer.items, path+"/*")
+	}
+
+	c.lowerBound(path, "minimum", reader.minimum, writer.minimum)
+	c.lowerBound(path, "exclusiveMinimum", reader.exclusiveMinimum, writer.exclusiveMinimum)
+	c.upperBound(path, "maximum", reader.maximum, writer.maximum)
+	c.upperBound(path, "exclusiveMaximum", reader.exclusiveMaximum, writer.exclusiveMaximum)
+	c.lowerBound(path, "minLength", intBound(reader.minLength), intBound(writer.minLength))
+	c.upperBound(path, "maxLength", intBound(reader.maxLength), intBound(writer.maxLength))
+	c.lowerBound(path, "minItems", intBound(reader.minItems), intBound(writer.minItems))
+	c.upperBound(path, "maxItems", intBound(reader.maxItems), intBound(writer.maxItems))
+}
+
+// lowerBound flags a lower bound that was added or raised
+func (c *compatChecker) lowerBound(path, keyword string, reader, writer *float64) {
+	if reader != nil && (writer == nil || *reader > *writer) {
+		c.fail(path, "%s was raised", keyword)
+	}
+}
+
+// upperBound flags an upper bound that was added or lowered
+func (c *compatChecker) upperBound(path, keyword string, reader, writer *float64) {
+	if reader != nil && (writer == nil || *reader < *writer) {
+		c.fail(path, "%s was lowered", keyword)
+	}
+}
+
+func intBound(n *int) *float64 {
+	if n == nil {
+		return nil
+	}
+	f := float64(*n)
+	return &f
+}
+
+// exampleOf returns a value of a JSON type, for type comparisons
+func exampleOf(t string) interface{} {
+	switch t {
+	case "null":
+		return nil
+	case "boolean":
+		return true
+	case "object":
+		return map[string]interface{}{}
+	case "array":
+		return []interface{}{}
+	case "integer":
+		return 1.0
+	case "number":
+		return 1.5
+	}
+	return ""
+}
+
+// deref follows a schema that is only a reference
+func (s *jsonSchema) deref() *jsonSchema {
+	for i := 0; s.ref != "" && i < maxDepth; i++ {
+		target, err := s.root.resolve(s.ref)
+		if err != nil {
+			break
+		}
+		s = target
+	}
+	return s
+}
+
+// avroPromotions lists the writer types each reader type can read, per
+// the Avro schema resolution rules
+var avroPromotions = map[string][]string{
+	"long":   {"int"},
+	"float":  {"int", "long"},
+	"double": {"int", "long", "float"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+func (c *compatChecker) avro(reader, writer *avroType, path string) {
+	if !c.visit(reader, writer) {
+		return
+	}
+	if writer.kind == "union" {
+		for _, branch := range writer.union {
+			c.avro(reader, branch, path)
+		}
+		return
+	}
+	if reader.kind == "union" {
+		for _, branch := range reader.union {
+			probe := &compatChecker{seen: make(map[[2]interface{}]bool)}
+			probe.avro(branch, writer, path)
+			if len(probe.reasons) == 0 {
+				return
+			}
+		}
+		c.fail(path, "no branch of the union can read %s", writer.describe())
+		return
+	}
+
+	if reader.kind != writer.kind {
+		for _, from := range avroPromotions[reader.kind] {
+			if from == writer.kind {
+				return
+			}
+		}
+		c.fail(path, "%s cannot be read as %s", writer.describe(), reader.describe())
+		return
+	}
+
+	switch reader.kind {
+	case "record":
+		writerFields := make(map[string]*avroType, len(writer.fields))
+		for _, f := range writer.fields {
+			writerFields[f.name] = f.typ
+		}
+		for _, f := range reader.fields {
+			child := path + "/" + escapePointer(f.name)
+			if wt, ok := writerFields[f.name]; ok {
+				c.avro(f.typ, wt, child)
+			} else if !f.hasDefault {
+				c.fail(child, "field was added without a default")
+			}
+		}
+	case "enum":
+		symbols := make(map[string]bool, len(reader.symbols))
+		for _, s := range reader.symbols {
+			symbols[s] = true
+		}
+		for _, s := range writer.symbols {
+			if !symbols[s] && reader.def == "" {
+				c.fail(path, "enum symbol %s was removed without a default", s)
+			}
+		}
+	case "array":
+		c.avro(reader.items, writer.items, path+"/*")
+	case "map":
+		c.avro(reader.values, writer.values, path+"/*")
+	case "fixed":
+		if reader.size != writer.size {
+			c.fail(path, "fixed size changed from %d to %d", writer.size, reader.size)
+		}
+	}
+}
+
+// describe names an Avro type in compatibility errors
+func (t *avroType) describe() string {
+	if t.name != "" {
+		return t.kind + " " + t.name
+	}
+	return t.kind
+}
+
+// proto checks messages field by field number. Fields the reader does not
+// declare are flagged too, since payloads with unknown fields are rejected.
+func (c *compatChecker) proto(reader, writer protoreflect.MessageDescriptor, path string) {
+	if !c.visit(reader, writer) {
+		return
+	}
+	writerFields := writer.Fields()
+	for i := 0; i < writerFields.Len(); i++ {
+		wf := writerFields.Get(i)
+		fieldPath := path + "/" + string(wf.Name())
+		rf := reader.Fields().ByNumber(wf.Number())
+		if rf == nil {
+			c.fail(fieldPath, "field %d was removed", wf.Number())
+			continue
+		}
+		if rf.Name() != wf.Name() {
+			c.fail(fieldPath, "field %d was renamed to %s", wf.Number(), rf.Name())
+		}
+		if rf.Kind() != wf.Kind() || rf.IsList() != wf.IsList() || rf.IsMap() != wf.IsMap() {
+			c.fail(fieldPath, "field %d changed type", wf.Number())
+			continue
+		}
+		switch {
+		case rf.IsMap():
+			if rf.MapKey().Kind() != wf.MapKey().Kind() || rf.MapValue().Kind() != wf.MapValue().Kind() {
+				c.fail(fieldPath, "field %d changed type", wf.Number())
+			} else if rf.MapValue().Message() != nil {
+				c.proto(rf.MapValue().Message(), wf.MapValue().Message(), fieldPath)
+			} else if rf.MapValue().Enum() != nil {
+				c.protoEnum(rf.MapValue().Enum(), wf.MapValue().Enum(), fieldPath)
+			}
+		case rf.Message() != nil:
+			c.proto(rf.Message(), wf.Message(), fieldPath)
+		case rf.Enum() != nil:
+			c.protoEnum(rf.Enum(), wf.Enum(), fieldPath)
+		}
+	}
+	readerFields := reader.Fields()
+	for i := 0; i < readerFields.Len(); i++ {
+		rf := readerFields.Get(i)
+		if rf.Cardinality() == protoreflect.Required && writerFields.ByNumber(rf.Number()) == nil {
+			c.fail(path+"/"+string(rf.Name()), "new required field")
+		}
+	}
+}
+
+func (c *compatChecker) protoEnum(reader, writer protoreflect.EnumDescriptor, path string) {
+	values := writer.Values()
+	for i := 0; i < values.Len(); i++ {
+		if v := values.Get(i); reader.Values().ByNumber(v.Number()) == nil {
+			c.fail(path, "enum value %s is no longer accepted", v.Name())
+		}
+	}
+}
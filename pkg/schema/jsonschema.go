@@ -0,0 +1,473 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON Schema. It supports the structural and
+// validation keywords shared by drafts 7 and 2020-12: type, enum, const,
+// properties, required, additionalProperties, items, min/maxItems,
+// uniqueItems, min/maxProperties, min/maxLength, pattern, minimum,
+// maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf,
+// oneOf, not and local $ref. Other keywords, such as format, are ignored.
+type jsonSchema struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+
+	types            []string
+	enum             []interface{}
+	constant         interface{}
+	hasConst         bool
+	properties       map[string]*jsonSchema
+	required         []string
+	additional       *jsonSchema
+	items            *jsonSchema
+	minItems         *int
+	maxItems         *int
+	uniqueItems      bool
+	minProperties    *int
+	maxProperties    *int
+	minLength        *int
+	maxLength        *int
+	pattern          *regexp.Regexp
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+	allOf            []*jsonSchema
+	anyOf            []*jsonSchema
+	oneOf            []*jsonSchema
+	not              *jsonSchema
+	ref              string
+
+	// root resolves $ref
+	root *jsonSchemaRoot
+}
+
+// jsonSchemaRoot holds the raw document that local references point into
+type jsonSchemaRoot struct {
+	doc      interface{}
+	compiled map[string]*jsonSchema
+}
+
+// compileJSONSchema compiles a JSON Schema document
+func compileJSONSchema(definition []byte) (*jsonSchema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(definition, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %v", err)
+	}
+	root := &jsonSchemaRoot{doc: doc, compiled: make(map[string]*jsonSchema)}
+	return root.compile(doc, "#", 0)
+}
+
+func (r *jsonSchemaRoot) compile(doc interface{}, at string, depth int) (*jsonSchema, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%s: schema nested too deeply", at)
+	}
+	s := &jsonSchema{root: r}
+	if b, ok := doc.(bool); ok {
+		s.always = &b
+		return s, nil
+	}
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or a boolean", at)
+	}
+
+	var err error
+	sub := func(key string, v interface{}) *jsonSchema {
+		if err != nil {
+			return nil
+		}
+		var compiled *jsonSchema
+		compiled, err = r.compile(v, at+"/"+key, depth+1)
+		return compiled
+	}
+	subs := func(key string) []*jsonSchema {
+		arr, ok := obj[key].([]interface{})
+		if !ok {
+			if _, present := obj[key]; present && err == nil {
+				err = fmt.Errorf("%s/%s: must be an array of schemas", at, key)
+			}
+			return nil
+		}
+		out := make([]*jsonSchema, len(arr))
+		for i, v := range arr {
+			out[i] = sub(key+"/"+strconv.Itoa(i), v)
+		}
+		return out
+	}
+	num := func(key string) *float64 {
+		v, ok := obj[key].(float64)
+		if !ok {
+			return nil
+		}
+		return &v
+	}
+	count := func(key string) *int {
+		v, ok := obj[key].(float64)
+		if !ok {
+			return nil
+		}
+		n := int(v)
+		return &n
+	}
+
+	switch t := obj["type"].(type) {
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type: must be a string or an array of strings", at)
+			}
+			s.types = append(s.types, name)
+		}
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("%s/type: unknown type %q", at, t)
+		}
+	}
+
+	if enum, ok := obj["enum"].([]interface{}); ok {
+		s.enum = enum
+	}
+	s.constant, s.hasConst = obj["const"]
+
+	if props, ok := obj["properties"].(map[string]interface{}); ok {
+		s.properties = make(map[string]*jsonSchema, len(props))
+		for name, v := range props {
+			s.properties[name] = sub("properties/"+name, v)
+		}
+	}
+	if req, ok := obj["required"].([]interface{}); ok {
+		for _, v := range req {
+			if name, ok := v.(string); ok {
+				s.required = append(s.required, name)
+			}
+		}
+	}
+	if v, ok := obj["additionalProperties"]; ok {
+		s.additional = sub("additionalProperties", v)
+	}
+	if v, ok := obj["items"]; ok {
+		s.items = sub("items", v)
+	}
+	if v, ok := obj["not"]; ok {
+		s.not = sub("not", v)
+	}
+	s.allOf, s.anyOf, s.oneOf = subs("allOf"), subs("anyOf"), subs("oneOf")
+
+	s.minItems, s.maxItems = count("minItems"), count("maxItems")
+	s.uniqueItems, _ = obj["uniqueItems"].(bool)
+	s.minProperties, s.maxProperties = count("minProperties"), count("maxProperties")
+	s.minLength, s.maxLength = count("minLength"), count("maxLength")
+	s.minimum, s.maximum = num("minimum"), num("maximum")
+	s.exclusiveMinimum, s.exclusiveMaximum = num("exclusiveMinimum"), num("exclusiveMaximum")
+	s.multipleOf = num("multipleOf")
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, fmt.Errorf("%s/multipleOf: must be greater than 0", at)
+	}
+
+	if p, ok := obj["pattern"].(string); ok {
+		if s.pattern, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %v", at, err)
+		}
+	}
+	if ref, ok := obj["$ref"].(string); ok {
+		if !strings.HasPrefix(ref, "#") {
+			return nil, fmt.Errorf("%s/$ref: only local references are supported", at)
+		}
+		if _, err := r.resolve(ref); err != nil {
+			return nil, fmt.Errorf("%s/$ref: %v", at, err)
+		}
+		s.ref = ref
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resolve looks up a local reference such as #/$defs/point, compiling it
+// on first use so that recursive schemas work
+func (r *jsonSchemaRoot) resolve(ref string) (*jsonSchema, error) {
+	if s, ok := r.compiled[ref]; ok {
+		return s, nil
+	}
+	node := r.doc
+	if ref != "#" {
+		for _, seg := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			seg = strings.Replace(strings.Replace(seg, "~1", "/", -1), "~0", "~", -1)
+			obj, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unresolvable reference %q", ref)
+			}
+			if node, ok = obj[seg]; !ok {
+				return nil, fmt.Errorf("unresolvable reference %q", ref)
+			}
+		}
+	}
+	// Register a placeholder first so that a schema referring to itself terminates
+	placeholder := &jsonSchema{root: r}
+	r.compiled[ref] = placeholder
+	s, err := r.compile(node, ref, 0)
+	if err != nil {
+		delete(r.compiled, ref)
+		return nil, err
+	}
+	*placeholder = *s
+	return placeholder, nil
+}
+
+// validate appends every violation of v to errs
+func (s *jsonSchema) validate(v interface{}, path string, errs *[]ValidationError, depth int) {
+	if depth > maxDepth {
+		*errs = append(*errs, ValidationError{path, "value nested too deeply"})
+		return
+	}
+	if s.always != nil {
+		if !*s.always {
+			*errs = append(*errs, ValidationError{path, "no value is allowed here"})
+		}
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{path, fmt.Sprintf(format, args...)})
+	}
+
+	if s.ref != "" {
+		target, _ := s.root.resolve(s.ref)
+		target.validate(v, path, errs, depth+1)
+	}
+
+	if len(s.types) > 0 && !matchesAnyType(v, s.types) {
+		fail("expected %s, got %s", strings.Join(s.types, " or "), jsonTypeOf(v))
+		return
+	}
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if jsonEqual(v, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !jsonEqual(v, s.constant) {
+		fail("value must be %v", s.constant)
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(val, path, errs, depth)
+	case []interface{}:
+		if s.minItems != nil && len(val) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(val) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+			for i := range val {
+				for j := i + 1; j < len(val); j++ {
+					if jsonEqual(val[i], val[j]) {
+						fail("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, elem := range val {
+				s.items.validate(elem, path+"/"+strconv.Itoa(i), errs, depth+1)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(val)
+		if s.minLength != nil && n < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			fail("does not match pattern %q", s.pattern.String())
+		}
+	default:
+		if f, ok := toFloat(v); ok {
+			s.validateNumber(f, fail)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs, depth+1)
+	}
+	if len(s.anyOf) > 0 && countMatches(s.anyOf, v, path, depth) == 0 {
+		fail("does not match any of the allowed schemas")
+	}
+	if len(s.oneOf) > 0 {
+		if n := countMatches(s.oneOf, v, path, depth); n != 1 {
+			fail("must match exactly one schema, matched %d", n)
+		}
+	}
+	if s.not != nil && countMatches([]*jsonSchema{s.not}, v, path, depth) == 1 {
+		fail("must not match the excluded schema")
+	}
+}
+
+func (s *jsonSchema) validateObject(obj map[string]interface{}, path string, errs *[]ValidationError, depth int) {
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			*errs = append(*errs, ValidationError{path + "/" + escapePointer(name), "required property is missing"})
+		}
+	}
+	if s.minProperties != nil && len(obj) < *s.minProperties {
+		*errs = append(*errs, ValidationError{path, fmt.Sprintf("must have at least %d properties", *s.minProperties)})
+	}
+	if s.maxProperties != nil && len(obj) > *s.maxProperties {
+		*errs = append(*errs, ValidationError{path, fmt.Sprintf("must have at most %d properties", *s.maxProperties)})
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := path + "/" + escapePointer(name)
+		if prop, ok := s.properties[name]; ok {
+			prop.validate(obj[name], child, errs, depth+1)
+		} else if s.additional != nil {
+			if s.additional.always != nil && !*s.additional.always {
+				*errs = append(*errs, ValidationError{child, "additional property is not allowed"})
+				continue
+			}
+			s.additional.validate(obj[name], child, errs, depth+1)
+		}
+	}
+}
+
+func (s *jsonSchema) validateNumber(f float64, fail func(string, ...interface{})) {
+	if s.minimum != nil && f < *s.minimum {
+		fail("must be at least %v", *s.minimum)
+	}
+	if s.maximum != nil && f > *s.maximum {
+		fail("must be at most %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+		fail("must be greater than %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+		fail("must be less than %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		q := f / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", *s.multipleOf)
+		}
+	}
+}
+
+// countMatches returns how many schemas accept v
+func countMatches(schemas []*jsonSchema, v interface{}, path string, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		var errs []ValidationError
+		sub.validate(v, path, &errs, depth+1)
+		if len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// matchesAnyType reports whether v is an instance of one of the JSON types
+func matchesAnyType(v interface{}, types []string) bool {
+	actual := jsonTypeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf names the JSON type of a decoded value. Numbers without a
+// fractional part are integers.
+func jsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string, []byte:
+		return "string"
+	}
+	if f, ok := toFloat(v); ok {
+		if f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual compares decoded values structurally, treating all numbers alike
+func jsonEqual(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case []byte:
+		bs, ok := b.(string)
+		return ok && string(av) == bs
+	}
+	return a == b
+}
+
+// escapePointer escapes a property name for use in a JSON Pointer
+func escapePointer(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
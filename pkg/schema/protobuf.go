@@ -0,0 +1,156 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoDefinition is the definition of a Protobuf schema: a serialized
+// FileDescriptorSet, as written by protoc --include_imports
+// --descriptor_set_out, and the full name of the message payloads hold
+type protoDefinition struct {
+	DescriptorSet []byte `json:"descriptor_set"`
+	Message       string `json:"message"`
+}
+
+// compileProtobuf resolves the message of a Protobuf schema definition
+func compileProtobuf(definition []byte) (protoreflect.MessageDescriptor, error) {
+	var def protoDefinition
+	decoder := json.NewDecoder(bytes.NewReader(definition))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&def); err != nil {
+		return nil, errors.New(`protobuf schema must be {"descriptor_set": "<base64 FileDescriptorSet>", "message": "<full message name>"}`)
+	}
+	if len(def.DescriptorSet) == 0 || def.Message == "" {
+		return nil, errors.New("protobuf schema needs descriptor_set and message")
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(def.DescriptorSet, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor_set: %v", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor_set: %v", err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(def.Message))
+	if err != nil {
+		return nil, fmt.Errorf("message %q is not in descriptor_set", def.Message)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a message", def.Message)
+	}
+	return md, nil
+}
+
+// DecodeProtobuf decodes a Protobuf payload into generic values, following
+// the Protobuf JSON mapping with field names as declared. It returns
+// ValidationErrors when the payload is not an encoded message of the
+// schema, or ErrUnvalidated when the schema is not a Protobuf schema.
+func (s *Schema) DecodeProtobuf(data []byte) (map[string]interface{}, error) {
+	if s.proto == nil {
+		return nil, ErrUnvalidated
+	}
+	m := dynamicpb.NewMessage(s.proto)
+	if err := proto.Unmarshal(data, m); err != nil {
+		return nil, ValidationErrors{{Message: protoError(err)}}
+	}
+	var errs []ValidationError
+	unknownFields(m, "", &errs)
+	if len(errs) > 0 {
+		return nil, ValidationErrors(errs)
+	}
+
+	encoded, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// EncodeProtobuf encodes generic values, following the Protobuf JSON
+// mapping, as a message of the schema. Fields may be missing, so that
+// projections of a message can be encoded.
+func (s *Schema) EncodeProtobuf(v interface{}) ([]byte, error) {
+	if s.proto == nil {
+		return nil, ErrUnvalidated
+	}
+	m, err := s.protoMessage(v, true)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{AllowPartial: true}.Marshal(m)
+}
+
+// validateProtobuf checks decoded values against the Protobuf JSON mapping
+// of the schema's message
+func (s *Schema) validateProtobuf(v interface{}, errs *[]ValidationError) {
+	if _, err := s.protoMessage(v, false); err != nil {
+		*errs = append(*errs, ValidationError{Message: protoError(err)})
+	}
+}
+
+// protoMessage builds a message of the schema from generic values
+func (s *Schema) protoMessage(v interface{}, partial bool) (*dynamicpb.Message, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(s.proto)
+	if err := (protojson.UnmarshalOptions{AllowPartial: partial}).Unmarshal(encoded, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// unknownFields reports the fields of a decoded message, and of the
+// messages it holds, that the schema does not declare
+func unknownFields(m protoreflect.Message, path string, errs *[]ValidationError) {
+	if len(m.GetUnknown()) > 0 {
+		*errs = append(*errs, ValidationError{Path: path, Message: "fields not in the schema"})
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Message() == nil || (fd.IsMap() && fd.MapValue().Message() == nil) {
+			return true
+		}
+		fieldPath := path + "/" + string(fd.Name())
+		switch {
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				unknownFields(list.Get(i).Message(), fmt.Sprintf("%s/%d", fieldPath, i), errs)
+			}
+		case fd.IsMap():
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				unknownFields(v.Message(), fieldPath+"/"+k.String(), errs)
+				return true
+			})
+		default:
+			unknownFields(v.Message(), fieldPath, errs)
+		}
+		return true
+	})
+}
+
+// protoError strips the package prefix from a protobuf error
+func protoError(err error) string {
+	// The separator after the prefix is a space or a non-breaking space
+	return strings.TrimLeft(strings.TrimPrefix(err.Error(), "proto:"), " \u00a0")
+}
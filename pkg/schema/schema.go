@@ -0,0 +1,320 @@
+// Package schema implements a local schema registry. Schemas are
+// registered under a subject, usually a stream ID, and every registration
+// creates a new version after passing the subject's compatibility check.
+//
+// JSON Schema and Avro schemas validate payloads decoded by pkg/codec.
+// Protobuf schemas are given as compiled descriptors rather than .proto
+// text, and validate Protobuf payloads as well as decoded payloads
+// following the Protobuf JSON mapping.
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Type identifies a schema language
+type Type string
+
+const (
+	JSONSchema Type = "json"
+	Avro       Type = "avro"
+	Protobuf   Type = "protobuf"
+)
+
+// Compatibility decides which new versions a subject accepts
+type Compatibility string
+
+const (
+	// CompatibilityNone accepts any new version
+	CompatibilityNone Compatibility = "none"
+	// CompatibilityBackward requires the new version to accept data valid under the previous one
+	CompatibilityBackward Compatibility = "backward"
+	// CompatibilityForward requires the previous version to accept data valid under the new one
+	CompatibilityForward Compatibility = "forward"
+	// CompatibilityFull requires both
+	CompatibilityFull Compatibility = "full"
+)
+
+// DefaultCompatibility is applied to subjects that do not pick one
+const DefaultCompatibility = CompatibilityBackward
+
+// maxDepth bounds the nesting of schemas and validated values
+const maxDepth = 100
+
+var (
+	// ErrNotFound is returned when a subject or version does not exist
+	ErrNotFound = errors.New("schema not found")
+	// ErrUnvalidated is returned when validating against a schema that cannot validate payloads
+	ErrUnvalidated = errors.New("schema cannot validate payloads")
+)
+
+// IncompatibleError lists why a new version was rejected
+type IncompatibleError struct {
+	Reasons []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "schema is incompatible with the previous version: " + strings.Join(e.Reasons, "; ")
+}
+
+// ValidationError is a single violation, located by a JSON Pointer
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors are all the violations found in a payload
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	parts := make([]string, len(e))
+	for i, v := range e {
+		path := v.Path
+		if path == "" {
+			path = "/"
+		}
+		parts[i] = path + ": " + v.Message
+	}
+	return "payload does not match schema: " + strings.Join(parts, "; ")
+}
+
+// ParseType validates a schema type name. An empty name yields JSONSchema.
+func ParseType(name string) (Type, error) {
+	switch t := Type(strings.ToLower(name)); t {
+	case "", "jsonschema", "json_schema":
+		return JSONSchema, nil
+	case JSONSchema, Avro, Protobuf:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown schema type %q", name)
+}
+
+// ParseCompatibility validates a compatibility name. An empty name yields DefaultCompatibility.
+func ParseCompatibility(name string) (Compatibility, error) {
+	switch c := Compatibility(strings.ToLower(name)); c {
+	case "":
+		return DefaultCompatibility, nil
+	case CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compatibility %q", name)
+}
+
+// Schema is a registered version of a subject's schema
+type Schema struct {
+	Subject    string          `json:"subject"`
+	Version    int             `json:"version"`
+	Type       Type            `json:"type"`
+	Definition json.RawMessage `json:"schema"`
+	CreatedAt  time.Time       `json:"created_at"`
+
+	json  *jsonSchema
+	avro  *avroType
+	proto protoreflect.MessageDescriptor
+}
+
+// Compile parses a schema definition without registering it
+func Compile(t Type, definition []byte) (*Schema, error) {
+	s := &Schema{Type: t, Definition: definition}
+	var err error
+	switch t {
+	case JSONSchema:
+		s.json, err = compileJSONSchema(definition)
+	case Avro:
+		s.avro, err = compileAvro(definition)
+	case Protobuf:
+		s.proto, err = compileProtobuf(definition)
+	default:
+		err = fmt.Errorf("unknown schema type %q", t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validates reports whether payloads can be checked against the schema
+func (s *Schema) Validates() bool {
+	return s.json != nil || s.avro != nil || s.proto != nil
+}
+
+// Validate checks a decoded payload. It returns ValidationErrors listing
+// every violation, or ErrUnvalidated for schemas that cannot validate.
+func (s *Schema) Validate(v interface{}) error {
+	var errs []ValidationError
+	switch {
+	case s.json != nil:
+		s.json.validate(v, "", &errs, 0)
+	case s.avro != nil:
+		s.avro.validate(v, "", &errs, 0)
+	case s.proto != nil:
+		s.validateProtobuf(v, &errs)
+	default:
+		return ErrUnvalidated
+	}
+	if len(errs) > 0 {
+		return ValidationErrors(errs)
+	}
+	return nil
+}
+
+// subject is the version history of a subject
+type subject struct {
+	compatibility Compatibility
+	versions      []*Schema
+}
+
+// Registry stores the schemas of every subject. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	subjects map[string]*subject
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{subjects: make(map[string]*subject)}
+}
+
+// Register compiles a schema and adds it as the next version of a subject.
+// The first registration sets the subject's compatibility; later ones may
+// pass an empty compatibility to keep it. A definition identical to the
+// latest version is not registered again.
+func (r *Registry) Register(subjectName string, t Type, definition []byte, compatibility Compatibility) (*Schema, error) {
+	s, err := Compile(t, definition)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The requested compatibility only replaces the subject's once the
+	// registration succeeds, so that a rejected one changes nothing
+	sub, ok := r.subjects[subjectName]
+	if !ok {
+		sub = &subject{compatibility: DefaultCompatibility}
+	}
+	if compatibility == "" {
+		compatibility = sub.compatibility
+	}
+
+	if n := len(sub.versions); n > 0 {
+		latest := sub.versions[n-1]
+		if latest.Type == s.Type && string(latest.Definition) == string(s.Definition) {
+			sub.compatibility = compatibility
+			return latest, nil
+		}
+		if reasons := checkCompatibility(latest, s, compatibility); len(reasons) > 0 {
+			return nil, &IncompatibleError{Reasons: reasons}
+		}
+	}
+
+	s.Subject = subjectName
+	s.Version = len(sub.versions) + 1
+	s.CreatedAt = time.Now().UTC()
+	sub.versions = append(sub.versions, s)
+	sub.compatibility = compatibility
+	r.subjects[subjectName] = sub
+	return s, nil
+}
+
+// Subject returns the compatibility and every version of a subject
+func (r *Registry) Subject(subjectName string) (Compatibility, []*Schema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[subjectName]
+	if !ok {
+		return "", nil, false
+	}
+	return sub.compatibility, append([]*Schema(nil), sub.versions...), true
+}
+
+// Restore replaces a subject with versions registered before, for example
+// by another process. Versions are compiled again but not checked for
+// compatibility with each other, since the subject's compatibility may
+// have changed between them.
+func (r *Registry) Restore(subjectName string, compatibility Compatibility, versions []*Schema) error {
+	if compatibility == "" {
+		compatibility = DefaultCompatibility
+	}
+	sub := &subject{compatibility: compatibility}
+	for i, v := range versions {
+		s, err := Compile(v.Type, v.Definition)
+		if err != nil {
+			return fmt.Errorf("version %d: %v", i+1, err)
+		}
+		s.Subject = subjectName
+		s.Version = i + 1
+		s.CreatedAt = v.CreatedAt
+		sub.versions = append(sub.versions, s)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subjects[subjectName] = sub
+	return nil
+}
+
+// Latest returns the newest version of a subject
+func (r *Registry) Latest(subjectName string) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[subjectName]
+	if !ok || len(sub.versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return sub.versions[len(sub.versions)-1], nil
+}
+
+// Version returns a specific version of a subject
+func (r *Registry) Version(subjectName string, version int) (*Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[subjectName]
+	if !ok || version < 1 || version > len(sub.versions) {
+		return nil, ErrNotFound
+	}
+	return sub.versions[version-1], nil
+}
+
+// Versions returns the version numbers of a subject
+func (r *Registry) Versions(subjectName string) []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sub, ok := r.subjects[subjectName]
+	if !ok {
+		return nil
+	}
+	versions := make([]int, len(sub.versions))
+	for i := range versions {
+		versions[i] = i + 1
+	}
+	return versions
+}
+
+// toFloat converts the numeric types produced by the payload decoders
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
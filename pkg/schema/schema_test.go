@@ -0,0 +1,314 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rithindattag/realtime-streaming-api/pkg/codec"
+	"github.com/rithindattag/realtime-streaming-api/pkg/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const sensorSchema = `{
+	"type": "object",
+	"required": ["id", "temperature"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^s-[0-9]+$"},
+		"temperature": {"type": "number", "minimum": -50, "maximum": 150},
+		"unit": {"enum": ["C", "F"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+		"location": {"$ref": "#/$defs/point"}
+	},
+	"$defs": {
+		"point": {"type": "object", "required": ["lat"], "properties": {"lat": {"type": "number"}, "next": {"$ref": "#/$defs/point"}}}
+	}
+}`
+
+func decode(t *testing.T, payload string) interface{} {
+	v, err := codec.Decode(codec.JSON, []byte(payload))
+	require.NoError(t, err)
+	return v
+}
+
+// protoField declares an optional proto3 field
+func protoField(name string, number int32, t descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(number),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:     t.Enum(),
+	}
+}
+
+// protoSchema returns the definition of a Protobuf schema for a message of
+// package test, as a descriptor set compiled by protoc would describe it
+func protoSchema(t *testing.T, message string, fields ...*descriptorpb.FieldDescriptorProto) []byte {
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:        proto.String("test.proto"),
+		Package:     proto.String("test"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String(message), Field: fields}},
+	}}})
+	require.NoError(t, err)
+	definition, err := json.Marshal(map[string]interface{}{"descriptor_set": set, "message": "test." + message})
+	require.NoError(t, err)
+	return definition
+}
+
+// TestProtobufValidation tests decoding and validating payloads against a
+// Protobuf schema, in Protobuf and in other formats
+func TestProtobufValidation(t *testing.T) {
+	s, err := schema.Compile(schema.Protobuf, protoSchema(t, "Reading",
+		protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+		protoField("temperature", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE)))
+	require.NoError(t, err)
+	require.True(t, s.Validates())
+
+	data, err := s.EncodeProtobuf(decode(t, `{"id":"s-1","temperature":21.5}`))
+	require.NoError(t, err)
+	v, err := s.DecodeProtobuf(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"id": "s-1", "temperature": json.Number("21.5")}, v)
+
+	_, err = s.DecodeProtobuf([]byte{0x0a, 0x05, 's'})
+	assert.IsType(t, schema.ValidationErrors{}, err)
+	unknown := protowire.AppendVarint(protowire.AppendTag(data, 9, protowire.VarintType), 1)
+	_, err = s.DecodeProtobuf(unknown)
+	assert.Equal(t, schema.ValidationErrors{{Message: "fields not in the schema"}}, err)
+
+	assert.NoError(t, s.Validate(decode(t, `{"id":"s-1"}`)))
+	assert.IsType(t, schema.ValidationErrors{}, s.Validate(decode(t, `{"id":"s-1","temperature":"hot"}`)))
+	assert.IsType(t, schema.ValidationErrors{}, s.Validate(decode(t, `{"id":"s-1","humidity":40}`)))
+
+	_, err = schema.Compile(schema.Protobuf, []byte("syntax = \"proto3\";\nmessage M { int32 a = 1; }"))
+	assert.Error(t, err)
+	_, err = schema.Compile(schema.Protobuf, []byte(`{"descriptor_set":"","message":"test.Reading"}`))
+	assert.Error(t, err)
+	var def map[string]interface{}
+	require.NoError(t, json.Unmarshal(protoSchema(t, "Reading"), &def))
+	def["message"] = "test.Missing"
+	missing, _ := json.Marshal(def)
+	_, err = schema.Compile(schema.Protobuf, missing)
+	assert.Error(t, err)
+
+	// Fields may be added but not removed or retyped
+	r := schema.NewRegistry()
+	_, err = r.Register("s", schema.Protobuf, protoSchema(t, "Reading",
+		protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING)), schema.CompatibilityFull)
+	require.NoError(t, err)
+	_, err = r.Register("s", schema.Protobuf, protoSchema(t, "Reading",
+		protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64)), "")
+	assert.IsType(t, &schema.IncompatibleError{}, err)
+	_, err = r.Register("s", schema.Protobuf, protoSchema(t, "Reading",
+		protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+		protoField("unit", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING)), schema.CompatibilityBackward)
+	assert.NoError(t, err)
+	_, err = r.Register("s", schema.Protobuf, protoSchema(t, "Reading",
+		protoField("unit", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING)), "")
+	assert.IsType(t, &schema.IncompatibleError{}, err)
+}
+
+// TestJSONSchemaValidation tests the reported violations of JSON Schema payloads
+func TestJSONSchemaValidation(t *testing.T) {
+	s, err := schema.Compile(schema.JSONSchema, []byte(sensorSchema))
+	require.NoError(t, err)
+
+	assert.NoError(t, s.Validate(decode(t, `{"id":"s-1","temperature":21.5,"unit":"C","tags":["a"],"location":{"lat":1,"next":{"lat":2}}}`)))
+
+	err = s.Validate(decode(t, `{"id":"x","temperature":"hot","unit":"K","tags":["a","b",3],"extra":1,"location":{"next":{}}}`))
+	require.Error(t, err)
+	assert.ElementsMatch(t, schema.ValidationErrors{
+		{Path: "/extra", Message: "additional property is not allowed"},
+		{Path: "/id", Message: `does not match pattern "^s-[0-9]+$"`},
+		{Path: "/location/lat", Message: "required property is missing"},
+		{Path: "/location/next/lat", Message: "required property is missing"},
+		{Path: "/tags", Message: "must have at most 2 items"},
+		{Path: "/tags/2", Message: "expected string, got integer"},
+		{Path: "/temperature", Message: "expected number, got string"},
+		{Path: "/unit", Message: "value is not one of the allowed values"},
+	}, err.(schema.ValidationErrors))
+
+	err = s.Validate(decode(t, `{"id":"s-1"}`))
+	assert.Equal(t, schema.ValidationErrors{{Path: "/temperature", Message: "required property is missing"}}, err)
+}
+
+// TestAvroValidation tests Avro records, unions, enums and defaults
+func TestAvroValidation(t *testing.T) {
+	s, err := schema.Compile(schema.Avro, []byte(`{
+		"type": "record", "name": "Reading", "namespace": "iot",
+		"fields": [
+			{"name": "id", "type": "string"},
+			{"name": "count", "type": "int"},
+			{"name": "unit", "type": {"type": "enum", "name": "Unit", "symbols": ["C", "F"]}},
+			{"name": "note", "type": ["null", "string"]},
+			{"name": "source", "type": "string", "default": "api"},
+			{"name": "previous", "type": ["null", "Reading"], "default": null}
+		]
+	}`))
+	require.NoError(t, err)
+
+	assert.NoError(t, s.Validate(decode(t, `{"id":"a","count":3,"unit":"C","previous":{"id":"b","count":1,"unit":"F"}}`)))
+
+	err = s.Validate(decode(t, `{"count":3000000000,"unit":"K","note":5,"other":true}`))
+	assert.ElementsMatch(t, schema.ValidationErrors{
+		{Path: "/id", Message: "required field is missing"},
+		{Path: "/count", Message: "3000000000 does not fit in an int"},
+		{Path: "/unit", Message: `"K" is not one of C, F`},
+		{Path: "/note", Message: "does not match any branch of the union"},
+		{Path: "/other", Message: "field is not part of record iot.Reading"},
+	}, err.(schema.ValidationErrors))
+}
+
+// TestCompatibility tests the compatibility modes on new versions
+func TestCompatibility(t *testing.T) {
+	testCases := []struct {
+		name       string
+		typ        schema.Type
+		mode       schema.Compatibility
+		prev, next string
+		compatible bool
+	}{
+		{"json optional property", schema.JSONSchema, schema.CompatibilityBackward,
+			`{"type":"object","properties":{"a":{"type":"string"}}}`,
+			`{"type":"object","properties":{"a":{"type":"string"},"b":{"type":"number"}}}`, true},
+		{"json new required property", schema.JSONSchema, schema.CompatibilityBackward,
+			`{"type":"object","properties":{"a":{"type":"string"}}}`,
+			`{"type":"object","required":["b"],"properties":{"a":{"type":"string"},"b":{"type":"number"}}}`, false},
+		{"json widened type", schema.JSONSchema, schema.CompatibilityBackward,
+			`{"type":"object","properties":{"a":{"type":"integer"}}}`,
+			`{"type":"object","properties":{"a":{"type":"number"}}}`, true},
+		{"json widened type forward", schema.JSONSchema, schema.CompatibilityForward,
+			`{"type":"object","properties":{"a":{"type":"integer"}}}`,
+			`{"type":"object","properties":{"a":{"type":"number"}}}`, false},
+		{"json raised minimum", schema.JSONSchema, schema.CompatibilityFull,
+			`{"type":"number","minimum":0}`, `{"type":"number","minimum":1}`, false},
+		{"any change without checks", schema.JSONSchema, schema.CompatibilityNone,
+			`{"type":"number"}`, `{"type":"string"}`, true},
+		{"avro field with default", schema.Avro, schema.CompatibilityFull,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"int"},{"name":"b","type":"string","default":""}]}`, true},
+		{"avro field without default", schema.Avro, schema.CompatibilityBackward,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"int"},{"name":"b","type":"string"}]}`, false},
+		{"avro promotion", schema.Avro, schema.CompatibilityBackward,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"long"}]}`, true},
+		{"avro narrowing", schema.Avro, schema.CompatibilityBackward,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"long"}]}`,
+			`{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`, false},
+		{"avro removed symbol", schema.Avro, schema.CompatibilityBackward,
+			`{"type":"enum","name":"E","symbols":["A","B"]}`, `{"type":"enum","name":"E","symbols":["A"]}`, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := schema.NewRegistry()
+			_, err := r.Register("s", tc.typ, []byte(tc.prev), tc.mode)
+			require.NoError(t, err)
+			s, err := r.Register("s", tc.typ, []byte(tc.next), "")
+			if tc.compatible {
+				require.NoError(t, err)
+				assert.Equal(t, 2, s.Version)
+				return
+			}
+			_, ok := err.(*schema.IncompatibleError)
+			assert.True(t, ok, "expected an incompatibility, got %v", err)
+		})
+	}
+}
+
+// TestRejectedCompatibility tests that a registration rejected under a new
+// compatibility leaves the subject's compatibility alone
+func TestRejectedCompatibility(t *testing.T) {
+	r := schema.NewRegistry()
+	_, err := r.Register("s", schema.JSONSchema, []byte(`{"type":"object","properties":{"a":{"type":"integer"}}}`), schema.CompatibilityBackward)
+	require.NoError(t, err)
+
+	widened := []byte(`{"type":"object","properties":{"a":{"type":"number"}}}`)
+	_, err = r.Register("s", schema.JSONSchema, widened, schema.CompatibilityFull)
+	_, ok := err.(*schema.IncompatibleError)
+	require.True(t, ok, "expected an incompatibility, got %v", err)
+	compatibility, versions, _ := r.Subject("s")
+	assert.Equal(t, schema.CompatibilityBackward, compatibility)
+	assert.Len(t, versions, 1)
+
+	s, err := r.Register("s", schema.JSONSchema, widened, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Version)
+}
+
+// TestRegistryVersions tests versioning and lookups
+func TestRegistryVersions(t *testing.T) {
+	r := schema.NewRegistry()
+	v1, err := r.Register("s", schema.JSONSchema, []byte(`{"type":"object"}`), "")
+	require.NoError(t, err)
+	again, err := r.Register("s", schema.JSONSchema, []byte(`{"type":"object"}`), "")
+	require.NoError(t, err)
+	assert.Same(t, v1, again)
+
+	_, err = r.Register("s", schema.JSONSchema, []byte(`{"type":"object","properties":{"a":{}}}`), "")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, r.Versions("s"))
+
+	latest, err := r.Latest("s")
+	require.NoError(t, err)
+	assert.Equal(t, 2, latest.Version)
+	first, err := r.Version("s", 1)
+	require.NoError(t, err)
+	assert.Same(t, v1, first)
+
+	_, err = r.Version("s", 3)
+	assert.Equal(t, schema.ErrNotFound, err)
+	_, err = r.Latest("missing")
+	assert.Equal(t, schema.ErrNotFound, err)
+
+	proto, err := r.Register("p", schema.Protobuf, protoSchema(t, "Reading", protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING)), "")
+	require.NoError(t, err)
+	assert.True(t, proto.Validates())
+	_, err = first.DecodeProtobuf(nil)
+	assert.Equal(t, schema.ErrUnvalidated, err)
+
+	_, err = schema.Compile(schema.JSONSchema, []byte(`{"$ref":"#/$defs/missing"}`))
+	assert.Error(t, err)
+}
+
+// TestRegistryRestore tests restoring a subject's versions into another registry
+func TestRegistryRestore(t *testing.T) {
+	r := schema.NewRegistry()
+	_, err := r.Register("s", schema.JSONSchema, []byte(`{"type":"object"}`), schema.CompatibilityNone)
+	require.NoError(t, err)
+	_, err = r.Register("s", schema.JSONSchema, []byte(`{"type":"object","required":["id"]}`), "")
+	require.NoError(t, err)
+	// Later versions may change the compatibility, which the earlier ones
+	// need not satisfy
+	_, err = r.Register("s", schema.JSONSchema, []byte(`{"type":"object","required":["id"],"properties":{"v":{}}}`), schema.CompatibilityBackward)
+	require.NoError(t, err)
+
+	compatibility, versions, ok := r.Subject("s")
+	require.True(t, ok)
+	assert.Equal(t, schema.CompatibilityBackward, compatibility)
+	_, _, ok = r.Subject("missing")
+	assert.False(t, ok)
+
+	restored := schema.NewRegistry()
+	require.NoError(t, restored.Restore("s", compatibility, versions))
+	assert.Equal(t, []int{1, 2, 3}, restored.Versions("s"))
+	latest, err := restored.Latest("s")
+	require.NoError(t, err)
+	assert.Equal(t, 3, latest.Version)
+	assert.Equal(t, versions[2].CreatedAt, latest.CreatedAt)
+	assert.Error(t, latest.Validate(decode(t, `{}`)))
+	assert.NoError(t, latest.Validate(decode(t, `{"id":1}`)))
+
+	// The restored compatibility still applies
+	_, err = restored.Register("s", schema.JSONSchema, []byte(`{"type":"string"}`), "")
+	assert.Error(t, err)
+
+	assert.Error(t, restored.Restore("bad", "", []*schema.Schema{{Type: schema.JSONSchema, Definition: []byte(`{`)}}))
+}